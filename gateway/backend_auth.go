@@ -0,0 +1,231 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec // nolint
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"strings"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+)
+
+// LoadPasswordFile reads a password from a file, with surrounding
+// whitespace trimmed.
+func LoadPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// LoadPublicKeyFile reads an RSA public key in PEM, e.g. the key of backends
+// for Config.BackendPublicKey.
+func LoadPublicKeyFile(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	key, err := parsePublicKey(data)
+	return key, errors.WithMessage(err, path)
+}
+
+// LoadClientPasswords reads the passwords of clients from a file with one
+// user:password per line. Empty lines and lines starting with # are ignored.
+func LoadClientPasswords(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	passwords := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, errors.Errorf("invalid client password at %s:%d", path, n)
+		}
+		passwords[line[:i]] = line[i+1:]
+	}
+	return passwords, errors.WithStack(scanner.Err())
+}
+
+// authClient authenticates the client as user against
+// Config.ClientPasswords with mysql_native_password, switching the client to
+// it if it proposes another plugin. scramble is from the initial handshake.
+// Clients must be authenticated by the gateway before it logs in to backends
+// with its own credentials on their behalf.
+func (g *Gateway) authClient(conn *mysql.Conn, res *mysql.HandshakeResponse, user string, scramble []byte) error {
+	auth := res.Auth
+	if res.Capability&mysql.ClientPluginAuth != 0 && res.AuthPlugin != mysql.AuthNativePassword {
+		sw := &mysql.AuthSwitchRequest{
+			PluginName: mysql.AuthNativePassword,
+			PluginData: append(append([]byte(nil), scramble...), 0),
+		}
+		if err := conn.SendPacket(sw); err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		if err := conn.ReadPacket(&b); err != nil {
+			return err
+		}
+		auth = b.Bytes()
+	}
+	password, ok := g.conf.ClientPasswords[user]
+	if !ok || subtle.ConstantTimeCompare(auth, mysql.NativePasswordAuth(password, scramble)) != 1 {
+		return errors.Errorf("Access denied for user '%s'", user)
+	}
+	return nil
+}
+
+// authBackend authenticates to backend with the configured credentials on
+// behalf of the client, and forwards the result to the client. scramble is
+// from the initial handshake of backend. It returns the auth plugin used.
+func (g *Gateway) authBackend(clientConn, backendConn *mysql.Conn, res *mysql.HandshakeResponse, scramble []byte) (string, error) {
+	data, plugin, err := loginBackend(backendConn, res, g.conf.BackendUser, g.conf.BackendPassword, scramble, g.conf.BackendPublicKey)
+	if err != nil {
+		return plugin, err
+	}
+	if err := clientConn.WritePacket(data); err != nil {
+		return plugin, err
+	}
+	if err := clientConn.Flush(); err != nil {
+		return plugin, err
+	}
+	if data[0] == mysql.HeaderErr {
+		return plugin, errAuthRejected
+	}
+	return plugin, nil
+}
+
+// loginBackend sends res to backend to authenticate as user with password
+// using mysql_native_password, or caching_sha2_password if backend switches
+// to it. It returns the OK or ERR packet ending auth, and the auth plugin.
+// publicKey encrypts the password in caching_sha2_password full auth
+// without TLS, and may be nil.
+func loginBackend(backendConn *mysql.Conn, res *mysql.HandshakeResponse, user, password string, scramble []byte, publicKey *rsa.PublicKey) ([]byte, string, error) {
+	plugin := mysql.AuthNativePassword
+	res.UserName = user
+	res.Capability |= mysql.ClientPluginAuth
+	res.AuthPlugin = plugin
+	res.Auth = mysql.NativePasswordAuth(password, scramble)
+	if err := backendConn.SendPacket(res); err != nil {
+		return nil, plugin, err
+	}
+	for {
+		var b bytes.Buffer
+		if err := backendConn.ReadPacket(&b); err != nil {
+			return nil, plugin, err
+		}
+		data := b.Bytes()
+		if len(data) == 0 {
+			return nil, plugin, errors.WithStack(mysql.ErrMalformPacket)
+		}
+		var reply []byte
+		switch data[0] {
+		case mysql.HeaderOK, mysql.HeaderErr:
+			return data, plugin, nil
+		case mysql.HeaderEOF:
+			var sw mysql.AuthSwitchRequest
+			if err := sw.Read(mysql.NewBuffer(data)); err != nil {
+				return nil, plugin, err
+			}
+			plugin = sw.PluginName
+			scramble = bytes.TrimSuffix(sw.PluginData, []byte{0})
+			switch plugin {
+			case mysql.AuthNativePassword:
+				reply = mysql.NativePasswordAuth(password, scramble)
+			case mysql.AuthCachingSha2Password:
+				reply = mysql.CachingSha2PasswordAuth(password, scramble)
+			default:
+				return nil, plugin, errors.Errorf("unsupported backend auth plugin %s", plugin)
+			}
+		case mysql.HeaderAuthMoreData:
+			if plugin != mysql.AuthCachingSha2Password {
+				return nil, plugin, errors.Errorf("unexpected auth more data for auth plugin %s", plugin)
+			}
+			var more mysql.AuthMoreData
+			if err := more.Read(mysql.NewBuffer(data)); err != nil {
+				return nil, plugin, err
+			}
+			var err error
+			if reply, err = cachingSha2FullAuth(backendConn, &more, password, scramble, publicKey); err != nil {
+				return nil, plugin, err
+			}
+			if reply == nil {
+				continue
+			}
+		default:
+			return nil, plugin, errors.Errorf("unexpected auth packet %#x from backend", data[0])
+		}
+		if err := backendConn.WritePacket(reply); err != nil {
+			return nil, plugin, err
+		}
+		if err := backendConn.Flush(); err != nil {
+			return nil, plugin, err
+		}
+	}
+}
+
+// cachingSha2FullAuth returns the reply to AuthMoreData of
+// caching_sha2_password, or nil if no reply is needed. Full auth sends the
+// password in clear text over TLS, or encrypted with the pinned public key
+// of backends otherwise. The key is never requested from backends, since
+// anyone in the path of a plaintext connection could replace it and decrypt
+// the password.
+func cachingSha2FullAuth(backendConn *mysql.Conn, more *mysql.AuthMoreData, password string, scramble []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	switch {
+	case more.FastAuthSuccess():
+		return nil, nil
+	case len(more.Data) == 1 && more.Data[0] == mysql.CachingSha2PerformFullAuth:
+		if _, ok := backendConn.RawConn().(*tls.Conn); ok {
+			return append([]byte(password), 0), nil
+		}
+		if publicKey == nil {
+			return nil, errors.New("caching_sha2_password full auth requires TLS to the backend or its public key")
+		}
+		return encryptPassword(publicKey, password, scramble)
+	default:
+		return nil, errors.New("unexpected caching_sha2_password auth data from backend")
+	}
+}
+
+// parsePublicKey parses an RSA public key in PEM.
+func parsePublicKey(pemKey []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid public key")
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not RSA")
+	}
+	return rsaKey, nil
+}
+
+// encryptPassword encrypts the password XORed with scramble with the RSA
+// public key, as caching_sha2_password full auth without TLS.
+func encryptPassword(rsaKey *rsa.PublicKey, password string, scramble []byte) ([]byte, error) {
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, plain, nil) // nolint:gosec // nolint
+	return encrypted, errors.WithStack(err)
+}
@@ -0,0 +1,203 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/sha1" // nolint:gosec // nolint
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// checkNativePassword verifies auth the way a server does: it only knows
+// SHA1(SHA1(password)).
+func checkNativePassword(auth, scramble []byte, password string) bool {
+	if len(auth) != sha1.Size {
+		return false
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stored := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stored[:])
+	hash := h.Sum(nil)
+	for i := range hash {
+		hash[i] ^= auth[i]
+	}
+	got := sha1.Sum(hash)
+	return bytes.Equal(got[:], stored[:])
+}
+
+func TestLoadPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("  secret\n"), 0o600))
+	password, err := LoadPasswordFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "secret", password)
+
+	_, err = LoadPasswordFile(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestLoadClientPasswords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clients")
+	require.NoError(t, os.WriteFile(path, []byte("# user:password\napp:a:b\n\nreport:\n"), 0o600))
+	passwords, err := LoadClientPasswords(path)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"app": "a:b", "report": ""}, passwords)
+
+	require.NoError(t, os.WriteFile(path, []byte("app\n"), 0o600))
+	_, err = LoadClientPasswords(path)
+	require.Error(t, err)
+}
+
+// dialTestGatewayPassword connects as user with password checked by the
+// gateway with mysql_native_password.
+func dialTestGatewayPassword(t *testing.T, gw *Gateway, user, password string) *mysql.Conn {
+	conn, err := connectTestGatewayPassword(gw, newTestHandshakeResponse(user), password)
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+func connectTestGatewayPassword(gw *Gateway, res *mysql.HandshakeResponse, password string) (*mysql.Conn, error) {
+	rawConn, err := net.Dial("tcp", gw.l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	conn := mysql.NewConn(rawConn)
+	if err := testHandshakePassword(conn, res, nil, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestBackendUser(t *testing.T) {
+	backend := startMockBackend(t, nil, mockPassword("secret"), mockRecordResponses())
+	wrongBackend := startMockBackend(t, nil, mockPassword("other"))
+	conf := &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend.addr()},
+			{ClusterID: "c2", Address: wrongBackend.addr()},
+		},
+		BackendUser:     "gateway",
+		BackendPassword: "secret",
+	}
+	_, err := New(nil, conf)
+	require.EqualError(t, err, "backend user requires client passwords")
+	conf.ClientPasswords = map[string]string{"c1.root": "pass", "c2.root": "pass"}
+	gw, _ := startTestGateway(t, conf)
+
+	conn := dialTestGatewayPassword(t, gw, "c1.root", "pass")
+	require.Equal(t, "gateway", (<-backend.responses).UserName)
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	_, err = connectTestGatewayPassword(gw, newTestHandshakeResponse("c2.root"), "pass")
+	require.Equal(t, uint16(1045), err.(*testErr).code)
+}
+
+func TestBackendUserAuthClient(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRecordResponses())
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:  BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		BackendUser:     "gateway",
+		ClientPasswords: map[string]string{"c1.root": "pass", "c1.empty": ""},
+	})
+
+	// Clients proposing other plugins are switched to mysql_native_password.
+	res := newTestHandshakeResponse("c1.root")
+	res.AuthPlugin = mysql.AuthCachingSha2Password
+	conn, err := connectTestGatewayPassword(gw, res, "pass")
+	require.NoError(t, err)
+	conn.Close()
+	<-backend.responses
+	// Clients send no auth data for empty passwords.
+	res = newTestHandshakeResponse("c1.empty")
+	res.Auth = nil
+	conn, err = connectTestGatewayPassword(gw, res, "")
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
+	<-backend.responses
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	for _, c := range []struct {
+		user     string
+		password string
+	}{
+		{"c1.root", "wrong"},
+		{"c1.root", ""},
+		{"c1.unknown", "pass"},
+	} {
+		_, err := connectTestGatewayPassword(gw, newTestHandshakeResponse(c.user), c.password)
+		require.Error(t, err, c.user)
+		require.Equal(t, uint16(1045), err.(*testErr).code, c.user)
+	}
+	// Backends are never reached by clients failing auth.
+	require.Len(t, backend.responses, 0)
+}
+
+func TestBackendUserCachingSha2(t *testing.T) {
+	fast := startMockBackend(t, nil, mockPassword("secret"), mockAuthPlugin(mysql.AuthCachingSha2Password))
+	full := startMockBackend(t, nil, mockPassword("secret"), mockAuthPlugin(mysql.AuthCachingSha2Password), mockSha2FullAuth(true))
+	wrong := startMockBackend(t, nil, mockPassword("other"), mockAuthPlugin(mysql.AuthCachingSha2Password), mockSha2FullAuth(true))
+	backends := BackendConfigs{
+		{ClusterID: "fast", Address: fast.addr()},
+		{ClusterID: "full", Address: full.addr()},
+		{ClusterID: "wrong", Address: wrong.addr()},
+	}
+	clientPasswords := map[string]string{"fast.root": "pass", "full.root": "pass", "wrong.root": "pass"}
+
+	// Without TLS, full auth needs the public key of backends, which is
+	// never requested over plaintext.
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:  backends,
+		BackendUser:     "gateway",
+		BackendPassword: "secret",
+		ClientPasswords: clientPasswords,
+	})
+	dialTestGatewayPassword(t, gw, "fast.root", "pass")
+	_, err := connectTestGatewayPassword(gw, newTestHandshakeResponse("full.root"), "pass")
+	require.Contains(t, err.(*testErr).msg, "requires TLS to the backend or its public key")
+
+	key, publicKey := mockRSAKey()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, publicKey, 0o600))
+	loaded, err := LoadPublicKeyFile(path)
+	require.NoError(t, err)
+	require.Equal(t, &key.PublicKey, loaded)
+	gw, _ = startTestGateway(t, &Config{
+		BackendConfigs:   backends,
+		BackendUser:      "gateway",
+		BackendPassword:  "secret",
+		BackendPublicKey: loaded,
+		ClientPasswords:  clientPasswords,
+	})
+
+	for _, user := range []string{"fast.root", "full.root"} {
+		conn := dialTestGatewayPassword(t, gw, user, "pass")
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}), user)
+	}
+	_, err = connectTestGatewayPassword(gw, newTestHandshakeResponse("wrong.root"), "pass")
+	require.Equal(t, uint16(1045), err.(*testErr).code)
+}
+
+func TestCachingSha2PasswordAuth(t *testing.T) {
+	scramble := []byte("0123456789abcdefghij")
+	require.Nil(t, mysql.CachingSha2PasswordAuth("", scramble))
+	auth := mysql.CachingSha2PasswordAuth("secret", scramble)
+	// The server checks SHA256(SHA256(auth XOR SHA256(stored + scramble))),
+	// where stored is SHA256(SHA256(password)).
+	stage1 := sha256.Sum256([]byte("secret"))
+	stored := sha256.Sum256(stage1[:])
+	h := sha256.Sum256(append(stored[:], scramble...))
+	for i := range h {
+		h[i] ^= auth[i]
+	}
+	got := sha256.Sum256(h[:])
+	require.Equal(t, stored, got)
+}
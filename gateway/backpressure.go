@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ErrWriteStalled is returned by RelayPackets if a write to remote blocks for
+// RelayOptions.WriteStallTimeout, i.e. the client stops reading.
+var ErrWriteStalled = errors.New("client does not read for too long")
+
+// Write stall stages, as labels of writeStallCounter.
+const (
+	stallWarn  = "warn"
+	stallClose = "close"
+)
+
+// stallWatcher detects that writes to remote block for too long because of
+// backpressure. A write blocking for warn is logged and counted, so that slow
+// clients can be told apart from dead ones, which block for timeout and are
+// closed.
+type stallWatcher struct {
+	warn, timeout time.Duration
+	// start is the unix nano time the pending write starts, 0 if there is no
+	// pending write.
+	start int64
+	done  chan struct{}
+}
+
+// newStallWatcher returns nil if neither threshold is set.
+func newStallWatcher(warn, timeout time.Duration) *stallWatcher {
+	if warn <= 0 && timeout <= 0 {
+		return nil
+	}
+	return &stallWatcher{
+		warn:    warn,
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+}
+
+// begin records that a write starts.
+func (w *stallWatcher) begin() {
+	if w != nil {
+		atomic.StoreInt64(&w.start, time.Now().UnixNano())
+	}
+}
+
+// end records that the write ends.
+func (w *stallWatcher) end() {
+	if w != nil {
+		atomic.StoreInt64(&w.start, 0)
+	}
+}
+
+// interval returns how often pending writes are checked.
+func (w *stallWatcher) interval() time.Duration {
+	d := w.timeout
+	if w.warn > 0 && (d <= 0 || w.warn < d) {
+		d = w.warn
+	}
+	d /= 4
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// watch warns about each write blocking for the warn threshold, and sends
+// ErrWriteStalled to errCh once a write blocks for the timeout.
+func (w *stallWatcher) watch(log *zap.SugaredLogger, errCh chan<- error) {
+	if w == nil {
+		return
+	}
+	ticker := time.NewTicker(w.interval())
+	defer ticker.Stop()
+	// warned is the start of the last write warned about.
+	var warned int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+		start := atomic.LoadInt64(&w.start)
+		if start == 0 {
+			continue
+		}
+		stalled := time.Since(time.Unix(0, start))
+		if w.timeout > 0 && stalled >= w.timeout {
+			writeStallCounter.WithLabelValues(stallClose).Inc()
+			log.Warnw("client does not read, closing connection", "stalled", stalled)
+			errCh <- ErrWriteStalled
+			return
+		}
+		if w.warn > 0 && stalled >= w.warn && start != warned {
+			warned = start
+			writeStallCounter.WithLabelValues(stallWarn).Inc()
+			log.Warnw("client reads slowly", "stalled", stalled)
+		}
+	}
+}
+
+func (w *stallWatcher) stop() {
+	if w != nil {
+		close(w.done)
+	}
+}
@@ -0,0 +1,97 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+)
+
+// CircuitBreaker configures fast-failing new connections to a cluster that
+// backend connections keep failing to, instead of making each client wait
+// for its own dial to fail.
+type CircuitBreaker struct {
+	// Failures is the number of consecutive failures connecting to a
+	// cluster that opens its breaker. 0 disables the breaker.
+	Failures int
+	// Cooldown is how long the breaker stays open. Afterwards connections
+	// are tried again, and the breaker opens again at the next failure.
+	Cooldown time.Duration
+	// ErrCode and ErrMessage are sent to clients rejected by an open
+	// breaker, so that they can tell it apart from dial failures and retry
+	// later. They default to defaultBreakerErrCode and defaultBreakerErrMsg.
+	ErrCode    uint16
+	ErrMessage string
+}
+
+const (
+	defaultBreakerErrCode = mysql.ErrCodeTiKVServerBusy
+	defaultBreakerErrMsg  = "cluster temporarily unavailable, retry shortly"
+)
+
+// circuitBreaker tracks consecutive connect failures of clusters.
+type circuitBreaker struct {
+	conf CircuitBreaker
+	mu   sync.Mutex
+	// failures is the number of consecutive failures by cluster.
+	failures map[string]int
+	// openUntil is the time breakers close by cluster.
+	openUntil map[string]time.Time
+}
+
+// newCircuitBreaker returns nil if the breaker is disabled.
+func newCircuitBreaker(conf CircuitBreaker) *circuitBreaker {
+	if conf.Failures <= 0 {
+		return nil
+	}
+	if conf.ErrCode == 0 {
+		conf.ErrCode = defaultBreakerErrCode
+	}
+	if conf.ErrMessage == "" {
+		conf.ErrMessage = defaultBreakerErrMsg
+	}
+	return &circuitBreaker{
+		conf:      conf,
+		failures:  make(map[string]int),
+		openUntil: make(map[string]time.Time),
+	}
+}
+
+// allow returns whether connections to cluster are allowed.
+func (b *circuitBreaker) allow(cluster string) bool {
+	if b == nil {
+		return true
+	}
+	cluster = strings.ToLower(cluster)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.openUntil[cluster])
+}
+
+// record records the result of connecting to cluster, and returns whether
+// it opens the breaker.
+func (b *circuitBreaker) record(cluster string, err error) bool {
+	if b == nil {
+		return false
+	}
+	cluster = strings.ToLower(cluster)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.failures, cluster)
+		delete(b.openUntil, cluster)
+		return false
+	}
+	b.failures[cluster]++
+	if b.failures[cluster] < b.conf.Failures {
+		return false
+	}
+	b.openUntil[cluster] = time.Now().Add(b.conf.Cooldown)
+	return true
+}
+
+// reject sends the configured error to a client rejected by an open breaker.
+func (b *circuitBreaker) reject(conn *mysql.Conn) error {
+	return sendErrCode(conn, b.conf.ErrCode, b.conf.ErrMessage)
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: deadAddr},
+			{ClusterID: "c2", Address: backend.addr()},
+		},
+		CircuitBreaker: CircuitBreaker{
+			Failures:   2,
+			Cooldown:   200 * time.Millisecond,
+			ErrMessage: "c1 is unavailable",
+		},
+	})
+
+	// Dial failures open the breaker.
+	for i := 0; i < 2; i++ {
+		_, err := connectTestGateway(gw, "c1.root")
+		require.Equal(t, uint16(mysql.ErrCodeUnknown), err.(*testErr).code)
+	}
+	require.Equal(t, 1, logs.FilterMessage("open circuit breaker").Len())
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeTiKVServerBusy), err.(*testErr).code)
+	require.EqualError(t, err, "c1 is unavailable")
+	require.Equal(t, 1, logs.FilterMessage("circuit breaker is open").Len())
+
+	// Other clusters are not affected.
+	dialTestGateway(t, gw, "c2.root")
+
+	// Connections are tried again after the cooldown, and the breaker opens
+	// again at the next failure.
+	time.Sleep(250 * time.Millisecond)
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeUnknown), err.(*testErr).code)
+	_, err = connectTestGateway(gw, "c1.root")
+	require.EqualError(t, err, "c1 is unavailable")
+}
+
+func TestCircuitBreakerReset(t *testing.T) {
+	b := newCircuitBreaker(CircuitBreaker{Failures: 2, Cooldown: time.Minute, ErrCode: 1040})
+	require.Equal(t, uint16(1040), b.conf.ErrCode)
+	require.Equal(t, defaultBreakerErrMsg, b.conf.ErrMessage)
+	require.False(t, b.record("c1", errDialTest))
+	// A success resets consecutive failures.
+	require.False(t, b.record("c1", nil))
+	require.False(t, b.record("c1", errDialTest))
+	require.True(t, b.allow("c1"))
+	require.True(t, b.record("C1", errDialTest))
+	require.False(t, b.allow("c1"))
+	require.True(t, b.allow("c2"))
+
+	require.Nil(t, newCircuitBreaker(CircuitBreaker{}))
+}
+
+var errDialTest = errors.New("dial failed")
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"bytes"
+	"sync"
+)
+
+// bufferPool reuses relay buffers. The total capacity of buffers retained
+// is bounded, buffers beyond it are left to GC.
+type bufferPool struct {
+	mu       sync.Mutex
+	bufs     []*bytes.Buffer
+	retained int
+	// maxRetained is the max total capacity of retained buffers.
+	maxRetained int
+}
+
+func newBufferPool(maxRetained int) *bufferPool {
+	return &bufferPool{maxRetained: maxRetained}
+}
+
+// get returns an empty buffer. A nil pool always allocates a new one.
+func (p *bufferPool) get() *bytes.Buffer {
+	if p == nil {
+		return new(bytes.Buffer)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.bufs)
+	if n == 0 {
+		bufferPoolGetCounter.WithLabelValues("miss").Inc()
+		return new(bytes.Buffer)
+	}
+	bufferPoolGetCounter.WithLabelValues("hit").Inc()
+	b := p.bufs[n-1]
+	p.bufs[n-1] = nil
+	p.bufs = p.bufs[:n-1]
+	p.retained -= b.Cap()
+	bufferPoolRetainedGauge.Add(-float64(b.Cap()))
+	return b
+}
+
+// put returns a buffer to the pool. It is discarded if retaining it exceeds
+// the limit.
+func (p *bufferPool) put(b *bytes.Buffer) {
+	if p == nil {
+		return
+	}
+	b.Reset()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retained+b.Cap() > p.maxRetained {
+		bufferPoolDiscardCounter.Inc()
+		return
+	}
+	p.bufs = append(p.bufs, b)
+	p.retained += b.Cap()
+	bufferPoolRetainedGauge.Add(float64(b.Cap()))
+}
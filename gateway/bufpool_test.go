@@ -0,0 +1,41 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(1024)
+	hits := bufferPoolGetCounter.WithLabelValues("hit").Value()
+	misses := bufferPoolGetCounter.WithLabelValues("miss").Value()
+	discards := bufferPoolDiscardCounter.Value()
+	retained := bufferPoolRetainedGauge.Value()
+
+	small := p.get()
+	require.Equal(t, misses+1, bufferPoolGetCounter.WithLabelValues("miss").Value())
+	small.Write(make([]byte, 512))
+	p.put(small)
+	require.Equal(t, small.Cap(), p.retained)
+	require.Equal(t, retained+float64(small.Cap()), bufferPoolRetainedGauge.Value())
+
+	// A buffer exceeding the cap is not retained.
+	large := bytes.NewBuffer(make([]byte, 0, 2048))
+	p.put(large)
+	require.Equal(t, discards+1, bufferPoolDiscardCounter.Value())
+	require.Equal(t, small.Cap(), p.retained)
+	require.Len(t, p.bufs, 1)
+
+	b := p.get()
+	require.Same(t, small, b)
+	require.Zero(t, b.Len())
+	require.Equal(t, hits+1, bufferPoolGetCounter.WithLabelValues("hit").Value())
+	require.Zero(t, p.retained)
+	require.Equal(t, retained, bufferPoolRetainedGauge.Value())
+
+	// A nil pool does not pool.
+	var nilPool *bufferPool
+	nilPool.put(nilPool.get())
+}
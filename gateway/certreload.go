@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CertReloader serves the certificate of TLS handshakes, which can be
+// re-read from disk without restarting the gateway. Established connections
+// keep the certificate they negotiated, and new handshakes get the reloaded
+// one.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// NewCertReloader loads the key pair of certFile and keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the key pair. The previous certificate is kept if it
+// fails.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load key pair")
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate, as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ReloadCerts re-reads the TLS certificate served to clients. It does nothing
+// if TLS is not configured with a certificate.
+func (g *Gateway) ReloadCerts() error {
+	if g.certs == nil {
+		return nil
+	}
+	if err := g.certs.Reload(); err != nil {
+		return err
+	}
+	g.log.Infow("tls certificates are reloaded", "cert", g.certs.certFile)
+	return nil
+}
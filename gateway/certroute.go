@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// certField is a field of client certificates containing the cluster ID,
+// parsed from Config.RouteByCert:
+//
+//	CN           the common name
+//	OU           the first organizational unit
+//	OU:<prefix>  the first organizational unit with the prefix, stripped
+//	OID:<oid>    the subject attribute or extension with the OID
+type certField struct {
+	name   string
+	prefix string
+	oid    asn1.ObjectIdentifier
+}
+
+func parseCertField(s string) (*certField, error) {
+	name, arg, hasArg := strings.Cut(s, ":")
+	f := &certField{name: strings.ToUpper(name)}
+	switch {
+	case f.name == "CN" && !hasArg:
+	case f.name == "OU":
+		f.prefix = arg
+	case f.name == "OID" && hasArg:
+		for _, part := range strings.Split(arg, ".") {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 {
+				return nil, errors.Errorf("invalid oid %q in cert field", arg)
+			}
+			f.oid = append(f.oid, n)
+		}
+		if len(f.oid) < 2 {
+			return nil, errors.Errorf("invalid oid %q in cert field", arg)
+		}
+	default:
+		return nil, errors.Errorf("invalid cert field %q", s)
+	}
+	return f, nil
+}
+
+// clusterID extracts the cluster ID from cert.
+func (f *certField) clusterID(cert *x509.Certificate) (string, error) {
+	switch f.name {
+	case "CN":
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, nil
+		}
+	case "OU":
+		for _, ou := range cert.Subject.OrganizationalUnit {
+			if strings.HasPrefix(ou, f.prefix) && len(ou) > len(f.prefix) {
+				return ou[len(f.prefix):], nil
+			}
+		}
+	case "OID":
+		for _, name := range cert.Subject.Names {
+			if name.Type.Equal(f.oid) {
+				if v, ok := name.Value.(string); ok && v != "" {
+					return v, nil
+				}
+			}
+		}
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(f.oid) {
+				var v string
+				if _, err := asn1.Unmarshal(ext.Value, &v); err != nil {
+					return "", errors.Wrapf(err, "failed to parse cert extension %s", f.oid)
+				}
+				if v != "" {
+					return v, nil
+				}
+			}
+		}
+	}
+	return "", errors.Errorf("no cluster ID in %s of client certificate", f)
+}
+
+func (f *certField) String() string {
+	switch {
+	case f.oid != nil:
+		return "OID:" + f.oid.String()
+	case f.prefix != "":
+		return "OU:" + f.prefix
+	}
+	return f.name
+}
+
+// getBackendAddrByCert picks the backend address of the cluster encoded in
+// the verified client certificate. The user name is left unchanged.
+func (g *Gateway) getBackendAddrByCert(certs []*x509.Certificate) (string, string, error) {
+	if len(certs) == 0 {
+		return "", "", errors.New("client certificate is required")
+	}
+	clusterID, err := g.certRoute.clusterID(certs[0])
+	if err != nil {
+		return "", "", err
+	}
+	addr, err := g.pickAddr(clusterID, nil)
+	return clusterID, addr, err
+}
+
+// checkCertUser checks that user is the CN of the verified client
+// certificate, for TLSConfig.MatchUserCN.
+func checkCertUser(certs []*x509.Certificate, user string) error {
+	if len(certs) == 0 {
+		return errors.New("client certificate is required")
+	}
+	if cn := certs[0].Subject.CommonName; cn != user {
+		return errors.Errorf("user %s does not match client certificate CN %s", user, cn)
+	}
+	return nil
+}
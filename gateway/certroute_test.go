@@ -0,0 +1,100 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertField(t *testing.T) {
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	ext, err := asn1.Marshal("c4")
+	require.NoError(t, err)
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "c1",
+			OrganizationalUnit: []string{"team-a", "cluster=c2"},
+			// Names are only set by parsing.
+			Names: []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}, Value: "c3"}},
+		},
+		Extensions: []pkix.Extension{{Id: oid, Value: ext}},
+	}
+	for _, c := range []struct {
+		field     string
+		clusterID string
+	}{
+		{"CN", "c1"},
+		{"ou", "team-a"},
+		{"OU:cluster=", "c2"},
+		{"OID:1.3.6.1.4.1.99999.2", "c3"},
+		{"OID:1.3.6.1.4.1.99999.1", "c4"},
+		{"OU:region=", ""},
+		{"OID:1.2.3", ""},
+	} {
+		f, err := parseCertField(c.field)
+		require.NoError(t, err, c.field)
+		clusterID, err := f.clusterID(cert)
+		if c.clusterID == "" {
+			require.Error(t, err, c.field)
+		} else {
+			require.NoError(t, err, c.field)
+			require.Equal(t, c.clusterID, clusterID, c.field)
+		}
+	}
+
+	for _, field := range []string{"", "SN", "CN:x", "OID:", "OID:1", "OID:1.x"} {
+		_, err := parseCertField(field)
+		require.Error(t, err, field)
+	}
+}
+
+func TestRouteByCert(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "gateway"})
+	backend1 := startMockBackend(t, nil)
+	backend2 := startMockBackend(t, nil)
+	_, err := New(nil, &Config{RouteByCert: "OU:cluster="})
+	require.Error(t, err)
+	gw, logs := startTestGateway(t, &Config{
+		TLS: TLSConfig{CA: ca.caFile, Cert: certFile, Key: keyFile, VerifyClient: true},
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend1.addr()},
+			{ClusterID: "c2", Address: backend2.addr()},
+		},
+		RouteByCert: "OU:cluster=",
+	})
+	clientConfig := func(ou ...string) *tls.Config {
+		certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "client", OrganizationalUnit: ou})
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+		return &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true} // nolint: gosec // nolint
+	}
+	res := func() *mysql.HandshakeResponse {
+		res := newTestHandshakeResponse("root")
+		res.Capability |= mysql.ClientSSL
+		return res
+	}
+
+	// The cluster ID is taken from the OU, and the user name is unchanged.
+	conn, err := connectTestGatewayTLS(gw, res(), clientConfig("team-a", "cluster=c2"))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	entry := waitTestLog(t, logs, "start to connect backend")
+	require.Equal(t, backend2.addr(), entry.ContextMap()["backend"])
+
+	// Certificates without the OU are rejected.
+	_, err = connectTestGatewayTLS(gw, res(), clientConfig("team-a"))
+	require.ErrorContains(t, err, "no cluster ID in OU:cluster= of client certificate")
+
+	// So are clients without certificates or TLS.
+	_, err = connectTestGatewayTLS(gw, res(), &tls.Config{InsecureSkipVerify: true}) // nolint: gosec // nolint
+	require.Error(t, err)
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeSecureTransportRequired), err.(*testErr).code)
+}
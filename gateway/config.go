@@ -1,13 +1,54 @@
 package gateway
 
 import (
-	"errors"
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
 )
 
 type BackendConfig struct {
-	ClusterID string
-	Address   string
+	ClusterID string `yaml:"cluster-id"`
+	// Address is a comma separated list of the addresses of the cluster.
+	// Connections are spread across them round-robin.
+	Address string `yaml:"-"`
+	// MinConnections is the share of MaxConnections reserved for the cluster.
+	// The reservation is best-effort: connections still in the handshake
+	// count against MaxConnections before their cluster is known.
+	MinConnections int `yaml:"min-conns"`
+	// IdleTimeout overrides Config.IdleTimeout for the cluster if not zero.
+	IdleTimeout time.Duration `yaml:"idle-timeout"`
+	// ReplicaAddress is the address of a read replica of the cluster, which
+	// receives read-only statements if Config.EnableRWSplit is set.
+	ReplicaAddress string `yaml:"replica-address"`
+	// Compress decides whether data sent to clients of the cluster is
+	// compressed if they negotiate compression. Packets are still framed
+	// with the compression protocol if it is false. nil means
+	// Config.CompressDirection decides if Config.EnableCompression is set, and
+	// false otherwise.
+	Compress *bool `yaml:"compress"`
+	// next is the round-robin counter of the cluster, shared by copies of
+	// the config. Pick always returns the first address if it is nil.
+	next *uint32
+}
+
+// Addresses returns the addresses of the cluster.
+func (c *BackendConfig) Addresses() []string {
+	var addrs []string
+	for _, addr := range strings.Split(c.Address, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
 type BackendConfigs []BackendConfig
@@ -16,36 +57,508 @@ func (b *BackendConfigs) String() string {
 	return "backend clusters"
 }
 
+// Set parses a backend in the form of clusterID=address[,address...][?options],
+// where options are URL query parameters:
+//
+//	min-conns: the minimum share of max connections for the cluster.
+//	idle-timeout: the idle timeout of connections to the cluster.
+//	compress: whether to compress data sent to clients of the cluster.
+//	replica: the address of a read replica of the cluster.
 func (b *BackendConfigs) Set(value string) error {
 	splits := strings.SplitN(value, "=", 2)
 	if len(splits) != 2 {
 		return errors.New("backend must be in the form of clusterID=address")
 	}
-	*b = append(*b, BackendConfig{ClusterID: splits[0], Address: splits[1]})
+	c := BackendConfig{ClusterID: splits[0], Address: splits[1]}
+	if c.ClusterID == defaultClusterID {
+		return errors.Errorf("cluster ID %q is reserved", c.ClusterID)
+	}
+	if i := strings.IndexByte(c.Address, '?'); i >= 0 {
+		opts, err := url.ParseQuery(c.Address[i+1:])
+		if err != nil {
+			return errors.Wrap(err, "invalid backend options")
+		}
+		c.Address = c.Address[:i]
+		for k, v := range opts {
+			switch k {
+			case "min-conns":
+				if c.MinConnections, err = strconv.Atoi(v[0]); err != nil {
+					return errors.Wrap(err, "invalid min-conns")
+				}
+				if c.MinConnections < 0 {
+					return errors.Errorf("invalid min-conns %d of cluster %s", c.MinConnections, c.ClusterID)
+				}
+			case "idle-timeout":
+				if c.IdleTimeout, err = time.ParseDuration(v[0]); err != nil {
+					return errors.Wrap(err, "invalid idle-timeout")
+				}
+			case "compress":
+				compress, err := strconv.ParseBool(v[0])
+				if err != nil {
+					return errors.Wrap(err, "invalid compress")
+				}
+				c.Compress = &compress
+			case "replica":
+				c.ReplicaAddress = v[0]
+			default:
+				return errors.Errorf("unknown backend option %q", k)
+			}
+		}
+	}
+	*b = append(*b, c)
+	return nil
+}
+
+// ValidateMinConnections checks that min-conns are not negative and that the
+// connections reserved by all clusters fit in maxConnections, 0 meaning no
+// limit.
+func (b BackendConfigs) ValidateMinConnections(maxConnections int) error {
+	var reserved int
+	for _, c := range b {
+		if c.MinConnections < 0 {
+			return errors.Errorf("invalid min-conns %d of cluster %s", c.MinConnections, c.ClusterID)
+		}
+		reserved += c.MinConnections
+		if maxConnections > 0 && reserved > maxConnections {
+			return errors.Errorf("min-conns of cluster %s makes the reserved connections %d exceed max connections %d", c.ClusterID, reserved, maxConnections)
+		}
+	}
 	return nil
 }
 
-func (b *BackendConfigs) Find(cluster string) string {
+// get returns the config of a cluster.
+func (b *BackendConfigs) get(cluster string) (BackendConfig, bool) {
 	for _, c := range *b {
 		if strings.EqualFold(c.ClusterID, cluster) {
-			return c.Address
+			return c, true
+		}
+	}
+	return BackendConfig{}, false
+}
+
+// FindByHost returns the cluster whose ID is host or the first label of it,
+// e.g. c1 for c1.tidb.example.com, and whether the cluster is found.
+func (b *BackendConfigs) FindByHost(host string) (string, bool) {
+	if c, ok := b.get(host); ok {
+		return c.ClusterID, true
+	}
+	if label, _, ok := strings.Cut(host, "."); ok {
+		if c, ok := b.get(label); ok {
+			return c.ClusterID, true
+		}
+	}
+	return "", false
+}
+
+// Find returns the address of a cluster, and whether the cluster is found.
+func (b *BackendConfigs) Find(cluster string) (string, bool) {
+	c, ok := b.get(cluster)
+	return c.Address, ok
+}
+
+// Pick returns an address of a cluster, and whether the cluster is found. The
+// addresses of a cluster are returned in turn. A cluster without addresses is
+// not found.
+func (b *BackendConfigs) Pick(cluster string) (string, bool) {
+	return b.pick(cluster, nil)
+}
+
+// pick is Pick skipping addresses for which skip returns true, unless all of
+// them are skipped.
+func (b *BackendConfigs) pick(cluster string, skip func(addr string) bool) (string, bool) {
+	c, ok := b.get(cluster)
+	if !ok {
+		return "", false
+	}
+	addrs := c.Addresses()
+	switch {
+	case len(addrs) == 0:
+		return "", false
+	case len(addrs) == 1 || c.next == nil:
+		return addrs[0], true
+	}
+	n := atomic.AddUint32(c.next, 1) - 1
+	for i := range addrs {
+		addr := addrs[(n+uint32(i))%uint32(len(addrs))]
+		if skip == nil || !skip(addr) {
+			return addr, true
 		}
 	}
-	return cluster
+	return addrs[n%uint32(len(addrs))], true
+}
+
+// withCounters returns a copy of the configs with round-robin counters, which
+// are carried over from old for the same clusters.
+func (b BackendConfigs) withCounters(old BackendConfigs) BackendConfigs {
+	backends := make(BackendConfigs, 0, len(b))
+	for _, c := range b {
+		if prev, ok := old.get(c.ClusterID); ok && prev.next != nil {
+			c.next = prev.next
+		} else {
+			c.next = new(uint32)
+		}
+		backends = append(backends, c)
+	}
+	return backends
 }
 
 // TLSConfig is used to establish TLS connection.
 type TLSConfig struct {
-	CA         string
-	Cert       string
-	Key        string
-	MinVersion string
+	CA         string `yaml:"ca"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	MinVersion string `yaml:"min-version"`
+	// VerifyClient requires clients to connect with TLS and present
+	// certificates signed by ClientCA, or CA if it is empty.
+	VerifyClient bool   `yaml:"verify-client"`
+	ClientCA     string `yaml:"client-ca"`
+	// MatchUserCN requires the user name sent to backend to equal the CN of
+	// the verified client certificate. It requires VerifyClient.
+	MatchUserCN bool `yaml:"match-user-cn"`
 }
 
+// BackendTLSConfig is used to establish TLS connections to backends, which
+// happens when clients connect with TLS.
+type BackendTLSConfig struct {
+	// CA verifies backend certificates. Empty means the system roots.
+	CA string `yaml:"ca"`
+	// Cert and Key are presented to backends requiring client certificates.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ServerName is verified in backend certificates. Empty means the host
+	// of backend addresses.
+	ServerName string `yaml:"server-name"`
+	// InsecureSkipVerify accepts any backend certificate.
+	InsecureSkipVerify bool `yaml:"insecure-skip-verify"`
+}
+
+// CompressDirection is the direction of traffic to be compressed.
+//
+// The gateway only controls the data it writes to the client, so
+// client-to-backend makes it send results uncompressed. Requests are
+// compressed or not as the client decides.
+type CompressDirection string
+
+// Compression directions.
+const (
+	CompressBoth            CompressDirection = "both"
+	CompressBackendToClient CompressDirection = "backend-to-client"
+	CompressClientToBackend CompressDirection = "client-to-backend"
+)
+
+// Validate checks whether the direction is known.
+func (d CompressDirection) Validate() error {
+	switch d {
+	case "", CompressBoth, CompressBackendToClient, CompressClientToBackend:
+		return nil
+	}
+	return errors.Errorf("invalid compress direction %q", d)
+}
+
+// defaultClusterID is the cluster of connections routed to
+// Config.DefaultBackend. It is reserved, so that it never names a configured
+// cluster.
+const defaultClusterID = "*"
+
 // Config is used to configure a gateway.
 type Config struct {
-	TLS                      TLSConfig
-	BackendConfigs           BackendConfigs
+	TLS            TLSConfig
+	BackendTLS     BackendTLSConfig
+	BackendConfigs BackendConfigs
+	// EnableCompression advertises compression in the initial handshake.
+	// It is also advertised if any cluster enables BackendConfig.Compress.
 	EnableCompression        bool
 	BackendInsecureTransport bool
+	// BackendConnectRetries is the number of times to retry connecting to
+	// the next address of a cluster if connecting fails.
+	BackendConnectRetries int
+	// BackendHandshakeTimeout limits the time of the handshake and auth with
+	// backends, including waiting for clients during auth. 0 means no limit.
+	BackendHandshakeTimeout time.Duration
+	// SendProxyProtocol sends a PROXY protocol v2 header with the client
+	// address to backends, so that they see the real client IP. Backends
+	// must be configured to expect it.
+	SendProxyProtocol bool
+	// TCPKeepAlive is the keepalive period of client and backend connections.
+	// 0 means the system default and a negative value disables keepalive.
+	TCPKeepAlive time.Duration
+	// TCPRecvBuffer and TCPSendBuffer set SO_RCVBUF and SO_SNDBUF of client
+	// and backend connections. 0 means system default.
+	TCPRecvBuffer int
+	TCPSendBuffer int
+	// BufferPoolSize is the max total bytes of relay buffers retained for
+	// reuse. 0 disables pooling.
+	BufferPoolSize int
+	// IdleTimeout closes relaying connections if no data moves in either
+	// direction for the duration. 0 means no timeout. When commands are
+	// inspected, a command waiting for its response, such as a long-running
+	// query, keeps the connection from being idle.
+	IdleTimeout time.Duration
+	// HalfClose keeps relaying results after clients shut down their write
+	// side, which is propagated to backend. It only applies to raw byte
+	// relay.
+	HalfClose bool
+	// MaxConnDuration closes connections at the first command after they
+	// last for the duration, with an error sent to the client. 0 means no
+	// limit. It enables command inspection.
+	MaxConnDuration time.Duration
+	// MaxConnDurationErrCode and MaxConnDurationErrMsg are the error sent to
+	// clients when their connections are closed for MaxConnDuration, e.g.
+	// ER_SERVER_SHUTDOWN (1053) so that pools reconnect instead of treating it
+	// as a failure. Zero values mean ER_UNKNOWN_ERROR (1105) and
+	// "Connection exceeds max duration".
+	MaxConnDurationErrCode uint16
+	MaxConnDurationErrMsg  string
+	// WriteStallWarn logs and meters writes to clients blocking for the
+	// duration because they read slowly. WriteStallTimeout closes the
+	// connection once a write blocks for the longer duration. 0 disables
+	// either stage. Both enable command inspection.
+	WriteStallWarn    time.Duration
+	WriteStallTimeout time.Duration
+	// HealthCheck checks backend addresses in the background so that
+	// unhealthy ones are skipped.
+	HealthCheck HealthCheck
+	// CircuitBreaker fast-fails new connections to clusters failing to
+	// connect, with a dedicated error.
+	CircuitBreaker CircuitBreaker
+	// DialQueue limits concurrent backend dials of each cluster, queueing
+	// connections beyond the limit.
+	DialQueue DialQueue
+	// MaxConnections limits the number of connections, 0 means no limit.
+	// Connections accepted beyond it are rejected before the handshake.
+	// Each cluster can reserve a share with BackendConfig.MinConnections. It
+	// can be changed by Gateway.SetMaxConnections.
+	MaxConnections int
+	// AcceptRate limits the number of new connections per second, allowing
+	// bursts of AcceptBurst. Excess connections are queued or rejected
+	// according to AcceptRatePolicy. 0 means no limit.
+	AcceptRate       float64
+	AcceptBurst      int
+	AcceptRatePolicy AcceptRatePolicy
+	// ShedLoad rejects new connections with ER_CON_COUNT_ERROR while the
+	// gateway is near its resource limits.
+	ShedLoad ShedLoad
+	// Tarpit delays the initial handshake to clients from IPs failing auth
+	// repeatedly.
+	Tarpit Tarpit
+	// MaxConcurrentTLSHandshakes limits in-progress TLS handshakes with both
+	// clients and backends, so that bursts of TLS connections queue instead
+	// of saturating CPU. 0 means no limit.
+	MaxConcurrentTLSHandshakes int
+	// TLSHandshakeTimeout limits the time of a TLS handshake including
+	// waiting for a slot, so that stalled peers cannot hold slots forever.
+	// 0 means the default of 10 seconds.
+	TLSHandshakeTimeout time.Duration
+	// AddressRewriter transforms the backend address resolved for a cluster
+	// before connecting to it. An error is sent to the client.
+	AddressRewriter func(clusterID, addr string) (string, error)
+	// CompressDirection decides which directions of a compressed connection
+	// the gateway compresses.
+	CompressDirection CompressDirection
+	// CompressLevel is the zlib level of data compressed for clients, from
+	// 0 (no compression) to 9 (best compression). nil means the default level.
+	CompressLevel *int
+	// CompressThreshold is the length below which data sent to clients is
+	// not compressed. 0 means the default of 128 bytes.
+	CompressThreshold int
+	// CountCommands counts commands of each connection for the access log.
+	// It forces packet relay even if compression is disabled.
+	CountCommands bool
+	// CountRows counts result set rows of each connection for the access
+	// log, following responses packet by packet. It enables command
+	// inspection.
+	CountRows bool
+	// LogBackendVersion adds the server version of the backend to the access
+	// log, and counts connections by cluster and backend version.
+	LogBackendVersion bool
+	// BackendUser makes the gateway authenticate to backends as the user with
+	// BackendPassword using mysql_native_password or caching_sha2_password,
+	// instead of passing the auth of clients through. Every client logs in to
+	// backends as this user, so the gateway authenticates clients itself
+	// against ClientPasswords first, which is required in this mode.
+	BackendUser     string
+	BackendPassword string
+	// BackendPublicKey is the RSA public key of backends, which encrypts
+	// passwords in caching_sha2_password full auth over plaintext
+	// connections. Without it, such auth requires TLS to backends, since a
+	// key sent by backends over plaintext can be replaced in transit. It
+	// also applies to the mysql mode of HealthCheck.
+	BackendPublicKey *rsa.PublicKey
+	// ClientPasswords are the passwords of the users that clients can log in
+	// as when BackendUser is set, checked with mysql_native_password. Users
+	// are named as sent by clients, before the cluster is stripped.
+	ClientPasswords map[string]string
+	// EnableRWSplit routes read-only COM_QUERY statements outside
+	// transactions to BackendConfig.ReplicaAddress of clusters, over a second
+	// backend connection per session. Statements are matched by their first
+	// keyword (SELECT, SHOW, DESC), which is best-effort. Once a session
+	// changes its state, e.g. with SET, USE or COM_INIT_DB, all its commands
+	// go to the primary. It requires BackendUser to log in to replicas, and
+	// enables command inspection.
+	EnableRWSplit bool
+	// MaxAllowedPacket limits the size of packets read from clients, who get
+	// ER_NET_PACKET_TOO_LARGE if exceeded. 0 means no limit. It enables
+	// command inspection, so that commands are limited too.
+	MaxAllowedPacket uint64
+	// BackendMaxPacketSize clamps the max packet size that clients advertise
+	// in handshake responses forwarded to backends. 0 means no clamping.
+	BackendMaxPacketSize uint32
+	// MaxUserNameLen and MaxDBNameLen limit the user name and database in
+	// handshake responses of clients. 0 means no limit.
+	MaxUserNameLen int
+	MaxDBNameLen   int
+	// MaxBackendAttrsLen limits the serialized connection attributes sent to
+	// backend. 0 means no limit.
+	MaxBackendAttrsLen int
+	// HandshakeStatusFlags is the status flags advertised in the initial
+	// handshake. nil means SERVER_STATUS_AUTOCOMMIT.
+	HandshakeStatusFlags *uint16
+	// MaskDeprecateEOF keeps clients from negotiating CLIENT_DEPRECATE_EOF,
+	// so result sets end with EOF packets rather than OK packets. The
+	// initial handshake never advertises it, but some clients request it
+	// anyway. It is a compatibility escape hatch for the packet relay.
+	MaskDeprecateEOF bool
+	// PreserveReservedBytes forwards the reserved block of client handshake
+	// responses to backends as is, instead of zeros.
+	PreserveReservedBytes bool
+	// SpliceHandshakeResponse forwards client handshake responses as read
+	// with only the changed user name, capabilities and auth plugin spliced
+	// in, instead of encoding them again. Responses with other changes are
+	// still encoded again.
+	SpliceHandshakeResponse bool
+	// StrictHandshake rejects backend handshakes deviating from the protocol.
+	StrictHandshake bool
+	// UnknownCommandPolicy decides how to treat unknown commands from
+	// clients. Anything other than forward enables command inspection.
+	UnknownCommandPolicy UnknownCommandPolicy
+	// DrainNotice sends ER_SERVER_SHUTDOWN to clients at their next command
+	// once the gateway is draining. It enables command inspection.
+	DrainNotice bool
+	// QueryCommentTemplate is the comment prepended to COM_QUERY statements.
+	// {connID} and {cluster} are replaced with values of the connection.
+	// It enables command inspection if not empty.
+	QueryCommentTemplate string
+	// LogTxnStatus logs transaction starts and ends seen in backend status
+	// flags. It enables command inspection.
+	LogTxnStatus bool
+	// InterceptPing answers COM_PING in the gateway without forwarding it to
+	// backend, so it no longer checks backend liveness. It enables command
+	// inspection.
+	InterceptPing bool
+	// MaxPreparedStmts limits the prepared statements open on each
+	// connection, and COM_STMT_PREPARE beyond it is answered with
+	// ER_MAX_PREPARED_STMT_COUNT_REACHED without being forwarded. 0 means
+	// no limit. It enables command inspection.
+	MaxPreparedStmts int
+	// CommandLatency records the latency histogram of commands per cluster.
+	// It enables command inspection.
+	CommandLatency bool
+	// LogQueries logs commands of clients, sampled by QueryLogSampleRate
+	// which is the fraction of commands logged, in (0, 1]. 0 means 1, i.e.
+	// all commands are logged. It enables command inspection.
+	LogQueries         bool
+	QueryLogSampleRate float64
+	// RouteByAttr routes connections by the connection attribute with the
+	// key, leaving the user name as is. Connections without the attribute
+	// are routed by the user name.
+	RouteByAttr string
+	// RouteBySNI routes TLS connections by the server name the client
+	// requests, matched by BackendConfigs.FindByHost, leaving the user name
+	// as is. Connections without a matching server name are routed as usual.
+	RouteBySNI bool
+	// DefaultBackend is the address connections to unknown clusters are
+	// routed to, as the cluster defaultClusterID with the whole user name.
+	// Empty means rejecting them. It doesn't apply to RouteByCert, which
+	// rejects unknown clusters.
+	DefaultBackend string
+	// RouteByCert routes connections by a field of the verified client
+	// certificate instead of the user name, one of CN, OU, OU:<prefix> or
+	// OID:<oid>. It requires TLS.VerifyClient. Connections to unknown
+	// clusters are rejected even with DefaultBackend.
+	RouteByCert string
+	// MetricsAddr is the address serving metrics over HTTP at /metrics, the
+	// version and the status of backends at /status, and readiness at /ready.
+	// Empty means not serving.
+	MetricsAddr string
+	// PprofAddr is the address serving runtime profiles over HTTP at
+	// /debug/pprof/, e.g. goroutine profiles to find leaked relays. Empty
+	// means not serving.
+	PprofAddr string
+	// WaitForBackends is used by WaitForBackends to decide whether any or
+	// all backends need to be reachable. Empty means not waiting.
+	WaitForBackends        string
+	WaitForBackendsTimeout time.Duration
+	// FailClosedOnReload rejects new connections with ER_UNKNOWN_ERROR and
+	// reports not ready at /ready after a failed reload reported by
+	// ReportReload, until a successful one.
+	FailClosedOnReload bool
+	// EventSink receives connection lifecycle events. Events are dropped if
+	// it is nil.
+	EventSink EventSink
+}
+
+// fileConfig is the part of Config that can be loaded from a config file.
+type fileConfig struct {
+	TLS                      TLSConfig        `yaml:"tls"`
+	BackendTLS               BackendTLSConfig `yaml:"backend-tls"`
+	EnableCompression        bool             `yaml:"enable-compression"`
+	BackendInsecureTransport bool             `yaml:"backend-insecure-transport"`
+	Backends                 []fileBackend    `yaml:"backends"`
+}
+
+// fileBackend is a backend in a config file, whose address can be a list.
+type fileBackend struct {
+	BackendConfig `yaml:",inline"`
+	Address       addressList `yaml:"address"`
+}
+
+// addressList is a comma separated list of addresses, which can be written
+// as a YAML sequence.
+type addressList string
+
+func (l *addressList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var addrs []string
+		if err := value.Decode(&addrs); err != nil {
+			return err
+		}
+		*l = addressList(strings.Join(addrs, ","))
+		return nil
+	}
+	var addr string
+	if err := value.Decode(&addr); err != nil {
+		return err
+	}
+	*l = addressList(addr)
+	return nil
+}
+
+// LoadConfig reads a config from a YAML or JSON file. Unknown keys are
+// rejected so that typos are not ignored silently.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "invalid config file %s", path)
+	}
+	var backends BackendConfigs
+	for _, b := range fc.Backends {
+		if b.ClusterID == "" {
+			return nil, errors.Errorf("backend in config file %s must have cluster-id", path)
+		}
+		b.BackendConfig.Address = string(b.Address)
+		backends = append(backends, b.BackendConfig)
+	}
+	return &Config{
+		TLS:                      fc.TLS,
+		BackendTLS:               fc.BackendTLS,
+		BackendConfigs:           backends,
+		EnableCompression:        fc.EnableCompression,
+		BackendInsecureTransport: fc.BackendInsecureTransport,
+	}, nil
 }
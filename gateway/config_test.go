@@ -0,0 +1,57 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	conf, err := LoadConfig("testdata/config.yaml")
+	require.NoError(t, err)
+	compress := false
+	require.Equal(t, &Config{
+		TLS: TLSConfig{
+			CA:         "/etc/gateway/ca.pem",
+			Cert:       "/etc/gateway/cert.pem",
+			Key:        "/etc/gateway/key.pem",
+			MinVersion: "TLSv1.2",
+		},
+		BackendTLS: BackendTLSConfig{
+			CA:         "/etc/gateway/backend-ca.pem",
+			ServerName: "tidb.example.com",
+		},
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: "10.0.0.1:4000"},
+			{ClusterID: "c2", Address: "10.0.0.2:4000", MinConnections: 10, IdleTimeout: 5 * time.Minute, Compress: &compress},
+		},
+		EnableCompression:        true,
+		BackendInsecureTransport: true,
+	}, conf)
+
+	// JSON is accepted as well.
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"backends": [{"cluster-id": "c1", "address": "10.0.0.1:4000"}]}`), 0o600))
+	conf, err = LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, BackendConfigs{{ClusterID: "c1", Address: "10.0.0.1:4000"}}, conf.BackendConfigs)
+
+	// Addresses can be a list.
+	require.NoError(t, os.WriteFile(path, []byte("backends:\n  - cluster-id: c1\n    address: [10.0.0.1:4000, 10.0.0.2:4000]\n"), 0o600))
+	conf, err = LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:4000", "10.0.0.2:4000"}, conf.BackendConfigs[0].Addresses())
+
+	for _, content := range []string{
+		"unknown: 1\n",
+		"backends:\n  - address: 10.0.0.1:4000\n",
+		"backends: c1\n",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = LoadConfig(path)
+		require.Error(t, err, content)
+	}
+}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DialQueue configures limiting concurrent backend dials of each cluster.
+// When a cluster dials slowly, connections wait in a bounded queue for a dial
+// slot instead of piling up more dials.
+type DialQueue struct {
+	// MaxDials is the number of concurrent dials to each cluster, 0 means no
+	// limit.
+	MaxDials int
+	// MaxQueued is the number of connections waiting for a dial slot of each
+	// cluster. Connections beyond it are rejected with ER_CON_COUNT_ERROR.
+	MaxQueued int
+	// Timeout is how long connections wait for a dial slot before they are
+	// rejected, 0 means waiting until the gateway is closed.
+	Timeout time.Duration
+}
+
+var (
+	// errDialQueueFull is returned if the dial queue of a cluster is full.
+	errDialQueueFull = errors.New("too many connections waiting to connect backend")
+	// errDialQueueTimeout is returned if no dial slot is available in time.
+	errDialQueueTimeout = errors.New("wait for connecting backend timeout")
+)
+
+// Dial queue results, as labels of dialQueueCounter.
+const (
+	dialQueued  = "queued"
+	dialTimeout = "timeout"
+	dialFull    = "full"
+)
+
+// dialLimiter limits concurrent dials by cluster.
+type dialLimiter struct {
+	conf DialQueue
+	mu   sync.Mutex
+	// slots are the semaphores of clusters.
+	slots map[string]*dialSlots
+}
+
+type dialSlots struct {
+	sem    chan struct{}
+	queued int
+}
+
+// newDialLimiter returns nil if dials are not limited.
+func newDialLimiter(conf DialQueue) *dialLimiter {
+	if conf.MaxDials <= 0 {
+		return nil
+	}
+	return &dialLimiter{
+		conf:  conf,
+		slots: make(map[string]*dialSlots),
+	}
+}
+
+func (l *dialLimiter) getSlots(cluster string) *dialSlots {
+	cluster = strings.ToLower(cluster)
+	s, ok := l.slots[cluster]
+	if !ok {
+		s = &dialSlots{sem: make(chan struct{}, l.conf.MaxDials)}
+		l.slots[cluster] = s
+	}
+	return s
+}
+
+// acquire takes a dial slot of cluster, waiting in the queue if there is no
+// free one. It returns the function releasing the slot.
+func (l *dialLimiter) acquire(cluster string, quit <-chan struct{}) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	s := l.getSlots(cluster)
+	release := func() { <-s.sem }
+	select {
+	case s.sem <- struct{}{}:
+		l.mu.Unlock()
+		return release, nil
+	default:
+	}
+	if s.queued >= l.conf.MaxQueued {
+		l.mu.Unlock()
+		dialQueueCounter.WithLabelValues(dialFull).Inc()
+		return nil, errDialQueueFull
+	}
+	s.queued++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		s.queued--
+		l.mu.Unlock()
+	}()
+	dialQueueCounter.WithLabelValues(dialQueued).Inc()
+
+	var timeout <-chan time.Time
+	if l.conf.Timeout > 0 {
+		timer := time.NewTimer(l.conf.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		dialQueueCounter.WithLabelValues(dialTimeout).Inc()
+		return nil, errDialQueueTimeout
+	case <-quit:
+		return nil, errors.New("gateway is closed")
+	}
+}
+
+// isDialQueueErr returns whether err is caused by the dial queue, rather
+// than the backend.
+func isDialQueueErr(err error) bool {
+	err = errors.Cause(err)
+	return err == errDialQueueFull || err == errDialQueueTimeout
+}
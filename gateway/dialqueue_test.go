@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialLimiter(t *testing.T) {
+	require.Nil(t, newDialLimiter(DialQueue{}))
+	l := newDialLimiter(DialQueue{MaxDials: 1, MaxQueued: 1, Timeout: 100 * time.Millisecond})
+	quit := make(chan struct{})
+
+	release, err := l.acquire("c1", quit)
+	require.NoError(t, err)
+	// Other clusters have their own slots.
+	release2, err := l.acquire("c2", quit)
+	require.NoError(t, err)
+	release2()
+
+	// A queued connection takes the slot once it is released.
+	acquired := make(chan error)
+	go func() {
+		release, err := l.acquire("C1", quit)
+		if err == nil {
+			release()
+		}
+		acquired <- err
+	}()
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.slots["c1"].queued == 1
+	}, time.Second, time.Millisecond)
+	// The queue is full.
+	_, err = l.acquire("c1", quit)
+	require.Equal(t, errDialQueueFull, err)
+	release()
+	require.NoError(t, <-acquired)
+
+	// A queued connection times out.
+	release, err = l.acquire("c1", quit)
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = l.acquire("c1", quit)
+	require.Equal(t, errDialQueueTimeout, err)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	release()
+}
+
+func TestDialQueue(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		DialQueue:      DialQueue{MaxDials: 1, MaxQueued: 1, Timeout: 100 * time.Millisecond},
+	})
+	dialTestGateway(t, gw, "c1.root")
+
+	// Connections wait for the slot taken by a slow dial.
+	release, err := gw.dials.acquire("c1", gw.quit)
+	require.NoError(t, err)
+	timeouts := dialQueueCounter.WithLabelValues(dialTimeout).Value()
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+	require.Equal(t, timeouts+1, dialQueueCounter.WithLabelValues(dialTimeout).Value())
+	require.Equal(t, 1, logs.FilterMessage("too many connections connecting backend").Len())
+
+	connected := make(chan error)
+	go func() {
+		conn, err := connectTestGateway(gw, "c1.root")
+		if err == nil {
+			conn.Close()
+		}
+		connected <- err
+	}()
+	require.Eventually(t, func() bool {
+		gw.dials.mu.Lock()
+		defer gw.dials.mu.Unlock()
+		return gw.dials.slots["c1"].queued == 1
+	}, time.Second, time.Millisecond)
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+	release()
+	require.NoError(t, <-connected)
+}
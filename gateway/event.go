@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EventType is the type of a connection lifecycle event.
+type EventType string
+
+// Connection lifecycle events.
+const (
+	EventConnect  EventType = "connect"
+	EventAuthOK   EventType = "auth-ok"
+	EventAuthFail EventType = "auth-fail"
+	EventClose    EventType = "close"
+)
+
+// Event is a connection lifecycle event. Fields unknown at the time of the
+// event are left empty.
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	ConnID     uint32    `json:"connID"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Cluster    string    `json:"cluster,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	CertCN     string    `json:"certCN,omitempty"`
+	Err        string    `json:"err,omitempty"`
+}
+
+// EventSink receives connection lifecycle events. It is called by all
+// connections concurrently, and should not block.
+type EventSink interface {
+	Emit(e *Event)
+}
+
+type nopEventSink struct{}
+
+func (nopEventSink) Emit(*Event) {}
+
+// FileEventSink writes events to a file as JSON lines.
+type FileEventSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewFileEventSink opens the file for appending events.
+func NewFileEventSink(path string) (*FileEventSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644) // nolint:gomnd // nolint
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &FileEventSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Emit writes an event as a line. Write errors are ignored.
+func (s *FileEventSink) Emit(e *Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.enc.Encode(e)
+}
+
+// Close closes the file.
+func (s *FileEventSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.WithStack(s.f.Close())
+}
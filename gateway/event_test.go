@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	sync.Mutex
+	events []Event
+}
+
+func (s *recordingSink) Emit(e *Event) {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, *e)
+}
+
+// types returns the event types of a connection.
+func (s *recordingSink) types(connID uint32) []EventType {
+	s.Lock()
+	defer s.Unlock()
+	var types []EventType
+	for _, e := range s.events {
+		if e.ConnID == connID {
+			types = append(types, e.Type)
+		}
+	}
+	return types
+}
+
+func TestEventSink(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRejectUser("bad"))
+	var sink recordingSink
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		EventSink:      &sink,
+	})
+
+	conn := dialTestGateway(t, gw, "c1.root")
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return len(sink.types(1)) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []EventType{EventConnect, EventAuthOK, EventClose}, sink.types(1))
+
+	_, err := connectTestGateway(gw, "c1.bad")
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return len(sink.types(2)) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []EventType{EventConnect, EventAuthFail, EventClose}, sink.types(2))
+
+	sink.Lock()
+	defer sink.Unlock()
+	for _, e := range sink.events {
+		if e.Type == EventConnect {
+			require.Empty(t, e.Cluster)
+			continue
+		}
+		require.Equal(t, "c1", e.Cluster)
+		require.Equal(t, backend.addr(), e.Backend)
+	}
+	var authFail *Event
+	for i := range sink.events {
+		if sink.events[i].Type == EventAuthFail {
+			authFail = &sink.events[i]
+		}
+	}
+	require.NotNil(t, authFail)
+	require.Equal(t, "bad", authFail.User)
+	require.Equal(t, errAuthRejected.Error(), authFail.Err)
+}
+
+func TestEventSinkNil(t *testing.T) {
+	conf := &Config{}
+	_, err := New(nil, conf)
+	require.NoError(t, err)
+	// The config of the caller is not changed.
+	require.Nil(t, conf.EventSink)
+}
+
+func TestFileEventSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	sink, err := NewFileEventSink(path)
+	require.NoError(t, err)
+	sink.Emit(&Event{Type: EventConnect, ConnID: 1})
+	sink.Emit(&Event{Type: EventClose, ConnID: 1, Err: "closed"})
+	require.NoError(t, sink.Close())
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var events []Event
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(s.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.Len(t, events, 2)
+	require.Equal(t, EventClose, events[1].Type)
+	require.Equal(t, "closed", events[1].Err)
+}
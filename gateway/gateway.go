@@ -2,132 +2,640 @@ package gateway
 
 import (
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"net"
+	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/oh-my-tidb/tidb-gateway/mysql"
 	"github.com/oh-my-tidb/tidb-gateway/utility"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 type Gateway struct {
-	log          *zap.SugaredLogger
-	l            net.Listener
-	conf         *Config
-	tlsConf      *tls.Config
-	quit         chan struct{}
-	wg           sync.WaitGroup
+	log       *zap.SugaredLogger
+	l         net.Listener
+	conf      *Config
+	tlsConf   *tls.Config
+	quit      chan struct{}
+	quitOnce  sync.Once
+	drain     chan struct{}
+	drainOnce sync.Once
+	done      chan struct{}
+	doneOnce  sync.Once
+	wg        sync.WaitGroup
+	// bgWG tracks background goroutines which are not connections.
+	bgWG         sync.WaitGroup
 	connectionID uint32
+	// activeConns is the number of connections being handled, counted from
+	// being accepted.
+	activeConns int64
+	limiter     *connLimiter
+	bufPool     *bufferPool
+	// tlsSem limits concurrent TLS handshakes if not nil.
+	tlsSem chan struct{}
+	// acceptLimiter limits the rate of accepting connections if not nil.
+	acceptLimiter *rateLimiter
+	// shedding is 1 if new connections are rejected because the gateway is
+	// near its resource limits.
+	shedding int32
+	// reloadFailed is 1 if new connections are rejected because the last
+	// reload failed under Config.FailClosedOnReload.
+	reloadFailed int32
+	// connsMu protects conns, backends and reload, which change on reload.
+	connsMu  sync.Mutex
+	conns    map[uint32]*connEntry
+	backends BackendConfigs
+	reload   *ReloadStatus
+	health   *healthChecker
+	// breaker fast-fails connections to failing clusters if not nil.
+	breaker *circuitBreaker
+	// dials limits concurrent backend dials if not nil.
+	dials *dialLimiter
+	// tarpit delays clients failing auth repeatedly if not nil.
+	tarpit *tarpit
+	// certRoute is the field of client certificates routed by, if not nil.
+	certRoute *certField
+	// backendTLS is the TLS config connecting backends.
+	backendTLS *tls.Config
+	// certs serves the certificate of tlsConf if it is configured.
+	certs *CertReloader
+	// backendErrs records the last error of each backend address.
+	backendErrs *backendErrors
+	// events receives the lifecycle events of connections. It is
+	// Config.EventSink, or drops them if that is nil.
+	events EventSink
+	// metricsServer serves metrics if Config.MetricsAddr is set.
+	metricsServer *http.Server
+	metricsAddr   net.Addr
+	// pprofServer serves profiles if Config.PprofAddr is set.
+	pprofServer *http.Server
+	pprofAddr   net.Addr
+	// commandHook is passed to RelayOptions. Tests set it before serving.
+	commandHook func(cmd []byte)
+	// nonceSource is the random source of scrambles sent to clients if not
+	// nil, instead of crypto/rand.Reader. Tests set it before serving for
+	// reproducible handshakes.
+	nonceSource io.Reader
+	// serveHealthyInterval is how long the accept loop runs before its
+	// earlier restarts are forgiven. Tests shorten it before serving.
+	serveHealthyInterval time.Duration
+	// serveErr is the error the accept loop gives up with. It is set before
+	// done is closed.
+	serveErr error
 }
 
 func New(l net.Listener, conf *Config) (*Gateway, error) {
-	tlsConfig, err := loadTLSConfig(conf.TLS.CA, conf.TLS.Cert, conf.TLS.Key, conf.TLS.MinVersion)
+	tlsConfig, err := loadTLSConfig(conf.TLS.CA, conf.TLS.ClientCA, conf.TLS.Cert, conf.TLS.Key, conf.TLS.MinVersion, conf.TLS.VerifyClient)
 	if err != nil {
 		return nil, err
 	}
+	var certs *CertReloader
+	if tlsConfig != nil && len(tlsConfig.Certificates) > 0 {
+		// Serve the certificate by the reloader, so that it can be renewed
+		// by ReloadCerts.
+		if certs, err = NewCertReloader(conf.TLS.Cert, conf.TLS.Key); err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = nil
+		tlsConfig.GetCertificate = certs.GetCertificate
+	}
+	backendTLS, err := loadBackendTLSConfig(conf.BackendTLS)
+	if err != nil {
+		return nil, err
+	}
+	if conf.TLS.MatchUserCN && !conf.TLS.VerifyClient {
+		return nil, errors.New("matching user names with client certificates requires verifying them")
+	}
+	var certRoute *certField
+	if conf.RouteByCert != "" {
+		if !conf.TLS.VerifyClient {
+			return nil, errors.New("routing by client certificates requires verifying them")
+		}
+		if certRoute, err = parseCertField(conf.RouteByCert); err != nil {
+			return nil, err
+		}
+	}
+	if err := conf.UnknownCommandPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	for _, b := range conf.BackendConfigs {
+		if b.ClusterID == defaultClusterID {
+			return nil, errors.Errorf("cluster ID %q is reserved", b.ClusterID)
+		}
+	}
+	if err := conf.BackendConfigs.ValidateMinConnections(conf.MaxConnections); err != nil {
+		return nil, err
+	}
+	if conf.BackendUser != "" && len(conf.ClientPasswords) == 0 {
+		return nil, errors.New("backend user requires client passwords")
+	}
+	if conf.LogQueries && (conf.QueryLogSampleRate < 0 || conf.QueryLogSampleRate > 1) {
+		return nil, errors.Errorf("invalid query log sample rate %v, it must be in (0, 1]", conf.QueryLogSampleRate)
+	}
+	if conf.EnableRWSplit && conf.BackendUser == "" {
+		return nil, errors.New("read/write split requires a backend user")
+	}
+	if err := conf.CompressDirection.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.CompressLevel != nil && !mysql.ValidCompressLevel(*conf.CompressLevel) {
+		return nil, errors.Errorf("invalid compress level %d", *conf.CompressLevel)
+	}
+	if conf.CompressThreshold < 0 {
+		return nil, errors.Errorf("invalid compress threshold %d", conf.CompressThreshold)
+	}
+	if err := conf.AcceptRatePolicy.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conf.HealthCheck.Mode.Validate(); err != nil {
+		return nil, err
+	}
+	switch conf.WaitForBackends {
+	case "", WaitForAnyBackend, WaitForAllBackends:
+	default:
+		return nil, errors.Errorf("invalid wait for backends mode %q", conf.WaitForBackends)
+	}
+
+	var events EventSink = nopEventSink{}
+	if conf.EventSink != nil {
+		events = conf.EventSink
+	}
+	var bufPool *bufferPool
+	if conf.BufferPoolSize > 0 {
+		bufPool = newBufferPool(conf.BufferPoolSize)
+	}
+	var tlsSem chan struct{}
+	if conf.MaxConcurrentTLSHandshakes > 0 {
+		tlsSem = make(chan struct{}, conf.MaxConcurrentTLSHandshakes)
+	}
+	var acceptLimiter *rateLimiter
+	if conf.AcceptRate > 0 {
+		acceptLimiter = newRateLimiter(conf.AcceptRate, conf.AcceptBurst)
+	}
 
-	return &Gateway{
-		log:     utility.GetLogger(),
-		conf:    conf,
-		tlsConf: tlsConfig,
-		l:       l,
-		quit:    make(chan struct{}),
-	}, nil
+	g := &Gateway{
+		log:           utility.GetLogger(),
+		conf:          conf,
+		tlsConf:       tlsConfig,
+		backendTLS:    backendTLS,
+		certRoute:     certRoute,
+		certs:         certs,
+		l:             l,
+		quit:          make(chan struct{}),
+		drain:         make(chan struct{}),
+		done:          make(chan struct{}),
+		limiter:       newConnLimiter(conf.MaxConnections, conf.BackendConfigs),
+		bufPool:       bufPool,
+		tlsSem:        tlsSem,
+		acceptLimiter: acceptLimiter,
+		conns:         make(map[uint32]*connEntry),
+		backends:      conf.BackendConfigs.withCounters(nil),
+		health:        newHealthChecker(),
+		breaker:       newCircuitBreaker(conf.CircuitBreaker),
+		tarpit:        newTarpit(conf.Tarpit),
+		dials:         newDialLimiter(conf.DialQueue),
+		backendErrs:   newBackendErrors(),
+		events:        events,
+
+		serveHealthyInterval: defaultServeHealthyInterval,
+	}
+	if conf.MetricsAddr != "" {
+		if err := g.serveMetrics(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.PprofAddr != "" {
+		if err := g.servePprof(); err != nil {
+			if g.metricsServer != nil {
+				g.metricsServer.Close()
+			}
+			return nil, err
+		}
+	}
+	return g, nil
 }
 
-func (g *Gateway) Stop() {
-	g.log.Info("gateway starts to stop")
-	close(g.quit)
-	g.l.Close()
+// Done returns a channel that is closed once the gateway is stopped or
+// drained, or its accept loop gives up, and all connections have terminated.
+func (g *Gateway) Done() <-chan struct{} {
+	return g.done
+}
+
+// Err returns the error the accept loop gives up with once Done is closed,
+// or nil if the gateway is stopped or drained.
+func (g *Gateway) Err() error {
+	select {
+	case <-g.done:
+		return g.serveErr
+	default:
+		return nil
+	}
+}
+
+func (g *Gateway) waitDone() {
 	g.wg.Wait()
+	g.doneOnce.Do(func() {
+		g.log.Info("all connections are terminated")
+		close(g.done)
+	})
+}
+
+// Drain stops accepting new connections. Connections relaying packets are
+// closed at their next command boundary.
+func (g *Gateway) Drain() {
+	g.drainOnce.Do(func() {
+		g.log.Info("gateway starts to drain")
+		close(g.drain)
+		g.l.Close()
+		go g.waitDone()
+	})
+}
+
+func (g *Gateway) Stop() {
+	g.close()
+	g.waitDone()
+	g.bgWG.Wait()
 	g.log.Sync()
 }
 
+// close stops accepting and closes all relaying connections.
+func (g *Gateway) close() {
+	g.quitOnce.Do(func() {
+		g.log.Info("gateway starts to stop")
+		close(g.quit)
+		g.l.Close()
+		if g.metricsServer != nil {
+			g.metricsServer.Close()
+		}
+		if g.pprofServer != nil {
+			g.pprofServer.Close()
+		}
+	})
+}
+
+// GracefulStop shuts down the gateway in two phases. It drains first, letting
+// connections finish by themselves within drainTimeout. Then the remaining
+// connections are closed, and it returns an error if some of them are still
+// not terminated after forceTimeout.
+func (g *Gateway) GracefulStop(drainTimeout, forceTimeout time.Duration) error {
+	defer g.log.Sync()
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if g.drainAndWait(ctx) {
+		return nil
+	}
+	select {
+	case <-g.Done():
+		shutdownRemainingGauge.WithLabelValues(phaseForce).Set(0)
+		g.bgWG.Wait()
+		return nil
+	case <-time.After(forceTimeout):
+	}
+
+	remaining := atomic.LoadInt64(&g.activeConns)
+	shutdownRemainingGauge.WithLabelValues(phaseForce).Set(float64(remaining))
+	g.log.Errorw("force close timeout, connections are not terminated", "remaining", remaining)
+	return errors.Errorf("%d connections are not terminated", remaining)
+}
+
+// Shutdown drains the gateway and waits for connections to terminate. Idle
+// connections relaying packets are closed immediately, and busy ones once
+// their current commands finish. If ctx expires first, the remaining
+// connections are closed and ctx.Err() is returned without waiting for them.
+// Connections relaying raw bytes cannot tell idle from busy, so they are left
+// to end by themselves until ctx expires.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	defer g.log.Sync()
+	if !g.drainAndWait(ctx) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// drainAndWait drains the gateway and waits for connections to terminate,
+// then stops it and waits for background goroutines. If ctx expires first,
+// the remaining connections are closed without being waited for, and it
+// returns false.
+func (g *Gateway) drainAndWait(ctx context.Context) bool {
+	shutdownPhaseCounter.WithLabelValues(phaseDrain).Inc()
+	g.Drain()
+	select {
+	case <-g.Done():
+		shutdownRemainingGauge.WithLabelValues(phaseDrain).Set(0)
+		g.close()
+		g.bgWG.Wait()
+		return true
+	case <-ctx.Done():
+	}
+
+	remaining := atomic.LoadInt64(&g.activeConns)
+	shutdownRemainingGauge.WithLabelValues(phaseDrain).Set(float64(remaining))
+	g.log.Warnw("drain timeout, force closing connections", "remaining", remaining)
+	shutdownPhaseCounter.WithLabelValues(phaseForce).Inc()
+	g.close()
+	return false
+}
+
 func (g *Gateway) StartServe() {
 	g.wg.Add(1)
-	go g.serve()
+	go g.superviseServe()
+	if g.conf.HealthCheck.Interval > 0 {
+		g.bgWG.Add(1)
+		go g.checkHealth()
+	}
+	if g.conf.ShedLoad.enabled() {
+		g.bgWG.Add(1)
+		go g.sampleResources()
+	}
 }
 
-func (g *Gateway) serve() {
+// maxServeRestarts is the max number of times the accept loop is restarted
+// after exiting unexpectedly.
+const maxServeRestarts = 5
+
+// serveRestartBackoff is the time to wait before restarting the accept loop.
+const serveRestartBackoff = 100 * time.Millisecond
+
+// defaultServeHealthyInterval is how long the accept loop runs before its
+// earlier restarts are forgiven, so that rare failures far apart never add up
+// to maxServeRestarts.
+const defaultServeHealthyInterval = time.Minute
+
+// superviseServe runs the accept loop, and restarts it up to maxServeRestarts
+// times in a row if it exits while the gateway is neither stopped nor
+// draining. Then it stops the gateway, so that the gateway does not keep
+// running without accepting connections.
+func (g *Gateway) superviseServe() {
 	defer g.wg.Done()
+	var restarts int
+	for {
+		start := time.Now()
+		err := g.serve()
+		select {
+		case <-g.quit:
+			return
+		case <-g.drain:
+			return
+		default:
+		}
+		if time.Since(start) >= g.serveHealthyInterval {
+			restarts = 0
+		}
+		if restarts == maxServeRestarts {
+			g.log.Errorw("accept loop exits unexpectedly, giving up", "err", err, "restarts", restarts)
+			// Without accepting, the gateway is useless, so it stops and
+			// lets the owner exit.
+			g.serveErr = err
+			g.close()
+			go g.waitDone()
+			return
+		}
+		restarts++
+		g.log.Warnw("accept loop exits unexpectedly, restarting", "err", err, "restarts", restarts)
+		serveRestartCounter.Inc()
+		select {
+		case <-g.quit:
+			return
+		case <-g.drain:
+			return
+		case <-time.After(serveRestartBackoff):
+		}
+	}
+}
+
+// serve accepts connections until accepting fails, and returns the error.
+func (g *Gateway) serve() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = handlePanic(g.log, goroutineServe, v)
+		}
+	}()
 	g.log.Info("gateway starts to accept connections")
 	for {
 		conn, err := g.l.Accept()
 		if err != nil {
-			return
+			return errors.WithStack(err)
+		}
+		if !g.checkReload(conn) || !g.shedLoad(conn) || !g.limitAccept(conn) {
+			continue
+		}
+		// Rejected before the handshake, so that excess connections take
+		// no backend capacity.
+		if max := g.limiter.getMax(); max > 0 && atomic.LoadInt64(&g.activeConns) >= int64(max) {
+			g.rejectConn(conn, mysql.ErrCodeConCount, "Too many connections")
+			continue
 		}
+		atomic.AddInt64(&g.activeConns, 1)
 		g.wg.Add(1)
 		go g.handleConn(conn)
 	}
 }
 
+// gatewayCapability is the capabilities the gateway honors end-to-end. TLS
+// and compression are terminated by the gateway.
+const gatewayCapability = mysql.DefaultCapability | mysql.ClientSSL | mysql.ClientCompress |
+	mysql.ClientPluginAuthLenencClientData | mysql.ClientDeprecateEOF
+
 func (g *Gateway) handleConn(rawConn net.Conn) {
 	defer g.wg.Done()
+	defer atomic.AddInt64(&g.activeConns, -1)
+	connsCounter.Inc()
+	activeConnsGauge.Inc()
+	defer activeConnsGauge.Dec()
+	start := time.Now()
 
 	connID := atomic.AddUint32(&g.connectionID, 1)
-	// TODO: set keepalive and nodelay options
+	defer func() {
+		if v := recover(); v != nil {
+			_ = handlePanic(g.log.With("connID", connID), goroutineConn, v)
+		}
+	}()
 	g.log.Infow("accepting new connection", "connID", connID)
+	if err := g.setTCPOptions(rawConn); err != nil {
+		g.log.Warnw("failed to set tcp options", "connID", connID, "err", err)
+	}
+	if err := g.setSocketBuffers(rawConn); err != nil {
+		g.log.Warnw("failed to set socket buffers", "connID", connID, "err", err)
+	}
 	conn := mysql.NewConn(rawConn)
 	defer conn.Close()
+	if g.conf.MaxAllowedPacket > 0 {
+		conn.SetMaxAllowedPacket(g.conf.MaxAllowedPacket)
+	}
+
+	ev := Event{ConnID: connID, RemoteAddr: rawConn.RemoteAddr().String()}
+	g.emit(&ev, EventConnect, nil)
+	var relayErr error
+	defer func() { g.emit(&ev, EventClose, relayErr) }()
 
-	if err := g.sendInitialHandshake(conn, connID); err != nil {
+	if !g.waitTarpit(rawConn, connID) {
+		return
+	}
+	scramble, err := g.sendInitialHandshake(conn, connID)
+	if err != nil {
 		g.log.Warnw("failed to send initial handshake", "connID", connID, "err", err)
+		clientHandshakeFailures.Inc()
+		return
+	}
+
+	if ok, err := g.checkProtocol(conn, connID); !ok {
+		if err != nil {
+			g.log.Warnw("failed to sniff client protocol", "connID", connID, "err", err)
+		}
+		clientHandshakeFailures.Inc()
 		return
 	}
 
 	res, err := g.recvHandshakeResponse(conn)
 	if err != nil {
 		g.log.Warnw("failed to recv handshake response", "connID", connID, "err", err)
+		clientHandshakeFailures.Inc()
 		return
 	}
 
+	var (
+		peerCerts  []*x509.Certificate
+		serverName string
+	)
 	if res.Capability&mysql.ClientSSL != 0 {
-		tlsConn := tls.Server(rawConn, g.tlsConf)
-		if err := tlsConn.Handshake(); err != nil {
-			g.log.Warnw("failed to upgrade to tls connection", "err", err)
+		tlsConn := tls.Server(conn.BufferedConn(), g.tlsConf)
+		if err := g.handshakeTLS(tlsConn); err != nil {
+			g.log.Warnw("failed to upgrade to tls connection", "connID", connID, "err", err)
+			clientHandshakeFailures.Inc()
 			return
 		}
 		conn.SetRawConn(tlsConn)
+		state := tlsConn.ConnectionState()
+		peerCerts, serverName = state.PeerCertificates, state.ServerName
+		if len(peerCerts) > 0 {
+			ev.CertCN = peerCerts[0].Subject.CommonName
+		}
 		res, err = g.recvHandshakeResponse(conn)
 		if err != nil {
 			g.log.Warnw("failed to recv handshake response", "err", err)
+			clientHandshakeFailures.Inc()
 			return
 		}
+	} else if g.conf.TLS.VerifyClient {
+		// Clients without TLS would bypass the verification of certificates.
+		g.log.Warnw("client without tls is rejected", "connID", connID)
+		clientHandshakeFailures.Inc()
+		sendErrCode(conn, mysql.ErrCodeSecureTransportRequired, "Connections using insecure transport are prohibited")
+		return
 	}
 
+	if g.conf.MaskDeprecateEOF && res.Capability&mysql.ClientDeprecateEOF != 0 {
+		g.log.Infow("mask deprecate eof capability", "connID", connID)
+		res.Capability &^= mysql.ClientDeprecateEOF
+	}
 	enableCompress := res.Capability&mysql.ClientCompress != 0
+	res.PreserveReserved = g.conf.PreserveReservedBytes
 
-	backendAddr, err := g.getBackendAddr(res)
+	// clientUser is the user name as sent by the client, before routing
+	// strips the cluster from it.
+	clientUser := res.UserName
+	var clusterID, backendAddr string
+	if g.certRoute != nil {
+		clusterID, backendAddr, err = g.getBackendAddrByCert(peerCerts)
+	} else {
+		clusterID, backendAddr, err = g.getBackendAddr(res, serverName)
+	}
 	if err != nil {
 		g.log.Warnw("failed to get cluster address", "connID", connID, "err", err)
 		g.sendErr(conn, err.Error())
 		return
 	}
 
+	ev.Cluster, ev.User, ev.Backend = clusterID, res.UserName, backendAddr
+	if g.conf.TLS.MatchUserCN {
+		if err := checkCertUser(peerCerts, res.UserName); err != nil {
+			g.log.Warnw("client certificate does not match user", "connID", connID, "err", err)
+			sendErrCode(conn, mysql.ErrCodeAccessDenied, err.Error())
+			return
+		}
+	}
+	if g.conf.BackendUser != "" {
+		if err := g.authClient(conn, res, clientUser, scramble); err != nil {
+			g.log.Warnw("failed to authenticate client", "connID", connID, "user", clientUser, "err", err)
+			authFailureCounter.WithLabelValues(clusterID).Inc()
+			g.tarpit.fail(rawConn.RemoteAddr())
+			g.emit(&ev, EventAuthFail, err)
+			sendErrCode(conn, mysql.ErrCodeAccessDenied, errors.Cause(err).Error())
+			return
+		}
+	}
+
+	if !g.breaker.allow(clusterID) {
+		g.log.Warnw("circuit breaker is open", "connID", connID, "cluster", clusterID)
+		g.breaker.reject(conn)
+		return
+	}
+
+	if !g.limiter.acquire(clusterID) {
+		g.log.Warnw("too many connections", "connID", connID, "cluster", clusterID)
+		sendErrCode(conn, mysql.ErrCodeConCount, "Too many connections")
+		return
+	}
+	defer g.limiter.release(clusterID)
+
+	if err := g.checkAttrsLen(res); err != nil {
+		g.log.Warnw("failed to check connection attributes", "connID", connID, "err", err)
+		g.sendErr(conn, err.Error())
+		return
+	}
+
 	g.log.Infow("start to connect backend", "connID", connID, "backend", backendAddr)
 
-	backendConn, err := g.connectBackend(backendAddr)
+	// The backend is chosen once per connection and never switched, since
+	// session state like prepared statements only exists on it.
+	backendConn, backendAddr, err := g.connectCluster(connID, clusterID, backendAddr)
+	if isDialQueueErr(err) {
+		g.log.Warnw("too many connections connecting backend", "connID", connID, "cluster", clusterID, "err", err)
+		sendErrCode(conn, mysql.ErrCodeConCount, "Too many connections")
+		return
+	}
+	if g.breaker.record(clusterID, err) {
+		g.log.Warnw("open circuit breaker", "cluster", clusterID, "cooldown", g.conf.CircuitBreaker.Cooldown)
+	}
 	if err != nil {
 		g.log.Errorw("failed to connect backend", "connID", connID, "err", err)
 		g.sendErr(conn, err.Error())
 		return
 	}
 	defer backendConn.Close()
+	ev.Backend = backendAddr
 
-	_, err = g.recvInitialHandshake(backendConn)
+	backendRawConn := backendConn.RawConn()
+	backendHs, err := g.startBackendHandshake(backendConn, conn.RawConn())
 	if err != nil {
 		g.log.Errorw("recv initial handshake from backend failed", "connID", connID, "err", err)
+		backendHandshakeFailures.Inc()
 		g.sendErr(conn, err.Error())
 		return
 	}
 
-	// We do not really care about the content of InitialHandshake here.
-	// Simply redirect remote's response to backend.
-	// Hopefully they can come to a consensus.
+	// Simply redirect remote's response to backend, with capabilities the
+	// gateway or backend can't honor masked.
+	if masked := res.Capability &^ (gatewayCapability & backendHs.Capability) &^ mysql.ClientCompress; masked != 0 {
+		g.log.Infow("mask unsupported capabilities", "connID", connID, "masked", masked)
+		res.Capability &^= masked
+	}
+	// Responses relayed to the client are formatted by the capabilities
+	// left after masking, e.g. with EOF packets if DEPRECATE_EOF is masked.
+	conn.SetCapability(res.Capability)
 
 	// Always connect backend without compression.
 	// TiDB allows it even if it has compression enabled.
@@ -137,65 +645,288 @@ func (g *Gateway) handleConn(rawConn net.Conn) {
 		res.Capability &= ^mysql.ClientSecureConnection
 	}
 
-	// Change auth plugin to a invalid name that backend does not know.
-	// Backend will send a SwitchMethod to complete auth process.
-	res.Capability |= mysql.ClientPluginAuth
-	res.AuthPlugin = mysql.AuthInvalidMethod
+	if limit := g.conf.BackendMaxPacketSize; limit > 0 && res.MaxPacketSize > limit {
+		res.MaxPacketSize = limit
+	}
+
+	// authPlugin is the auth plugin negotiated with the client, and
+	// clientPlugin is the one it proposes, recorded for auditing clients
+	// before it is overwritten.
+	authPlugin := res.AuthPlugin
+	clientPlugin := res.AuthPlugin
+	clientAuthPluginCounter.WithLabelValues(clusterID, authPluginLabel(clientPlugin)).Inc()
+	if g.conf.BackendUser == "" {
+		// Change auth plugin to a invalid name that backend does not know.
+		// Backend will send a SwitchMethod to complete auth process.
+		res.Capability |= mysql.ClientPluginAuth
+		res.AuthPlugin = mysql.AuthInvalidMethod
+	}
 
-	if err := backendConn.SendPacket(res); err != nil {
-		g.log.Errorw("failed to send handshake response to backend", "connID", connID, "err", err)
+	if err := g.upgradeBackendTLS(connID, backendConn, backendAddr, res); err != nil {
+		backendHandshakeFailures.Inc()
 		g.sendErr(conn, err.Error())
 		return
 	}
 
-	if res.Capability&mysql.ClientSSL != 0 {
-		tlsConn := tls.Client(backendConn.RawConn(), &tls.Config{InsecureSkipVerify: true}) // nolint: gosec // nolint
-		if err = tlsConn.Handshake(); err != nil {
-			g.log.Errorw("failed to upgrade to tls connection with backend", "err", err)
+	if g.conf.BackendUser != "" {
+		authPlugin, err = g.authBackend(conn, backendConn, res, backendHs.AuthPluginData)
+		if err != nil && err != errAuthRejected {
+			err = g.backendHandshakeErr(err)
 			g.sendErr(conn, err.Error())
-			return
 		}
-		backendConn.SetRawConn(tlsConn)
-		if err := backendConn.SendPacket(res); err != nil {
-			g.log.Errorw("failed to send handshake response to backend", "err", err)
+	} else {
+		if err := g.sendHandshakeResponse(backendConn, res); err != nil {
+			g.log.Errorw("failed to send handshake response to backend", "connID", connID, "err", err)
+			backendHandshakeFailures.Inc()
 			g.sendErr(conn, err.Error())
 			return
 		}
+		var switched string
+		switched, err = g.exchangeAuth(connID, conn, backendConn)
+		if switched != "" {
+			authPlugin = switched
+		}
+		if timeoutErr := g.backendHandshakeErr(err); timeoutErr != err {
+			err = timeoutErr
+			g.sendErr(conn, err.Error())
+		}
 	}
-
-	err = g.exchangeAuth(conn, backendConn)
 	if err != nil {
-		g.log.Errorw("failed to exchanage auth", "err", err)
+		g.log.Errorw("failed to exchanage auth", "connID", connID, "clientAuthPlugin", clientPlugin, "err", err)
+		authFailureCounter.WithLabelValues(clusterID).Inc()
+		g.tarpit.fail(rawConn.RemoteAddr())
+		g.emit(&ev, EventAuthFail, err)
 		return
 	}
+	if g.conf.BackendHandshakeTimeout > 0 {
+		if err := backendRawConn.SetDeadline(time.Time{}); err != nil {
+			g.log.Errorw("failed to clear backend handshake deadline", "connID", connID, "err", err)
+			return
+		}
+	}
+	g.emit(&ev, EventAuthOK, nil)
+	authPluginCounter.WithLabelValues(clusterID, authPluginLabel(authPlugin)).Inc()
+	if g.conf.LogBackendVersion {
+		backendVersionCounter.WithLabelValues(clusterID, backendHs.ServerVersion).Inc()
+	}
+	backendConn.SetCapability(res.Capability & backendHs.Capability)
+
+	var replicaConn *mysql.Conn
+	replicaAddr := g.replicaAddr(clusterID)
+	if replicaAddr != "" {
+		var replicaErr error
+		if replicaConn, replicaErr = g.connectReplica(connID, replicaAddr, conn.RawConn(), *res); replicaErr != nil {
+			g.log.Warnw("failed to connect replica, reads go to primary", "connID", connID, "replica", replicaAddr, "err", replicaErr)
+		} else {
+			defer replicaConn.Close()
+		}
+	}
 
 	g.log.Infow("start to relay data", "connID", connID, "backend", backendAddr)
+	var noticeConn net.Conn
+	if !enableCompress {
+		noticeConn = conn.RawConn()
+	}
+	g.registerConn(connID, clusterID, noticeConn, conn.Close, backendConn.Close)
+	defer g.unregisterConn(connID)
 
-	if enableCompress {
-		conn.EnableCompression()
-		err = RelayPackets(conn, backendConn, g.quit)
+	idleTimeout := g.idleTimeout(clusterID)
+	var stats RelayStats
+	if enableCompress || g.inspectCommands() {
+		if enableCompress {
+			conn.EnableCompression(g.compressLevel())
+			conn.SetCompressWrite(g.compressWrite(clusterID))
+			if g.conf.CompressThreshold > 0 {
+				conn.SetCompressThreshold(g.conf.CompressThreshold)
+			}
+		}
+		opts := &RelayOptions{
+			Log:                  g.log.With("connID", connID),
+			UnknownCommandPolicy: g.conf.UnknownCommandPolicy,
+			Drain:                g.drain,
+			DrainNotice:          g.conf.DrainNotice,
+			QueryComment:         g.queryComment(connID, clusterID),
+			LogTxnStatus:         g.conf.LogTxnStatus,
+			InterceptPing:        g.conf.InterceptPing,
+			MaxPreparedStmts:     g.conf.MaxPreparedStmts,
+			IdleTimeout:          idleTimeout,
+			Deadline:             g.deadline(start),
+			DeadlineErrCode:      g.conf.MaxConnDurationErrCode,
+			DeadlineErrMsg:       g.conf.MaxConnDurationErrMsg,
+			CommandLatency:       g.conf.CommandLatency,
+			Cluster:              clusterID,
+			LogQueries:           g.conf.LogQueries,
+			QueryLogSampleRate:   g.conf.QueryLogSampleRate,
+			WriteStallWarn:       g.conf.WriteStallWarn,
+			WriteStallTimeout:    g.conf.WriteStallTimeout,
+			CountRows:            g.conf.CountRows,
+			Replica:              replicaConn,
+			ReplicaFailed: func(err error) {
+				g.backendErrs.record(normalizeAddr(replicaAddr), err)
+			},
+			bufPool:     g.bufPool,
+			commandHook: g.commandHook,
+		}
+		stats, relayErr = RelayPackets(conn, backendConn, opts, g.quit)
 	} else {
-		err = RelayRawBytes(conn, backendConn, g.quit)
+		stats, relayErr = RelayRawBytes(conn, backendConn, idleTimeout, g.conf.HalfClose, g.quit)
+	}
+	fields := []interface{}{"connID", connID, "authPlugin", authPlugin, "clientAuthPlugin", clientPlugin,
+		"clientToBackend", stats.ClientToBackend, "backendToClient", stats.BackendToClient}
+	if g.conf.CountCommands {
+		fields = append(fields, "commands", stats.Commands)
+	}
+	if g.conf.CountRows {
+		fields = append(fields, "rows", stats.Rows)
+	}
+	if g.conf.LogBackendVersion {
+		fields = append(fields, "backendVersion", backendHs.ServerVersion)
+	}
+	relayErrorCounter.WithLabelValues(relayErrorReason(relayErr)).Inc()
+	var closed *RelayClosedError
+	if errors.As(relayErr, &closed) {
+		fields = append(fields, "closedBy", closed.Side, "eof", closed.EOF)
+		if closed.Side == SideBackend && !closed.EOF {
+			g.backendErrs.record(backendAddr, relayErr)
+		}
+	}
+	if closed == nil || !closed.EOF {
+		fields = append(fields, "err", relayErr)
+	}
+	g.log.Infow("connection is closed", fields...)
+}
+
+// idleTimeout returns the idle timeout of connections to a cluster.
+func (g *Gateway) idleTimeout(clusterID string) time.Duration {
+	backends := g.backendConfigs()
+	if c, ok := backends.get(clusterID); ok && c.IdleTimeout > 0 {
+		return c.IdleTimeout
 	}
-	g.log.Infow("connection is closed", "connID", connID)
+	return g.conf.IdleTimeout
 }
 
-func (g *Gateway) sendInitialHandshake(conn *mysql.Conn, connID uint32) error {
+// advertiseCompression returns whether compression is advertised to clients.
+// The cluster is unknown in the initial handshake, so it is advertised if any
+// cluster enables it.
+func (g *Gateway) advertiseCompression() bool {
+	if g.conf.EnableCompression {
+		return true
+	}
+	for _, c := range g.backendConfigs() {
+		if c.Compress != nil && *c.Compress {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWrite returns whether data sent to compressed clients of a cluster
+// is compressed. Clusters not deciding it only compress if compression is
+// enabled for the gateway, since it may be advertised for other clusters.
+func (g *Gateway) compressWrite(clusterID string) bool {
+	backends := g.backendConfigs()
+	if c, ok := backends.get(clusterID); ok && c.Compress != nil {
+		return *c.Compress
+	}
+	return g.conf.EnableCompression && g.conf.CompressDirection != CompressClientToBackend
+}
+
+// compressLevel returns the zlib level of data compressed for clients.
+func (g *Gateway) compressLevel() int {
+	if g.conf.CompressLevel == nil {
+		return zlib.DefaultCompression
+	}
+	return *g.conf.CompressLevel
+}
+
+// inspectCommands returns whether commands need to be inspected, which
+// requires relaying packets instead of raw bytes.
+func (g *Gateway) inspectCommands() bool {
+	return g.conf.CountCommands || g.conf.CountRows || g.conf.DrainNotice || g.conf.QueryCommentTemplate != "" || g.conf.LogTxnStatus ||
+		g.conf.InterceptPing || g.conf.EnableRWSplit || g.conf.MaxPreparedStmts > 0 || g.conf.CommandLatency || g.conf.LogQueries || g.conf.MaxConnDuration > 0 ||
+		g.conf.WriteStallWarn > 0 || g.conf.WriteStallTimeout > 0 || g.conf.MaxAllowedPacket > 0 ||
+		(g.conf.UnknownCommandPolicy != "" && g.conf.UnknownCommandPolicy != UnknownCommandForward)
+}
+
+// deadline returns the deadline of a connection started at start, or zero
+// if connections have no max duration.
+func (g *Gateway) deadline(start time.Time) time.Time {
+	if g.conf.MaxConnDuration <= 0 {
+		return time.Time{}
+	}
+	return start.Add(g.conf.MaxConnDuration)
+}
+
+// queryComment renders the comment injected to queries of a connection.
+func (g *Gateway) queryComment(connID uint32, clusterID string) string {
+	if g.conf.QueryCommentTemplate == "" {
+		return ""
+	}
+	// Values must not terminate the comment.
+	escape := strings.NewReplacer("*/", "* /")
+	r := strings.NewReplacer(
+		"{connID}", strconv.FormatUint(uint64(connID), 10),
+		"{cluster}", escape.Replace(clusterID),
+	)
+	return "/* " + escape.Replace(r.Replace(g.conf.QueryCommentTemplate)) + " */ "
+}
+
+// sendInitialHandshake sends the initial handshake to the client, and returns
+// the scramble in it.
+func (g *Gateway) sendInitialHandshake(conn *mysql.Conn, connID uint32) ([]byte, error) {
+	scramble, err := mysql.NewScramble(g.scrambleSource())
+	if err != nil {
+		return nil, err
+	}
 	hs := &mysql.Handshake{
 		ProtocolVersion: mysql.DefaultHandshakeVersion,
 		ServerVersion:   "5.7.25-TiDB",
 		ConnectionID:    connID,
-		AuthPluginData:  make([]byte, 20),
+		AuthPluginData:  scramble,
 		Capability:      mysql.DefaultCapability,
 		CharacterSet:    mysql.DefaultCollationID,
 		StatusFlags:     mysql.ServerStatusAutocommit,
 		AuthPluginName:  mysql.AuthNativePassword,
 	}
-	return conn.SendPacket(hs)
+	if g.advertiseCompression() {
+		hs.Capability |= mysql.ClientCompress
+	}
+	if g.conf.HandshakeStatusFlags != nil {
+		hs.StatusFlags = *g.conf.HandshakeStatusFlags
+	}
+	return scramble, conn.SendPacket(hs)
+}
+
+// scrambleSource returns the random source of scrambles.
+func (g *Gateway) scrambleSource() io.Reader {
+	if g.nonceSource == nil {
+		return rand.Reader
+	}
+	return g.nonceSource
+}
+
+// upgradeBackendTLS upgrades the connection to backend at addr to TLS if res
+// requests it, so that credentials are only sent after TLS is established.
+func (g *Gateway) upgradeBackendTLS(connID uint32, backendConn *mysql.Conn, addr string, res *mysql.HandshakeResponse) error {
+	if res.Capability&mysql.ClientSSL == 0 {
+		return nil
+	}
+	if err := backendConn.SendPacket((*mysql.SSLRequest)(res)); err != nil {
+		g.log.Errorw("failed to send ssl request to backend", "connID", connID, "err", err)
+		return err
+	}
+	tlsConn := tls.Client(backendConn.BufferedConn(), g.backendTLSConfig(addr))
+	if err := g.handshakeTLS(tlsConn); err != nil {
+		err = g.backendHandshakeErr(err)
+		g.log.Errorw("failed to upgrade to tls connection with backend", "err", err)
+		return err
+	}
+	backendConn.SetRawConn(tlsConn)
+	return nil
 }
 
 func (g *Gateway) recvInitialHandshake(conn *mysql.Conn) (*mysql.Handshake, error) {
-	var hs mysql.Handshake
+	hs := mysql.Handshake{Strict: g.conf.StrictHandshake}
 	if err := conn.RecvPacket(&hs); err != nil {
 		return nil, err
 	}
@@ -203,13 +934,34 @@ func (g *Gateway) recvInitialHandshake(conn *mysql.Conn) (*mysql.Handshake, erro
 }
 
 func (g *Gateway) recvHandshakeResponse(conn *mysql.Conn) (*mysql.HandshakeResponse, error) {
-	var res mysql.HandshakeResponse
+	res := mysql.HandshakeResponse{
+		MaxUserNameLen: g.conf.MaxUserNameLen,
+		MaxDBNameLen:   g.conf.MaxDBNameLen,
+		KeepRaw:        g.conf.SpliceHandshakeResponse,
+	}
 	if err := conn.RecvPacket(&res); err != nil {
+		if mysql.IsNetPacketTooLarge(err) {
+			sendErrCode(conn, mysql.ErrCodeNetPacketTooLarge, errMsgNetPacketTooLarge)
+		}
 		return nil, err
 	}
 	return &res, nil
 }
 
+// sendHandshakeResponse sends res to backend, spliced into the packet read
+// from the client if Config.SpliceHandshakeResponse is set.
+func (g *Gateway) sendHandshakeResponse(backendConn *mysql.Conn, res *mysql.HandshakeResponse) error {
+	if g.conf.SpliceHandshakeResponse {
+		if data, ok := res.Splice(); ok {
+			if err := backendConn.WritePacket(data); err != nil {
+				return err
+			}
+			return backendConn.Flush()
+		}
+	}
+	return backendConn.SendPacket(res)
+}
+
 func copyPacket(dst, src *mysql.Conn) ([]byte, error) {
 	var b bytes.Buffer
 	err := src.ReadPacket(&b)
@@ -223,53 +975,307 @@ func copyPacket(dst, src *mysql.Conn) ([]byte, error) {
 	return b.Bytes(), dst.Flush()
 }
 
-func (g *Gateway) exchangeAuth(clientConn, backendConn *mysql.Conn) error {
+// errMsgNetPacketTooLarge is the message of ER_NET_PACKET_TOO_LARGE.
+const errMsgNetPacketTooLarge = "Got a packet bigger than 'max_allowed_packet' bytes"
+
+// errAuthRejected is returned by exchangeAuth if backend rejects the auth.
+var errAuthRejected = errors.New("auth is rejected by backend")
+
+// exchangeAuth relays the auth packets between client and backend. It
+// returns the auth plugin that backend switches to, if any.
+func (g *Gateway) exchangeAuth(connID uint32, clientConn, backendConn *mysql.Conn) (string, error) {
+	var plugin string
 	for {
 		data, err := copyPacket(clientConn, backendConn)
 		if err != nil {
-			return err
+			return plugin, err
 		}
-		if len(data) > 0 && (data[0] == mysql.HeaderOK || data[0] == mysql.HeaderErr) {
-			return nil
+		if len(data) > 0 {
+			switch data[0] {
+			case mysql.HeaderOK:
+				return plugin, nil
+			case mysql.HeaderErr:
+				return plugin, errAuthRejected
+			case mysql.HeaderEOF:
+				if mysql.IsAuthSwitchRequest(data) {
+					var sw mysql.AuthSwitchRequest
+					if err := sw.Read(mysql.NewBuffer(data)); err != nil {
+						return plugin, err
+					}
+					plugin = sw.PluginName
+					g.log.Debugw("backend requests auth switch", "connID", connID, "plugin", plugin)
+				}
+			case mysql.HeaderAuthMoreData:
+				var more mysql.AuthMoreData
+				if err := more.Read(mysql.NewBuffer(data)); err != nil {
+					return plugin, err
+				}
+				// The OK packet follows without a reply from the client.
+				if more.FastAuthSuccess() {
+					continue
+				}
+			}
 		}
 		_, err = copyPacket(backendConn, clientConn)
 		if err != nil {
-			return err
+			return plugin, err
 		}
 	}
 }
 
+// emit sends a lifecycle event of the connection described by ev.
+func (g *Gateway) emit(ev *Event, typ EventType, err error) {
+	e := *ev
+	e.Type, e.Time = typ, time.Now()
+	if err != nil {
+		e.Err = err.Error()
+	}
+	g.events.Emit(&e)
+}
+
 func (g *Gateway) sendErr(conn *mysql.Conn, msg string) {
+	sendErrCode(conn, mysql.ErrCodeUnknown, msg)
+}
+
+func sendErrCode(conn *mysql.Conn, code uint16, msg string) error {
 	err := &mysql.Err{
 		Header:     mysql.HeaderErr,
-		Code:       mysql.ErrCodeUnknown,
+		Code:       code,
 		State:      mysql.UnknownState,
 		Message:    msg,
 		Capability: mysql.DefaultCapability,
 	}
-	conn.SendPacket(err)
+	return conn.SendPacket(err)
 }
 
-func (g *Gateway) getBackendAddr(res *mysql.HandshakeResponse) (string, error) {
+// getBackendAddr picks the backend address of the cluster given by the TLS
+// server name, the connection attribute or the user name, in that order.
+func (g *Gateway) getBackendAddr(res *mysql.HandshakeResponse, serverName string) (string, string, error) {
 	var clusterID string
-	if splits := strings.SplitN(res.UserName, ".", 2); len(splits) == 1 {
+	user := res.UserName
+	if cluster, ok := g.clusterBySNI(serverName); ok {
+		clusterID = cluster
+	} else if attr := res.Attrs[g.conf.RouteByAttr]; g.conf.RouteByAttr != "" && attr != "" {
+		clusterID = attr
+	} else if splits := strings.SplitN(res.UserName, ".", 2); len(splits) == 1 {
 		clusterID, res.UserName = splits[0], ""
 	} else {
 		clusterID, res.UserName = splits[0], splits[1]
 	}
 
-	clusterAddr := g.conf.BackendConfigs.Find(clusterID)
-	if ok, _ := regexp.MatchString(`:\d+$`, clusterAddr); !ok {
-		clusterAddr = clusterAddr + ":4000"
+	// Unknown clusters go to the default backend with the user name as is,
+	// so that clients of single cluster deployments need no prefix.
+	if g.conf.DefaultBackend != "" {
+		backends := g.backendConfigs()
+		if _, ok := backends.get(clusterID); !ok {
+			res.UserName = user
+			addr, err := g.rewriteAddr(defaultClusterID, g.conf.DefaultBackend)
+			return defaultClusterID, addr, err
+		}
 	}
+	addr, err := g.pickAddr(clusterID, nil)
+	return clusterID, addr, err
+}
 
+// clusterBySNI returns the cluster matching the TLS server name if
+// Config.RouteBySNI is set.
+func (g *Gateway) clusterBySNI(serverName string) (string, bool) {
+	if !g.conf.RouteBySNI || serverName == "" {
+		return "", false
+	}
+	backends := g.backendConfigs()
+	return backends.FindByHost(serverName)
+}
+
+// pickAddr picks an address of a cluster and rewrites it. Addresses in tried,
+// which are rewritten, are skipped while others remain, and unhealthy ones
+// are skipped after them.
+func (g *Gateway) pickAddr(clusterID string, tried map[string]struct{}) (string, error) {
+	// Health and tried are keyed by the addresses connections dial.
+	isTried := func(addr string) bool {
+		if len(tried) == 0 {
+			return false
+		}
+		rewritten, err := g.rewriteAddr(clusterID, addr)
+		_, ok := tried[rewritten]
+		return err == nil && ok
+	}
+	backends := g.backendConfigs()
+	addr, ok := backends.pick(clusterID, func(addr string) bool {
+		rewritten, err := g.rewriteAddr(clusterID, addr)
+		if err != nil {
+			return false
+		}
+		_, ok := tried[rewritten]
+		return ok || g.health.isUnhealthy(rewritten)
+	})
+	if ok && isTried(addr) {
+		// All untried addresses are unhealthy, which beats a failed one.
+		addr, ok = backends.pick(clusterID, isTried)
+	}
+	if !ok {
+		return "", errors.Errorf("unknown cluster %q", clusterID)
+	}
+	return g.rewriteAddr(clusterID, addr)
+}
+
+// rewriteAddr normalizes addr of a cluster and rewrites it by
+// Config.AddressRewriter.
+func (g *Gateway) rewriteAddr(clusterID, addr string) (string, error) {
+	clusterAddr := normalizeAddr(addr)
+	if g.conf.AddressRewriter != nil {
+		addr, err := g.conf.AddressRewriter(clusterID, clusterAddr)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to rewrite address of cluster %s", clusterID)
+		}
+		clusterAddr = addr
+	}
 	return clusterAddr, nil
 }
 
-func (g *Gateway) connectBackend(addr string) (*mysql.Conn, error) {
+// connectCluster connects to addr of a cluster. If it fails, the next
+// addresses of the cluster are tried up to BackendConnectRetries times,
+// preferring those not tried yet. It returns the address connected, or the
+// last error.
+func (g *Gateway) connectCluster(connID uint32, clusterID, addr string) (*mysql.Conn, string, error) {
+	tried := make(map[string]struct{})
+	for attempt := 0; ; attempt++ {
+		release, err := g.dials.acquire(clusterID, g.quit)
+		if err != nil {
+			return nil, "", err
+		}
+		conn, err := g.connectBackend(addr)
+		release()
+		if err == nil || attempt >= g.conf.BackendConnectRetries {
+			return conn, addr, err
+		}
+		g.log.Warnw("failed to connect backend, retrying", "connID", connID, "backend", addr, "err", err)
+		if clusterID == defaultClusterID {
+			// The default backend has a single address to retry.
+			continue
+		}
+		tried[addr] = struct{}{}
+		if addr, err = g.pickAddr(clusterID, tried); err != nil {
+			return nil, "", err
+		}
+	}
+}
+
+// normalizeAddr appends the default TiDB port if addr has no port.
+func normalizeAddr(addr string) string {
+	if ok, _ := regexp.MatchString(`:\d+$`, addr); !ok {
+		return addr + ":4000"
+	}
+	return addr
+}
+
+// checkAttrsLen makes sure the attributes forwarded to backend are not
+// larger than configured, as backend rejects oversized responses opaquely.
+func (g *Gateway) checkAttrsLen(res *mysql.HandshakeResponse) error {
+	if g.conf.MaxBackendAttrsLen <= 0 || res.Capability&mysql.ClientConnectAttrs == 0 {
+		return nil
+	}
+	if l := res.AttrsLen(); l > g.conf.MaxBackendAttrsLen {
+		return errors.Errorf("connection attributes too large: %d bytes exceeds limit %d", l, g.conf.MaxBackendAttrsLen)
+	}
+	return nil
+}
+
+func (g *Gateway) connectBackend(addr string) (_ *mysql.Conn, err error) {
+	defer func() {
+		if err != nil {
+			g.backendErrs.record(addr, err)
+		}
+	}()
 	rawConn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	if err := g.setTCPOptions(rawConn); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	if err := g.setSocketBuffers(rawConn); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
 	return mysql.NewConn(rawConn), nil
 }
+
+// startBackendHandshake sends the PROXY protocol header to a new backend
+// connection for client, and receives its initial handshake. The handshake
+// deadline is set and left for the caller to clear after auth, so that a
+// backend accepting connections without responding does not hang them.
+func (g *Gateway) startBackendHandshake(backendConn *mysql.Conn, client net.Conn) (*mysql.Handshake, error) {
+	if err := g.sendProxyHeader(backendConn.RawConn(), client); err != nil {
+		return nil, err
+	}
+	if err := g.setBackendHandshakeDeadline(backendConn.RawConn()); err != nil {
+		return nil, err
+	}
+	hs, err := g.recvInitialHandshake(backendConn)
+	if err != nil {
+		return nil, g.backendHandshakeErr(err)
+	}
+	return hs, nil
+}
+
+// setBackendHandshakeDeadline sets the deadline of the handshake and auth with
+// backend if BackendHandshakeTimeout is set.
+func (g *Gateway) setBackendHandshakeDeadline(conn net.Conn) error {
+	if g.conf.BackendHandshakeTimeout <= 0 {
+		return nil
+	}
+	return errors.WithStack(conn.SetDeadline(time.Now().Add(g.conf.BackendHandshakeTimeout)))
+}
+
+// backendHandshakeErr replaces err with a clear one if it is caused by the
+// backend handshake deadline.
+func (g *Gateway) backendHandshakeErr(err error) error {
+	if g.conf.BackendHandshakeTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+		return errors.Errorf("backend does not finish handshake in %s", g.conf.BackendHandshakeTimeout)
+	}
+	return err
+}
+
+// setTCPOptions disables Nagle's algorithm and applies the keepalive option
+// to a TCP connection. Other connections are left untouched.
+func (g *Gateway) setTCPOptions(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetNoDelay(true); err != nil {
+		return errors.WithStack(err)
+	}
+	if g.conf.TCPKeepAlive < 0 {
+		return errors.WithStack(tcpConn.SetKeepAlive(false))
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return errors.WithStack(err)
+	}
+	if g.conf.TCPKeepAlive > 0 {
+		return errors.WithStack(tcpConn.SetKeepAlivePeriod(g.conf.TCPKeepAlive))
+	}
+	return nil
+}
+
+// setSocketBuffers applies the configured socket buffer sizes to a TCP
+// connection. Other connections are left untouched.
+func (g *Gateway) setSocketBuffers(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if g.conf.TCPRecvBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(g.conf.TCPRecvBuffer); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if g.conf.TCPSendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(g.conf.TCPSendBuffer); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
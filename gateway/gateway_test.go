@@ -0,0 +1,1508 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1" // nolint:gosec // nolint
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+var okPacket = []byte{mysql.HeaderOK, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+
+// mockBackend is a minimal MySQL server. It accepts any auth and answers
+// every command with handler, which replies OK by default.
+type mockBackend struct {
+	l       net.Listener
+	handler func(conn *mysql.Conn, cmd []byte) error
+	tlsConf *tls.Config
+	// rejectUser is rejected with an error packet during auth.
+	rejectUser string
+	// password is checked with the auth plugin if not empty.
+	password string
+	// authPlugin is the plugin switched to during auth, native by default.
+	authPlugin string
+	// sha2FullAuth makes caching_sha2_password auth go through full auth
+	// with the public key requested, instead of fast auth.
+	sha2FullAuth bool
+	// capability overrides the advertised capability if not zero.
+	capability uint32
+	// responses receives handshake responses if not nil.
+	responses chan *mysql.HandshakeResponse
+	// proxyHeaders receives PROXY protocol v2 headers read before the
+	// handshake if not nil.
+	proxyHeaders chan []byte
+	wg           sync.WaitGroup
+}
+
+// mockOption configures a mock backend before it starts serving, so that
+// connections never race with the configuration.
+type mockOption func(b *mockBackend)
+
+func mockTLS(tlsConf *tls.Config) mockOption {
+	return func(b *mockBackend) { b.tlsConf = tlsConf }
+}
+
+func mockPassword(password string) mockOption {
+	return func(b *mockBackend) { b.password = password }
+}
+
+func mockRejectUser(user string) mockOption {
+	return func(b *mockBackend) { b.rejectUser = user }
+}
+
+func mockAuthPlugin(plugin string) mockOption {
+	return func(b *mockBackend) { b.authPlugin = plugin }
+}
+
+func mockSha2FullAuth(fullAuth bool) mockOption {
+	return func(b *mockBackend) { b.sha2FullAuth = fullAuth }
+}
+
+func mockCapability(capability uint32) mockOption {
+	return func(b *mockBackend) { b.capability = capability }
+}
+
+// mockRecordResponses records one handshake response in responses.
+func mockRecordResponses() mockOption {
+	return func(b *mockBackend) { b.responses = make(chan *mysql.HandshakeResponse, 1) }
+}
+
+// mockRecordProxyHeaders records one PROXY protocol header in proxyHeaders.
+func mockRecordProxyHeaders() mockOption {
+	return func(b *mockBackend) { b.proxyHeaders = make(chan []byte, 1) }
+}
+
+func startMockBackend(t *testing.T, handler func(conn *mysql.Conn, cmd []byte) error, opts ...mockOption) *mockBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if handler == nil {
+		handler = func(conn *mysql.Conn, cmd []byte) error {
+			return writeTestPacket(conn, okPacket)
+		}
+	}
+	b := &mockBackend{l: l, handler: handler}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.wg.Add(1)
+	go b.serve()
+	t.Cleanup(b.close)
+	return b
+}
+
+// startMockTLSBackend starts a mock backend which supports TLS.
+func startMockTLSBackend(t *testing.T, tlsConf *tls.Config, handler func(conn *mysql.Conn, cmd []byte) error, opts ...mockOption) *mockBackend {
+	return startMockBackend(t, handler, append(opts, mockTLS(tlsConf))...)
+}
+
+func (b *mockBackend) addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *mockBackend) close() {
+	b.l.Close()
+	b.wg.Wait()
+}
+
+func (b *mockBackend) serve() {
+	defer b.wg.Done()
+	for {
+		rawConn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer rawConn.Close()
+			if b.proxyHeaders != nil {
+				header, err := readTestProxyHeader(rawConn)
+				if err != nil {
+					return
+				}
+				b.proxyHeaders <- header
+			}
+			b.handleConn(mysql.NewConn(rawConn))
+		}()
+	}
+}
+
+// readTestProxyHeader reads a PROXY protocol v2 header.
+func readTestProxyHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, err
+	}
+	return append(header, addrs...), nil
+}
+
+func (b *mockBackend) handleConn(conn *mysql.Conn) {
+	hs := &mysql.Handshake{
+		ProtocolVersion: mysql.DefaultHandshakeVersion,
+		ServerVersion:   "5.7.25-TiDB-mock",
+		ConnectionID:    1,
+		AuthPluginData:  []byte("0123456789abcdefghij"),
+		Capability:      mysql.DefaultCapability,
+		CharacterSet:    mysql.DefaultCollationID,
+		StatusFlags:     mysql.ServerStatusAutocommit,
+		AuthPluginName:  mysql.AuthNativePassword,
+	}
+	if b.capability != 0 {
+		hs.Capability = b.capability
+	}
+	if b.tlsConf != nil {
+		hs.Capability |= mysql.ClientSSL
+	}
+	if err := conn.SendPacket(hs); err != nil {
+		return
+	}
+	var res mysql.HandshakeResponse
+	if err := conn.RecvPacket(&res); err != nil {
+		return
+	}
+	if res.Capability&mysql.ClientSSL != 0 {
+		if b.tlsConf == nil || res.UserName != "" {
+			return
+		}
+		tlsConn := tls.Server(conn.BufferedConn(), b.tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn.SetRawConn(tlsConn)
+		if err := conn.RecvPacket(&res); err != nil {
+			return
+		}
+	}
+	if b.responses != nil {
+		b.responses <- &res
+	}
+	auth := res.Auth
+	authPlugin := b.authPlugin
+	if authPlugin == "" {
+		authPlugin = mysql.AuthNativePassword
+	}
+	if res.AuthPlugin != authPlugin {
+		var sw bytes.Buffer
+		sw.WriteByte(mysql.HeaderEOF)
+		sw.WriteString(authPlugin)
+		sw.WriteByte(0x00)
+		sw.Write(hs.AuthPluginData)
+		sw.WriteByte(0x00)
+		if err := writeTestPacket(conn, sw.Bytes()); err != nil {
+			return
+		}
+		var authRes bytes.Buffer
+		if err := conn.ReadPacket(&authRes); err != nil {
+			return
+		}
+		auth = authRes.Bytes()
+	}
+	passed := checkNativePassword(auth, hs.AuthPluginData, b.password)
+	if authPlugin == mysql.AuthCachingSha2Password {
+		fullAuth, err := b.cachingSha2Auth(conn, hs.AuthPluginData)
+		if err != nil {
+			return
+		}
+		passed = fullAuth == b.password ||
+			(!b.sha2FullAuth && bytes.Equal(auth, mysql.CachingSha2PasswordAuth(b.password, hs.AuthPluginData)))
+	}
+	if b.password != "" && !passed {
+		_ = sendErrCode(conn, 1045, "Access denied")
+		return
+	}
+	if b.rejectUser != "" && res.UserName == b.rejectUser {
+		_ = sendErrCode(conn, 1045, "Access denied")
+		return
+	}
+	if err := writeTestPacket(conn, okPacket); err != nil {
+		return
+	}
+	for {
+		conn.SetResetOption(mysql.SeqResetOnRead)
+		var cmd bytes.Buffer
+		if err := conn.ReadPacket(&cmd); err != nil {
+			return
+		}
+		if cmd.Len() > 0 && cmd.Bytes()[0] == mysql.ComQuit {
+			return
+		}
+		if err := b.handler(conn, cmd.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+var (
+	testRSAKeyOnce sync.Once
+	testRSAKey     *rsa.PrivateKey
+	testPublicKey  []byte
+)
+
+// mockRSAKey returns the RSA key of caching_sha2_password full auth, and its
+// public key in PEM. It is generated once for all mock backends.
+func mockRSAKey() (*rsa.PrivateKey, []byte) {
+	testRSAKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			panic(err)
+		}
+		testRSAKey = key
+		testPublicKey = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	})
+	return testRSAKey, testPublicKey
+}
+
+// cachingSha2Auth continues caching_sha2_password auth after the scramble
+// is received, until the OK or ERR packet is to be sent. It returns the
+// password sent in clear text over TLS or encrypted during full auth, or
+// an empty string if it cannot be recovered.
+func (b *mockBackend) cachingSha2Auth(conn *mysql.Conn, scramble []byte) (string, error) {
+	if !b.sha2FullAuth {
+		return "", conn.SendPacket(&mysql.AuthMoreData{Data: []byte{mysql.CachingSha2FastAuthSuccess}})
+	}
+	if err := conn.SendPacket(&mysql.AuthMoreData{Data: []byte{mysql.CachingSha2PerformFullAuth}}); err != nil {
+		return "", err
+	}
+	var req bytes.Buffer
+	if err := conn.ReadPacket(&req); err != nil {
+		return "", err
+	}
+	if _, ok := conn.RawConn().(*tls.Conn); ok {
+		return string(bytes.TrimSuffix(req.Bytes(), []byte{0})), nil
+	}
+	// Clients with the public key send the encrypted password right away.
+	key, publicKey := mockRSAKey()
+	encrypted := req
+	if bytes.Equal(req.Bytes(), []byte{mysql.CachingSha2RequestPublicKey}) {
+		if err := conn.SendPacket(&mysql.AuthMoreData{Data: publicKey}); err != nil {
+			return "", err
+		}
+		encrypted.Reset()
+		if err := conn.ReadPacket(&encrypted); err != nil {
+			return "", err
+		}
+	}
+	plain, err := rsa.DecryptOAEP(sha1.New(), nil, key, encrypted.Bytes(), nil) // nolint:gosec // nolint
+	if err != nil {
+		return "", nil
+	}
+	for i := range plain {
+		plain[i] ^= scramble[i%len(scramble)]
+	}
+	return string(bytes.TrimSuffix(plain, []byte{0})), nil
+}
+
+func writeTestPacket(conn *mysql.Conn, data []byte) error {
+	if err := conn.WritePacket(data); err != nil {
+		return err
+	}
+	return conn.Flush()
+}
+
+// startTestGateway starts a gateway on a random port with its logs recorded.
+func startTestGateway(t *testing.T, conf *Config) (*Gateway, *observer.ObservedLogs) {
+	gw, logs := newTestGateway(t, conf)
+	gw.StartServe()
+	t.Cleanup(gw.Stop)
+	return gw, logs
+}
+
+// newTestGateway creates a gateway on a random port with its logs recorded,
+// and leaves starting it to the caller.
+func newTestGateway(t *testing.T, conf *Config) (*Gateway, *observer.ObservedLogs) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gw, err := New(l, conf)
+	require.NoError(t, err)
+	core, logs := observer.New(zapcore.DebugLevel)
+	gw.log = zap.New(core).Sugar()
+	return gw, logs
+}
+
+// dialTestGateway connects to the gateway as user and completes the auth.
+func dialTestGateway(t *testing.T, gw *Gateway, user string) *mysql.Conn {
+	conn, err := connectTestGateway(gw, user)
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+func connectTestGateway(gw *Gateway, user string) (*mysql.Conn, error) {
+	return connectTestGatewayWith(gw, newTestHandshakeResponse(user))
+}
+
+func connectTestGatewayWith(gw *Gateway, res *mysql.HandshakeResponse) (*mysql.Conn, error) {
+	return connectTestGatewayTLS(gw, res, &tls.Config{InsecureSkipVerify: true}) // nolint: gosec // nolint
+}
+
+// connectTestGatewayTLS connects with tlsConf if res requests TLS.
+func connectTestGatewayTLS(gw *Gateway, res *mysql.HandshakeResponse, tlsConf *tls.Config) (*mysql.Conn, error) {
+	rawConn, err := net.Dial("tcp", gw.l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	conn := mysql.NewConn(rawConn)
+	if err := testHandshake(conn, res, tlsConf); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func newTestHandshakeResponse(user string) *mysql.HandshakeResponse {
+	return &mysql.HandshakeResponse{
+		Capability:    mysql.DefaultCapability,
+		MaxPacketSize: mysql.MaxPayloadLen,
+		CharacterSet:  mysql.DefaultCollationID,
+		UserName:      user,
+		Auth:          make([]byte, 20),
+		AuthPlugin:    mysql.AuthNativePassword,
+	}
+}
+
+// initialPacket is the initial handshake, or an error packet the server
+// sends instead.
+type initialPacket struct {
+	mysql.Handshake
+	err error
+}
+
+func (p *initialPacket) Read(b *mysql.Buffer) error {
+	if data := b.Bytes(); len(data) > 0 && data[0] == mysql.HeaderErr {
+		p.err = readTestErr(data)
+		return nil
+	}
+	return p.Handshake.Read(b)
+}
+
+func testHandshake(conn *mysql.Conn, res *mysql.HandshakeResponse, tlsConf *tls.Config) error {
+	return testHandshakePassword(conn, res, tlsConf, "")
+}
+
+// testHandshakePassword logs in with password using mysql_native_password
+// if it is not empty, or with dummy auth data otherwise.
+func testHandshakePassword(conn *mysql.Conn, res *mysql.HandshakeResponse, tlsConf *tls.Config, password string) error {
+	var hs initialPacket
+	if err := conn.RecvPacket(&hs); err != nil {
+		return err
+	}
+	if hs.err != nil {
+		return hs.err
+	}
+	if res.Capability&mysql.ClientSSL != 0 {
+		if err := conn.SendPacket((*mysql.SSLRequest)(res)); err != nil {
+			return err
+		}
+		tlsConn := tls.Client(conn.BufferedConn(), tlsConf)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		conn.SetRawConn(tlsConn)
+	}
+	if password != "" && res.AuthPlugin == mysql.AuthNativePassword {
+		res.Auth = mysql.NativePasswordAuth(password, hs.AuthPluginData)
+	}
+	if err := conn.SendPacket(res); err != nil {
+		return err
+	}
+	for {
+		var b bytes.Buffer
+		if err := conn.ReadPacket(&b); err != nil {
+			return err
+		}
+		reply := make([]byte, 20)
+		switch b.Bytes()[0] {
+		case mysql.HeaderOK:
+			if res.Capability&mysql.ClientCompress != 0 {
+				conn.EnableCompression(zlib.DefaultCompression)
+			}
+			return nil
+		case mysql.HeaderErr:
+			return readTestErr(b.Bytes())
+		case mysql.HeaderAuthMoreData:
+			switch b.Bytes()[1] {
+			case mysql.CachingSha2FastAuthSuccess:
+				continue
+			case mysql.CachingSha2PerformFullAuth:
+				reply = []byte{mysql.CachingSha2RequestPublicKey}
+			}
+		case mysql.HeaderEOF:
+			var sw mysql.AuthSwitchRequest
+			if err := sw.Read(mysql.NewBuffer(b.Bytes())); err != nil {
+				return err
+			}
+			if password != "" && sw.PluginName == mysql.AuthNativePassword {
+				reply = mysql.NativePasswordAuth(password, bytes.TrimSuffix(sw.PluginData, []byte{0}))
+			}
+		}
+		if err := writeTestPacket(conn, reply); err != nil {
+			return err
+		}
+	}
+}
+
+type testErr struct {
+	code uint16
+	msg  string
+}
+
+func (e *testErr) Error() string {
+	return e.msg
+}
+
+func readTestErr(data []byte) error {
+	e := &testErr{code: uint16(data[1]) | uint16(data[2])<<8}
+	if len(data) > 9 && data[3] == '#' {
+		e.msg = string(data[9:])
+	} else {
+		e.msg = string(data[3:])
+	}
+	return e
+}
+
+// execTestCommand sends a command and returns the first response packet.
+func execTestCommand(t *testing.T, conn *mysql.Conn, cmd []byte) []byte {
+	conn.SetResetOption(mysql.SeqResetOnWrite)
+	require.NoError(t, writeTestPacket(conn, cmd))
+	var b bytes.Buffer
+	require.NoError(t, conn.ReadPacket(&b))
+	return b.Bytes()
+}
+
+func waitTestLog(t *testing.T, logs *observer.ObservedLogs, msg string) observer.LoggedEntry {
+	var entries []observer.LoggedEntry
+	require.Eventually(t, func() bool {
+		entries = logs.FilterMessage(msg).All()
+		return len(entries) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	return entries[0]
+}
+
+func TestCountCommands(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		CountCommands:  true,
+	})
+
+	conn := dialTestGateway(t, gw, "c1.root")
+	for i := 0; i < 3; i++ {
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComQuery, 's', 'e', 'l', 'e', 'c', 't', ' ', '1'}))
+	}
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	conn.Close()
+
+	entry := waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, int64(4), entry.ContextMap()["commands"])
+}
+
+func TestCountRows(t *testing.T) {
+	eof := []byte{mysql.HeaderEOF, 0, 0, 0x02, 0}
+	// A result set of 1 column and 3 rows, the second one an empty string.
+	result := [][]byte{{0x01}, {0x03, 'd', 'e', 'f'}, eof, {0x01, 'a'}, {0x00}, {0x01, 'c'}, eof}
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		if cmd[0] != mysql.ComQuery {
+			return writeTestPacket(conn, okPacket)
+		}
+		for _, p := range result {
+			if err := writeTestPacket(conn, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		CountRows:      true,
+	})
+
+	conn := dialTestGateway(t, gw, "c1.root")
+	for i := 0; i < 2; i++ {
+		require.Equal(t, result[0], execTestCommand(t, conn, append([]byte{mysql.ComQuery}, "select c from t"...)))
+		var b bytes.Buffer
+		for _, p := range result[1:] {
+			b.Reset()
+			require.NoError(t, conn.ReadPacket(&b))
+			require.Equal(t, p, b.Bytes())
+		}
+	}
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	conn.Close()
+
+	entry := waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, int64(6), entry.ContextMap()["rows"])
+}
+
+func TestLogBackendVersion(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	for _, logVersion := range []bool{false, true} {
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs:    BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			LogBackendVersion: logVersion,
+		})
+		counter := backendVersionCounter.WithLabelValues("c1", "5.7.25-TiDB-mock")
+		conns := counter.Value()
+		conn := dialTestGateway(t, gw, "c1.root")
+		conn.Close()
+
+		entry := waitTestLog(t, logs, "connection is closed")
+		version, ok := entry.ContextMap()["backendVersion"]
+		require.Equal(t, logVersion, ok)
+		if logVersion {
+			require.Equal(t, "5.7.25-TiDB-mock", version)
+			require.Equal(t, conns+1, counter.Value())
+		} else {
+			require.Equal(t, conns, counter.Value())
+		}
+	}
+}
+
+func TestMaxBackendAttrsLen(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:     BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxBackendAttrsLen: 64,
+	})
+
+	res := newTestHandshakeResponse("c1.root")
+	res.Attrs = map[string]string{"_client_name": "test"}
+	conn, err := connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	conn.Close()
+
+	res = newTestHandshakeResponse("c1.root")
+	res.Attrs = make(map[string]string)
+	for i := 0; i < 10; i++ {
+		res.Attrs[fmt.Sprintf("attr%d", i)] = "value"
+	}
+	_, err = connectTestGatewayWith(gw, res)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "connection attributes too large")
+}
+
+func TestSpliceHandshakeResponse(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRecordResponses())
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:          BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		SpliceHandshakeResponse: true,
+	})
+
+	res := newTestHandshakeResponse("c1.root")
+	res.Capability |= mysql.ClientConnectWithDB
+	res.DBName = "test"
+	res.Attrs = map[string]string{"_client_name": "test", "_pid": "1"}
+	conn, err := connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	got := <-backend.responses
+	require.Equal(t, "root", got.UserName)
+	require.Equal(t, "test", got.DBName)
+	require.Equal(t, res.Attrs, got.Attrs)
+}
+
+func TestRouteByAttr(t *testing.T) {
+	backend1 := startMockBackend(t, nil, mockRecordResponses())
+	backend2 := startMockBackend(t, nil, mockRecordResponses())
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend1.addr()},
+			{ClusterID: "c2", Address: backend2.addr()},
+		},
+		RouteByAttr: "tidb_cluster",
+	})
+
+	// The cluster comes from the attribute, and the user name is kept.
+	res := newTestHandshakeResponse("c1.root")
+	res.Attrs = map[string]string{"tidb_cluster": "c2"}
+	conn, err := connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, "c1.root", (<-backend2.responses).UserName)
+
+	// Without the attribute, the user name decides.
+	conn = dialTestGateway(t, gw, "c1.root")
+	conn.Close()
+	require.Equal(t, "root", (<-backend1.responses).UserName)
+
+	res = newTestHandshakeResponse("root")
+	res.Attrs = map[string]string{"tidb_cluster": "c3"}
+	_, err = connectTestGatewayWith(gw, res)
+	require.ErrorContains(t, err, `unknown cluster "c3"`)
+}
+
+func TestRouteBySNI(t *testing.T) {
+	backends := BackendConfigs{{ClusterID: "c1"}, {ClusterID: "C2"}}
+	for host, clusterID := range map[string]string{
+		"c1":                  "c1",
+		"c2.tidb.example.com": "C2",
+		"tidb.example.com":    "",
+		"c3.c1":               "",
+	} {
+		got, ok := backends.FindByHost(host)
+		require.Equal(t, clusterID != "", ok, host)
+		require.Equal(t, clusterID, got, host)
+	}
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "gateway"})
+	backend1 := startMockBackend(t, nil, mockRecordResponses())
+	backend2 := startMockBackend(t, nil, mockRecordResponses())
+	gw, _ := startTestGateway(t, &Config{
+		TLS: TLSConfig{Cert: certFile, Key: keyFile},
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend1.addr()},
+			{ClusterID: "c2", Address: backend2.addr()},
+		},
+		RouteBySNI: true,
+	})
+	connect := func(user, serverName string) {
+		res := newTestHandshakeResponse(user)
+		res.Capability |= mysql.ClientSSL
+		conn, err := connectTestGatewayTLS(gw, res, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}) // nolint: gosec // nolint
+		require.NoError(t, err)
+		conn.Close()
+	}
+
+	// The cluster comes from the server name, and the user name is kept.
+	connect("c1.root", "c2.tidb.example.com")
+	require.Equal(t, "c1.root", (<-backend2.responses).UserName)
+
+	// Without a matching server name, the user name decides.
+	connect("c1.root", "tidb.example.com")
+	require.Equal(t, "root", (<-backend1.responses).UserName)
+	conn := dialTestGateway(t, gw, "c2.root")
+	conn.Close()
+	require.Equal(t, "root", (<-backend2.responses).UserName)
+}
+
+func TestDefaultBackend(t *testing.T) {
+	backend1 := startMockBackend(t, nil, mockRecordResponses())
+	backend2 := startMockBackend(t, nil, mockRecordResponses())
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend1.addr()},
+			{ClusterID: "default", Address: backend1.addr()},
+		},
+		DefaultBackend: backend2.addr(),
+	})
+
+	// Known clusters are routed as usual.
+	conn := dialTestGateway(t, gw, "c1.root")
+	conn.Close()
+	require.Equal(t, "root", (<-backend1.responses).UserName)
+
+	// Unknown clusters go to the default backend with the user name as is.
+	for _, user := range []string{"root", "c2.root"} {
+		conn = dialTestGateway(t, gw, user)
+		conn.Close()
+		require.Equal(t, user, (<-backend2.responses).UserName)
+	}
+	entry := waitTestLog(t, logs, "start to connect backend")
+	require.Equal(t, backend1.addr(), entry.ContextMap()["backend"])
+	require.Equal(t, backend2.addr(), logs.FilterMessage("start to connect backend").All()[1].ContextMap()["backend"])
+
+	// A cluster named default is an ordinary one.
+	conn = dialTestGateway(t, gw, "default.root")
+	conn.Close()
+	require.Equal(t, "root", (<-backend1.responses).UserName)
+
+	// Connections to the default backend survive reloads.
+	conn = dialTestGateway(t, gw, "c2.root")
+	<-backend2.responses
+	gw.ReloadBackends(BackendConfigs{{ClusterID: "c1", Address: backend1.addr()}})
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	conn.Close()
+
+	// The ID of the default backend is reserved.
+	var backends BackendConfigs
+	require.EqualError(t, backends.Set(defaultClusterID+"="+backend1.addr()), `cluster ID "*" is reserved`)
+	_, err := New(nil, &Config{BackendConfigs: BackendConfigs{{ClusterID: defaultClusterID, Address: backend1.addr()}}})
+	require.EqualError(t, err, `cluster ID "*" is reserved`)
+
+	// Without a default backend, unknown clusters are rejected.
+	gw, _ = startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend1.addr()}},
+	})
+	_, err = connectTestGateway(gw, "c2.root")
+	require.EqualError(t, err, `unknown cluster "c2"`)
+}
+
+func TestMaxAllowedPacket(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:   BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxAllowedPacket: 256,
+	})
+	dialTestGateway(t, gw, "c1.root")
+
+	res := newTestHandshakeResponse("c1.root")
+	res.Attrs = map[string]string{"attr": strings.Repeat("x", 256)}
+	_, err := connectTestGatewayWith(gw, res)
+	require.Equal(t, uint16(mysql.ErrCodeNetPacketTooLarge), err.(*testErr).code)
+
+	// Commands are limited as well.
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, append([]byte{mysql.ComQuery}, strings.Repeat("x", 200)...)))
+	err = readTestErr(execTestCommand(t, conn, append([]byte{mysql.ComQuery}, strings.Repeat("x", 256)...)))
+	require.Equal(t, uint16(mysql.ErrCodeNetPacketTooLarge), err.(*testErr).code)
+}
+
+func TestAuthPlugin(t *testing.T) {
+	nativeBackend := startMockBackend(t, nil)
+	sha2Backend := startMockBackend(t, nil, mockAuthPlugin(mysql.AuthCachingSha2Password))
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "native", Address: nativeBackend.addr()},
+			{ClusterID: "sha2", Address: sha2Backend.addr()},
+		},
+	})
+	native := authPluginCounter.WithLabelValues("native", mysql.AuthNativePassword).Value()
+	sha2 := authPluginCounter.WithLabelValues("sha2", mysql.AuthCachingSha2Password).Value()
+
+	conn := dialTestGateway(t, gw, "native.root")
+	require.Eventually(t, func() bool {
+		return authPluginCounter.WithLabelValues("native", mysql.AuthNativePassword).Value() == native+1
+	}, 5*time.Second, 10*time.Millisecond)
+	entry := waitTestLog(t, logs, "backend requests auth switch")
+	require.Equal(t, mysql.AuthNativePassword, entry.ContextMap()["plugin"])
+	conn.Close()
+	entry = waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, mysql.AuthNativePassword, entry.ContextMap()["authPlugin"])
+
+	dialTestGateway(t, gw, "sha2.root")
+	require.Eventually(t, func() bool {
+		return authPluginCounter.WithLabelValues("sha2", mysql.AuthCachingSha2Password).Value() == sha2+1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClientAuthPlugin(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRecordResponses())
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+	proposed := clientAuthPluginCounter.WithLabelValues("c1", "sha256_password").Value()
+
+	// The proposed plugin is recorded although the backend never sees it.
+	res := newTestHandshakeResponse("c1.root")
+	res.AuthPlugin = "sha256_password"
+	conn, err := connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	require.Equal(t, mysql.AuthInvalidMethod, (<-backend.responses).AuthPlugin)
+	require.Equal(t, proposed+1, clientAuthPluginCounter.WithLabelValues("c1", "sha256_password").Value())
+	conn.Close()
+	entry := waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, "sha256_password", entry.ContextMap()["clientAuthPlugin"])
+	require.Equal(t, mysql.AuthNativePassword, entry.ContextMap()["authPlugin"])
+
+	// Unknown plugins are counted together.
+	other := clientAuthPluginCounter.WithLabelValues("c1", "other").Value()
+	res.AuthPlugin = "made_up_plugin"
+	conn, err = connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	conn.Close()
+	<-backend.responses
+	require.Equal(t, other+1, clientAuthPluginCounter.WithLabelValues("c1", "other").Value())
+}
+
+func TestCachingSha2Auth(t *testing.T) {
+	for _, fullAuth := range []bool{false, true} {
+		backend := startMockBackend(t, nil, mockAuthPlugin(mysql.AuthCachingSha2Password), mockSha2FullAuth(fullAuth), mockRejectUser("bad"))
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		})
+
+		// The packet after auth is a command, which would be mistaken for
+		// auth data if the exchange ends early or late.
+		conn := dialTestGateway(t, gw, "c1.root")
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+		conn.Close()
+		entry := waitTestLog(t, logs, "connection is closed")
+		require.Equal(t, mysql.AuthCachingSha2Password, entry.ContextMap()["authPlugin"])
+
+		_, err := connectTestGateway(gw, "c1.bad")
+		require.Equal(t, uint16(1045), err.(*testErr).code)
+	}
+}
+
+func TestDrainNotice(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		DrainNotice:    true,
+	})
+
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	gw.Drain()
+	_, err := connectTestGateway(gw, "c1.root")
+	require.Error(t, err)
+
+	res := execTestCommand(t, conn, []byte{mysql.ComPing})
+	require.Equal(t, uint16(mysql.ErrCodeServerShutdown), readTestErr(res).(*testErr).code)
+	var b bytes.Buffer
+	require.Error(t, conn.ReadPacket(&b))
+}
+
+func TestUnknownCluster(t *testing.T) {
+	backends := BackendConfigs{{ClusterID: "c1", Address: "127.0.0.1:4000"}}
+	addr, ok := backends.Find("C1")
+	require.True(t, ok)
+	require.Equal(t, "127.0.0.1:4000", addr)
+	_, ok = backends.Find("c2")
+	require.False(t, ok)
+
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+	_, err := connectTestGateway(gw, "c2.root")
+	require.EqualError(t, err, `unknown cluster "c2"`)
+}
+
+func TestBackendHandshakeTimeout(t *testing.T) {
+	// The backend accepts connections but never sends the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:          BackendConfigs{{ClusterID: "c1", Address: l.Addr().String()}},
+		BackendHandshakeTimeout: 100 * time.Millisecond,
+	})
+	_, err = connectTestGateway(gw, "c1.root")
+	require.EqualError(t, err, "backend does not finish handshake in 100ms")
+	entry := waitTestLog(t, logs, "recv initial handshake from backend failed")
+	require.Equal(t, "backend does not finish handshake in 100ms", entry.ContextMap()["err"])
+
+	// The deadline is cleared after auth.
+	backend := startMockBackend(t, nil)
+	gw.ReloadBackends(BackendConfigs{{ClusterID: "c1", Address: backend.addr()}})
+	conn := dialTestGateway(t, gw, "c1.root")
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+}
+
+func TestRoundRobin(t *testing.T) {
+	var counts [3]int32
+	var addrs []string
+	for i := range counts {
+		count := &counts[i]
+		backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+			atomic.AddInt32(count, 1)
+			return writeTestPacket(conn, okPacket)
+		})
+		addrs = append(addrs, backend.addr())
+	}
+	var backends BackendConfigs
+	require.NoError(t, backends.Set("c1="+strings.Join(addrs, ",")))
+	require.NoError(t, backends.Set("c2="+addrs[0]))
+	require.NoError(t, backends.Set("c3=,"))
+	gw, _ := startTestGateway(t, &Config{BackendConfigs: backends})
+
+	for i := 0; i < 3*len(addrs); i++ {
+		conn := dialTestGateway(t, gw, "c1.root")
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	}
+	for i := range counts {
+		require.Equal(t, int32(3), atomic.LoadInt32(&counts[i]))
+	}
+
+	// A single address is always picked.
+	current := gw.backendConfigs()
+	for i := 0; i < 3; i++ {
+		addr, ok := current.Pick("c2")
+		require.True(t, ok)
+		require.Equal(t, addrs[0], addr)
+	}
+
+	// A cluster without addresses is unknown.
+	_, err := connectTestGateway(gw, "c3.root")
+	require.EqualError(t, err, `unknown cluster "c3"`)
+}
+
+func TestBackendConnectRetries(t *testing.T) {
+	// The first address refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	refused := l.Addr().String()
+	l.Close()
+	backend := startMockBackend(t, nil)
+
+	for _, retries := range []int{0, 1} {
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs:        BackendConfigs{{ClusterID: "c1", Address: refused + "," + backend.addr()}},
+			BackendConnectRetries: retries,
+		})
+		_, err := connectTestGateway(gw, "c1.root")
+		if retries == 0 {
+			require.ErrorContains(t, err, "connection refused")
+			continue
+		}
+		require.NoError(t, err)
+		entry := waitTestLog(t, logs, "failed to connect backend, retrying")
+		require.Equal(t, refused, entry.ContextMap()["backend"])
+		require.Equal(t, backend.addr(), waitTestLog(t, logs, "start to relay data").ContextMap()["backend"])
+	}
+
+	// The last error is returned if all attempts fail.
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:        BackendConfigs{{ClusterID: "c1", Address: refused}},
+		BackendConnectRetries: 2,
+	})
+	_, err = connectTestGateway(gw, "c1.root")
+	require.ErrorContains(t, err, "connection refused")
+}
+
+func TestPickAddrSkipsTried(t *testing.T) {
+	gw, err := New(nil, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: "a:4000,b:4000,c:4000"}},
+	})
+	require.NoError(t, err)
+
+	// Tried addresses are skipped whatever the round-robin position is.
+	tried := map[string]struct{}{"a:4000": {}, "b:4000": {}}
+	for i := 0; i < 3; i++ {
+		addr, err := gw.pickAddr("c1", tried)
+		require.NoError(t, err)
+		require.Equal(t, "c:4000", addr)
+	}
+
+	// An unhealthy address is still preferred to a tried one.
+	gw.health.update(map[string]bool{"c:4000": false})
+	for i := 0; i < 3; i++ {
+		addr, err := gw.pickAddr("c1", tried)
+		require.NoError(t, err)
+		require.Equal(t, "c:4000", addr)
+	}
+
+	// Once all are tried, any of them is picked.
+	tried["c:4000"] = struct{}{}
+	_, err = gw.pickAddr("c1", tried)
+	require.NoError(t, err)
+}
+
+func TestAddressRewriter(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	// The rewriter runs on the connection goroutines of the gateway, so its
+	// arguments are checked here.
+	rewritten := make(chan [2]string, 2)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: "c1.internal"},
+			{ClusterID: "c2", Address: "c2.internal"},
+		},
+		AddressRewriter: func(clusterID, addr string) (string, error) {
+			rewritten <- [2]string{clusterID, addr}
+			if clusterID != "c1" {
+				return "", errors.New("cluster is not allowed")
+			}
+			return backend.addr(), nil
+		},
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	require.Equal(t, [2]string{"c1", "c1.internal:4000"}, <-rewritten)
+
+	_, err := connectTestGateway(gw, "c2.root")
+	require.EqualError(t, err, "failed to rewrite address of cluster c2: cluster is not allowed")
+	require.Equal(t, [2]string{"c2", "c2.internal:4000"}, <-rewritten)
+}
+
+func TestBackendMaxPacketSize(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRecordResponses())
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:       BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		BackendMaxPacketSize: 1 << 20,
+	})
+
+	for _, c := range []struct{ advertised, forwarded uint32 }{
+		{mysql.MaxPayloadLen, 1 << 20},
+		{1 << 10, 1 << 10},
+	} {
+		res := newTestHandshakeResponse("c1.root")
+		res.MaxPacketSize = c.advertised
+		conn, err := connectTestGatewayWith(gw, res)
+		require.NoError(t, err)
+		require.Equal(t, c.forwarded, (<-backend.responses).MaxPacketSize)
+		conn.Close()
+	}
+}
+
+func TestReconcileCapability(t *testing.T) {
+	backend := startMockBackend(t, nil, mockCapability(mysql.DefaultCapability&^mysql.ClientMultiStatements), mockRecordResponses())
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		InterceptPing:  true,
+	})
+
+	res := newTestHandshakeResponse("c1.root")
+	res.Capability |= mysql.ClientSessionTrack | mysql.ClientDeprecateEOF
+	conn, err := connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	forwarded := <-backend.responses
+	// Not supported by the gateway.
+	require.Zero(t, forwarded.Capability&mysql.ClientSessionTrack)
+	// Not supported by the backend.
+	require.Zero(t, forwarded.Capability&mysql.ClientMultiStatements)
+	// Supported by both.
+	require.NotZero(t, forwarded.Capability&mysql.ClientConnectAttrs)
+	entry := waitTestLog(t, logs, "mask unsupported capabilities")
+	require.Equal(t, uint32(mysql.ClientSessionTrack|mysql.ClientMultiStatements|mysql.ClientDeprecateEOF), entry.ContextMap()["masked"])
+	// Packets made by the gateway follow the masked capabilities, e.g.
+	// without session tracking.
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+}
+
+func TestMaskDeprecateEOF(t *testing.T) {
+	backend := startMockBackend(t, nil, mockCapability(mysql.DefaultCapability|mysql.ClientDeprecateEOF), mockRecordResponses())
+	for _, mask := range []bool{false, true} {
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs:   BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			MaskDeprecateEOF: mask,
+		})
+		res := newTestHandshakeResponse("c1.root")
+		res.Capability |= mysql.ClientDeprecateEOF
+		conn, err := connectTestGatewayWith(gw, res)
+		require.NoError(t, err)
+		forwarded := <-backend.responses
+		require.Equal(t, !mask, forwarded.Capability&mysql.ClientDeprecateEOF != 0)
+		require.Equal(t, mask, logs.FilterMessage("mask deprecate eof capability").Len() == 1)
+		conn.Close()
+	}
+}
+
+func TestHandshakeStatusFlags(t *testing.T) {
+	flags := mysql.ServerStatusAutocommit | mysql.ServerStatusNoBackslashEscaped
+	for _, conf := range []*Config{{}, {HandshakeStatusFlags: &flags}} {
+		gw, _ := startTestGateway(t, conf)
+		rawConn, err := net.Dial("tcp", gw.l.Addr().String())
+		require.NoError(t, err)
+		conn := mysql.NewConn(rawConn)
+		var hs mysql.Handshake
+		require.NoError(t, conn.RecvPacket(&hs))
+		if conf.HandshakeStatusFlags == nil {
+			require.Equal(t, mysql.ServerStatusAutocommit, hs.StatusFlags)
+		} else {
+			require.Equal(t, flags, hs.StatusFlags)
+		}
+		conn.Close()
+	}
+}
+
+// repeatReader fills reads with its byte, as a deterministic random source.
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestNonceSource(t *testing.T) {
+	gw, _ := newTestGateway(t, &Config{})
+	gw.nonceSource = repeatReader('x')
+	gw.StartServe()
+	t.Cleanup(gw.Stop)
+	for i := 0; i < 2; i++ {
+		rawConn, err := net.Dial("tcp", gw.l.Addr().String())
+		require.NoError(t, err)
+		conn := mysql.NewConn(rawConn)
+		var hs mysql.Handshake
+		require.NoError(t, conn.RecvPacket(&hs))
+		require.Equal(t, bytes.Repeat([]byte{'x'}, mysql.ScrambleLen), bytes.TrimRight(hs.AuthPluginData, "\x00"))
+		conn.Close()
+	}
+}
+
+func TestDone(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+
+	gw.Drain()
+	select {
+	case <-gw.Done():
+		t.Fatal("done before connections terminate")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case <-gw.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not done after connections terminate")
+	}
+	gw.Stop()
+	require.Equal(t, 1, logs.FilterMessage("all connections are terminated").Len())
+}
+
+// failingListener fails the next fails accepts.
+type failingListener struct {
+	net.Listener
+	fails int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.fails, -1) >= 0 {
+		return nil, errors.New("accept failed")
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeRestart(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fl := &failingListener{Listener: l, fails: 1}
+	gw, err := New(fl, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+	require.NoError(t, err)
+	core, logs := observer.New(zapcore.DebugLevel)
+	gw.log = zap.New(core).Sugar()
+	restarts := serveRestartCounter.Value()
+	gw.StartServe()
+	defer gw.Stop()
+
+	// The accept loop is restarted after it fails.
+	entry := waitTestLog(t, logs, "accept loop exits unexpectedly, restarting")
+	require.Contains(t, entry.ContextMap()["err"], "accept failed")
+	require.Equal(t, restarts+1, serveRestartCounter.Value())
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	conn.Close()
+
+	// It gives up if it keeps failing. The connection wakes up the pending
+	// accept.
+	atomic.StoreInt32(&fl.fails, maxServeRestarts)
+	rawConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	rawConn.Close()
+	waitTestLog(t, logs, "accept loop exits unexpectedly, giving up")
+	require.Equal(t, restarts+maxServeRestarts, serveRestartCounter.Value())
+	// Then the gateway stops with the error.
+	select {
+	case <-gw.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("gateway is not stopped after giving up")
+	}
+	require.ErrorContains(t, gw.Err(), "accept failed")
+
+	// It is not restarted once the gateway is stopped.
+	gw2, logs2 := startTestGateway(t, &Config{})
+	gw2.Stop()
+	require.Zero(t, logs2.FilterMessage("accept loop exits unexpectedly, restarting").Len())
+}
+
+func TestServeRestartForgiven(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	fl := &failingListener{Listener: l, fails: maxServeRestarts + 1}
+	gw, err := New(fl, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+	require.NoError(t, err)
+	core, logs := observer.New(zapcore.DebugLevel)
+	gw.log = zap.New(core).Sugar()
+	// Every accept loop counts as healthy, so failures never add up.
+	gw.serveHealthyInterval = 0
+	gw.StartServe()
+	defer gw.Stop()
+
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	conn.Close()
+	require.Equal(t, maxServeRestarts+1, logs.FilterMessage("accept loop exits unexpectedly, restarting").Len())
+	require.Zero(t, logs.FilterMessage("accept loop exits unexpectedly, giving up").Len())
+	require.NoError(t, gw.Err())
+}
+
+func TestGracefulStop(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	conf := &Config{BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}}}
+
+	// Connections finish during drain.
+	gw, logs := startTestGateway(t, conf)
+	conn := dialTestGateway(t, gw, "c1.root")
+	time.AfterFunc(50*time.Millisecond, conn.Close)
+	forced := shutdownPhaseCounter.WithLabelValues(phaseForce).Value()
+	require.NoError(t, gw.GracefulStop(5*time.Second, time.Second))
+	require.Equal(t, 0, logs.FilterMessage("drain timeout, force closing connections").Len())
+	require.Equal(t, forced, shutdownPhaseCounter.WithLabelValues(phaseForce).Value())
+
+	// Idle connections are force closed after drain timeout.
+	gw, logs = startTestGateway(t, conf)
+	conn = dialTestGateway(t, gw, "c1.root")
+	require.NoError(t, gw.GracefulStop(100*time.Millisecond, 5*time.Second))
+	entry := waitTestLog(t, logs, "drain timeout, force closing connections")
+	require.Equal(t, int64(1), entry.ContextMap()["remaining"])
+	require.Equal(t, forced+1, shutdownPhaseCounter.WithLabelValues(phaseForce).Value())
+	require.Equal(t, float64(1), shutdownRemainingGauge.WithLabelValues(phaseDrain).Value())
+	require.Equal(t, float64(0), shutdownRemainingGauge.WithLabelValues(phaseForce).Value())
+	var b bytes.Buffer
+	require.Error(t, conn.ReadPacket(&b))
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		if cmd[0] == mysql.ComQuery {
+			started <- struct{}{}
+			<-release
+		}
+		return writeTestPacket(conn, okPacket)
+	})
+	// Blocked commands must be released before the backend is closed.
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	conf := &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		CountCommands:  true,
+	}
+	gw, logs := startTestGateway(t, conf)
+	idle := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, idle, []byte{mysql.ComPing}))
+	busy := dialTestGateway(t, gw, "c1.root")
+	busy.SetResetOption(mysql.SeqResetOnWrite)
+	require.NoError(t, writeTestPacket(busy, []byte{mysql.ComQuery}))
+	<-started
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- gw.Shutdown(context.Background())
+	}()
+	// The idle connection is closed immediately, and the busy one after its
+	// command.
+	var b bytes.Buffer
+	require.Error(t, idle.ReadPacket(&b))
+	select {
+	case err := <-errCh:
+		t.Fatalf("shutdown returns with a busy connection: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	b.Reset()
+	require.NoError(t, busy.ReadPacket(&b))
+	require.Equal(t, okPacket, b.Bytes())
+	require.Error(t, busy.ReadPacket(&b))
+	require.NoError(t, <-errCh)
+	require.Equal(t, 2, logs.FilterMessage("connection is closed").Len())
+	for _, entry := range logs.FilterMessage("connection is closed").All() {
+		require.Equal(t, ErrDrained.Error(), entry.ContextMap()["err"])
+	}
+
+	// Connections left when the context expires are closed.
+	release = make(chan struct{})
+	gw, logs = startTestGateway(t, conf)
+	busy = dialTestGateway(t, gw, "c1.root")
+	busy.SetResetOption(mysql.SeqResetOnWrite)
+	require.NoError(t, writeTestPacket(busy, []byte{mysql.ComQuery}))
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, gw.Shutdown(ctx))
+	entry := waitTestLog(t, logs, "drain timeout, force closing connections")
+	require.Equal(t, int64(1), entry.ContextMap()["remaining"])
+	require.Error(t, busy.ReadPacket(&b))
+
+	// Connections relaying raw bytes are not drained, but the gateway stops
+	// accepting and closes them when the context expires.
+	gw, logs = startTestGateway(t, &Config{BackendConfigs: conf.BackendConfigs})
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, gw.Shutdown(ctx))
+	entry = waitTestLog(t, logs, "drain timeout, force closing connections")
+	require.Equal(t, int64(1), entry.ContextMap()["remaining"])
+	require.Error(t, conn.ReadPacket(&b))
+	_, err := net.Dial("tcp", gw.l.Addr().String())
+	require.Error(t, err)
+}
+
+func TestTLSWithCompression(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "gateway"})
+	var rec recordedCommands
+	backend := startMockTLSBackend(t, ca.serverConfig(t), func(conn *mysql.Conn, cmd []byte) error {
+		if _, ok := conn.RawConn().(*tls.Conn); !ok {
+			return errors.New("backend connection is not tls")
+		}
+		return rec.handler(conn, cmd)
+	})
+	gw, _ := startTestGateway(t, &Config{
+		TLS:            TLSConfig{Cert: certFile, Key: keyFile},
+		BackendTLS:     BackendTLSConfig{CA: ca.caFile},
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+
+	res := newTestHandshakeResponse("c1.root")
+	res.Capability |= mysql.ClientSSL | mysql.ClientCompress
+	conn, err := connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, ok := conn.RawConn().(*tls.Conn)
+	require.True(t, ok)
+
+	// Both small and large (compressed) commands, with sequence reset for
+	// each of them.
+	large := append([]byte{mysql.ComQuery}, bytes.Repeat([]byte("select 1;"), 1000)...)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+		require.Equal(t, okPacket, execTestCommand(t, conn, large))
+	}
+	cmds := rec.all()
+	require.Len(t, cmds, 6)
+	require.Equal(t, large, cmds[5])
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func TestClusterCompress(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 100*1024)
+	// An OK header makes the gateway flush the response.
+	response := append([]byte{mysql.HeaderOK}, large...)
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		return writeTestPacket(conn, response)
+	})
+	var backends BackendConfigs
+	require.NoError(t, backends.Set("far="+backend.addr()+"?compress=true"))
+	require.NoError(t, backends.Set("near="+backend.addr()+"?compress=false"))
+	require.NoError(t, backends.Set("default="+backend.addr()))
+	require.Error(t, backends.Set("bad="+backend.addr()+"?compress=maybe"))
+	gw, _ := startTestGateway(t, &Config{BackendConfigs: backends})
+	enabled, _ := startTestGateway(t, &Config{BackendConfigs: backends, EnableCompression: true})
+
+	// Compression is advertised since a cluster enables it.
+	rawConn, err := net.Dial("tcp", gw.l.Addr().String())
+	require.NoError(t, err)
+	var hs mysql.Handshake
+	require.NoError(t, mysql.NewConn(rawConn).RecvPacket(&hs))
+	require.NotZero(t, hs.Capability&mysql.ClientCompress)
+	rawConn.Close()
+
+	// Clusters not deciding compression follow EnableCompression.
+	for _, c := range []struct {
+		gw         *Gateway
+		cluster    string
+		compressed bool
+	}{
+		{gw, "far", true},
+		{gw, "near", false},
+		{gw, "default", false},
+		{enabled, "near", false},
+		{enabled, "default", true},
+	} {
+		rawConn, err := net.Dial("tcp", c.gw.l.Addr().String())
+		require.NoError(t, err)
+		counting := &countingConn{Conn: rawConn}
+		conn := mysql.NewConn(counting)
+		res := newTestHandshakeResponse(c.cluster + ".root")
+		res.Capability |= mysql.ClientCompress
+		require.NoError(t, testHandshake(conn, res, nil))
+		before := atomic.LoadInt64(&counting.n)
+		require.Equal(t, response, execTestCommand(t, conn, []byte{mysql.ComPing}))
+		received := atomic.LoadInt64(&counting.n) - before
+		require.Equal(t, c.compressed, received < int64(len(large)), c.cluster)
+		conn.Close()
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	invalid := 10
+	_, err := New(nil, &Config{CompressLevel: &invalid})
+	require.EqualError(t, err, "invalid compress level 10")
+	_, err = New(nil, &Config{CompressThreshold: -1})
+	require.EqualError(t, err, "invalid compress threshold -1")
+
+	large := bytes.Repeat([]byte("a"), 100*1024)
+	response := append([]byte{mysql.HeaderOK}, large...)
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		return writeTestPacket(conn, response)
+	})
+	// Level 0 stores data without compressing it.
+	for _, level := range []int{0, 9} {
+		level := level
+		gw, _ := startTestGateway(t, &Config{
+			BackendConfigs:    BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			EnableCompression: true,
+			CompressLevel:     &level,
+		})
+		rawConn, err := net.Dial("tcp", gw.l.Addr().String())
+		require.NoError(t, err)
+		counting := &countingConn{Conn: rawConn}
+		conn := mysql.NewConn(counting)
+		res := newTestHandshakeResponse("c1.root")
+		res.Capability |= mysql.ClientCompress
+		require.NoError(t, testHandshake(conn, res, nil))
+		before := atomic.LoadInt64(&counting.n)
+		require.Equal(t, response, execTestCommand(t, conn, []byte{mysql.ComPing}))
+		received := atomic.LoadInt64(&counting.n) - before
+		require.Equal(t, level > 0, received < int64(len(large)), level)
+		conn.Close()
+	}
+}
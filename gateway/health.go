@@ -0,0 +1,264 @@
+package gateway
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+)
+
+// HealthCheckMode is how backend addresses are checked.
+type HealthCheckMode string
+
+// Health check modes.
+const (
+	// HealthCheckTCP checks whether addresses accept TCP connections.
+	HealthCheckTCP HealthCheckMode = "tcp"
+	// HealthCheckMySQL logs in to addresses and checks that they answer
+	// COM_PING with OK, which detects backends accepting connections but
+	// failing to serve.
+	HealthCheckMySQL HealthCheckMode = "mysql"
+)
+
+// Validate checks whether the mode is known.
+func (m HealthCheckMode) Validate() error {
+	switch m {
+	case "", HealthCheckTCP, HealthCheckMySQL:
+		return nil
+	}
+	return errors.Errorf("invalid health check mode %q", m)
+}
+
+// HealthCheck configures checking the health of backend addresses in the
+// background. Addresses failing the check are skipped when picking addresses
+// for new connections until they recover, unless all addresses of the
+// cluster fail.
+type HealthCheck struct {
+	// Interval is the interval between checks. 0 disables health checking.
+	Interval time.Duration
+	// Timeout limits each check. 0 means Interval.
+	Timeout time.Duration
+	// Mode is how addresses are checked, tcp by default.
+	Mode HealthCheckMode
+	// User and Password are the credentials of the mysql mode, logging in
+	// with mysql_native_password.
+	User     string
+	Password string
+}
+
+// healthChecker records the health of backend addresses.
+type healthChecker struct {
+	mu sync.RWMutex
+	// unhealthy is the set of addresses failing the last check.
+	unhealthy map[string]struct{}
+	// checked is the set of addresses checked, with their health.
+	checked map[string]bool
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		unhealthy: make(map[string]struct{}),
+		checked:   make(map[string]bool),
+	}
+}
+
+// isUnhealthy returns whether addr fails the last check. addr is the address
+// after Config.AddressRewriter. Unchecked addresses are healthy.
+func (h *healthChecker) isUnhealthy(addr string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.unhealthy[addr]
+	return ok
+}
+
+// update replaces the health of all addresses, and returns the addresses
+// whose health changes.
+func (h *healthChecker) update(health map[string]bool) (changed []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for addr, healthy := range health {
+		if prev, ok := h.checked[addr]; (ok && prev != healthy) || (!ok && !healthy) {
+			changed = append(changed, addr)
+		}
+	}
+	h.checked = health
+	h.unhealthy = make(map[string]struct{})
+	for addr, healthy := range health {
+		if !healthy {
+			h.unhealthy[addr] = struct{}{}
+		}
+	}
+	return changed
+}
+
+func (h *healthChecker) snapshot() map[string]bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	health := make(map[string]bool, len(h.checked))
+	for addr, healthy := range h.checked {
+		health[addr] = healthy
+	}
+	return health
+}
+
+// BackendHealth returns the health of backend addresses by the last check.
+// It is empty if health checking is disabled or not done yet.
+func (g *Gateway) BackendHealth() map[string]bool {
+	return g.health.snapshot()
+}
+
+// checkHealth checks backends every interval until the gateway is stopped or
+// draining.
+func (g *Gateway) checkHealth() {
+	defer g.bgWG.Done()
+	ticker := time.NewTicker(g.conf.HealthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		g.checkBackends()
+		select {
+		case <-ticker.C:
+		case <-g.quit:
+			return
+		case <-g.drain:
+			return
+		}
+	}
+}
+
+// checkBackends checks all addresses of backends concurrently. Addresses are
+// rewritten as for connections, and their health is keyed by the rewritten
+// addresses.
+func (g *Gateway) checkBackends() {
+	timeout := g.conf.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = g.conf.HealthCheck.Interval
+	}
+	addrs := make(map[string]struct{})
+	for _, c := range g.backendConfigs() {
+		for _, addr := range c.Addresses() {
+			rewritten, err := g.rewriteAddr(c.ClusterID, addr)
+			if err != nil {
+				g.log.Warnw("skip health check of backend", "cluster", c.ClusterID, "addr", addr, "err", err)
+				continue
+			}
+			addrs[rewritten] = struct{}{}
+		}
+	}
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		health = make(map[string]bool, len(addrs))
+		errs   = make(map[string]error)
+	)
+	for addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := g.probeHealth(addr, timeout)
+			if err != nil {
+				g.backendErrs.record(addr, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			health[addr] = err == nil
+			if err != nil {
+				errs[addr] = err
+			}
+		}(addr)
+	}
+	wg.Wait()
+	for _, addr := range g.health.update(health) {
+		if health[addr] {
+			g.log.Infow("backend is healthy", "addr", addr)
+		} else {
+			g.log.Warnw("backend is unhealthy", "addr", addr, "err", errs[addr])
+		}
+	}
+}
+
+// probeHealth checks whether addr is healthy.
+func (g *Gateway) probeHealth(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if g.conf.HealthCheck.Mode != HealthCheckMySQL {
+		return nil
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := g.sendProxyHeader(conn, nil); err != nil {
+		return err
+	}
+	return g.pingMySQL(mysql.NewConn(conn))
+}
+
+// initialHandshake is the initial handshake of a server, or the error it
+// sends instead, e.g. if it has too many connections.
+type initialHandshake struct {
+	mysql.Handshake
+	err *mysql.Err
+}
+
+func (p *initialHandshake) Read(b *mysql.Buffer) error {
+	if data := b.Bytes(); len(data) > 0 && data[0] == mysql.HeaderErr {
+		p.err = &mysql.Err{Capability: mysql.DefaultCapability}
+		return p.err.Read(b)
+	}
+	return p.Handshake.Read(b)
+}
+
+// pingMySQL logs in to a backend and sends COM_PING, expecting OK.
+func (g *Gateway) pingMySQL(conn *mysql.Conn) error {
+	hs := initialHandshake{Handshake: mysql.Handshake{Strict: g.conf.StrictHandshake}}
+	if err := conn.RecvPacket(&hs); err != nil {
+		return err
+	}
+	if hs.err != nil {
+		return errors.Errorf("backend sends error %d instead of handshake: %s", hs.err.Code, hs.err.Message)
+	}
+	res := &mysql.HandshakeResponse{
+		Capability:    mysql.DefaultCapability & hs.Capability &^ (mysql.ClientSSL | mysql.ClientCompress | mysql.ClientConnectWithDB),
+		MaxPacketSize: mysql.MaxPayloadLen,
+		CharacterSet:  mysql.DefaultCollationID,
+	}
+	data, _, err := loginBackend(conn, res, g.conf.HealthCheck.User, g.conf.HealthCheck.Password, hs.AuthPluginData, g.conf.BackendPublicKey)
+	if err != nil {
+		return err
+	}
+	if err := checkOK(data); err != nil {
+		return errors.WithMessage(err, "failed to log in")
+	}
+	conn.SetResetOption(mysql.SeqResetOnWrite)
+	if err := conn.WritePacket([]byte{mysql.ComPing}); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := conn.ReadPacket(&b); err != nil {
+		return err
+	}
+	return errors.WithMessage(checkOK(b.Bytes()), "failed to ping")
+}
+
+// checkOK returns an error if data is not an OK packet.
+func checkOK(data []byte) error {
+	switch {
+	case len(data) > 0 && data[0] == mysql.HeaderOK:
+		return nil
+	case len(data) > 0 && data[0] == mysql.HeaderErr:
+		e := mysql.Err{Capability: mysql.DefaultCapability}
+		if err := e.Read(mysql.NewBuffer(data)); err != nil {
+			return err
+		}
+		return errors.Errorf("backend error %d: %s", e.Code, e.Message)
+	}
+	return errors.New("unexpected response from backend")
+}
@@ -0,0 +1,151 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheck(t *testing.T) {
+	backend1 := startMockBackend(t, nil)
+	backend2 := startMockBackend(t, nil)
+	addr1, addr2 := backend1.addr(), backend2.addr()
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: addr1 + "," + addr2}},
+		HealthCheck:    HealthCheck{Interval: 20 * time.Millisecond},
+	})
+	waitHealth := func(addr string, healthy bool) {
+		require.Eventually(t, func() bool {
+			h, ok := gw.BackendHealth()[addr]
+			return ok && h == healthy
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	waitHealth(addr1, true)
+	waitHealth(addr2, true)
+
+	// Connections skip the address which is down.
+	backend2.close()
+	waitHealth(addr2, false)
+	require.Equal(t, addr2, waitTestLog(t, logs, "backend is unhealthy").ContextMap()["addr"])
+	for i := 0; i < 4; i++ {
+		conn := dialTestGateway(t, gw, "c1.root")
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	}
+
+	// The address is picked again once it is up.
+	l, err := net.Listen("tcp", addr2)
+	require.NoError(t, err)
+	backend2 = &mockBackend{l: l, handler: func(conn *mysql.Conn, cmd []byte) error {
+		return writeTestPacket(conn, okPacket)
+	}}
+	backend2.wg.Add(1)
+	go backend2.serve()
+	t.Cleanup(backend2.close)
+	waitHealth(addr2, true)
+	require.Equal(t, addr2, waitTestLog(t, logs, "backend is healthy").ContextMap()["addr"])
+	picked := make(map[string]int)
+	backends := gw.backendConfigs()
+	for i := 0; i < 4; i++ {
+		addr, ok := backends.pick("c1", gw.health.isUnhealthy)
+		require.True(t, ok)
+		picked[addr]++
+	}
+	require.Equal(t, map[string]int{addr1: 2, addr2: 2}, picked)
+
+	// All addresses are picked if none is healthy.
+	h := newHealthChecker()
+	require.ElementsMatch(t, []string{addr1, addr2}, h.update(map[string]bool{addr1: false, addr2: false}))
+	addr, ok := backends.pick("c1", h.isUnhealthy)
+	require.True(t, ok)
+	require.Contains(t, []string{addr1, addr2}, addr)
+
+	// Health checking stops with the gateway.
+	gw.Stop()
+}
+
+func TestMySQLHealthCheck(t *testing.T) {
+	healthy := startMockBackend(t, nil, mockPassword("secret"))
+	// The backend accepts connections but does not speak the protocol.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+	// The backend rejects the login.
+	rejecting := startMockBackend(t, nil, mockRejectUser("health"))
+
+	backends := BackendConfigs{{ClusterID: "c1", Address: healthy.addr() + "," + l.Addr().String() + "," + rejecting.addr()}}
+	for _, c := range []struct {
+		mode   HealthCheckMode
+		health map[string]bool
+	}{
+		{HealthCheckTCP, map[string]bool{healthy.addr(): true, l.Addr().String(): true, rejecting.addr(): true}},
+		{HealthCheckMySQL, map[string]bool{healthy.addr(): true, l.Addr().String(): false, rejecting.addr(): false}},
+	} {
+		gw, _ := startTestGateway(t, &Config{
+			BackendConfigs: backends,
+			HealthCheck:    HealthCheck{Interval: time.Minute, Timeout: time.Second, Mode: c.mode, User: "health", Password: "secret"},
+		})
+		require.Eventually(t, func() bool {
+			return len(gw.BackendHealth()) == 3
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, c.health, gw.BackendHealth(), c.mode)
+	}
+
+	// Backends expecting PROXY protocol headers get LOCAL ones.
+	proxied := startMockBackend(t, nil, mockRecordProxyHeaders())
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:    BackendConfigs{{ClusterID: "c1", Address: proxied.addr()}},
+		HealthCheck:       HealthCheck{Interval: time.Minute, Timeout: time.Second, Mode: HealthCheckMySQL, User: "health"},
+		SendProxyProtocol: true,
+	})
+	require.Eventually(t, func() bool {
+		return len(gw.BackendHealth()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]bool{proxied.addr(): true}, gw.BackendHealth())
+	require.Equal(t, byte(proxyVersionLocal), (<-proxied.proxyHeaders)[12])
+
+	_, err = New(l, &Config{HealthCheck: HealthCheck{Mode: "http"}})
+	require.Error(t, err)
+}
+
+func TestHealthCheckRewritesAddress(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+	rewritten := map[string]string{"up.internal:4000": backend.addr(), "down.internal:4000": deadAddr}
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: "up.internal,down.internal"}},
+		HealthCheck:    HealthCheck{Interval: time.Minute, Timeout: time.Second},
+		AddressRewriter: func(clusterID, addr string) (string, error) {
+			return rewritten[addr], nil
+		},
+	})
+
+	// The addresses connections dial are checked, and keyed as connections
+	// record their errors.
+	require.Eventually(t, func() bool {
+		return len(gw.BackendHealth()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]bool{backend.addr(): true, deadAddr: false}, gw.BackendHealth())
+	require.Contains(t, gw.BackendErrors(), deadAddr)
+
+	// Connections skip the configured address whose rewritten one is down.
+	for i := 0; i < 4; i++ {
+		conn := dialTestGateway(t, gw, "c1.root")
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	}
+}
@@ -0,0 +1,298 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+)
+
+// maxPendingCmds is the max number of commands waiting for responses that a
+// cmdTimer follows before giving up.
+const maxPendingCmds = 1024
+
+// timedCommands are the commands whose responses cmdTimer understands, by
+// their metric labels.
+var timedCommands = map[byte]string{
+	mysql.ComInitDB:          "init_db",
+	mysql.ComQuery:           "query",
+	mysql.ComFieldList:       "field_list",
+	mysql.ComStatistics:      "statistics",
+	mysql.ComPing:            "ping",
+	mysql.ComStmtPrepare:     "stmt_prepare",
+	mysql.ComStmtExecute:     "stmt_execute",
+	mysql.ComStmtReset:       "stmt_reset",
+	mysql.ComSetOption:       "set_option",
+	mysql.ComStmtFetch:       "stmt_fetch",
+	mysql.ComResetConnection: "reset_connection",
+}
+
+// respState is the part of a response that a cmdTimer expects next.
+type respState int
+
+const (
+	// respFirst is the first packet of a response or of the next result.
+	respFirst respState = iota
+	// respRows is a result set until the EOF packets left are read.
+	respRows
+	// respDefs is the definitions following a COM_STMT_PREPARE OK.
+	respDefs
+)
+
+type timedCmd struct {
+	cmd   byte
+	start time.Time
+	// record is false if the command is pipelined after others, so its
+	// latency includes waiting for them.
+	record bool
+}
+
+// cmdTimer times commands from being forwarded to backend until their
+// responses end. Responses are followed packet by packet since they come in
+// the order of commands. Only commands sent while no other command is
+// pending are recorded, and the timer gives up on the connection once it
+// meets a response it does not understand.
+//
+// The timer also tells whether the connection is idle, so that draining
+// connections can be closed without waiting for their next commands, and
+// which packets are rows of result sets, whose first bytes are not headers.
+// It counts the prepared statements open on the connection and the rows
+// returned as well.
+type cmdTimer struct {
+	mu      sync.Mutex
+	cluster string
+	backend *mysql.Conn
+	// observe is false if latencies are not recorded, and the timer only
+	// follows responses for draining.
+	observe  bool
+	disabled bool
+	// draining refuses new commands.
+	draining bool
+	pending  []timedCmd
+	state    respState
+	// left is the number of EOF packets left in respRows, or the number of
+	// packets left in respDefs.
+	left int
+	// columns is the number of column definitions left before rows in
+	// respRows.
+	columns int
+	// rows is the number of rows of result sets followed.
+	rows int64
+	// stmts are the IDs of the prepared statements open on the connection.
+	stmts map[uint32]struct{}
+}
+
+func newCmdTimer(cluster string, backend *mysql.Conn, observe bool) *cmdTimer {
+	return &cmdTimer{cluster: cluster, backend: backend, observe: observe, stmts: make(map[uint32]struct{})}
+}
+
+// start is called before a command is forwarded to backend, with the first
+// chunk of it. It returns false if the connection is draining and the
+// command must not be forwarded.
+func (t *cmdTimer) start(data []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	if t.disabled {
+		return true
+	}
+	cmd := data[0]
+	switch cmd {
+	case mysql.ComStmtClose:
+		if len(data) >= 5 {
+			delete(t.stmts, binary.LittleEndian.Uint32(data[1:]))
+		}
+	case mysql.ComResetConnection, mysql.ComChangeUser:
+		// Both free the statements of the session.
+		t.stmts = make(map[uint32]struct{})
+	}
+	switch cmd {
+	case mysql.ComStmtClose, mysql.ComStmtSendLongData, mysql.ComQuit:
+		// No response.
+		return true
+	}
+	if _, ok := timedCommands[cmd]; !ok || len(t.pending) >= maxPendingCmds {
+		t.disable()
+		return true
+	}
+	t.pending = append(t.pending, timedCmd{cmd: cmd, start: time.Now(), record: len(t.pending) == 0})
+	return true
+}
+
+// drain refuses new commands, and returns whether the connection is idle. A
+// disabled timer never knows it.
+func (t *cmdTimer) drain() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	return t.idle()
+}
+
+// busy returns whether a command waits for its response. A disabled timer
+// never knows it.
+func (t *cmdTimer) busy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.disabled && len(t.pending) > 0
+}
+
+// preparedStmts returns the number of prepared statements open or being
+// prepared. It returns false once the timer is disabled, since statements
+// are no longer counted.
+func (t *cmdTimer) preparedStmts() (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.disabled {
+		return 0, false
+	}
+	n := len(t.stmts)
+	for _, c := range t.pending {
+		if c.cmd == mysql.ComStmtPrepare {
+			n++
+		}
+	}
+	return n, true
+}
+
+// rowCount returns the number of rows returned, until the timer is
+// disabled.
+func (t *cmdTimer) rowCount() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rows
+}
+
+// responded returns whether every command has its response. A disabled timer
+// never knows it.
+func (t *cmdTimer) responded() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.idle()
+}
+
+func (t *cmdTimer) idle() bool {
+	return !t.disabled && len(t.pending) == 0
+}
+
+func (t *cmdTimer) disable() {
+	t.disabled = true
+	t.pending = nil
+}
+
+// packet is called with each packet read from backend. data is the first
+// chunk of the packet. drained is true if the connection is draining and
+// becomes idle after the packet. rows is true if the packet is a row or a
+// column definition of a result set, so an OK header in it is not an OK
+// packet: rows of binary result sets from COM_STMT_EXECUTE and
+// COM_STMT_FETCH always start with 0x00.
+func (t *cmdTimer) packet(data []byte) (drained, rows bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows = t.follow(data)
+	return t.draining && t.idle(), rows
+}
+
+// follow advances the response state with a packet, and returns whether the
+// packet is in the rows of a result set.
+func (t *cmdTimer) follow(data []byte) bool {
+	if t.disabled || len(t.pending) == 0 || len(data) == 0 {
+		return false
+	}
+	cmd := t.pending[0].cmd
+	deprecateEOF := t.backend.Capability()&mysql.ClientDeprecateEOF != 0
+	isEOF := t.backend.IsEOFPacket(data)
+	switch t.state {
+	case respFirst:
+		switch {
+		case data[0] == mysql.HeaderErr || cmd == mysql.ComStatistics:
+			t.done()
+		case cmd == mysql.ComStmtPrepare && data[0] == mysql.HeaderOK && len(data) >= 9:
+			t.stmts[binary.LittleEndian.Uint32(data[1:])] = struct{}{}
+			columns := int(binary.LittleEndian.Uint16(data[5:]))
+			params := int(binary.LittleEndian.Uint16(data[7:]))
+			t.left = columns + params
+			if !deprecateEOF {
+				for _, n := range []int{columns, params} {
+					if n > 0 {
+						t.left++
+					}
+				}
+			}
+			if t.left == 0 {
+				t.done()
+			} else {
+				t.state = respDefs
+			}
+		case isEOF:
+			t.endResult(data)
+		case cmd == mysql.ComFieldList || cmd == mysql.ComStmtFetch:
+			// Column definitions or rows, up to an EOF. Binary rows of
+			// COM_STMT_FETCH start with an OK header.
+			t.state, t.left, t.columns = respRows, 1, 0
+			if cmd == mysql.ComStmtFetch {
+				t.rows++
+			}
+			return true
+		case data[0] == mysql.HeaderOK:
+			t.endResult(data)
+		case data[0] == mysql.HeaderLocalInFile:
+			t.disable()
+		default:
+			// The column count of a result set. Column definitions are
+			// followed by an EOF unless CLIENT_DEPRECATE_EOF is set.
+			t.state, t.left = respRows, 2
+			if deprecateEOF {
+				t.left = 1
+			}
+			columns, _ := mysql.NewBuffer(data).ReadLenencInt()
+			t.columns = int(columns)
+		}
+	case respRows:
+		switch {
+		case data[0] == mysql.HeaderErr:
+			t.done()
+		case isEOF:
+			t.left--
+			status, _ := t.backend.StatusFlags(data)
+			if t.left == 0 || status&mysql.ServerStatusCursorExists != 0 {
+				t.endResult(data)
+			}
+		default:
+			switch {
+			case t.columns > 0:
+				t.columns--
+			case cmd != mysql.ComFieldList:
+				t.rows++
+			}
+			return true
+		}
+	case respDefs:
+		t.left--
+		if t.left == 0 {
+			t.done()
+		}
+	}
+	return false
+}
+
+// endResult ends a result, and the response unless more results follow.
+func (t *cmdTimer) endResult(data []byte) {
+	if status, ok := t.backend.StatusFlags(data); ok && status&mysql.ServerMoreResultsExists != 0 {
+		t.state = respFirst
+		return
+	}
+	t.done()
+}
+
+// done ends the response of the first pending command.
+func (t *cmdTimer) done() {
+	c := t.pending[0]
+	t.pending = t.pending[1:]
+	t.state = respFirst
+	if c.record && t.observe {
+		commandDurationHistogram.WithLabelValues(timedCommands[c.cmd], t.cluster).Observe(time.Since(c.start).Seconds())
+	}
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandLatency(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	eof := []byte{mysql.HeaderEOF, 0, 0, 0x02, 0}
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		if cmd[0] != mysql.ComQuery {
+			return writeTestPacket(conn, okPacket)
+		}
+		// The response ends with a delayed EOF after the rows.
+		for _, p := range [][]byte{{0x01}, {0x03, 'd', 'e', 'f'}, eof, {0x01, '1'}} {
+			if err := writeTestPacket(conn, p); err != nil {
+				return err
+			}
+		}
+		time.Sleep(delay)
+		return writeTestPacket(conn, eof)
+	})
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "latency", Address: backend.addr()}},
+		CommandLatency: true,
+	})
+	conn := dialTestGateway(t, gw, "latency.root")
+	query := commandDurationHistogram.WithLabelValues("query", "latency")
+	ping := commandDurationHistogram.WithLabelValues("ping", "latency")
+	queries, queriesSum, pings := query.Count(), query.Sum(), ping.Count()
+
+	execTestCommand(t, conn, []byte{mysql.ComQuery, '1'})
+	for i := 0; i < 4; i++ {
+		var b bytes.Buffer
+		require.NoError(t, conn.ReadPacket(&b))
+	}
+	require.Eventually(t, func() bool { return query.Count() == queries+1 }, 5*time.Second, 10*time.Millisecond)
+	require.GreaterOrEqual(t, query.Sum()-queriesSum, delay.Seconds())
+
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	require.Eventually(t, func() bool { return ping.Count() == pings+1 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, queries+1, query.Count())
+}
+
+func TestCmdTimer(t *testing.T) {
+	backend := mysql.NewConn(nil)
+	backend.SetCapability(mysql.DefaultCapability)
+	timer := newCmdTimer("timer", backend, true)
+	eof := []byte{mysql.HeaderEOF, 0, 0, 0x02, 0}
+	ping := commandDurationHistogram.WithLabelValues("ping", "timer")
+	prepare := commandDurationHistogram.WithLabelValues("stmt_prepare", "timer")
+	query := commandDurationHistogram.WithLabelValues("query", "timer")
+	pings, prepares, queries := ping.Count(), prepare.Count(), query.Count()
+
+	// Pipelined commands are not recorded since their latency includes
+	// waiting for the previous ones.
+	timer.start([]byte{mysql.ComPing})
+	timer.start([]byte{mysql.ComPing})
+	timer.packet(okPacket)
+	timer.packet(okPacket)
+	require.Equal(t, pings+1, ping.Count())
+
+	// The prepare OK is followed by definitions of 1 param and 2 columns,
+	// each part ending with an EOF. COM_STMT_CLOSE has no response.
+	timer.start([]byte{mysql.ComStmtPrepare})
+	timer.start([]byte{mysql.ComStmtClose})
+	for _, p := range [][]byte{{mysql.HeaderOK, 1, 0, 0, 0, 2, 0, 1, 0, 0, 0, 0}, {0x03, 'd', 'e', 'f'}, eof, {0x03, 'd', 'e', 'f'}, {0x03, 'd', 'e', 'f'}} {
+		timer.packet(p)
+	}
+	require.Equal(t, prepares, prepare.Count())
+	timer.packet(eof)
+	require.Equal(t, prepares+1, prepare.Count())
+	n, ok := timer.preparedStmts()
+	require.True(t, ok)
+	require.Equal(t, 1, n)
+	timer.start([]byte{mysql.ComStmtClose, 1, 0, 0, 0})
+	n, _ = timer.preparedStmts()
+	require.Equal(t, 0, n)
+
+	// Multiple results end with the one without SERVER_MORE_RESULTS_EXISTS.
+	timer.start([]byte{mysql.ComQuery})
+	timer.packet([]byte{mysql.HeaderOK, 0, 0, 0x0a, 0, 0, 0})
+	require.Equal(t, queries, query.Count())
+	timer.packet(okPacket)
+	require.Equal(t, queries+1, query.Count())
+
+	// Rows of COM_STMT_FETCH start with an OK header.
+	timer.start([]byte{mysql.ComStmtFetch})
+	_, rows := timer.packet([]byte{0x00, 0x00, 0x01})
+	require.True(t, rows)
+	_, rows = timer.packet(eof)
+	require.False(t, rows)
+	_, rows = timer.packet(okPacket)
+	require.False(t, rows)
+	require.Equal(t, int64(1), timer.rowCount())
+
+	// Rows are counted after the column definitions.
+	timer.start([]byte{mysql.ComQuery})
+	for _, p := range [][]byte{{0x02}, {0x03, 'd', 'e', 'f'}, {0x03, 'd', 'e', 'f'}, eof, {0x01, '1'}, {0x00}, eof} {
+		timer.packet(p)
+	}
+	require.Equal(t, int64(3), timer.rowCount())
+
+	// Unknown responses stop timing.
+	timer.start([]byte{mysql.ComQuery})
+	timer.packet([]byte{mysql.HeaderLocalInFile, 'f'})
+	timer.start([]byte{mysql.ComPing})
+	timer.packet(okPacket)
+	require.Equal(t, queries+2, query.Count())
+	require.Equal(t, pings+1, ping.Count())
+}
+
+func TestCmdTimerResetStmts(t *testing.T) {
+	backend := mysql.NewConn(nil)
+	backend.SetCapability(mysql.DefaultCapability)
+	for _, cmd := range []byte{mysql.ComResetConnection, mysql.ComChangeUser} {
+		timer := newCmdTimer("timer", backend, false)
+		timer.start([]byte{mysql.ComStmtPrepare})
+		timer.packet([]byte{mysql.HeaderOK, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+		n, ok := timer.preparedStmts()
+		require.True(t, ok)
+		require.Equal(t, 1, n)
+
+		timer.start([]byte{cmd})
+		require.Empty(t, timer.stmts, cmd)
+	}
+}
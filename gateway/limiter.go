@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"strings"
+	"sync"
+)
+
+// connLimiter limits the total number of connections, while reserving a
+// minimum share for each cluster. Clusters can burst into capacity that is
+// not reserved by others.
+type connLimiter struct {
+	mu sync.Mutex
+	// max is the global limit, 0 means no limit.
+	max      int
+	reserved map[string]int
+	counts   map[string]int
+	total    int
+}
+
+func newConnLimiter(max int, backends BackendConfigs) *connLimiter {
+	l := &connLimiter{
+		max:    max,
+		counts: make(map[string]int),
+	}
+	l.setReserved(backends)
+	return l
+}
+
+// setMax updates the global limit. Connections above it are not closed.
+func (l *connLimiter) setMax(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+}
+
+func (l *connLimiter) getMax() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.max
+}
+
+// setReserved updates the reserved shares of clusters.
+func (l *connLimiter) setReserved(backends BackendConfigs) {
+	reserved := make(map[string]int)
+	for _, b := range backends {
+		if b.MinConnections > 0 {
+			reserved[strings.ToLower(b.ClusterID)] = b.MinConnections
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reserved = reserved
+}
+
+// acquire takes a connection slot for cluster. It returns false if the
+// cluster has reached its share.
+func (l *connLimiter) acquire(cluster string) bool {
+	cluster = strings.ToLower(cluster)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 {
+		if l.total >= l.max {
+			return false
+		}
+		if l.counts[cluster] >= l.reserved[cluster] && l.total+1+l.unusedReservation(cluster) > l.max {
+			return false
+		}
+	}
+	l.counts[cluster]++
+	l.total++
+	return true
+}
+
+// release returns a slot taken by acquire.
+func (l *connLimiter) release(cluster string) {
+	cluster = strings.ToLower(cluster)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[cluster]--
+	if l.counts[cluster] == 0 {
+		delete(l.counts, cluster)
+	}
+	l.total--
+}
+
+// unusedReservation returns the reserved slots not used by clusters other
+// than the given one.
+func (l *connLimiter) unusedReservation(cluster string) int {
+	var n int
+	for c, r := range l.reserved {
+		if c != cluster && l.counts[c] < r {
+			n += r - l.counts[c]
+		}
+	}
+	return n
+}
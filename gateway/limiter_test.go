@@ -0,0 +1,95 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendMinConnections(t *testing.T) {
+	var backends BackendConfigs
+	require.NoError(t, backends.Set("c1=127.0.0.1:4000?min-conns=3"))
+	require.NoError(t, backends.Set("c2=127.0.0.1:4001"))
+	require.Equal(t, BackendConfigs{
+		{ClusterID: "c1", Address: "127.0.0.1:4000", MinConnections: 3},
+		{ClusterID: "c2", Address: "127.0.0.1:4001"},
+	}, backends)
+	require.Error(t, backends.Set("c3=127.0.0.1:4000?min-conns=x"))
+	require.Error(t, backends.Set("c3=127.0.0.1:4000?foo=1"))
+	require.EqualError(t, backends.Set("c3=127.0.0.1:4000?min-conns=-1"), "invalid min-conns -1 of cluster c3")
+
+	require.NoError(t, backends.ValidateMinConnections(0))
+	require.NoError(t, backends.ValidateMinConnections(3))
+	require.NoError(t, append(backends, BackendConfig{ClusterID: "c3", MinConnections: 2}).ValidateMinConnections(0))
+	_, err := New(nil, &Config{
+		BackendConfigs: append(backends, BackendConfig{ClusterID: "c3", Address: "127.0.0.1:4002", MinConnections: 2}),
+		MaxConnections: 4,
+	})
+	require.EqualError(t, err, "min-conns of cluster c3 makes the reserved connections 5 exceed max connections 4")
+	_, err = New(nil, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c3", Address: "127.0.0.1:4002", MinConnections: -1}},
+	})
+	require.EqualError(t, err, "invalid min-conns -1 of cluster c3")
+}
+
+func TestClusterConnectionShare(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend.addr(), MinConnections: 1},
+			{ClusterID: "c2", Address: backend.addr(), MinConnections: 2},
+		},
+		MaxConnections: 4,
+	})
+
+	// c1 can burst into the capacity not reserved by c2.
+	dialTestGateway(t, gw, "c1.root")
+	dialTestGateway(t, gw, "c1.root")
+	_, err := connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+
+	// c2 still gets its guarantee.
+	dialTestGateway(t, gw, "c2.root")
+	c2 := dialTestGateway(t, gw, "c2.root")
+	_, err = connectTestGateway(gw, "c2.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+
+	// Closed connections free their slots.
+	c2.Close()
+	require.Eventually(t, func() bool {
+		conn, err := connectTestGateway(gw, "c2.root")
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMaxConnections(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxConnections: 2,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	dialTestGateway(t, gw, "c1.root")
+
+	// The connection is rejected before the handshake.
+	_, err := connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+	require.Equal(t, 2, logs.FilterMessage("accepting new connection").Len())
+
+	// Raising the limit takes effect for new connections.
+	gw.SetMaxConnections(3)
+	dialTestGateway(t, gw, "c1.root")
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+
+	// Lowering it keeps existing connections.
+	gw.SetMaxConnections(1)
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+}
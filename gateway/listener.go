@@ -0,0 +1,29 @@
+package gateway
+
+import (
+	"context"
+	"net"
+)
+
+// ListenConfig is used to configure the listening socket.
+type ListenConfig struct {
+	// Backlog overrides the system default listen backlog if positive.
+	Backlog   int
+	ReuseAddr bool
+}
+
+// Listen announces on the local TCP address with the socket options applied.
+func Listen(addr string, conf ListenConfig) (net.Listener, error) {
+	lc := net.ListenConfig{Control: conf.control}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Backlog > 0 {
+		if err := setBacklog(l, conf.Backlog); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenSocketOptions(t *testing.T) {
+	for _, reuse := range []bool{true, false} {
+		l, err := Listen("127.0.0.1:0", ListenConfig{Backlog: 16, ReuseAddr: reuse})
+		require.NoError(t, err)
+
+		rc, err := l.(*net.TCPListener).SyscallConn()
+		require.NoError(t, err)
+		var v int
+		var serr error
+		err = rc.Control(func(fd uintptr) {
+			v, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+		})
+		require.NoError(t, err)
+		require.NoError(t, serr)
+		require.Equal(t, reuse, v != 0)
+
+		// For listening sockets, tcpi_sacked of TCP_INFO is the backlog.
+		var info syscall.TCPInfo
+		size := uint32(unsafe.Sizeof(info))
+		err = rc.Control(func(fd uintptr) {
+			_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+				uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+			if errno != 0 {
+				serr = errno
+			}
+		})
+		require.NoError(t, err)
+		require.NoError(t, serr)
+		require.Equal(t, uint32(16), info.Sacked)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	g := &Gateway{conf: &Config{TCPRecvBuffer: 4096, TCPSendBuffer: 8192}}
+	require.NoError(t, g.setSocketBuffers(conn))
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	require.NoError(t, err)
+	var rcvbuf, sndbuf int
+	err = rc.Control(func(fd uintptr) {
+		rcvbuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		sndbuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	require.NoError(t, err)
+	// Linux doubles the value for bookkeeping overhead.
+	require.Equal(t, 2*4096, rcvbuf)
+	require.Equal(t, 2*8192, sndbuf)
+
+	// Non-TCP connections are skipped.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	require.NoError(t, g.setSocketBuffers(c1))
+}
+
+func TestTCPOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	getsockopt := func(conn net.Conn, level, opt int) int {
+		rc, err := conn.(*net.TCPConn).SyscallConn()
+		require.NoError(t, err)
+		var v int
+		var serr error
+		require.NoError(t, rc.Control(func(fd uintptr) {
+			v, serr = syscall.GetsockoptInt(int(fd), level, opt)
+		}))
+		require.NoError(t, serr)
+		return v
+	}
+	for _, keepAlive := range []time.Duration{30 * time.Second, -1} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.(*net.TCPConn).SetNoDelay(false))
+
+		g := &Gateway{conf: &Config{TCPKeepAlive: keepAlive}}
+		require.NoError(t, g.setTCPOptions(conn))
+		require.Equal(t, 1, getsockopt(conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY))
+		if keepAlive > 0 {
+			require.Equal(t, 1, getsockopt(conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+			require.Equal(t, 30, getsockopt(conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+		} else {
+			require.Equal(t, 0, getsockopt(conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+		}
+	}
+
+	// Non-TCP connections are skipped.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	require.NoError(t, (&Gateway{conf: &Config{}}).setTCPOptions(c1))
+}
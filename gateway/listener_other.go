@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package gateway
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func (c ListenConfig) control(network, address string, rc syscall.RawConn) error {
+	return nil
+}
+
+func setBacklog(l net.Listener, backlog int) error {
+	return errors.New("listen backlog is not supported on this platform")
+}
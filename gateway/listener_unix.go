@@ -0,0 +1,46 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package gateway
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func (c ListenConfig) control(network, address string, rc syscall.RawConn) error {
+	reuse := 0
+	if c.ReuseAddr {
+		reuse = 1
+	}
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, reuse)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(serr, "failed to set SO_REUSEADDR")
+}
+
+// setBacklog calls listen(2) again on the bound socket, which updates the
+// backlog of an already listening socket.
+func setBacklog(l net.Listener, backlog int) error {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return errors.New("listen backlog is only supported for tcp listeners")
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(serr, "failed to set listen backlog")
+}
@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/oh-my-tidb/tidb-gateway/metrics"
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+)
+
+// Metrics of the gateway, registered to metrics.DefaultRegistry.
+var (
+	shutdownPhaseCounter = metrics.NewCounterVec("gateway_shutdown_phases_total",
+		"Number of shutdown phases entered.", "phase")
+	shutdownRemainingGauge = metrics.NewGaugeVec("gateway_shutdown_remaining_connections",
+		"Connections remaining at the end of a shutdown phase.", "phase")
+	bufferPoolGetCounter = metrics.NewCounterVec("gateway_buffer_pool_gets_total",
+		"Number of buffers taken from the pool by result (hit/miss).", "result")
+	bufferPoolDiscardCounter = metrics.NewCounter("gateway_buffer_pool_discards_total",
+		"Number of buffers discarded because the pool is full.")
+	bufferPoolRetainedGauge = metrics.NewGauge("gateway_buffer_pool_retained_bytes",
+		"Total capacity of buffers retained by the pool.")
+	acceptRateLimitedCounter = metrics.NewCounterVec("gateway_accept_rate_limited_total",
+		"Number of connections exceeding the accept rate by action (queue/reject).", "action")
+	authPluginCounter = metrics.NewCounterVec("gateway_auth_plugins_total",
+		"Number of authenticated connections by cluster and negotiated auth plugin.", "cluster", "plugin")
+	clientAuthPluginCounter = metrics.NewCounterVec("gateway_client_auth_plugins_total",
+		"Number of handshakes by cluster and auth plugin proposed by the client, or other if unknown.", "cluster", "plugin")
+	commandDurationHistogram = metrics.NewHistogramVec("gateway_command_duration_seconds",
+		"Latency from forwarding a command to backend until its response ends.", nil, "cmd", "cluster")
+	panicCounter = metrics.NewCounterVec("gateway_panics_total",
+		"Number of panics recovered by goroutine (conn/relay/serve).", "goroutine")
+	serveRestartCounter = metrics.NewCounter("gateway_serve_restarts_total",
+		"Number of times the accept loop is restarted after exiting unexpectedly.")
+	activeConnsGauge = metrics.NewGauge("gateway_active_connections",
+		"Number of connections being handled.")
+	connsCounter = metrics.NewCounter("gateway_connections_total",
+		"Number of connections accepted.")
+	relayedBytesCounter = metrics.NewCounterVec("gateway_relayed_bytes_total",
+		"Bytes of MySQL packets relayed by direction (client_to_backend/backend_to_client).", "direction")
+	handshakeFailureCounter = metrics.NewCounterVec("gateway_handshake_failures_total",
+		"Number of failed handshakes by side (client/backend).", "side")
+	authFailureCounter = metrics.NewCounterVec("gateway_auth_failures_total",
+		"Number of failed auth by cluster.", "cluster")
+	backendVersionCounter = metrics.NewCounterVec("gateway_backend_versions_total",
+		"Number of authenticated connections by cluster and backend server version.", "cluster", "version")
+	shedConnsCounter = metrics.NewCounter("gateway_shed_connections_total",
+		"Number of connections rejected because the gateway is near its resource limits.")
+	tarpitDelayCounter = metrics.NewCounter("gateway_tarpit_delays_total",
+		"Number of handshakes delayed because the client IP fails auth repeatedly.")
+	writeStallCounter = metrics.NewCounterVec("gateway_write_stalls_total",
+		"Number of writes to clients blocking for too long by stage (warn/close).", "stage")
+	relayErrorCounter = metrics.NewCounterVec("gateway_relay_errors_total",
+		"Number of relays ended by reason (client_eof/backend_eof/quit/sequence/timeout/oversized/write/drained/other).", "reason")
+	dialQueueCounter = metrics.NewCounterVec("gateway_dial_queue_total",
+		"Number of connections waiting for a backend dial slot by result (queued/timeout/full).", "result")
+
+	clientToBackendBytes     = relayedBytesCounter.WithLabelValues("client_to_backend")
+	backendToClientBytes     = relayedBytesCounter.WithLabelValues("backend_to_client")
+	clientHandshakeFailures  = handshakeFailureCounter.WithLabelValues(SideClient)
+	backendHandshakeFailures = handshakeFailureCounter.WithLabelValues(SideBackend)
+)
+
+// Shutdown phases.
+const (
+	phaseDrain = "drain"
+	phaseForce = "force"
+)
+
+// authPluginLabels are the auth plugins counted by name. Clients may send any
+// plugin name, so others are counted as "other" to bound the label values.
+var authPluginLabels = map[string]bool{
+	mysql.AuthNativePassword:          true,
+	mysql.AuthCachingSha2Password:     true,
+	mysql.AuthSocket:                  true,
+	"sha256_password":                 true,
+	"mysql_clear_password":            true,
+	"tidb_sm3_password":               true,
+	"authentication_ldap_sasl_client": true,
+	"authentication_ldap_simple":      true,
+}
+
+// authPluginLabel returns the label value of an auth plugin.
+func authPluginLabel(plugin string) string {
+	if authPluginLabels[plugin] {
+		return plugin
+	}
+	return "other"
+}
+
+func init() {
+	metrics.Register(
+		shutdownPhaseCounter,
+		shutdownRemainingGauge,
+		bufferPoolGetCounter,
+		bufferPoolDiscardCounter,
+		bufferPoolRetainedGauge,
+		acceptRateLimitedCounter,
+		authPluginCounter,
+		clientAuthPluginCounter,
+		commandDurationHistogram,
+		panicCounter,
+		serveRestartCounter,
+		activeConnsGauge,
+		connsCounter,
+		relayedBytesCounter,
+		handshakeFailureCounter,
+		authFailureCounter,
+		backendVersionCounter,
+		shedConnsCounter,
+		tarpitDelayCounter,
+		writeStallCounter,
+		relayErrorCounter,
+		dialQueueCounter,
+	)
+}
+
+// serveMetrics starts serving metrics over HTTP at Config.MetricsAddr, until
+// the gateway is closed.
+func (g *Gateway) serveMetrics() error {
+	l, err := net.Listen("tcp", g.conf.MetricsAddr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen metrics address")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry)
+	mux.HandleFunc("/status", g.serveStatus)
+	mux.HandleFunc("/ready", g.serveReady)
+	g.metricsServer = &http.Server{Handler: mux} // nolint:gosec // nolint
+	g.metricsAddr = l.Addr()
+	g.bgWG.Add(1)
+	go func() {
+		defer g.bgWG.Done()
+		if err := g.metricsServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			g.log.Errorw("failed to serve metrics", "err", err)
+		}
+	}()
+	g.log.Infow("serving metrics", "addr", l.Addr().String())
+	return nil
+}
+
+// MetricsAddr returns the address serving metrics, or nil if it is not
+// served.
+func (g *Gateway) MetricsAddr() net.Addr {
+	return g.metricsAddr
+}
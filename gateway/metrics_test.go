@@ -0,0 +1,85 @@
+package gateway
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// scrapeTestMetrics gets the metrics served by gw, keyed by series.
+func scrapeTestMetrics(t *testing.T, gw *Gateway) map[string]float64 {
+	resp, err := http.Get("http://" + gw.MetricsAddr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	series := make(map[string]float64)
+	s := bufio.NewScanner(strings.NewReader(string(body)))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		require.Greater(t, i, 0, line)
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		require.NoError(t, err, line)
+		series[line[:i]] = v
+	}
+	return series
+}
+
+func TestServeMetrics(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRejectUser("bad"))
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MetricsAddr:    "127.0.0.1:0",
+	})
+	before := scrapeTestMetrics(t, gw)
+
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	after := scrapeTestMetrics(t, gw)
+	require.Equal(t, before["gateway_connections_total"]+1, after["gateway_connections_total"])
+	require.Equal(t, before["gateway_active_connections"]+1, after["gateway_active_connections"])
+	// The ping and its OK packet, headers included.
+	require.Equal(t, before[`gateway_relayed_bytes_total{direction="client_to_backend"}`]+5,
+		after[`gateway_relayed_bytes_total{direction="client_to_backend"}`])
+	require.Equal(t, before[`gateway_relayed_bytes_total{direction="backend_to_client"}`]+float64(4+len(okPacket)),
+		after[`gateway_relayed_bytes_total{direction="backend_to_client"}`])
+	conn.Close()
+	require.Eventually(t, func() bool {
+		return scrapeTestMetrics(t, gw)["gateway_active_connections"] == before["gateway_active_connections"]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Failed handshakes and auth are counted.
+	auth := `gateway_auth_failures_total{cluster="c1"}`
+	_, err := connectTestGateway(gw, "c1.bad")
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return scrapeTestMetrics(t, gw)[auth] == before[auth]+1
+	}, 5*time.Second, 10*time.Millisecond)
+	handshake := `gateway_handshake_failures_total{side="client"}`
+	raw, err := net.Dial("tcp", gw.l.Addr().String())
+	require.NoError(t, err)
+	raw.Close()
+	require.Eventually(t, func() bool {
+		return scrapeTestMetrics(t, gw)[handshake] == before[handshake]+1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The metrics server is shut down with the gateway.
+	addr := gw.MetricsAddr().String()
+	gw.Stop()
+	_, err = http.Get("http://" + addr + "/metrics")
+	require.Error(t, err)
+}
@@ -0,0 +1,24 @@
+package gateway
+
+import (
+	"runtime/debug"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Goroutines recovering from panics, as labels of panicCounter.
+const (
+	goroutineConn  = "conn"
+	goroutineRelay = "relay"
+	goroutineServe = "serve"
+)
+
+// handlePanic logs and counts a panic recovered by a connection goroutine,
+// and returns it as an error. It must be called by the deferred function
+// calling recover so that the stack contains the panicking frames.
+func handlePanic(log *zap.SugaredLogger, goroutine string, v interface{}) error {
+	panicCounter.WithLabelValues(goroutine).Inc()
+	log.Errorw("recovered from panic", "goroutine", goroutine, "panic", v, "stack", string(debug.Stack()))
+	return errors.Errorf("panic in %s goroutine: %v", goroutine, v)
+}
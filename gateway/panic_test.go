@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	relayPanics := panicCounter.WithLabelValues(goroutineRelay).Value()
+	connPanics := panicCounter.WithLabelValues(goroutineConn).Value()
+
+	backend := startMockBackend(t, nil)
+	gw, logs := newTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend.addr()},
+			{ClusterID: "c2", Address: backend.addr()},
+		},
+		CountCommands: true,
+		AddressRewriter: func(clusterID, addr string) (string, error) {
+			if clusterID == "c2" {
+				panic("rewriter bug")
+			}
+			return addr, nil
+		},
+	})
+	gw.commandHook = func(cmd []byte) {
+		if cmd[0] == mysql.ComProcessKill {
+			panic("relay bug")
+		}
+	}
+	gw.StartServe()
+	t.Cleanup(gw.Stop)
+
+	// A panic in a relay goroutine closes the connection only.
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	conn.SetResetOption(mysql.SeqResetOnWrite)
+	require.NoError(t, writeTestPacket(conn, []byte{mysql.ComProcessKill}))
+	var b bytes.Buffer
+	require.Error(t, conn.ReadPacket(&b))
+	entry := waitTestLog(t, logs, "recovered from panic")
+	require.Equal(t, goroutineRelay, entry.ContextMap()["goroutine"])
+	require.Equal(t, "relay bug", entry.ContextMap()["panic"])
+	require.Contains(t, entry.ContextMap()["stack"], "copyInboundPackets")
+	require.Equal(t, relayPanics+1, panicCounter.WithLabelValues(goroutineRelay).Value())
+
+	// So does a panic in the connection goroutine.
+	_, err := connectTestGateway(gw, "c2.root")
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return panicCounter.WithLabelValues(goroutineConn).Value() == connPanics+1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The gateway keeps serving.
+	conn = dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+}
@@ -0,0 +1,42 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/pkg/errors"
+)
+
+// servePprof starts serving runtime profiles over HTTP at Config.PprofAddr,
+// until the gateway is closed. Profiles are served under /debug/pprof/ on a
+// listener separate from metrics, since they expose internals and cost CPU.
+func (g *Gateway) servePprof() error {
+	l, err := net.Listen("tcp", g.conf.PprofAddr)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen pprof address")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	g.pprofServer = &http.Server{Handler: mux} // nolint:gosec // nolint
+	g.pprofAddr = l.Addr()
+	g.bgWG.Add(1)
+	go func() {
+		defer g.bgWG.Done()
+		if err := g.pprofServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			g.log.Errorw("failed to serve pprof", "err", err)
+		}
+	}()
+	g.log.Infow("serving pprof", "addr", l.Addr().String())
+	return nil
+}
+
+// PprofAddr returns the address serving profiles, or nil if they are not
+// served.
+func (g *Gateway) PprofAddr() net.Addr {
+	return g.pprofAddr
+}
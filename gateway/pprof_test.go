@@ -0,0 +1,29 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPprof(t *testing.T) {
+	gw, _ := startTestGateway(t, &Config{})
+	require.Nil(t, gw.PprofAddr())
+
+	gw, _ = startTestGateway(t, &Config{PprofAddr: "127.0.0.1:0"})
+	addr := gw.PprofAddr().String()
+	resp, err := http.Get("http://" + addr + "/debug/pprof/goroutine?debug=1")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "goroutine profile")
+
+	// The pprof server is shut down with the gateway.
+	gw.Stop()
+	_, err = http.Get("http://" + addr + "/debug/pprof/")
+	require.Error(t, err)
+}
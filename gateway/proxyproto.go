@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// proxySignature starts PROXY protocol v2 headers.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 commands and address families.
+const (
+	proxyVersionLocal = 0x20
+	proxyVersionProxy = 0x21
+	proxyFamilyUnspec = 0x00
+	proxyFamilyTCP4   = 0x11
+	proxyFamilyTCP6   = 0x21
+)
+
+// sendProxyHeader sends a PROXY protocol v2 header to a new backend
+// connection if SendProxyProtocol is set. It tells that the connection comes
+// from client, or is a LOCAL one of the gateway itself if client is nil.
+func (g *Gateway) sendProxyHeader(backend, client net.Conn) error {
+	if !g.conf.SendProxyProtocol {
+		return nil
+	}
+	var src, dst net.Addr
+	if client != nil {
+		src, dst = client.RemoteAddr(), client.LocalAddr()
+	}
+	return errors.WithMessage(writeProxyHeader(backend, src, dst), "failed to send proxy protocol header")
+}
+
+// writeProxyHeader writes a PROXY protocol v2 header telling backend that the
+// connection comes from src and is accepted at dst. Addresses other than TCP
+// are sent as a LOCAL header, which backend treats as a direct connection.
+func writeProxyHeader(w io.Writer, src, dst net.Addr) error {
+	header := append([]byte(nil), proxySignature...)
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		header = append(header, proxyVersionLocal, proxyFamilyUnspec, 0, 0)
+		_, err := w.Write(header)
+		return errors.WithStack(err)
+	}
+	srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+	family := byte(proxyFamilyTCP4)
+	// Both addresses are encoded as IPv6 unless both are IPv4.
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		family = proxyFamilyTCP6
+	}
+	if srcIP == nil || dstIP == nil {
+		return errors.Errorf("invalid proxy addresses %s, %s", src, dst)
+	}
+	header = append(header, proxyVersionProxy, family)
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(2*len(srcIP)+4))
+	header = append(header, buf[:]...)
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	binary.BigEndian.PutUint16(buf[:], uint16(srcAddr.Port))
+	header = append(header, buf[:]...)
+	binary.BigEndian.PutUint16(buf[:], uint16(dstAddr.Port))
+	header = append(header, buf[:]...)
+	_, err := w.Write(header)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeTestProxyHeader decodes the addresses of a PROXY protocol v2 header.
+func decodeTestProxyHeader(t *testing.T, header []byte) (src, dst *net.TCPAddr) {
+	require.Equal(t, proxySignature, header[:12])
+	require.Equal(t, byte(proxyVersionProxy), header[12])
+	ipLen := net.IPv4len
+	if header[13] == proxyFamilyTCP6 {
+		ipLen = net.IPv6len
+	} else {
+		require.Equal(t, byte(proxyFamilyTCP4), header[13])
+	}
+	addrs := header[16:]
+	require.Equal(t, 2*ipLen+4, int(binary.BigEndian.Uint16(header[14:])))
+	require.Len(t, addrs, 2*ipLen+4)
+	src = &net.TCPAddr{IP: net.IP(addrs[:ipLen]), Port: int(binary.BigEndian.Uint16(addrs[2*ipLen:]))}
+	dst = &net.TCPAddr{IP: net.IP(addrs[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))}
+	return src, dst
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	cases := []struct {
+		src, dst string
+		family   byte
+	}{
+		{"10.0.0.1:50000", "192.168.1.2:4000", proxyFamilyTCP4},
+		{"[2001:db8::1]:50000", "[2001:db8::2]:4000", proxyFamilyTCP6},
+		{"10.0.0.1:50000", "[2001:db8::2]:4000", proxyFamilyTCP6},
+	}
+	for _, c := range cases {
+		src, err := net.ResolveTCPAddr("tcp", c.src)
+		require.NoError(t, err)
+		dst, err := net.ResolveTCPAddr("tcp", c.dst)
+		require.NoError(t, err)
+		var b bytes.Buffer
+		require.NoError(t, writeProxyHeader(&b, src, dst))
+		require.Equal(t, c.family, b.Bytes()[13], c.src)
+		gotSrc, gotDst := decodeTestProxyHeader(t, b.Bytes())
+		require.True(t, src.IP.Equal(gotSrc.IP), c.src)
+		require.Equal(t, src.Port, gotSrc.Port)
+		require.True(t, dst.IP.Equal(gotDst.IP), c.dst)
+		require.Equal(t, dst.Port, gotDst.Port)
+	}
+
+	// Addresses other than TCP are sent as LOCAL.
+	var b bytes.Buffer
+	require.NoError(t, writeProxyHeader(&b, &net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, &net.UnixAddr{Name: "/tmp/b.sock", Net: "unix"}))
+	require.Equal(t, append(append([]byte(nil), proxySignature...), proxyVersionLocal, proxyFamilyUnspec, 0, 0), b.Bytes())
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRecordProxyHeaders())
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:    BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		SendProxyProtocol: true,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	src, dst := decodeTestProxyHeader(t, <-backend.proxyHeaders)
+	require.Equal(t, conn.RawConn().LocalAddr().String(), src.String())
+	require.Equal(t, gw.l.Addr().String(), dst.String())
+}
@@ -0,0 +1,120 @@
+package gateway
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+)
+
+// AcceptRatePolicy decides what to do with connections exceeding the accept
+// rate.
+type AcceptRatePolicy string
+
+// Accept rate policies.
+const (
+	AcceptRateQueue  AcceptRatePolicy = "queue"
+	AcceptRateReject AcceptRatePolicy = "reject"
+)
+
+// Validate checks whether the policy is known.
+func (p AcceptRatePolicy) Validate() error {
+	switch p {
+	case "", AcceptRateQueue, AcceptRateReject:
+		return nil
+	}
+	return errors.Errorf("invalid accept rate policy %q", p)
+}
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	mu sync.Mutex
+	// rate is the number of tokens added per second.
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (l *rateLimiter) advance() {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// allow takes a token if there is one.
+func (l *rateLimiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance()
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// limitAccept applies the accept rate to a newly accepted connection. It
+// returns false if the connection is rejected or the gateway is stopped
+// while waiting, and the connection is closed.
+func (g *Gateway) limitAccept(conn net.Conn) bool {
+	if g.acceptLimiter == nil {
+		return true
+	}
+	if g.conf.AcceptRatePolicy == AcceptRateReject {
+		if g.acceptLimiter.allow() {
+			return true
+		}
+		acceptRateLimitedCounter.WithLabelValues(string(AcceptRateReject)).Inc()
+		g.rejectConn(conn, mysql.ErrCodeConCount, "Too many new connections")
+		return false
+	}
+	wait := g.acceptLimiter.reserve()
+	if wait == 0 {
+		return true
+	}
+	acceptRateLimitedCounter.WithLabelValues(string(AcceptRateQueue)).Inc()
+	select {
+	case <-time.After(wait):
+		return true
+	case <-g.quit:
+		conn.Close()
+		return false
+	}
+}
+
+// rejectWriteTimeout bounds writing the error to a rejected connection. The
+// error fits in the send buffer of a new connection, so the write hardly
+// blocks the accept loop.
+const rejectWriteTimeout = 10 * time.Millisecond
+
+// rejectConn answers a newly accepted connection with the error and closes
+// it. It runs in the accept loop rather than in a goroutine per
+// connection, which would pile up while rejecting a flood of connections.
+func (g *Gateway) rejectConn(conn net.Conn, code uint16, msg string) {
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	sendErrCode(mysql.NewConn(conn), code, msg)
+}
@@ -0,0 +1,40 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptRate(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		AcceptRate:     20,
+		AcceptBurst:    2,
+	})
+
+	// The burst is accepted at once, and the rest are queued at the rate.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		dialTestGateway(t, gw, "c1.root")
+	}
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond-10*time.Millisecond)
+}
+
+func TestAcceptRateReject(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:   BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		AcceptRate:       1,
+		AcceptRatePolicy: AcceptRateReject,
+	})
+	rejected := acceptRateLimitedCounter.WithLabelValues(string(AcceptRateReject)).Value()
+
+	dialTestGateway(t, gw, "c1.root")
+	_, err := connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+	require.Equal(t, rejected+1, acceptRateLimitedCounter.WithLabelValues(string(AcceptRateReject)).Value())
+}
@@ -0,0 +1,73 @@
+package gateway
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Modes of waiting for backends.
+const (
+	WaitForAnyBackend  = "any"
+	WaitForAllBackends = "all"
+)
+
+const waitForBackendsInterval = 500 * time.Millisecond
+
+// WaitForBackends blocks until the configured backends are reachable, or
+// returns an error once WaitForBackendsTimeout elapses. Depending on the
+// WaitForBackends mode, one reachable backend or all of them are required.
+func (g *Gateway) WaitForBackends() error {
+	if g.conf.WaitForBackends == "" {
+		return nil
+	}
+	deadline := time.Now().Add(g.conf.WaitForBackendsTimeout)
+	for {
+		backends := g.backendConfigs()
+		ready := 0
+		for _, c := range backends {
+			if g.probeCluster(c) {
+				ready++
+			}
+		}
+		if (g.conf.WaitForBackends == WaitForAllBackends && ready == len(backends)) ||
+			(g.conf.WaitForBackends == WaitForAnyBackend && ready > 0) {
+			g.log.Infow("backends are ready", "ready", ready)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("%d of %d backends are ready after %v", ready, len(backends), g.conf.WaitForBackendsTimeout)
+		}
+		select {
+		case <-time.After(waitForBackendsInterval):
+		case <-g.quit:
+			return errors.New("gateway is stopped")
+		}
+	}
+}
+
+// probeCluster returns whether any address of a cluster is reachable. The
+// addresses are rewritten as for connections.
+func (g *Gateway) probeCluster(c BackendConfig) bool {
+	for _, addr := range c.Addresses() {
+		rewritten, err := g.rewriteAddr(c.ClusterID, addr)
+		if err == nil {
+			err = g.probeBackend(rewritten)
+		}
+		if err != nil {
+			g.log.Infow("backend is not reachable", "cluster", c.ClusterID, "addr", addr, "err", err)
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func (g *Gateway) probeBackend(addr string) error {
+	conn, err := g.connectBackend(addr)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
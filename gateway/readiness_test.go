@@ -0,0 +1,67 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForBackends(t *testing.T) {
+	// Reserve an address for the backend which starts later.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	delayed := l.Addr().String()
+	require.NoError(t, l.Close())
+	ready := startMockBackend(t, nil)
+
+	newGateway := func(mode string, timeout time.Duration) *Gateway {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		gw, err := New(l, &Config{
+			BackendConfigs: BackendConfigs{
+				{ClusterID: "c1", Address: ready.addr()},
+				{ClusterID: "c2", Address: delayed},
+			},
+			WaitForBackends:        mode,
+			WaitForBackendsTimeout: timeout,
+		})
+		require.NoError(t, err)
+		t.Cleanup(gw.Stop)
+		return gw
+	}
+
+	require.NoError(t, newGateway(WaitForAnyBackend, time.Second).WaitForBackends())
+	require.Error(t, newGateway(WaitForAllBackends, 100*time.Millisecond).WaitForBackends())
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", delayed)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { l.Close() })
+	}()
+	start := time.Now()
+	require.NoError(t, newGateway(WaitForAllBackends, 5*time.Second).WaitForBackends())
+	require.Greater(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestWaitForBackendsRewritesAddress(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gw, err := New(l, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: "c1.internal"}},
+		AddressRewriter: func(clusterID, addr string) (string, error) {
+			return backend.addr(), nil
+		},
+		WaitForBackends:        WaitForAllBackends,
+		WaitForBackendsTimeout: time.Second,
+	})
+	require.NoError(t, err)
+	t.Cleanup(gw.Stop)
+	require.NoError(t, gw.WaitForBackends())
+	require.Empty(t, gw.BackendErrors())
+}
@@ -2,98 +2,951 @@ package gateway
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/oh-my-tidb/tidb-gateway/metrics"
 	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/oh-my-tidb/tidb-gateway/utility"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
-// RelayRawBytes relays raw bytes between remote and backend.
-func RelayRawBytes(remote, backend *mysql.Conn, quit <-chan struct{}) error {
+// RelayRawBytes relays raw bytes between remote and backend. It returns
+// ErrIdleTimeout if idleTimeout is not zero and no data moves in either
+// direction for the duration.
+//
+// If halfClose is set and remote closes its write side, the write side of
+// backend is shut down and results keep being relayed to remote until
+// backend closes, instead of ending the relay at once.
+func RelayRawBytes(remote, backend *mysql.Conn, idleTimeout time.Duration, halfClose bool, quit <-chan struct{}) (RelayStats, error) {
 	remote.SetResetOption(mysql.SeqResetBoth)
 	backend.SetResetOption(mysql.SeqResetBoth)
-	errCh := make(chan error, 2) // nolint:gomnd // nolint
+	var stats RelayStats
+	errCh := make(chan error, 3) // nolint:gomnd // nolint
+	// halfClosed receives the close of remote if backend is half-closed.
+	halfClosed := make(chan error, 1)
+	idle := newIdleWatcher(idleTimeout)
+	defer idle.stop()
 	go func() {
-		_, err := io.Copy(backend.RawConn(), remote.RawConn())
-		errCh <- errors.Wrap(err, "remote -> backend closed")
+		defer recoverRelay(nil, errCh)
+		r := &countingReader{r: remote.BufferedConn(), n: &stats.ClientToBackend, c: clientToBackendBytes}
+		_, err := io.Copy(backend.RawConn(), idle.reader(r))
+		closed := copyClosed(SideClient, SideBackend, errors.Wrap(err, "remote -> backend closed"))
+		if halfClose && errors.Cause(err) == nil {
+			if backend.CloseWrite() == nil {
+				halfClosed <- closed
+				return
+			}
+		}
+		errCh <- closed
 	}()
 	go func() {
-		_, err := io.Copy(remote.RawConn(), backend.RawConn())
-		errCh <- errors.Wrap(err, "backend -> remote closed")
+		defer recoverRelay(nil, errCh)
+		r := &countingReader{r: backend.BufferedConn(), n: &stats.BackendToClient, c: backendToClientBytes}
+		_, err := io.Copy(remote.RawConn(), idle.reader(r))
+		closed := copyClosed(SideBackend, SideClient, errors.Wrap(err, "backend -> remote closed"))
+		// Remote closes first if backend finishes after being half-closed.
+		select {
+		case clientClosed := <-halfClosed:
+			if errors.Cause(err) == nil {
+				closed = clientClosed
+			}
+		default:
+		}
+		errCh <- closed
 	}()
+	go idle.watch(errCh)
 	select {
 	case err := <-errCh:
-		return err
+		return stats.load(), err
 	case <-quit:
-		return errors.New("relayer is closed")
+		return stats.load(), errors.New("relayer is closed")
+	}
+}
+
+// singleRelayPollInterval is how long RelayRawBytesSingle waits for data
+// from one side before polling the other.
+const singleRelayPollInterval = 10 * time.Millisecond
+
+// RelayRawBytesSingle is like RelayRawBytes but relays both directions in the
+// calling goroutine, for embedders that proxy a single connection and do not
+// want to spawn goroutines per relay. It polls the sides in turn with short
+// read deadlines, so data may wait up to a poll interval, and a write blocks
+// polling until the other side accepts it.
+func RelayRawBytesSingle(remote, backend *mysql.Conn, idleTimeout time.Duration, quit <-chan struct{}) (RelayStats, error) {
+	remote.SetResetOption(mysql.SeqResetBoth)
+	backend.SetResetOption(mysql.SeqResetBoth)
+	var stats RelayStats
+	type direction struct {
+		src, dst         net.Conn
+		srcSide, dstSide string
+		msg              string
+		n                *int64
+		bytes            *metrics.Counter
+	}
+	dirs := [2]direction{
+		{remote.BufferedConn(), backend.RawConn(), SideClient, SideBackend, "remote -> backend closed", &stats.ClientToBackend, clientToBackendBytes},
+		{backend.BufferedConn(), remote.RawConn(), SideBackend, SideClient, "backend -> remote closed", &stats.BackendToClient, backendToClientBytes},
+	}
+	for _, d := range dirs {
+		defer d.src.SetReadDeadline(time.Time{}) // nolint:errcheck // nolint
+	}
+	buf := make([]byte, 32*1024)
+	last := time.Now()
+	for {
+		for _, d := range dirs {
+			select {
+			case <-quit:
+				return stats, errors.New("relayer is closed")
+			default:
+			}
+			if idleTimeout > 0 && time.Since(last) >= idleTimeout {
+				return stats, ErrIdleTimeout
+			}
+			if err := d.src.SetReadDeadline(time.Now().Add(singleRelayPollInterval)); err != nil {
+				return stats, closedBy(d.srcSide, errors.Wrap(err, d.msg))
+			}
+			n, err := d.src.Read(buf)
+			if n > 0 {
+				last = time.Now()
+				*d.n += int64(n)
+				d.bytes.Add(float64(n))
+				if _, err := d.dst.Write(buf[:n]); err != nil {
+					return stats, copyClosed(d.srcSide, d.dstSide, errors.Wrap(err, d.msg))
+				}
+			}
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					continue
+				}
+				if err == io.EOF {
+					err = nil
+				}
+				return stats, copyClosed(d.srcSide, d.dstSide, errors.Wrap(err, d.msg))
+			}
+		}
+	}
+}
+
+// ErrIdleTimeout is returned by a relay if no data moves in either direction
+// for the idle timeout.
+var ErrIdleTimeout = errors.New("connection is idle for too long")
+
+// idleWatcher detects that a relay is idle in both directions.
+type idleWatcher struct {
+	timeout time.Duration
+	// last is the unix nano time of the last activity.
+	last int64
+	// busy returns true if the relay waits for backend without moving data,
+	// which is not idle. Nil means never busy.
+	busy func() bool
+	done chan struct{}
+}
+
+func newIdleWatcher(timeout time.Duration) *idleWatcher {
+	return &idleWatcher{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+		done:    make(chan struct{}),
+	}
+}
+
+// touch records activity.
+func (w *idleWatcher) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+// watch sends ErrIdleTimeout to errCh once the relay is idle. It returns
+// immediately if there is no timeout.
+func (w *idleWatcher) watch(errCh chan<- error) {
+	if w.timeout <= 0 {
+		return
+	}
+	timer := time.NewTimer(w.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-w.done:
+			return
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+		if idle >= w.timeout && w.busy != nil && w.busy() {
+			w.touch()
+			idle = 0
+		}
+		if idle >= w.timeout {
+			errCh <- ErrIdleTimeout
+			return
+		}
+		timer.Reset(w.timeout - idle)
+	}
+}
+
+func (w *idleWatcher) stop() {
+	close(w.done)
+}
+
+// reader wraps r to record activity on reads.
+func (w *idleWatcher) reader(r io.Reader) io.Reader {
+	if w.timeout <= 0 {
+		return r
+	}
+	return &idleReader{r: r, w: w}
+}
+
+// countingReader adds the bytes read to n and a counter.
+type countingReader struct {
+	r io.Reader
+	n *int64
+	c *metrics.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(r.n, int64(n))
+		r.c.Add(float64(n))
+	}
+	return n, err
+}
+
+type idleReader struct {
+	r io.Reader
+	w *idleWatcher
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.touch()
+	}
+	return n, err
+}
+
+// Sides of a relay.
+const (
+	SideClient  = "client"
+	SideBackend = "backend"
+)
+
+// RelayClosedError is returned by a relay when one of the sides closes the
+// connection or fails.
+type RelayClosedError struct {
+	// Side is the side closing first.
+	Side string
+	// EOF is true if the side closes cleanly.
+	EOF bool
+	Err error
+}
+
+func (e *RelayClosedError) Error() string {
+	if e.Err == nil {
+		return e.Side + " closed"
 	}
+	return e.Err.Error()
+}
+
+func (e *RelayClosedError) Unwrap() error {
+	return e.Err
+}
+
+// Cause implements the causer of github.com/pkg/errors.
+func (e *RelayClosedError) Cause() error {
+	return e.Err
 }
 
+// closedBy attributes err to a side of the relay.
+func closedBy(side string, err error) error {
+	return &RelayClosedError{
+		Side: side,
+		EOF:  errors.Cause(err) == io.EOF,
+		Err:  err,
+	}
+}
+
+// copyClosed attributes the end of copying from src to dst. io.Copy returns
+// nil if src is closed cleanly, and a write error is caused by dst.
+func copyClosed(src, dst string, err error) error {
+	if errors.Cause(err) == nil {
+		return &RelayClosedError{Side: src, EOF: true, Err: err}
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" {
+		return closedBy(dst, err)
+	}
+	return closedBy(src, err)
+}
+
+// Reasons of relay errors, as labels of relayErrorCounter.
+const (
+	reasonClientEOF  = "client_eof"
+	reasonBackendEOF = "backend_eof"
+	reasonSequence   = "sequence"
+	reasonTimeout    = "timeout"
+	reasonOversized  = "oversized"
+	reasonWrite      = "write"
+	reasonDrained    = "drained"
+	reasonQuit       = "quit"
+	reasonOther      = "other"
+)
+
+// relayErrorReason classifies the error ending a relay, so that normal
+// disconnects can be told apart from anomalies.
+func relayErrorReason(err error) string {
+	if mysql.IsNetPacketTooLarge(err) {
+		return reasonOversized
+	}
+	if mysql.IsInvalidSequence(err) {
+		return reasonSequence
+	}
+	switch errors.Cause(err) {
+	case ErrIdleTimeout, ErrMaxDuration, ErrWriteStalled:
+		return reasonTimeout
+	case ErrDrained:
+		return reasonDrained
+	case ErrClientQuit:
+		return reasonQuit
+	}
+	var closed *RelayClosedError
+	if errors.As(err, &closed) && closed.EOF {
+		if closed.Side == SideClient {
+			return reasonClientEOF
+		}
+		return reasonBackendEOF
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return reasonTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "write" {
+		return reasonWrite
+	}
+	return reasonOther
+}
+
+// packetHeaderLen is the length of packet headers, counted as relayed bytes.
+const packetHeaderLen = 4
+
+// RelayStats records statistics of a relay.
+type RelayStats struct {
+	// Commands is the number of commands sent by remote, only counted by
+	// RelayPackets.
+	Commands int64
+	// Rows is the number of result set rows sent by backend, only counted by
+	// RelayPackets with RelayOptions.CountRows.
+	Rows int64
+	// ClientToBackend and BackendToClient are the bytes relayed in each
+	// direction. RelayPackets counts uncompressed packets with headers.
+	ClientToBackend int64
+	BackendToClient int64
+}
+
+func (s *RelayStats) load() RelayStats {
+	return RelayStats{
+		Commands:        atomic.LoadInt64(&s.Commands),
+		ClientToBackend: atomic.LoadInt64(&s.ClientToBackend),
+		BackendToClient: atomic.LoadInt64(&s.BackendToClient),
+	}
+}
+
+// UnknownCommandPolicy decides how the packet relay treats commands it does
+// not know.
+type UnknownCommandPolicy string
+
+// Unknown command policies.
+const (
+	UnknownCommandForward UnknownCommandPolicy = "forward"
+	UnknownCommandLog     UnknownCommandPolicy = "log"
+	UnknownCommandReject  UnknownCommandPolicy = "reject"
+)
+
+// Validate checks whether the policy is known.
+func (p UnknownCommandPolicy) Validate() error {
+	switch p {
+	case "", UnknownCommandForward, UnknownCommandLog, UnknownCommandReject:
+		return nil
+	}
+	return errors.Errorf("invalid unknown command policy %q", p)
+}
+
+// ErrDrained is returned by RelayPackets if the connection is closed because
+// of draining.
+var ErrDrained = errors.New("connection is drained")
+
+// ErrClientQuit is the cause of the RelayClosedError returned by
+// RelayPackets after forwarding COM_QUIT, which is a normal close by client.
+var ErrClientQuit = errors.New("client quits")
+
+// ErrMaxDuration is returned by RelayPackets if the connection is closed
+// because it exceeds the max duration.
+var ErrMaxDuration = errors.New("connection exceeds max duration")
+
+// RelayOptions controls the behavior of RelayPackets.
+type RelayOptions struct {
+	Log                  *zap.SugaredLogger
+	UnknownCommandPolicy UnknownCommandPolicy
+	// Drain is closed when the connection should be closed once no command
+	// is in flight, i.e. immediately if it is idle or after the responses of
+	// the pending commands. If the responses are not understood, it is
+	// closed at the next command boundary.
+	Drain <-chan struct{}
+	// DrainNotice answers the command with ER_SERVER_SHUTDOWN before closing.
+	// Idle connections then wait for their next commands to be answered.
+	DrainNotice bool
+	// QueryComment is prepended to the statement of COM_QUERY.
+	QueryComment string
+	// LogTxnStatus logs when backend status flags show a transaction starts
+	// or ends.
+	LogTxnStatus bool
+	// InterceptPing answers COM_PING with an OK packet without forwarding it
+	// to backend.
+	InterceptPing bool
+	// MaxPreparedStmts answers COM_STMT_PREPARE with
+	// ER_MAX_PREPARED_STMT_COUNT_REACHED if the statements open or being
+	// prepared reach it. 0 means no limit.
+	MaxPreparedStmts int
+	// IdleTimeout makes RelayPackets return ErrIdleTimeout if no packet
+	// moves in either direction for the duration, unless a command waits for
+	// its response. 0 means no timeout.
+	IdleTimeout time.Duration
+	// Deadline makes RelayPackets answer the next command after it with an
+	// error and return ErrMaxDuration. Zero means no deadline.
+	Deadline time.Time
+	// DeadlineErrCode and DeadlineErrMsg are the error answering the command
+	// after Deadline. Zero values mean ER_UNKNOWN_ERROR and a message saying
+	// the connection exceeds max duration.
+	DeadlineErrCode uint16
+	DeadlineErrMsg  string
+	// CommandLatency records the latency of commands to the histogram of
+	// Cluster.
+	CommandLatency bool
+	Cluster        string
+	// LogQueries logs commands sent by remote, sampled by QueryLogSampleRate
+	// which is the fraction of commands logged. Rates outside (0, 1) log
+	// all.
+	LogQueries         bool
+	QueryLogSampleRate float64
+	// WriteStallWarn logs and counts each write to remote blocking for the
+	// duration because the client reads slowly. 0 means no warning.
+	WriteStallWarn time.Duration
+	// WriteStallTimeout makes RelayPackets return ErrWriteStalled if a write
+	// to remote blocks for the duration. 0 means no timeout.
+	WriteStallTimeout time.Duration
+	// CountRows counts rows of result sets in RelayStats.Rows. Rows are no
+	// longer counted once a response is not understood.
+	CountRows bool
+	// Replica receives read-only COM_QUERY statements outside transactions
+	// if not nil, and other commands go to backend. Statements are told
+	// apart by their prefixes on a best-effort basis.
+	Replica *mysql.Conn
+	// ReplicaFailed is called if Replica fails during the relay, after which
+	// every command goes to backend.
+	ReplicaFailed func(err error)
+
+	bufPool *bufferPool
+	// commandHook is called with each command from remote, used by tests to
+	// inject faults.
+	commandHook func(cmd []byte)
+}
+
+// recoverRelay recovers a panic of a relay goroutine and sends it to errCh,
+// so that only the connection is closed. A nil log means the default logger.
+func recoverRelay(log *zap.SugaredLogger, errCh chan<- error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if log == nil {
+		log = utility.GetLogger()
+	}
+	errCh <- handlePanic(log, goroutineRelay, v)
+}
+
+type packetRelay struct {
+	remote  *mysql.Conn
+	backend *mysql.Conn
+	// backendConn is the connection the relay starts with. Session state
+	// like prepared statements lives on it, so it must never change.
+	backendConn net.Conn
+	// replica receives read-only statements if not nil and not down.
+	replica *mysql.Conn
+	// replicaDown is 1 once replica fails. replica is kept, as both loops
+	// use it, and only the flag changes.
+	replicaDown int32
+	// replicaBusy is 1 while a command waits for its response from replica.
+	replicaBusy int32
+	// done is closed once the relay returns, after which failures of
+	// replica are expected.
+	done chan struct{}
+	// pinned is set once the session changes its state, after which
+	// commands are never routed to replica. Only used by the inbound loop.
+	pinned bool
+	// outMu serializes writes to remote by the outbound loops of backend
+	// and replica, and replies of the inbound loop.
+	outMu sync.Mutex
+	opts  *RelayOptions
+	stats RelayStats
+	errCh chan error
+	// pendingCmd is the command waiting for the first packet of its response
+	// plus one, or zero if there is none.
+	pendingCmd int32
+	inTrans    bool
+	// status is the last status flags seen from backend, for answering
+	// intercepted commands.
+	status uint32
+	idle   *idleWatcher
+	// stall is nil if neither write stall threshold is set.
+	stall *stallWatcher
+	// timer follows responses, for command latencies, draining and telling
+	// rows from OK packets.
+	timer *cmdTimer
+	// rnd decides which commands are logged, only used by the inbound loop.
+	rnd *rand.Rand
+}
+
+// maxLoggedQueryLen is the max length of statements in query logs.
+const maxLoggedQueryLen = 1024
+
+// errBackendSwitched is returned if the backend connection changes during
+// the relay.
+var errBackendSwitched = errors.New("backend connection is switched")
+
 // RelayPacketes relays packets between remote and backend.
-func RelayPackets(remote, backend *mysql.Conn, quit <-chan struct{}) error {
+func RelayPackets(remote, backend *mysql.Conn, opts *RelayOptions, quit <-chan struct{}) (RelayStats, error) {
+	if opts == nil {
+		opts = &RelayOptions{}
+	}
+	if opts.Log == nil {
+		opts.Log = zap.NewNop().Sugar()
+	}
 	remote.SetResetOption(mysql.SeqResetBoth)
 	backend.SetResetOption(mysql.SeqResetBoth)
-	errCh := make(chan error, 2) // nolint:gomnd // nolint
-	go copyInboundPackets(remote, backend, errCh)
-	go copyOutboundPackets(remote, backend, errCh)
-	select {
-	case err := <-errCh:
-		return err
-	case <-quit:
-		return errors.New("relayer is closed")
+	r := &packetRelay{
+		remote:      remote,
+		backend:     backend,
+		backendConn: backend.RawConn(),
+		replica:     opts.Replica,
+		done:        make(chan struct{}),
+		opts:        opts,
+		errCh:       make(chan error, 5), // nolint:gomnd // nolint
+		idle:        newIdleWatcher(opts.IdleTimeout),
+		stall:       newStallWatcher(opts.WriteStallWarn, opts.WriteStallTimeout),
+		status:      uint32(mysql.ServerStatusAutocommit),
+	}
+	// drain closes idle connections without waiting for commands.
+	var drain <-chan struct{}
+	if !opts.DrainNotice {
+		drain = opts.Drain
+	}
+	r.timer = newCmdTimer(opts.Cluster, backend, opts.CommandLatency)
+	r.idle.busy = r.timer.busy
+	if opts.LogQueries && opts.QueryLogSampleRate > 0 && opts.QueryLogSampleRate < 1 {
+		r.rnd = rand.New(rand.NewSource(time.Now().UnixNano())) // nolint:gosec // nolint
+	}
+	defer r.idle.stop()
+	defer r.stall.stop()
+	defer close(r.done)
+	if r.replica != nil {
+		r.replica.SetResetOption(mysql.SeqResetBoth)
+	}
+	go r.copyInboundPackets()
+	go r.copyOutboundPackets(backend)
+	if r.replica != nil {
+		go r.copyOutboundPackets(r.replica)
+	}
+	go r.idle.watch(r.errCh)
+	go r.stall.watch(r.opts.Log, r.errCh)
+	for {
+		select {
+		case err := <-r.errCh:
+			return r.loadStats(), err
+		case <-quit:
+			return r.loadStats(), errors.New("relayer is closed")
+		case <-drain:
+			// Busy connections are closed by copyOutboundPackets once
+			// idle.
+			drain = nil
+			if r.timer.drain() {
+				return r.loadStats(), ErrDrained
+			}
+		}
 	}
 }
 
-func copyInboundPackets(remote, backend *mysql.Conn, errCh chan error) {
-	var b bytes.Buffer
+func (r *packetRelay) loadStats() RelayStats {
+	stats := r.stats.load()
+	if r.opts.CountRows {
+		stats.Rows = r.timer.rowCount()
+	}
+	return stats
+}
+
+func (r *packetRelay) copyInboundPackets() {
+	defer recoverRelay(r.opts.Log, r.errCh)
+	remote, backend := r.remote, r.backend
+	// dst is the connection the current command is forwarded to.
+	dst := backend
+	// noResponse is true if the current command has no response.
+	var noResponse bool
+	b := r.opts.bufPool.get()
+	defer r.opts.bufPool.put(b)
 	for {
 		b.Reset()
-		_, err := remote.ReadPartialPacket(&b)
+		n, err := remote.ReadPartialPacket(b)
 		if err != nil {
-			errCh <- errors.Wrap(err, "read from remote failed")
+			if mysql.IsNetPacketTooLarge(err) {
+				_ = r.replyErr(mysql.ErrCodeNetPacketTooLarge, errMsgNetPacketTooLarge)
+			}
+			r.errCh <- closedBy(SideClient, errors.Wrap(err, "read from remote failed"))
 			return
 		}
-		backend.SetResetOption(mysql.SeqResetOnWrite)
-		err = backend.WritePacket(b.Bytes())
+		r.idle.touch()
+		atomic.AddInt64(&r.stats.ClientToBackend, int64(n+packetHeaderLen))
+		clientToBackendBytes.Add(float64(n + packetHeaderLen))
+		// The first packet after the sequence is reset starts a new command.
+		if remote.Sequence() == 1 && b.Len() > 0 {
+			if r.opts.commandHook != nil {
+				r.opts.commandHook(b.Bytes())
+			}
+			forward, err := r.handleCommand(b.Bytes())
+			if err != nil {
+				r.errCh <- err
+				return
+			}
+			if !forward {
+				continue
+			}
+			noResponse = b.Bytes()[0] == mysql.ComStmtClose || b.Bytes()[0] == mysql.ComStmtSendLongData
+			dst = backend
+			if r.toReplica(b.Bytes()) {
+				dst = r.replica
+				atomic.StoreInt32(&r.replicaBusy, 1)
+			}
+			if backend.RawConn() != r.backendConn {
+				r.errCh <- errBackendSwitched
+				return
+			}
+			if r.trackStatus() && dst == backend {
+				atomic.StoreInt32(&r.pendingCmd, int32(b.Bytes()[0])+1)
+			}
+			if !r.timer.start(b.Bytes()) {
+				r.errCh <- r.drained()
+				return
+			}
+			if r.opts.LogQueries && (r.rnd == nil || r.rnd.Float64() < r.opts.QueryLogSampleRate) {
+				r.logQuery(b.Bytes())
+			}
+			dst.SetResetOption(mysql.SeqResetOnWrite)
+			if b.Bytes()[0] == mysql.ComQuery && r.opts.QueryComment != "" {
+				err = r.injectQueryComment(dst, b, n)
+				var closed *RelayClosedError
+				if dst == r.replica && errors.As(err, &closed) && closed.Side == SideBackend {
+					r.failReplica(err)
+					continue
+				}
+				if err != nil {
+					r.errCh <- err
+					return
+				}
+				continue
+			}
+		}
+		// The rest of a command to a failed replica is dropped, as its
+		// error is already sent.
+		if dst == r.replica && atomic.LoadInt32(&r.replicaDown) == 1 {
+			continue
+		}
+		// Backend closes the connection after COM_QUIT, so the relay ends
+		// once it is forwarded instead of reporting the close as an error.
+		quit := remote.Sequence() == 1 && b.Len() > 0 && b.Bytes()[0] == mysql.ComQuit
+		err = dst.WritePacket(b.Bytes())
 		if err == nil {
-			err = backend.Flush()
+			err = dst.Flush()
+		}
+		if err != nil && dst == r.replica {
+			r.failReplica(errors.Wrap(err, "write to replica failed"))
+			continue
 		}
 		if err != nil {
-			errCh <- errors.Wrap(err, "write to backend failed")
+			r.errCh <- closedBy(SideBackend, errors.Wrap(err, "write to backend failed"))
 			return
 		}
+		if quit {
+			r.errCh <- &RelayClosedError{Side: SideClient, EOF: true, Err: ErrClientQuit}
+			return
+		}
+		// No response resets the sequence, so the next command starts a new
+		// one once this command is forwarded.
+		if noResponse && n < mysql.MaxPayloadLen {
+			r.outMu.Lock()
+			remote.SetResetOption(mysql.SeqResetOnRead)
+			r.outMu.Unlock()
+		}
+	}
+}
+
+// handleCommand inspects a command sent by remote. It returns false if the
+// command is answered by the relay and must not be forwarded to backend.
+func (r *packetRelay) handleCommand(data []byte) (bool, error) {
+	atomic.AddInt64(&r.stats.Commands, 1)
+	select {
+	case <-r.opts.Drain:
+		return false, r.drained()
+	default:
+	}
+	if !r.opts.Deadline.IsZero() && time.Now().After(r.opts.Deadline) {
+		code, msg := uint16(mysql.ErrCodeUnknown), "Connection exceeds max duration"
+		if r.opts.DeadlineErrCode != 0 {
+			code = r.opts.DeadlineErrCode
+		}
+		if r.opts.DeadlineErrMsg != "" {
+			msg = r.opts.DeadlineErrMsg
+		}
+		if err := r.replyErr(code, msg); err != nil {
+			return false, errors.Wrap(err, "write to remote failed")
+		}
+		return false, ErrMaxDuration
+	}
+	cmd := data[0]
+	if cmd >= mysql.ComEnd {
+		switch r.opts.UnknownCommandPolicy {
+		case UnknownCommandLog:
+			r.opts.Log.Warnw("forward unknown command", "cmd", cmd)
+		case UnknownCommandReject:
+			r.opts.Log.Warnw("reject unknown command", "cmd", cmd)
+			err := r.replyErr(mysql.ErrCodeUnknownCom, "Unknown command")
+			return false, errors.Wrap(err, "write to remote failed")
+		}
+	}
+	if cmd == mysql.ComPing && r.opts.InterceptPing {
+		return false, errors.Wrap(r.replyOK(), "write to remote failed")
+	}
+	if cmd == mysql.ComStmtPrepare && r.opts.MaxPreparedStmts > 0 {
+		if n, ok := r.timer.preparedStmts(); ok && n >= r.opts.MaxPreparedStmts {
+			r.opts.Log.Warnw("reject prepare beyond max prepared statements", "stmts", n)
+			msg := fmt.Sprintf("Can't create more than max_prepared_stmt_count statements (current value: %d)", r.opts.MaxPreparedStmts)
+			err := r.replyErr(mysql.ErrCodeMaxPreparedStmtCountReached, msg)
+			return false, errors.Wrap(err, "write to remote failed")
+		}
 	}
+	return true, nil
 }
 
-func copyOutboundPackets(remote, backend *mysql.Conn, errCh chan error) {
-	var totalBytes int64
-	var b bytes.Buffer
+// drained answers a command refused by draining if DrainNotice is set, and
+// returns ErrDrained.
+func (r *packetRelay) drained() error {
+	if r.opts.DrainNotice {
+		if err := r.replyErr(mysql.ErrCodeServerShutdown, "Server shutdown in progress"); err != nil {
+			return errors.Wrap(err, "write to remote failed")
+		}
+	}
+	return ErrDrained
+}
+
+// logQuery logs a command sent by remote. data is the first chunk of it.
+func (r *packetRelay) logQuery(data []byte) {
+	switch data[0] {
+	case mysql.ComQuery, mysql.ComStmtPrepare:
+		query := data[1:]
+		if len(query) > maxLoggedQueryLen {
+			query = query[:maxLoggedQueryLen]
+		}
+		r.opts.Log.Infow("query", "cmd", data[0], "sql", string(query))
+	default:
+		r.opts.Log.Infow("query", "cmd", data[0])
+	}
+}
+
+// injectQueryComment prepends the comment to a COM_QUERY and forwards it to
+// dst. b holds the first wire packet of the command with n bytes payload.
+func (r *packetRelay) injectQueryComment(dst *mysql.Conn, b *bytes.Buffer, n int) error {
+	if n == mysql.MaxPayloadLen {
+		// Read the rest of the command, it is split again after the comment
+		// is injected.
+		if err := r.remote.ReadPacket(b); err != nil {
+			return closedBy(SideClient, errors.Wrap(err, "read from remote failed"))
+		}
+		// The rest is not counted by the inbound loop.
+		rest := b.Len() - n
+		rest += (rest/mysql.MaxPayloadLen + 1) * packetHeaderLen
+		atomic.AddInt64(&r.stats.ClientToBackend, int64(rest))
+		clientToBackendBytes.Add(float64(rest))
+	}
+	data := make([]byte, 0, b.Len()+len(r.opts.QueryComment))
+	data = append(data, mysql.ComQuery)
+	data = append(data, r.opts.QueryComment...)
+	data = append(data, b.Bytes()[1:]...)
+	for {
+		n := len(data)
+		if n > mysql.MaxPayloadLen {
+			n = mysql.MaxPayloadLen
+		}
+		if err := dst.WritePacket(data[:n]); err != nil {
+			return closedBy(SideBackend, errors.Wrap(err, "write to backend failed"))
+		}
+		data = data[n:]
+		// A payload of exactly MaxPayloadLen is followed by an empty packet.
+		if n < mysql.MaxPayloadLen {
+			break
+		}
+	}
+	if err := dst.Flush(); err != nil {
+		return closedBy(SideBackend, errors.Wrap(err, "write to backend failed"))
+	}
+	return nil
+}
+
+// replyErr answers the current command of remote with an error packet.
+func (r *packetRelay) replyErr(code uint16, msg string) error {
+	// The reply continues the sequence of the command, and the next command
+	// starts a new one.
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	r.remote.SetResetOption(mysql.SeqResetNone)
+	err := sendErrCode(r.remote, code, msg)
+	r.remote.SetResetOption(mysql.SeqResetOnRead)
+	return err
+}
+
+// replyStatusFlags are the status flags of backend carried by replyOK. The
+// others describe the response they come with, e.g. the last status may be of
+// the first OK of a multi-statement response, with
+// SERVER_MORE_RESULTS_EXISTS set.
+const replyStatusFlags = mysql.ServerStatusInTrans | mysql.ServerStatusAutocommit | mysql.ServerStatusInTransReadonly
+
+// replyOK answers the current command of remote with an OK packet carrying
+// the last status flags of backend.
+func (r *packetRelay) replyOK() error {
+	ok := &mysql.OK{
+		Header:      mysql.HeaderOK,
+		StatusFlags: uint16(atomic.LoadUint32(&r.status)) & replyStatusFlags,
+		Capability:  r.remote.Capability(),
+	}
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	r.remote.SetResetOption(mysql.SeqResetNone)
+	err := r.remote.SendPacket(ok)
+	r.remote.SetResetOption(mysql.SeqResetOnRead)
+	return err
+}
+
+// copyOutboundPackets relays responses from backend, which is either the
+// backend or the replica of the relay.
+func (r *packetRelay) copyOutboundPackets(backend *mysql.Conn) {
+	defer recoverRelay(r.opts.Log, r.errCh)
+	remote := r.remote
+	// partial is true if the last chunk read is followed by more chunks of
+	// the same packet.
+	var partial bool
+	// drained is true if the connection is draining and the packet being
+	// read ends the last pending response.
+	var drained bool
+	b := r.opts.bufPool.get()
+	defer r.opts.bufPool.put(b)
 	for {
 		b.Reset()
-		n, err := backend.ReadPartialPacket(&b)
-		if err != nil {
-			errCh <- errors.Wrap(err, "read from backend failed")
+		n, err := backend.ReadPartialPacket(b)
+		if err != nil && backend == r.replica {
+			r.failReplica(errors.Wrap(err, "read from replica failed"))
 			return
 		}
-		totalBytes += int64(n)
-		remote.SetResetOption(mysql.SeqResetOnRead)
-		err = remote.WritePacket(b.Bytes())
 		if err != nil {
-			errCh <- errors.Wrap(err, "write to remote failed")
+			r.errCh <- closedBy(SideBackend, errors.Wrap(err, "read from backend failed"))
 			return
 		}
-		if b.Len() == 0 ||
-			b.Bytes()[0] == mysql.HeaderOK ||
-			b.Bytes()[0] == mysql.HeaderEOF ||
-			b.Bytes()[0] == mysql.HeaderErr {
+		if backend == r.replica && !partial && atomic.LoadInt32(&r.replicaBusy) == 0 {
+			// E.g. the error a replica sends before closing the connection
+			// on wait_timeout, which the client does not expect.
+			r.failReplica(errors.New("unexpected packet from replica"))
+			return
+		}
+		r.idle.touch()
+		atomic.AddInt64(&r.stats.BackendToClient, int64(n+packetHeaderLen))
+		backendToClientBytes.Add(float64(n + packetHeaderLen))
+		// The transaction status only comes from backend.
+		if r.trackStatus() && backend == r.backend {
+			r.trackTxnStatus(b.Bytes())
+		}
+		r.outMu.Lock()
+		// header is false if the packet does not start with a header, for
+		// rows of result sets and chunks following the first one.
+		header := false
+		if !partial {
+			var rows bool
+			drained, rows = r.timer.packet(b.Bytes())
+			header = !rows
+			// The response ends before the client can send the next
+			// command, so the flag is not cleared after being set for it.
+			if backend == r.replica && r.timer.responded() {
+				atomic.StoreInt32(&r.replicaBusy, 0)
+			}
+		}
+		partial = n == mysql.MaxPayloadLen
+		remote.SetResetOption(mysql.SeqResetOnRead)
+		r.stall.begin()
+		err = remote.WritePacket(b.Bytes())
+		if err == nil && (b.Len() == 0 || drained || header &&
+			(b.Bytes()[0] == mysql.HeaderOK ||
+				backend.IsEOFPacket(b.Bytes()) ||
+				b.Bytes()[0] == mysql.HeaderErr)) {
 			err = remote.Flush()
 			// if first byte is other value, it means it is paritial
 			// result and there will be more packets so we don't
 			// need to flush.
 		}
+		r.stall.end()
+		r.outMu.Unlock()
 		if err != nil {
-			errCh <- errors.Wrap(err, "write to remote failed")
+			r.errCh <- closedBy(SideClient, errors.Wrap(err, "write to remote failed"))
 			return
 		}
+		if drained && !partial {
+			r.errCh <- ErrDrained
+			return
+		}
+	}
+}
+
+// trackStatus returns whether the status flags of backend are tracked.
+func (r *packetRelay) trackStatus() bool {
+	return r.opts.LogTxnStatus || r.opts.InterceptPing || r.replica != nil
+}
+
+// trackTxnStatus records the status flags in a packet read from backend, and
+// logs transitions of SERVER_STATUS_IN_TRANS if LogTxnStatus is set.
+func (r *packetRelay) trackTxnStatus(data []byte) {
+	cmd := atomic.SwapInt32(&r.pendingCmd, 0) - 1
+	// An OK header only means an OK packet at the start of a response, except
+	// for COM_STMT_PREPARE whose response starts with a different packet.
+	isOK := cmd >= 0 && byte(cmd) != mysql.ComStmtPrepare && len(data) > 0 && data[0] == mysql.HeaderOK
+	if !isOK && !r.backend.IsEOFPacket(data) {
+		return
+	}
+	status, ok := r.backend.StatusFlags(data)
+	if !ok {
+		return
+	}
+	atomic.StoreUint32(&r.status, uint32(status))
+	if !r.opts.LogTxnStatus {
+		return
+	}
+	inTrans := status&mysql.ServerStatusInTrans != 0
+	if inTrans == r.inTrans {
+		return
+	}
+	r.inTrans = inTrans
+	if inTrans {
+		r.opts.Log.Infow("transaction starts", "status", status)
+	} else {
+		r.opts.Log.Infow("transaction ends", "status", status)
 	}
 }
@@ -0,0 +1,724 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type recordedCommands struct {
+	sync.Mutex
+	cmds [][]byte
+}
+
+func (r *recordedCommands) handler(conn *mysql.Conn, cmd []byte) error {
+	r.Lock()
+	r.cmds = append(r.cmds, append([]byte(nil), cmd...))
+	r.Unlock()
+	return writeTestPacket(conn, okPacket)
+}
+
+func (r *recordedCommands) all() [][]byte {
+	r.Lock()
+	defer r.Unlock()
+	return r.cmds
+}
+
+func TestUnknownCommandPolicy(t *testing.T) {
+	bogus := []byte{0x99, 0x01}
+	for _, policy := range []UnknownCommandPolicy{UnknownCommandForward, UnknownCommandLog, UnknownCommandReject} {
+		var rec recordedCommands
+		backend := startMockBackend(t, rec.handler)
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs:       BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			UnknownCommandPolicy: policy,
+		})
+		conn := dialTestGateway(t, gw, "c1.root")
+
+		res := execTestCommand(t, conn, bogus)
+		if policy == UnknownCommandReject {
+			require.Equal(t, byte(mysql.HeaderErr), res[0])
+			require.Equal(t, uint16(mysql.ErrCodeUnknownCom), readTestErr(res).(*testErr).code)
+			require.Empty(t, rec.all())
+			require.Equal(t, 1, logs.FilterMessage("reject unknown command").Len())
+		} else {
+			require.Equal(t, okPacket, res)
+			require.Equal(t, [][]byte{bogus}, rec.all())
+			expected := 0
+			if policy == UnknownCommandLog {
+				expected = 1
+			}
+			require.Equal(t, expected, logs.FilterMessage("forward unknown command").Len())
+		}
+
+		// Known commands are always forwarded.
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+		conn.Close()
+	}
+}
+
+func TestInjectQueryComment(t *testing.T) {
+	var rec recordedCommands
+	backend := startMockBackend(t, rec.handler)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:       BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		QueryCommentTemplate: "gateway: connID={connID} cluster={cluster}",
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	comment := "/* gateway: connID=1 cluster=c1 */ "
+
+	query := append([]byte{mysql.ComQuery}, "select 1"...)
+	require.Equal(t, okPacket, execTestCommand(t, conn, query))
+	prepare := append([]byte{mysql.ComStmtPrepare}, "select ?"...)
+	require.Equal(t, okPacket, execTestCommand(t, conn, prepare))
+	// A query split into multiple packets, which must be split again.
+	large := make([]byte, mysql.MaxPayloadLen+10)
+	large[0] = mysql.ComQuery
+	for i := 1; i < len(large); i++ {
+		large[i] = 'a'
+	}
+	require.Equal(t, okPacket, execTestCommand(t, conn, large))
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	cmds := rec.all()
+	require.Len(t, cmds, 4)
+	require.Equal(t, append([]byte{mysql.ComQuery}, comment+"select 1"...), cmds[0])
+	require.Equal(t, prepare, cmds[1])
+	require.Len(t, cmds[2], len(large)+len(comment))
+	require.Equal(t, append([]byte{mysql.ComQuery}, comment...), cmds[2][:len(comment)+1])
+	require.Equal(t, large[1:], cmds[2][len(comment)+1:])
+	require.Equal(t, []byte{mysql.ComPing}, cmds[3])
+}
+
+// stmtBackend is a backend handler which prepares statements per backend
+// connection, executing a statement unknown to the connection fails.
+type stmtBackend struct {
+	sync.Mutex
+	nextID uint32
+	stmts  map[*mysql.Conn]map[uint32]struct{}
+}
+
+func (s *stmtBackend) handler(conn *mysql.Conn, cmd []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.stmts == nil {
+		s.stmts = make(map[*mysql.Conn]map[uint32]struct{})
+	}
+	if s.stmts[conn] == nil {
+		s.stmts[conn] = make(map[uint32]struct{})
+	}
+	switch cmd[0] {
+	case mysql.ComStmtPrepare:
+		s.nextID++
+		s.stmts[conn][s.nextID] = struct{}{}
+		res := make([]byte, 12)
+		binary.LittleEndian.PutUint32(res[1:], s.nextID)
+		return writeTestPacket(conn, res)
+	case mysql.ComStmtExecute:
+		if _, ok := s.stmts[conn][binary.LittleEndian.Uint32(cmd[1:])]; !ok {
+			return writeTestPacket(conn, []byte{mysql.HeaderErr, 0x13, 0x04, 'U', 'n', 'k', 'n', 'o', 'w', 'n'})
+		}
+	}
+	return writeTestPacket(conn, okPacket)
+}
+
+func (s *stmtBackend) conns() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.stmts)
+}
+
+func TestBackendStickiness(t *testing.T) {
+	for _, countCommands := range []bool{false, true} {
+		var stmts stmtBackend
+		backend := startMockBackend(t, stmts.handler)
+		gw, _ := startTestGateway(t, &Config{
+			BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			CountCommands:  countCommands,
+		})
+
+		var conns []*mysql.Conn
+		var ids []uint32
+		for i := 0; i < 3; i++ {
+			conn := dialTestGateway(t, gw, "c1.root")
+			res := execTestCommand(t, conn, append([]byte{mysql.ComStmtPrepare}, "select ?"...))
+			require.Equal(t, byte(mysql.HeaderOK), res[0])
+			conns = append(conns, conn)
+			ids = append(ids, binary.LittleEndian.Uint32(res[1:]))
+		}
+		for round := 0; round < 3; round++ {
+			for i, conn := range conns {
+				execute := make([]byte, 10)
+				execute[0] = mysql.ComStmtExecute
+				binary.LittleEndian.PutUint32(execute[1:], ids[i])
+				require.Equal(t, okPacket, execTestCommand(t, conn, execute))
+			}
+		}
+		require.Equal(t, len(conns), stmts.conns())
+	}
+}
+
+func TestLogTxnStatus(t *testing.T) {
+	ok := func(status uint16) []byte {
+		return []byte{mysql.HeaderOK, 0, 0, byte(status), byte(status >> 8), 0, 0}
+	}
+	eof := func(status uint16) []byte {
+		return []byte{mysql.HeaderEOF, 0, 0, byte(status), byte(status >> 8)}
+	}
+	inTrans := mysql.ServerStatusAutocommit | mysql.ServerStatusInTrans
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		switch string(cmd[1:]) {
+		case "begin":
+			return writeTestPacket(conn, ok(inTrans))
+		case "select 1":
+			for _, p := range [][]byte{{0x01}, {0x03, 'd', 'e', 'f'}, eof(inTrans), {0x01, '1'}, eof(inTrans)} {
+				if err := writeTestPacket(conn, p); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return writeTestPacket(conn, ok(mysql.ServerStatusAutocommit))
+	})
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		LogTxnStatus:   true,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+
+	query := func(sql string) {
+		execTestCommand(t, conn, append([]byte{mysql.ComQuery}, sql...))
+	}
+	query("set autocommit = 1")
+	require.Equal(t, 0, logs.FilterMessage("transaction starts").Len())
+	query("begin")
+	waitTestLog(t, logs, "transaction starts")
+	query("select 1")
+	for i := 0; i < 4; i++ {
+		var b bytes.Buffer
+		require.NoError(t, conn.ReadPacket(&b))
+	}
+	query("commit")
+	waitTestLog(t, logs, "transaction ends")
+	require.Equal(t, 1, logs.FilterMessage("transaction starts").Len())
+	require.Equal(t, 1, logs.FilterMessage("transaction ends").Len())
+}
+
+func TestRelayClosedBy(t *testing.T) {
+	for _, countCommands := range []bool{false, true} {
+		backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+			if cmd[0] == mysql.ComProcessKill {
+				return errors.New("closed by backend")
+			}
+			return writeTestPacket(conn, okPacket)
+		})
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			CountCommands:  countCommands,
+		})
+
+		conn := dialTestGateway(t, gw, "c1.root")
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+		conn.Close()
+		entry := waitTestLog(t, logs, "connection is closed")
+		require.Equal(t, SideClient, entry.ContextMap()["closedBy"])
+		require.Equal(t, true, entry.ContextMap()["eof"])
+
+		conn = dialTestGateway(t, gw, "c1.root")
+		conn.SetResetOption(mysql.SeqResetOnWrite)
+		require.NoError(t, writeTestPacket(conn, []byte{mysql.ComProcessKill}))
+		require.Eventually(t, func() bool {
+			return logs.FilterMessage("connection is closed").Len() == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		entry = logs.FilterMessage("connection is closed").All()[1]
+		require.Equal(t, SideBackend, entry.ContextMap()["closedBy"])
+		require.Equal(t, true, entry.ContextMap()["eof"])
+	}
+}
+
+func TestClusterIdleTimeout(t *testing.T) {
+	var backends BackendConfigs
+	require.NoError(t, backends.Set("c1=127.0.0.1:4000?idle-timeout=100ms"))
+	require.Equal(t, 100*time.Millisecond, backends[0].IdleTimeout)
+	require.Error(t, backends.Set("c1=127.0.0.1:4000?idle-timeout=1"))
+
+	for _, countCommands := range []bool{false, true} {
+		backend := startMockBackend(t, nil)
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs: BackendConfigs{
+				{ClusterID: "c1", Address: backend.addr(), IdleTimeout: 100 * time.Millisecond},
+				{ClusterID: "c2", Address: backend.addr()},
+			},
+			IdleTimeout:   time.Minute,
+			CountCommands: countCommands,
+		})
+		conn1 := dialTestGateway(t, gw, "c1.root")
+		conn2 := dialTestGateway(t, gw, "c2.root")
+
+		// Activity defers the timeout.
+		for i := 0; i < 3; i++ {
+			require.Equal(t, okPacket, execTestCommand(t, conn1, []byte{mysql.ComPing}))
+			time.Sleep(50 * time.Millisecond)
+		}
+		entry := waitTestLog(t, logs, "connection is closed")
+		require.Equal(t, ErrIdleTimeout.Error(), entry.ContextMap()["err"])
+		var b bytes.Buffer
+		require.Error(t, conn1.ReadPacket(&b))
+
+		// The other cluster uses the global timeout.
+		require.Equal(t, okPacket, execTestCommand(t, conn2, []byte{mysql.ComPing}))
+		require.Equal(t, 1, logs.FilterMessage("connection is closed").Len())
+	}
+}
+
+func TestIdleTimeoutLongQuery(t *testing.T) {
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		if cmd[0] == mysql.ComQuery {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return writeTestPacket(conn, okPacket)
+	})
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		IdleTimeout:    100 * time.Millisecond,
+		CountCommands:  true,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+
+	// A query running longer than the timeout is not idle.
+	require.Equal(t, okPacket, execTestCommand(t, conn, append([]byte{mysql.ComQuery}, "select sleep(1)"...)))
+	require.Equal(t, 0, logs.FilterMessage("connection is closed").Len())
+	// The connection without traffic is closed.
+	entry := waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, ErrIdleTimeout.Error(), entry.ContextMap()["err"])
+	var b bytes.Buffer
+	require.Error(t, conn.ReadPacket(&b))
+}
+
+func TestQueryLogSampling(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	for _, rate := range []float64{-1, 1.5} {
+		_, err := New(nil, &Config{LogQueries: true, QueryLogSampleRate: rate})
+		require.Error(t, err, rate)
+	}
+	// 0 logs all like 1.
+	for _, rate := range []float64{0, 1} {
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs:     BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			LogQueries:         true,
+			QueryLogSampleRate: rate,
+		})
+		conn := dialTestGateway(t, gw, "c1.root")
+		for i := 0; i < 10; i++ {
+			require.Equal(t, okPacket, execTestCommand(t, conn, []byte("\x03select 1")))
+		}
+		entry := waitTestLog(t, logs, "query")
+		require.Equal(t, "select 1", entry.ContextMap()["sql"])
+		require.Equal(t, 10, logs.FilterMessage("query").Len(), rate)
+	}
+
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:     BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		LogQueries:         true,
+		QueryLogSampleRate: 0.1,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	const queries = 2000
+	for i := 0; i < queries; i++ {
+		require.Equal(t, okPacket, execTestCommand(t, conn, []byte("\x03select 1")))
+	}
+	// The expectation is 200 with a standard deviation of about 13.
+	logged := logs.FilterMessage("query").Len()
+	require.Greater(t, logged, 120)
+	require.Less(t, logged, 280)
+}
+
+func TestMaxConnDuration(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:  BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxConnDuration: 200 * time.Millisecond,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	// The connection is closed at the first command after the duration.
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, 0, logs.FilterMessage("connection is closed").Len())
+	err := readTestErr(execTestCommand(t, conn, []byte{mysql.ComPing}))
+	require.EqualError(t, err, "Connection exceeds max duration")
+	entry := waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, ErrMaxDuration.Error(), entry.ContextMap()["err"])
+	var b bytes.Buffer
+	require.Error(t, conn.ReadPacket(&b))
+
+	// The error is configurable, so that clients know the close is intended.
+	gw, _ = startTestGateway(t, &Config{
+		BackendConfigs:         BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxConnDuration:        100 * time.Millisecond,
+		MaxConnDurationErrCode: mysql.ErrCodeServerShutdown,
+		MaxConnDurationErrMsg:  "Connection recycled by gateway",
+	})
+	conn = dialTestGateway(t, gw, "c1.root")
+	time.Sleep(150 * time.Millisecond)
+	err = readTestErr(execTestCommand(t, conn, []byte{mysql.ComPing}))
+	require.Equal(t, uint16(mysql.ErrCodeServerShutdown), err.(*testErr).code)
+	require.EqualError(t, err, "Connection recycled by gateway")
+}
+
+func TestRelayRawBytesSingle(t *testing.T) {
+	client, remote := net.Pipe()
+	backend, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := RelayRawBytesSingle(mysql.NewConn(remote), mysql.NewConn(backend), 0, make(chan struct{}))
+		errCh <- err
+	}()
+
+	buf := make([]byte, 16)
+	for i := 0; i < 3; i++ {
+		_, err := client.Write([]byte("request"))
+		require.NoError(t, err)
+		n, err := io.ReadFull(server, buf[:7])
+		require.NoError(t, err)
+		require.Equal(t, "request", string(buf[:n]))
+
+		_, err = server.Write([]byte("response"))
+		require.NoError(t, err)
+		n, err = io.ReadFull(client, buf[:8])
+		require.NoError(t, err)
+		require.Equal(t, "response", string(buf[:n]))
+	}
+
+	client.Close()
+	var closedErr *RelayClosedError
+	require.ErrorAs(t, <-errCh, &closedErr)
+	require.Equal(t, SideClient, closedErr.Side)
+
+	// The relay stops on quit and idle timeout.
+	_, remote = net.Pipe()
+	backend, _ = net.Pipe()
+	quit := make(chan struct{})
+	close(quit)
+	_, err := RelayRawBytesSingle(mysql.NewConn(remote), mysql.NewConn(backend), 0, quit)
+	require.EqualError(t, err, "relayer is closed")
+	_, err = RelayRawBytesSingle(mysql.NewConn(remote), mysql.NewConn(backend), 50*time.Millisecond, make(chan struct{}))
+	require.Equal(t, ErrIdleTimeout, err)
+}
+
+func TestRelayStats(t *testing.T) {
+	for _, conf := range []*Config{
+		{},
+		{CountCommands: true},
+		{QueryCommentTemplate: "gateway"},
+	} {
+		backend := startMockBackend(t, nil)
+		conf.BackendConfigs = BackendConfigs{{ClusterID: "c1", Address: backend.addr()}}
+		gw, logs := startTestGateway(t, conf)
+		conn := dialTestGateway(t, gw, "c1.root")
+
+		// Commands in single and multiple packets.
+		for _, l := range []int{mysql.MaxPayloadLen + 10, 10} {
+			cmd := make([]byte, l)
+			cmd[0] = mysql.ComQuery
+			require.Equal(t, okPacket, execTestCommand(t, conn, cmd))
+		}
+		conn.Close()
+
+		entry := waitTestLog(t, logs, "connection is closed")
+		fields := entry.ContextMap()
+		require.Equal(t, int64(mysql.MaxPayloadLen+4+10+4+10+4), fields["clientToBackend"])
+		require.Equal(t, int64(2*(4+len(okPacket))), fields["backendToClient"])
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	// The backend streams rows until the client stops reading and the
+	// connection is closed.
+	row := make([]byte, 1<<20)
+	row[0] = 1
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		for {
+			if err := writeTestPacket(conn, row); err != nil {
+				return err
+			}
+		}
+	})
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:    BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		WriteStallWarn:    100 * time.Millisecond,
+		WriteStallTimeout: 500 * time.Millisecond,
+	})
+	warns := writeStallCounter.WithLabelValues(stallWarn).Value()
+	closes := writeStallCounter.WithLabelValues(stallClose).Value()
+	conn := dialTestGateway(t, gw, "c1.root")
+	conn.SetResetOption(mysql.SeqResetOnWrite)
+	require.NoError(t, writeTestPacket(conn, []byte{mysql.ComQuery}))
+
+	// The stall is warned about before the connection is closed.
+	entry := waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, ErrWriteStalled.Error(), entry.ContextMap()["err"])
+	warned := logs.FilterMessage("client reads slowly").Len()
+	require.Greater(t, warned, 0)
+	require.Equal(t, warns+float64(warned), writeStallCounter.WithLabelValues(stallWarn).Value())
+	require.Equal(t, closes+1, writeStallCounter.WithLabelValues(stallClose).Value())
+
+	// The client finds the connection closed after reading what is buffered.
+	var b bytes.Buffer
+	for {
+		b.Reset()
+		if err := conn.ReadPacket(&b); err != nil {
+			break
+		}
+	}
+}
+
+func TestRelayErrorReason(t *testing.T) {
+	// readErr reads a packet with seq from a connection limiting packets to
+	// maxPacket bytes.
+	readErr := func(seq uint8, maxPacket uint64) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			_, _ = client.Write([]byte{10, 0, 0, seq, 'p', 'a', 'y', 'l', 'o', 'a', 'd', '1', '2', '3'})
+		}()
+		conn := mysql.NewConn(server)
+		defer conn.Close()
+		conn.SetMaxAllowedPacket(maxPacket)
+		err := conn.ReadPacket(&bytes.Buffer{})
+		return closedBy(SideClient, errors.Wrap(err, "read from remote failed"))
+	}
+	cases := []struct {
+		err    error
+		reason string
+	}{
+		{closedBy(SideClient, errors.Wrap(io.EOF, "read from remote failed")), reasonClientEOF},
+		{copyClosed(SideBackend, SideClient, nil), reasonBackendEOF},
+		{readErr(1, 1024), reasonSequence},
+		{readErr(0, 4), reasonOversized},
+		{ErrIdleTimeout, reasonTimeout},
+		{ErrWriteStalled, reasonTimeout},
+		{closedBy(SideBackend, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), reasonTimeout},
+		{closedBy(SideClient, errors.Wrap(&net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE}, "write to remote failed")), reasonWrite},
+		{ErrDrained, reasonDrained},
+		{&RelayClosedError{Side: SideClient, EOF: true, Err: ErrClientQuit}, reasonQuit},
+		{errors.New("relayer is closed"), reasonOther},
+	}
+	for i, c := range cases {
+		require.Equal(t, c.reason, relayErrorReason(c.err), "case %d: %v", i, c.err)
+	}
+}
+
+func TestInterceptPing(t *testing.T) {
+	inTrans := mysql.ServerStatusAutocommit | mysql.ServerStatusInTrans
+	var cmds int32
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		atomic.AddInt32(&cmds, 1)
+		return writeTestPacket(conn, []byte{mysql.HeaderOK, 0, 0, byte(inTrans), 0, 0, 0})
+	})
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		InterceptPing:  true,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	require.Equal(t, int32(0), atomic.LoadInt32(&cmds))
+	// The reply carries the last status flags of backend.
+	execTestCommand(t, conn, append([]byte{mysql.ComQuery}, "begin"...))
+	require.Equal(t, int32(1), atomic.LoadInt32(&cmds))
+	require.Equal(t, []byte{mysql.HeaderOK, 0, 0, byte(inTrans), 0, 0, 0}, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	require.Equal(t, int32(1), atomic.LoadInt32(&cmds))
+}
+
+func TestInterceptPingAfterMultiStatements(t *testing.T) {
+	inTrans := mysql.ServerStatusAutocommit | mysql.ServerStatusInTrans
+	more := inTrans | mysql.ServerMoreResultsExists | mysql.ServerSessionStateChanged
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		// The response of "begin; select 1" is two results, of which the
+		// first says more results follow.
+		if err := writeTestPacket(conn, []byte{mysql.HeaderOK, 0, 0, byte(more), byte(more >> 8), 0, 0}); err != nil {
+			return err
+		}
+		return writeTestPacket(conn, []byte{mysql.HeaderOK, 0, 0, byte(inTrans), 0, 0, 0})
+	})
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		InterceptPing:  true,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	execTestCommand(t, conn, append([]byte{mysql.ComQuery}, "begin; select 1"...))
+	var b bytes.Buffer
+	require.NoError(t, conn.ReadPacket(&b))
+
+	// The reply doesn't tell the client that more results follow.
+	require.Equal(t, []byte{mysql.HeaderOK, 0, 0, byte(inTrans), 0, 0, 0}, execTestCommand(t, conn, []byte{mysql.ComPing}))
+}
+
+func TestClientQuit(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		CountCommands:  true,
+	})
+	quits := relayErrorCounter.WithLabelValues(reasonQuit).Value()
+	conn := dialTestGateway(t, gw, "c1.root")
+	conn.SetResetOption(mysql.SeqResetOnWrite)
+	require.NoError(t, writeTestPacket(conn, []byte{mysql.ComQuit}))
+
+	entry := waitTestLog(t, logs, "connection is closed")
+	require.Equal(t, SideClient, entry.ContextMap()["closedBy"])
+	require.Equal(t, true, entry.ContextMap()["eof"])
+	require.NotContains(t, entry.ContextMap(), "err")
+	require.Equal(t, quits+1, relayErrorCounter.WithLabelValues(reasonQuit).Value())
+	// The gateway closes the client connection.
+	var b bytes.Buffer
+	require.Error(t, conn.ReadPacket(&b))
+}
+
+func TestHalfClose(t *testing.T) {
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		time.Sleep(100 * time.Millisecond)
+		return writeTestPacket(conn, okPacket)
+	})
+	for _, halfClose := range []bool{false, true} {
+		gw, logs := startTestGateway(t, &Config{
+			BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+			HalfClose:      halfClose,
+		})
+		conn := dialTestGateway(t, gw, "c1.root")
+		conn.SetResetOption(mysql.SeqResetOnWrite)
+		require.NoError(t, writeTestPacket(conn, []byte{mysql.ComPing}))
+		require.NoError(t, conn.CloseWrite())
+
+		var b bytes.Buffer
+		err := conn.ReadPacket(&b)
+		entry := waitTestLog(t, logs, "connection is closed")
+		require.Equal(t, SideClient, entry.ContextMap()["closedBy"])
+		require.Equal(t, true, entry.ContextMap()["eof"])
+		if !halfClose {
+			require.Error(t, err)
+			continue
+		}
+		// The pending result is relayed after the client shuts down writing.
+		require.NoError(t, err)
+		require.Equal(t, okPacket, b.Bytes())
+	}
+}
+
+func TestRelayBinaryResultSet(t *testing.T) {
+	eof := []byte{mysql.HeaderEOF, 0, 0, 0x02, 0}
+	// Binary rows start with an OK header, followed by the NULL bitmap.
+	rows := [][]byte{{0x00, 0x00, 0x01}, {0x00, 0x00, 0x02}}
+	release := make(chan struct{}, 1)
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		if cmd[0] != mysql.ComStmtExecute {
+			return writeTestPacket(conn, okPacket)
+		}
+		for _, p := range [][]byte{{0x01}, {0x03, 'd', 'e', 'f'}, eof} {
+			if err := writeTestPacket(conn, p); err != nil {
+				return err
+			}
+		}
+		for _, p := range rows {
+			if err := writeTestPacket(conn, p); err != nil {
+				return err
+			}
+		}
+		<-release
+		return writeTestPacket(conn, eof)
+	})
+	t.Cleanup(func() {
+		select {
+		case release <- struct{}{}:
+		default:
+		}
+	})
+	// Packets are relayed when commands are counted.
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		CountCommands:  true,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+
+	require.Equal(t, []byte{0x01}, execTestCommand(t, conn, []byte{mysql.ComStmtExecute, 1, 0, 0, 0, 0, 1, 0, 0, 0}))
+	var b bytes.Buffer
+	for _, p := range [][]byte{{0x03, 'd', 'e', 'f'}, eof} {
+		b.Reset()
+		require.NoError(t, conn.ReadPacket(&b))
+		require.Equal(t, p, b.Bytes())
+	}
+	// Rows are not mistaken for OK packets ending the response, so they are
+	// not flushed before the EOF.
+	read := make(chan []byte)
+	go func() {
+		var b bytes.Buffer
+		if conn.ReadPacket(&b) == nil {
+			read <- b.Bytes()
+		}
+		close(read)
+	}()
+	select {
+	case <-read:
+		require.Fail(t, "rows are flushed before the result ends")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release <- struct{}{}
+	require.Equal(t, rows[0], <-read)
+	for _, p := range [][]byte{rows[1], eof} {
+		b.Reset()
+		require.NoError(t, conn.ReadPacket(&b))
+		require.Equal(t, p, b.Bytes())
+	}
+	// The relay follows the next response.
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+}
+
+func TestMaxPreparedStmts(t *testing.T) {
+	var stmtID uint32
+	backend := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		switch cmd[0] {
+		case mysql.ComStmtPrepare:
+			ok := []byte{mysql.HeaderOK, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+			binary.LittleEndian.PutUint32(ok[1:], atomic.AddUint32(&stmtID, 1))
+			return writeTestPacket(conn, ok)
+		case mysql.ComStmtClose:
+			return nil
+		}
+		return writeTestPacket(conn, okPacket)
+	})
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:   BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxPreparedStmts: 2,
+	})
+	conn := dialTestGateway(t, gw, "c1.root")
+	prepare := append([]byte{mysql.ComStmtPrepare}, "select 1"...)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, byte(mysql.HeaderOK), execTestCommand(t, conn, prepare)[0])
+	}
+	data := execTestCommand(t, conn, prepare)
+	require.Equal(t, byte(mysql.HeaderErr), data[0])
+	require.Equal(t, uint16(mysql.ErrCodeMaxPreparedStmtCountReached), binary.LittleEndian.Uint16(data[1:]))
+	require.Equal(t, uint32(2), atomic.LoadUint32(&stmtID))
+	require.Equal(t, 1, logs.FilterMessage("reject prepare beyond max prepared statements").Len())
+
+	// Closing a statement makes room for another.
+	conn.SetResetOption(mysql.SeqResetOnWrite)
+	require.NoError(t, writeTestPacket(conn, []byte{mysql.ComStmtClose, 1, 0, 0, 0}))
+	require.Equal(t, byte(mysql.HeaderOK), execTestCommand(t, conn, prepare)[0])
+	require.Equal(t, uint32(3), atomic.LoadUint32(&stmtID))
+}
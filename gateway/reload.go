@@ -0,0 +1,196 @@
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+)
+
+// LoadBackendConfigs reads backends from a file with one clusterID=address
+// per line, in the same form as the -backend flag. Empty lines and lines
+// starting with # are ignored.
+func LoadBackendConfigs(path string) (BackendConfigs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	var backends BackendConfigs
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := backends.Set(text); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+	}
+	return backends, errors.WithStack(s.Err())
+}
+
+// connEntry is a connection in the registry.
+type connEntry struct {
+	cluster string
+	// client receives the notice before the connection is closed. It is nil
+	// if the notice can't be framed, e.g. with compression.
+	client  net.Conn
+	closers []func()
+}
+
+// registerConn records a relaying connection so that it can be closed when
+// its cluster is removed.
+func (g *Gateway) registerConn(connID uint32, cluster string, client net.Conn, closers ...func()) {
+	g.connsMu.Lock()
+	defer g.connsMu.Unlock()
+	g.conns[connID] = &connEntry{cluster: cluster, client: client, closers: closers}
+}
+
+func (g *Gateway) unregisterConn(connID uint32) {
+	g.connsMu.Lock()
+	defer g.connsMu.Unlock()
+	delete(g.conns, connID)
+}
+
+// backendConfigs returns the current backends.
+func (g *Gateway) backendConfigs() BackendConfigs {
+	g.connsMu.Lock()
+	defer g.connsMu.Unlock()
+	return g.backends
+}
+
+// ReloadBackends replaces the backends. Connections of clusters which no
+// longer exist are sent an error and closed, while others keep relaying.
+func (g *Gateway) ReloadBackends(backends BackendConfigs) {
+	g.connsMu.Lock()
+	// The default backend is not reloaded.
+	kept := map[string]struct{}{defaultClusterID: {}}
+	for _, b := range backends {
+		kept[strings.ToLower(b.ClusterID)] = struct{}{}
+	}
+	g.backends = backends.withCounters(g.backends)
+	g.limiter.setReserved(backends)
+	g.log.Infow("backends are reloaded", "backend", backends)
+
+	removed := make(map[uint32]*connEntry)
+	for connID, c := range g.conns {
+		if _, ok := kept[strings.ToLower(c.cluster)]; !ok {
+			removed[connID] = c
+			delete(g.conns, connID)
+		}
+	}
+	g.connsMu.Unlock()
+
+	// The notices are written without the lock, as each may block until
+	// rejectWriteTimeout.
+	for connID, c := range removed {
+		g.log.Warnw("close connection of removed cluster", "connID", connID, "cluster", c.cluster)
+		if c.client != nil {
+			sendNotice(c.client, mysql.ErrCodeUnknown, fmt.Sprintf("Cluster %s is removed", c.cluster))
+		}
+		for _, closer := range c.closers {
+			closer()
+		}
+	}
+}
+
+// sendNotice writes an ERR packet to a relaying client outside of its relay.
+// It has sequence 1, so that an idle client reads it as the response to its
+// next command. The notice is best effort: a client in the middle of a
+// response can't parse it anyway, as the connection is closed right after.
+func sendNotice(client net.Conn, code uint16, msg string) {
+	b := mysql.NewBuffer(nil)
+	(&mysql.Err{
+		Header:     mysql.HeaderErr,
+		Code:       code,
+		State:      mysql.UnknownState,
+		Message:    msg,
+		Capability: mysql.DefaultCapability,
+	}).Write(b)
+	payload := b.Bytes()
+	data := make([]byte, 4, 4+len(payload))
+	data[0], data[1], data[2], data[3] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16), 1
+	_ = client.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	_, _ = client.Write(append(data, payload...))
+}
+
+// SetMaxConnections changes Config.MaxConnections at runtime. Connections
+// above the new limit are not closed, but new ones are rejected until the
+// count drops below it. 0 means no limit.
+func (g *Gateway) SetMaxConnections(max int) {
+	g.limiter.setMax(max)
+	g.log.Infow("max connections is changed", "max", max)
+}
+
+// ReloadStatus is the result of the last reload, served at /status.
+type ReloadStatus struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// ReportReload records the result of a reload, e.g. of backends and
+// certificates on SIGHUP. With Config.FailClosedOnReload, a failed reload
+// makes the gateway not ready and reject new connections until a successful
+// one, so that no traffic hits a partially applied config.
+func (g *Gateway) ReportReload(err error) {
+	status := &ReloadStatus{Time: time.Now()}
+	var failed int32
+	if err != nil {
+		status.Error = err.Error()
+		failed = 1
+	}
+	g.connsMu.Lock()
+	g.reload = status
+	g.connsMu.Unlock()
+	if !g.conf.FailClosedOnReload || atomic.SwapInt32(&g.reloadFailed, failed) == failed {
+		return
+	}
+	if err != nil {
+		g.log.Errorw("reload failed, reject new connections until a successful reload", "err", err)
+	} else {
+		g.log.Infow("reload succeeds, accept new connections again")
+	}
+}
+
+// LastReload returns the result of the last reload, or nil if nothing is
+// reloaded.
+func (g *Gateway) LastReload() *ReloadStatus {
+	g.connsMu.Lock()
+	defer g.connsMu.Unlock()
+	return g.reload
+}
+
+// Ready returns why the gateway is not ready for new connections, or nil if
+// it is ready.
+func (g *Gateway) Ready() error {
+	select {
+	case <-g.drain:
+		return errors.New("gateway is draining")
+	default:
+	}
+	if atomic.LoadInt32(&g.reloadFailed) != 0 {
+		if status := g.LastReload(); status != nil {
+			return errors.Errorf("last reload failed: %s", status.Error)
+		}
+	}
+	return nil
+}
+
+// checkReload rejects a newly accepted connection if the gateway fails closed
+// after a failed reload. It returns false if the connection is rejected.
+func (g *Gateway) checkReload(conn net.Conn) bool {
+	if atomic.LoadInt32(&g.reloadFailed) == 0 {
+		return true
+	}
+	// It is not a connection limit, so clients are not told to back off
+	// with ER_CON_COUNT_ERROR.
+	g.rejectConn(conn, mysql.ErrCodeUnknown, "Gateway config reload failed, new connections are rejected until it is fixed")
+	return false
+}
@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadBackendConfigs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends")
+	require.NoError(t, os.WriteFile(path, []byte("# clusters\nc1=127.0.0.1:4000\n\nc2=127.0.0.1:4001?min-conns=2\n"), 0o600))
+	backends, err := LoadBackendConfigs(path)
+	require.NoError(t, err)
+	require.Equal(t, BackendConfigs{
+		{ClusterID: "c1", Address: "127.0.0.1:4000"},
+		{ClusterID: "c2", Address: "127.0.0.1:4001", MinConnections: 2},
+	}, backends)
+
+	require.NoError(t, os.WriteFile(path, []byte("c1=127.0.0.1:4000\nc2\n"), 0o600))
+	_, err = LoadBackendConfigs(path)
+	require.ErrorContains(t, err, ":2")
+}
+
+func TestReloadRemovedCluster(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: backend.addr()},
+			{ClusterID: "c2", Address: backend.addr()},
+		},
+	})
+	conn1 := dialTestGateway(t, gw, "c1.root")
+	conn2 := dialTestGateway(t, gw, "c2.root")
+	require.Equal(t, okPacket, execTestCommand(t, conn2, []byte{mysql.ComPing}))
+
+	gw.ReloadBackends(BackendConfigs{{ClusterID: "c1", Address: backend.addr()}})
+	require.Equal(t, 1, logs.FilterMessage("close connection of removed cluster").Len())
+
+	// The connection of the removed cluster gets an error as the response to
+	// its next command, and is closed.
+	head := make([]byte, 4)
+	_, err := io.ReadFull(conn2.RawConn(), head)
+	require.NoError(t, err)
+	require.Equal(t, byte(1), head[3])
+	data := make([]byte, int(head[0])|int(head[1])<<8|int(head[2])<<16)
+	_, err = io.ReadFull(conn2.RawConn(), data)
+	require.NoError(t, err)
+	require.Equal(t, &testErr{code: mysql.ErrCodeUnknown, msg: "Cluster c2 is removed"}, readTestErr(data))
+	var b bytes.Buffer
+	require.Error(t, conn2.ReadPacket(&b))
+	// Others keep working.
+	require.Equal(t, okPacket, execTestCommand(t, conn1, []byte{mysql.ComPing}))
+	// The removed cluster is no longer routed.
+	_, err = connectTestGateway(gw, "c2.root")
+	require.Error(t, err)
+}
+
+func TestFailClosedOnReload(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:     BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MetricsAddr:        "127.0.0.1:0",
+		FailClosedOnReload: true,
+	})
+	getReady := func() (int, string) {
+		resp, err := http.Get("http://" + gw.MetricsAddr().String() + "/ready")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	conn := dialTestGateway(t, gw, "c1.root")
+	code, _ := getReady()
+	require.Equal(t, http.StatusOK, code)
+
+	gw.ReportReload(errors.New("invalid backend config"))
+	require.Equal(t, 1, logs.FilterMessage("reload failed, reject new connections until a successful reload").Len())
+	require.Equal(t, "invalid backend config", gw.LastReload().Error)
+	code, body := getReady()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Contains(t, body, "invalid backend config")
+	_, err := connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeUnknown), err.(*testErr).code)
+	require.Contains(t, err.Error(), "reload failed")
+	// Established connections keep working.
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+
+	gw.ReportReload(nil)
+	require.Empty(t, gw.LastReload().Error)
+	code, _ = getReady()
+	require.Equal(t, http.StatusOK, code)
+	dialTestGateway(t, gw, "c1.root")
+
+	// Failed reloads are only recorded without fail-closed.
+	gw, _ = startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+	gw.ReportReload(errors.New("invalid backend config"))
+	require.NoError(t, gw.Ready())
+	dialTestGateway(t, gw, "c1.root")
+}
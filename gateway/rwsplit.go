@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+)
+
+// readOnlyPrefixes are the keywords starting statements routed to replicas.
+var readOnlyPrefixes = [][]byte{[]byte("SELECT"), []byte("SHOW"), []byte("DESCRIBE"), []byte("DESC")}
+
+// sessionStatePrefixes are the keywords starting statements that change
+// session state, which the replica would not share.
+var sessionStatePrefixes = [][]byte{[]byte("SET"), []byte("USE"), []byte("PREPARE"), []byte("LOCK"), []byte("CREATE TEMPORARY")}
+
+// lockingReadSuffixes mark SELECT statements that lock rows, which must go
+// to the primary.
+var lockingReadSuffixes = [][]byte{[]byte("FOR UPDATE"), []byte("LOCK IN SHARE MODE"), []byte("FOR SHARE")}
+
+// isReadOnlyQuery returns whether a statement only reads. It matches the
+// first keyword after leading spaces and comments, without parsing the
+// statement, so it is best-effort: e.g. SELECT calling functions that write
+// is taken as read-only.
+func isReadOnlyQuery(sql []byte) bool {
+	sql = skipSpacesAndComments(sql)
+	if !hasKeywordPrefix(sql, readOnlyPrefixes) {
+		return false
+	}
+	upper := bytes.ToUpper(sql)
+	for _, suffix := range lockingReadSuffixes {
+		if bytes.Contains(upper, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// changesSessionState returns whether a command changes session state, such
+// as the current database, variables or character sets. data is the first
+// chunk of the command. Like isReadOnlyQuery, statements are only matched
+// by their first keywords.
+func changesSessionState(data []byte) bool {
+	switch data[0] {
+	case mysql.ComInitDB, mysql.ComChangeUser:
+		return true
+	case mysql.ComQuery:
+		return hasKeywordPrefix(skipSpacesAndComments(data[1:]), sessionStatePrefixes)
+	}
+	return false
+}
+
+// hasKeywordPrefix returns whether sql starts with one of the keywords,
+// ignoring case.
+func hasKeywordPrefix(sql []byte, keywords [][]byte) bool {
+	for _, prefix := range keywords {
+		if len(sql) < len(prefix) || !bytes.EqualFold(sql[:len(prefix)], prefix) {
+			continue
+		}
+		// The keyword must end there, e.g. SELECTED is not SELECT.
+		if len(sql) > len(prefix) && isIdentChar(sql[len(prefix)]) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// skipSpacesAndComments strips leading spaces and /* */ comments.
+func skipSpacesAndComments(sql []byte) []byte {
+	for {
+		sql = bytes.TrimLeft(sql, " \t\r\n")
+		if !bytes.HasPrefix(sql, []byte("/*")) {
+			return sql
+		}
+		end := bytes.Index(sql[2:], []byte("*/"))
+		if end < 0 {
+			return nil
+		}
+		sql = sql[end+4:]
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// toReplica returns whether a command is routed to the replica: a read-only
+// COM_QUERY outside transactions. data is the first chunk of the command.
+// Once the session changes its state, every later command stays on the
+// primary, since the replica would run reads with stale state.
+func (r *packetRelay) toReplica(data []byte) bool {
+	if r.replica == nil || r.pinned || atomic.LoadInt32(&r.replicaDown) == 1 {
+		return false
+	}
+	if changesSessionState(data) {
+		r.pinned = true
+		return false
+	}
+	if data[0] != mysql.ComQuery {
+		return false
+	}
+	// Statements with autocommit off start transactions implicitly.
+	status := uint16(atomic.LoadUint32(&r.status))
+	if status&mysql.ServerStatusInTrans != 0 || status&mysql.ServerStatusAutocommit == 0 {
+		return false
+	}
+	return isReadOnlyQuery(data[1:])
+}
+
+// errMsgReplicaFailed answers the command which waits for the response of a
+// failed replica.
+const errMsgReplicaFailed = "Lost connection to the read replica"
+
+// failReplica marks replica down, so that later commands go to backend, and
+// closes it. The split is best-effort, so the session goes on, and only a
+// command waiting for the response of replica is answered with an error.
+func (r *packetRelay) failReplica(err error) {
+	if !atomic.CompareAndSwapInt32(&r.replicaDown, 0, 1) {
+		return
+	}
+	r.replica.Close()
+	select {
+	case <-r.done:
+		// Closed with the relay.
+		return
+	default:
+	}
+	r.opts.Log.Warnw("replica fails, reads go to primary", "err", err)
+	if r.opts.ReplicaFailed != nil {
+		r.opts.ReplicaFailed(err)
+	}
+	if atomic.LoadInt32(&r.replicaBusy) == 0 {
+		return
+	}
+	e := &mysql.Err{
+		Header:     mysql.HeaderErr,
+		Code:       mysql.ErrCodeUnknown,
+		State:      mysql.UnknownState,
+		Message:    errMsgReplicaFailed,
+		Capability: r.remote.Capability(),
+	}
+	b := mysql.NewBuffer(nil)
+	e.Write(b)
+	// The error ends the response, which may have started with rows.
+	r.outMu.Lock()
+	defer r.outMu.Unlock()
+	r.timer.packet(b.Bytes())
+	r.remote.SetResetOption(mysql.SeqResetOnRead)
+	err = r.remote.WritePacket(b.Bytes())
+	if err == nil {
+		err = r.remote.Flush()
+	}
+	if err != nil {
+		r.errCh <- closedBy(SideClient, errors.Wrap(err, "write to remote failed"))
+	}
+}
+
+// replicaAddr returns the replica address of a cluster if reads are split.
+func (g *Gateway) replicaAddr(clusterID string) string {
+	if !g.conf.EnableRWSplit {
+		return ""
+	}
+	backends := g.backendConfigs()
+	c, _ := backends.get(clusterID)
+	return c.ReplicaAddress
+}
+
+// connectReplica connects to the replica at addr and logs in with the
+// backend credentials, for client whose handshake response to the primary
+// is res.
+func (g *Gateway) connectReplica(connID uint32, addr string, client net.Conn, res mysql.HandshakeResponse) (conn *mysql.Conn, err error) {
+	conn, err = g.connectBackend(normalizeAddr(addr))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	rawConn := conn.RawConn()
+	hs, err := g.startBackendHandshake(conn, client)
+	if err != nil {
+		return nil, err
+	}
+	res.Capability &= hs.Capability
+	if err := g.upgradeBackendTLS(connID, conn, addr, &res); err != nil {
+		return nil, err
+	}
+	data, _, err := loginBackend(conn, &res, g.conf.BackendUser, g.conf.BackendPassword, hs.AuthPluginData, g.conf.BackendPublicKey)
+	if err != nil {
+		return nil, g.backendHandshakeErr(err)
+	}
+	if err := checkOK(data); err != nil {
+		return nil, errors.WithMessage(err, "failed to log in")
+	}
+	if g.conf.BackendHandshakeTimeout > 0 {
+		if err := rawConn.SetDeadline(time.Time{}); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	conn.SetCapability(res.Capability & hs.Capability)
+	return conn, nil
+}
@@ -0,0 +1,201 @@
+package gateway
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	cases := []struct {
+		sql      string
+		readOnly bool
+	}{
+		{"select 1", true},
+		{"  SELECT * from t", true},
+		{"/* comment */ select 1", true},
+		{"show tables", true},
+		{"desc t", true},
+		{"describe t", true},
+		{"select * from t for update", false},
+		{"select * from t lock in share mode", false},
+		{"selected", false},
+		{"update t set a = 1", false},
+		{"insert into t select * from s", false},
+		{"/* unterminated select", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.readOnly, isReadOnlyQuery([]byte(c.sql)), c.sql)
+	}
+}
+
+func TestChangesSessionState(t *testing.T) {
+	query := func(sql string) []byte {
+		return append([]byte{mysql.ComQuery}, sql...)
+	}
+	for _, c := range []struct {
+		cmd     []byte
+		changes bool
+	}{
+		{query("use db"), true},
+		{query(" SET NAMES utf8mb4"), true},
+		{query("/* c */ set @a = 1"), true},
+		{query("create temporary table t (a int)"), true},
+		{query("lock tables t read"), true},
+		{query("create table t (a int)"), false},
+		{query("select 1"), false},
+		{query("settings"), false},
+		{[]byte{mysql.ComInitDB, 'd', 'b'}, true},
+		{[]byte{mysql.ComChangeUser}, true},
+		{[]byte{mysql.ComPing}, false},
+	} {
+		require.Equal(t, c.changes, changesSessionState(c.cmd), string(c.cmd))
+	}
+}
+
+func TestRWSplit(t *testing.T) {
+	inTrans := mysql.ServerStatusAutocommit | mysql.ServerStatusInTrans
+	ok := func(status uint16) []byte {
+		return []byte{mysql.HeaderOK, 0, 0, byte(status), byte(status >> 8), 0, 0}
+	}
+	var mu sync.Mutex
+	var primaryQueries, replicaQueries []string
+	primary := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		mu.Lock()
+		primaryQueries = append(primaryQueries, string(cmd[1:]))
+		mu.Unlock()
+		switch string(cmd[1:]) {
+		case "begin", "select 2", "update t set a = 1":
+			return writeTestPacket(conn, ok(inTrans))
+		}
+		return writeTestPacket(conn, ok(mysql.ServerStatusAutocommit))
+	})
+	replica := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		mu.Lock()
+		replicaQueries = append(replicaQueries, string(cmd[1:]))
+		mu.Unlock()
+		return writeTestPacket(conn, ok(mysql.ServerStatusAutocommit))
+	})
+	var backends BackendConfigs
+	require.NoError(t, backends.Set("c1="+primary.addr()+"?replica="+replica.addr()))
+	require.Equal(t, replica.addr(), backends[0].ReplicaAddress)
+
+	_, err := New(nil, &Config{BackendConfigs: backends, EnableRWSplit: true})
+	require.EqualError(t, err, "read/write split requires a backend user")
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs:  backends,
+		BackendUser:     "gateway",
+		ClientPasswords: map[string]string{"c1.root": "pass"},
+		EnableRWSplit:   true,
+	})
+	conn := dialTestGatewayPassword(t, gw, "c1.root", "pass")
+	query := func(sql string) []byte {
+		return execTestCommand(t, conn, append([]byte{mysql.ComQuery}, sql...))
+	}
+	require.Equal(t, ok(mysql.ServerStatusAutocommit), query("select 1"))
+	query("begin")
+	// Reads in transactions go to the primary.
+	require.Equal(t, ok(inTrans), query("select 2"))
+	query("update t set a = 1")
+	query("commit")
+	query("select 3")
+	query("update t set a = 2")
+
+	// Reads after session state changes stay on the primary.
+	query("use db2")
+	query("select 4")
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"begin", "select 2", "update t set a = 1", "commit", "update t set a = 2", "use db2", "select 4"}, primaryQueries)
+	require.Equal(t, []string{"select 1", "select 3"}, replicaQueries)
+}
+
+func TestRWSplitProxyProtocol(t *testing.T) {
+	primary := startMockBackend(t, nil, mockRecordProxyHeaders())
+	replica := startMockBackend(t, nil, mockRecordProxyHeaders())
+	var backends BackendConfigs
+	require.NoError(t, backends.Set("c1="+primary.addr()+"?replica="+replica.addr()))
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:    backends,
+		BackendUser:       "gateway",
+		ClientPasswords:   map[string]string{"c1.root": "pass"},
+		EnableRWSplit:     true,
+		SendProxyProtocol: true,
+	})
+	conn := dialTestGatewayPassword(t, gw, "c1.root", "pass")
+	require.Equal(t, okPacket, execTestCommand(t, conn, append([]byte{mysql.ComQuery}, "select 1"...)))
+	require.Zero(t, logs.FilterMessage("failed to connect replica, reads go to primary").Len())
+
+	// Both connections tell the address of the client.
+	for _, backend := range []*mockBackend{primary, replica} {
+		src, _ := decodeTestProxyHeader(t, <-backend.proxyHeaders)
+		require.Equal(t, conn.RawConn().LocalAddr().String(), src.String())
+	}
+}
+
+func TestRWSplitReplicaFails(t *testing.T) {
+	okData := []byte{mysql.HeaderOK, 0, 0, byte(mysql.ServerStatusAutocommit), 0, 0, 0}
+	var mu sync.Mutex
+	var primaryQueries []string
+	primary := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		mu.Lock()
+		primaryQueries = append(primaryQueries, string(cmd[1:]))
+		mu.Unlock()
+		return writeTestPacket(conn, okData)
+	})
+	replica := startMockBackend(t, func(conn *mysql.Conn, cmd []byte) error {
+		switch string(cmd[1:]) {
+		case "select crash":
+			return errors.New("replica crashes")
+		case "select timeout":
+			// The replica answers, and then closes the idle connection
+			// on wait_timeout with an error the client doesn't expect.
+			if err := writeTestPacket(conn, okData); err != nil {
+				return err
+			}
+			_ = sendErrCode(conn, 4031, "The client was disconnected by the server because of inactivity.")
+			return errors.New("wait_timeout")
+		}
+		return writeTestPacket(conn, okData)
+	})
+	var backends BackendConfigs
+	require.NoError(t, backends.Set("c1="+primary.addr()+"?replica="+replica.addr()))
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs:  backends,
+		BackendUser:     "gateway",
+		ClientPasswords: map[string]string{"c1.root": "pass"},
+		EnableRWSplit:   true,
+	})
+
+	// The replica fails during a read, which gets an error.
+	conn := dialTestGatewayPassword(t, gw, "c1.root", "pass")
+	query := func(sql string) []byte {
+		return execTestCommand(t, conn, append([]byte{mysql.ComQuery}, sql...))
+	}
+	require.Equal(t, okData, query("select 1"))
+	require.Equal(t, &testErr{code: mysql.ErrCodeUnknown, msg: errMsgReplicaFailed}, readTestErr(query("select crash")))
+	// The session goes on with reads on the primary.
+	require.Equal(t, okData, query("select 2"))
+	require.Equal(t, okData, query("update t set a = 1"))
+	waitTestLog(t, logs, "replica fails, reads go to primary")
+	require.Contains(t, gw.BackendErrors(), replica.addr())
+	require.NotContains(t, gw.BackendErrors(), primary.addr())
+
+	// The replica closes an idle connection.
+	conn = dialTestGatewayPassword(t, gw, "c1.root", "pass")
+	require.Equal(t, okData, query("select timeout"))
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("replica fails, reads go to primary").Len() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, okData, query("select 3"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"select 2", "update t set a = 1", "select 3"}, primaryQueries)
+}
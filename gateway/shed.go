@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+)
+
+// ShedLoad configures rejecting new connections while the gateway is near
+// its resource limits, as the last resort of self-protection.
+type ShedLoad struct {
+	// MaxGoroutines sheds load while the number of goroutines exceeds it. 0
+	// means no limit.
+	MaxGoroutines int
+	// MaxFDRatio sheds load while open file descriptors exceed the ratio of
+	// the soft RLIMIT_NOFILE, e.g. 0.9. 0 means no limit. It is only
+	// supported on Linux.
+	MaxFDRatio float64
+	// Interval is the interval of sampling the usage, 1s by default.
+	Interval time.Duration
+}
+
+func (s ShedLoad) enabled() bool {
+	return s.MaxGoroutines > 0 || s.MaxFDRatio > 0
+}
+
+const defaultShedInterval = time.Second
+
+// sampleResources samples the resource usage every interval until the
+// gateway is stopped or draining, and updates whether to shed load.
+func (g *Gateway) sampleResources() {
+	defer g.bgWG.Done()
+	interval := g.conf.ShedLoad.Interval
+	if interval <= 0 {
+		interval = defaultShedInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		g.updateShedding()
+		select {
+		case <-ticker.C:
+		case <-g.quit:
+			return
+		case <-g.drain:
+			return
+		}
+	}
+}
+
+// updateShedding samples the resource usage once, and logs when shedding
+// starts or stops.
+func (g *Gateway) updateShedding() {
+	conf := g.conf.ShedLoad
+	goroutines := runtime.NumGoroutine()
+	shed := conf.MaxGoroutines > 0 && goroutines > conf.MaxGoroutines
+	fields := []interface{}{"goroutines", goroutines}
+	if conf.MaxFDRatio > 0 {
+		if fds, limit, ok := openFDs(); ok {
+			shed = shed || float64(fds) > conf.MaxFDRatio*float64(limit)
+			fields = append(fields, "fds", fds, "fdLimit", limit)
+		}
+	}
+	var v int32
+	if shed {
+		v = 1
+	}
+	if atomic.SwapInt32(&g.shedding, v) == v {
+		return
+	}
+	if shed {
+		g.log.Warnw("near resource limits, start to shed load", fields...)
+	} else {
+		g.log.Infow("resource usage recovers, stop shedding load", fields...)
+	}
+}
+
+// shedLoad rejects a newly accepted connection if the gateway is shedding
+// load. It returns false if the connection is rejected.
+func (g *Gateway) shedLoad(conn net.Conn) bool {
+	if atomic.LoadInt32(&g.shedding) == 0 {
+		return true
+	}
+	shedConnsCounter.Inc()
+	g.rejectConn(conn, mysql.ErrCodeConCount, "Too many connections")
+	return false
+}
@@ -0,0 +1,26 @@
+package gateway
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFDs returns the number of open file descriptors of the process and the
+// soft RLIMIT_NOFILE.
+func openFDs() (fds int, limit uint64, ok bool) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, false
+	}
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, 0, false
+	}
+	// Not counting the descriptor of dir.
+	return len(names) - 1, rlimit.Cur, true
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package gateway
+
+func openFDs() (fds int, limit uint64, ok bool) {
+	return 0, 0, false
+}
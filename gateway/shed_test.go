@@ -0,0 +1,42 @@
+package gateway
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShedLoad(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	conf := &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		ShedLoad:       ShedLoad{MaxGoroutines: 1, Interval: 10 * time.Millisecond},
+	}
+	gw, logs := startTestGateway(t, conf)
+	waitTestLog(t, logs, "near resource limits, start to shed load")
+	shed := shedConnsCounter.Value()
+	_, err := connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeConCount), err.(*testErr).code)
+	require.Equal(t, shed+1, shedConnsCounter.Value())
+
+	// Connections are accepted below the thresholds.
+	conf.ShedLoad = ShedLoad{MaxGoroutines: runtime.NumGoroutine() + 10000, MaxFDRatio: 0.99, Interval: 10 * time.Millisecond}
+	gw, logs = startTestGateway(t, conf)
+	dialTestGateway(t, gw, "c1.root")
+	require.Zero(t, logs.FilterMessage("near resource limits, start to shed load").Len())
+	require.Equal(t, shed+1, shedConnsCounter.Value())
+}
+
+func TestOpenFDs(t *testing.T) {
+	fds, limit, ok := openFDs()
+	if runtime.GOOS != "linux" {
+		require.False(t, ok)
+		return
+	}
+	require.True(t, ok)
+	require.Greater(t, fds, 0)
+	require.GreaterOrEqual(t, limit, uint64(fds))
+}
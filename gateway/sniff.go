@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"bytes"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+)
+
+// Protocols that clients speak to the MySQL port by mistake, e.g. scanners or
+// misconfigured load balancers.
+const (
+	protocolHTTP = "http"
+	protocolTLS  = "tls"
+)
+
+// sniffLen is the number of bytes inspected, the length of a packet header.
+const sniffLen = 4
+
+// httpMethods are the first sniffLen bytes of HTTP requests. The last one is
+// the HTTP/2 connection preface.
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD"), []byte("POST"), []byte("PUT "), []byte("DELE"),
+	[]byte("OPTI"), []byte("PATC"), []byte("CONN"), []byte("TRAC"), []byte("PRI "),
+}
+
+// sniffProtocol returns the protocol that the first bytes from a client look
+// like, or empty if they may be a MySQL packet. The first packet of a MySQL
+// client has sequence 1, which the HTTP methods never have in the 4th byte,
+// and a handshake response is never as large as the length of at least
+// 64KiB that a TLS record header reads as.
+func sniffProtocol(head []byte) string {
+	if len(head) < sniffLen {
+		return ""
+	}
+	for _, m := range httpMethods {
+		if bytes.Equal(head[:sniffLen], m) {
+			return protocolHTTP
+		}
+	}
+	// A TLS handshake record: content type 22 and version 3.1 to 3.4, i.e.
+	// TLS 1.0 to 1.3. SSL 3.0 is left out, since its version 3.0 reads as a
+	// length of 790 bytes, which a handshake response may have.
+	if head[0] == 0x16 && head[1] == 0x03 && head[2] >= 0x01 && head[2] <= 0x04 {
+		return protocolTLS
+	}
+	return ""
+}
+
+// checkProtocol peeks the first bytes from the client and returns false if
+// the client speaks another protocol, in which case the connection should be
+// closed. Nothing is sent back, since the client has already received the
+// initial handshake, and a response to it would only follow the greeting.
+func (g *Gateway) checkProtocol(conn *mysql.Conn, connID uint32) (bool, error) {
+	head, err := conn.Peek(sniffLen)
+	if err != nil {
+		return false, err
+	}
+	proto := sniffProtocol(head)
+	if proto == "" {
+		return true, nil
+	}
+	g.log.Warnw("client speaks another protocol on the MySQL port", "connID", connID,
+		"protocol", proto, "remoteAddr", conn.RawConn().RemoteAddr().String())
+	return false, nil
+}
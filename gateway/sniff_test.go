@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	for _, c := range []struct {
+		head  []byte
+		proto string
+	}{
+		{[]byte("GET / HTTP/1.1\r\n"), protocolHTTP},
+		{[]byte("POST /"), protocolHTTP},
+		{[]byte("PRI * HTTP/2.0"), protocolHTTP},
+		{[]byte{0x16, 0x03, 0x01, 0x02, 0x00}, protocolTLS},
+		// A handshake response and an SSL request.
+		{[]byte{0x55, 0x00, 0x00, 0x01}, ""},
+		{[]byte{0x20, 0x00, 0x00, 0x01}, ""},
+		// A handshake response of 790 bytes.
+		{[]byte{0x16, 0x03, 0x00, 0x01}, ""},
+		{[]byte{0x16, 0x03, 0x05, 0x01}, ""},
+		{[]byte("GE"), ""},
+	} {
+		require.Equal(t, c.proto, sniffProtocol(c.head), "%q", c.head)
+	}
+}
+
+func TestProtocolConfusion(t *testing.T) {
+	backend := startMockBackend(t, nil)
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+
+	// HTTP clients are disconnected after the initial handshake, which is
+	// sent before the request is read, without anything else.
+	conn, err := net.Dial("tcp", gw.l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Greater(t, len(data), 4)
+	require.Len(t, data, 4+(int(data[0])|int(data[1])<<8|int(data[2])<<16))
+	require.Equal(t, byte(mysql.DefaultHandshakeVersion), data[4])
+	entry := waitTestLog(t, logs, "client speaks another protocol on the MySQL port")
+	require.Equal(t, protocolHTTP, entry.ContextMap()["protocol"])
+
+	// TLS clients are disconnected.
+	conn, err = net.Dial("tcp", gw.l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Error(t, tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()) // nolint:gosec // nolint
+	require.Eventually(t, func() bool {
+		entries := logs.FilterMessage("client speaks another protocol on the MySQL port").All()
+		return len(entries) == 2 && entries[1].ContextMap()["protocol"] == protocolTLS
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 0, logs.FilterMessage("failed to recv handshake response").Len())
+	require.Equal(t, 0, logs.FilterMessage("failed to sniff client protocol").Len())
+
+	// MySQL clients are not affected.
+	dialTestGateway(t, gw, "c1.root")
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/version"
+)
+
+// BackendError is the last error observed on a backend address.
+type BackendError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// backendErrors records the last errors of backend addresses, from dials,
+// health checks and relays.
+type backendErrors struct {
+	mu   sync.Mutex
+	errs map[string]BackendError
+}
+
+func newBackendErrors() *backendErrors {
+	return &backendErrors{errs: make(map[string]BackendError)}
+}
+
+func (e *backendErrors) record(addr string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errs[addr] = BackendError{Time: time.Now(), Message: err.Error()}
+}
+
+func (e *backendErrors) snapshot() map[string]BackendError {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	errs := make(map[string]BackendError, len(e.errs))
+	for addr, err := range e.errs {
+		errs[addr] = err
+	}
+	return errs
+}
+
+// BackendErrors returns the last errors by backend address.
+func (g *Gateway) BackendErrors() map[string]BackendError {
+	return g.backendErrs.snapshot()
+}
+
+// BackendStatus is the status of a backend address served at /status.
+type BackendStatus struct {
+	// Healthy is the result of the last health check, nil if unchecked.
+	Healthy   *bool         `json:"healthy,omitempty"`
+	LastError *BackendError `json:"lastError,omitempty"`
+}
+
+// serveStatus serves the build information and the status of backend
+// addresses as JSON.
+func (g *Gateway) serveStatus(w http.ResponseWriter, _ *http.Request) {
+	backends := make(map[string]BackendStatus)
+	for addr, healthy := range g.BackendHealth() {
+		healthy := healthy
+		addr = normalizeAddr(addr)
+		s := backends[addr]
+		s.Healthy = &healthy
+		backends[addr] = s
+	}
+	for addr, err := range g.BackendErrors() {
+		err := err
+		s := backends[addr]
+		s.LastError = &err
+		backends[addr] = s
+	}
+	status := map[string]interface{}{"version": version.Get(), "backends": backends}
+	if reload := g.LastReload(); reload != nil {
+		status["reload"] = reload
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		g.log.Warnw("failed to write status", "err", err)
+	}
+}
+
+// serveReady answers 200 if the gateway is ready for new connections, or 503
+// with the reason.
+func (g *Gateway) serveReady(w http.ResponseWriter, _ *http.Request) {
+	if err := g.Ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,63 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/version"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeStatus(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{
+			{ClusterID: "c1", Address: deadAddr},
+			{ClusterID: "c2", Address: backend.addr()},
+		},
+		MetricsAddr: "127.0.0.1:0",
+	})
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Error(t, err)
+	dialTestGateway(t, gw, "c2.root")
+
+	resp, err := http.Get("http://" + gw.MetricsAddr().String() + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var status struct {
+		Version  version.Info             `json:"version"`
+		Backends map[string]BackendStatus `json:"backends"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Equal(t, version.Get(), status.Version)
+
+	lastErr := status.Backends[deadAddr].LastError
+	require.NotNil(t, lastErr)
+	require.Contains(t, lastErr.Message, "connection refused")
+	require.WithinDuration(t, time.Now(), lastErr.Time, time.Minute)
+	require.Nil(t, status.Backends[deadAddr].Healthy)
+	require.NotContains(t, status.Backends, backend.addr())
+}
+
+func TestStatusHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+	gw, _ := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: deadAddr}},
+		HealthCheck:    HealthCheck{Interval: 20 * time.Millisecond},
+	})
+	require.Eventually(t, func() bool {
+		return len(gw.BackendErrors()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Contains(t, gw.BackendErrors()[deadAddr].Message, "connection refused")
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tarpit configures delaying the initial handshake to clients from IPs that
+// fail auth repeatedly, which slows down scanning and brute forcing. IPv6
+// addresses are grouped by /64.
+type Tarpit struct {
+	// Failures is the number of recent auth failures of an IP from which its
+	// connections are delayed. 0 disables the tarpit.
+	Failures int
+	// Delay is the delay at Failures, doubled by each further failure up to
+	// MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Decay is the time for one failure to be forgotten, 1m by default.
+	Decay time.Duration
+}
+
+const (
+	defaultTarpitDecay = time.Minute
+	// maxTarpitIPs bounds the IPs tracked. Once exceeded, IPs whose failures
+	// are forgotten are dropped, or the one with the fewest failures if
+	// none is.
+	maxTarpitIPs = 10000
+	// tarpitIPv6PrefixLen groups IPv6 addresses by prefix, since a single
+	// client usually owns a whole /64.
+	tarpitIPv6PrefixLen = 64
+)
+
+type tarpitEntry struct {
+	// failures is the number of recent failures, decayed at last.
+	failures float64
+	last     time.Time
+}
+
+// tarpit tracks recent auth failures by IP.
+type tarpit struct {
+	conf Tarpit
+	mu   sync.Mutex
+	ips  map[string]*tarpitEntry
+}
+
+// newTarpit returns nil if the tarpit is disabled.
+func newTarpit(conf Tarpit) *tarpit {
+	if conf.Failures <= 0 || conf.Delay <= 0 {
+		return nil
+	}
+	if conf.Decay <= 0 {
+		conf.Decay = defaultTarpitDecay
+	}
+	if conf.MaxDelay < conf.Delay {
+		conf.MaxDelay = conf.Delay
+	}
+	return &tarpit{conf: conf, ips: make(map[string]*tarpitEntry)}
+}
+
+// decay forgets the failures older than the decay time.
+func (t *tarpit) decay(e *tarpitEntry, now time.Time) {
+	e.failures -= float64(now.Sub(e.last)) / float64(t.conf.Decay)
+	if e.failures < 0 {
+		e.failures = 0
+	}
+	e.last = now
+}
+
+// fail records an auth failure of addr.
+func (t *tarpit) fail(addr net.Addr) {
+	if t == nil {
+		return
+	}
+	ip := tarpitKey(addr)
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.ips[ip]
+	if !ok {
+		if len(t.ips) >= maxTarpitIPs {
+			t.prune(now)
+		}
+		e = &tarpitEntry{last: now}
+		t.ips[ip] = e
+	}
+	t.decay(e, now)
+	e.failures++
+}
+
+// prune drops IPs whose failures are forgotten. If there are none, it drops
+// the IP with the fewest failures, so that the IPs tracked stay bounded.
+func (t *tarpit) prune(now time.Time) {
+	var fewest string
+	for ip, e := range t.ips {
+		if t.decay(e, now); e.failures == 0 {
+			delete(t.ips, ip)
+		} else if fewest == "" || e.failures < t.ips[fewest].failures {
+			fewest = ip
+		}
+	}
+	if len(t.ips) >= maxTarpitIPs {
+		delete(t.ips, fewest)
+	}
+}
+
+// delay returns how long to delay the handshake to addr.
+func (t *tarpit) delay(addr net.Addr) time.Duration {
+	if t == nil {
+		return 0
+	}
+	ip := tarpitKey(addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.ips[ip]
+	if !ok {
+		return 0
+	}
+	t.decay(e, time.Now())
+	// A partly forgotten failure still counts.
+	excess := int(math.Ceil(e.failures)) - t.conf.Failures
+	if excess < 0 {
+		return 0
+	}
+	d := t.conf.Delay
+	for ; excess > 0 && d < t.conf.MaxDelay; excess-- {
+		d *= 2
+	}
+	if d > t.conf.MaxDelay {
+		d = t.conf.MaxDelay
+	}
+	return d
+}
+
+// tarpitKey returns the IP of addr whose failures are tracked, the /64
+// prefix for IPv6, or addr itself if it has no port.
+func tarpitKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	prefix := net.CIDRMask(tarpitIPv6PrefixLen, 8*net.IPv6len)
+	return ip.Mask(prefix).String() + "/" + strconv.Itoa(tarpitIPv6PrefixLen)
+}
+
+// waitTarpit delays the handshake to a client from an IP failing auth
+// repeatedly. It returns false if the gateway is stopped meanwhile.
+func (g *Gateway) waitTarpit(conn net.Conn, connID uint32) bool {
+	d := g.tarpit.delay(conn.RemoteAddr())
+	if d == 0 {
+		return true
+	}
+	g.log.Infow("delay handshake of client failing auth", "connID", connID, "delay", d)
+	tarpitDelayCounter.Inc()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-g.quit:
+		return false
+	}
+}
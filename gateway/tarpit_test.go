@@ -0,0 +1,75 @@
+package gateway
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarpitDelay(t *testing.T) {
+	tp := newTarpit(Tarpit{Failures: 2, Delay: time.Second, MaxDelay: 3 * time.Second, Decay: time.Minute})
+	ip1 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	ip2 := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	// The delay starts at the threshold, and escalates up to the max.
+	for _, d := range []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		tp.fail(ip1)
+		require.Equal(t, d, tp.delay(&net.TCPAddr{IP: ip1.IP, Port: 2000}))
+	}
+	require.Zero(t, tp.delay(ip2))
+
+	// Failures are forgotten over time.
+	tp.ips[ip1.IP.String()].last = time.Now().Add(-3 * time.Minute)
+	require.Equal(t, time.Second, tp.delay(ip1))
+	tp.ips[ip1.IP.String()].last = time.Now().Add(-time.Minute)
+	require.Zero(t, tp.delay(ip1))
+	tp.prune(time.Now().Add(time.Minute))
+	require.Empty(t, tp.ips)
+
+	require.Nil(t, newTarpit(Tarpit{}))
+}
+
+func TestTarpitBound(t *testing.T) {
+	tp := newTarpit(Tarpit{Failures: 2, Delay: time.Second, Decay: time.Hour})
+	// Addresses in the same IPv6 /64 share failures.
+	tp.fail(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000})
+	tp.fail(&net.TCPAddr{IP: net.ParseIP("2001:db8::ffff:2"), Port: 1000})
+	require.Equal(t, time.Second, tp.delay(&net.TCPAddr{IP: net.ParseIP("2001:db8::3"), Port: 1000}))
+	require.Zero(t, tp.delay(&net.TCPAddr{IP: net.ParseIP("2001:db8:0:1::1"), Port: 1000}))
+
+	// Once full, IPs with the fewest failures are evicted even if their
+	// failures are not forgotten yet.
+	for i := 1; i < maxTarpitIPs; i++ {
+		tp.fail(&net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1000})
+	}
+	require.Len(t, tp.ips, maxTarpitIPs)
+	tp.fail(&net.TCPAddr{IP: net.IPv4(11, 0, 0, 1), Port: 1000})
+	require.Len(t, tp.ips, maxTarpitIPs)
+	require.Contains(t, tp.ips, "2001:db8::/64")
+	require.Contains(t, tp.ips, "11.0.0.1")
+}
+
+func TestTarpit(t *testing.T) {
+	backend := startMockBackend(t, nil, mockRejectUser("bad"))
+	gw, logs := startTestGateway(t, &Config{
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		Tarpit:         Tarpit{Failures: 2, Delay: 200 * time.Millisecond},
+	})
+	delayed := tarpitDelayCounter.Value()
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		_, err := connectTestGateway(gw, "c1.bad")
+		require.Error(t, err)
+		require.Less(t, time.Since(start), 200*time.Millisecond)
+	}
+
+	// Clients from the IP are delayed once it fails repeatedly.
+	start := time.Now()
+	conn := dialTestGateway(t, gw, "c1.root")
+	conn.Close()
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	require.Equal(t, delayed+1, tarpitDelayCounter.Value())
+	require.Equal(t, 1, logs.FilterMessage("delay handshake of client failing auth").Len())
+}
@@ -1,28 +1,46 @@
 package gateway
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"net"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-func loadTLSConfig(ca, cert, key, version string) (*tls.Config, error) {
+// loadTLSConfig builds a TLS config. If verifyClient is set, client
+// certificates are required and verified against clientCA, or ca if it is
+// empty.
+func loadTLSConfig(ca, clientCA, cert, key, version string, verifyClient bool) (*tls.Config, error) {
+	if verifyClient && ca == "" && clientCA == "" {
+		return nil, errors.New("verifying client certificates requires a ca")
+	}
 	if ca == "" && cert == "" && key == "" {
 		return nil, nil
 	}
 
 	var tlsConfig tls.Config
 	if ca != "" {
-		caCert, err := ioutil.ReadFile(ca)
+		caCertPool, err := loadCertPool(ca)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to read ca")
+			return nil, errors.WithMessage(err, "failed to read ca")
 		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
 		tlsConfig.RootCAs = caCertPool
 	}
+	if verifyClient {
+		tlsConfig.ClientCAs = tlsConfig.RootCAs
+		if clientCA != "" {
+			clientCAPool, err := loadCertPool(clientCA)
+			if err != nil {
+				return nil, errors.WithMessage(err, "failed to read client ca")
+			}
+			tlsConfig.ClientCAs = clientCAPool
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 	if cert != "" && key != "" {
 		cert, err := tls.LoadX509KeyPair(cert, key)
 		if err != nil {
@@ -43,3 +61,71 @@ func loadTLSConfig(ca, cert, key, version string) (*tls.Config, error) {
 	}
 	return &tlsConfig, nil
 }
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificate in %s", path)
+	}
+	return pool, nil
+}
+
+// loadBackendTLSConfig builds the TLS config connecting backends, shared by
+// connections. Backend certificates are verified unless InsecureSkipVerify
+// is set.
+func loadBackendTLSConfig(conf BackendTLSConfig) (*tls.Config, error) {
+	tlsConfig, err := loadTLSConfig(conf.CA, "", conf.Cert, conf.Key, "", false)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid backend tls config")
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	tlsConfig.ServerName = conf.ServerName
+	tlsConfig.InsecureSkipVerify = conf.InsecureSkipVerify // nolint: gosec // nolint
+	return tlsConfig, nil
+}
+
+// backendTLSConfig returns the TLS config connecting backend at addr, which
+// verifies the host of addr unless a server name is configured.
+func (g *Gateway) backendTLSConfig(addr string) *tls.Config {
+	if g.backendTLS.ServerName != "" || g.backendTLS.InsecureSkipVerify {
+		return g.backendTLS
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	tlsConfig := g.backendTLS.Clone()
+	tlsConfig.ServerName = host
+	return tlsConfig
+}
+
+// defaultTLSHandshakeTimeout is the default of Config.TLSHandshakeTimeout.
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
+// handshakeTLS runs the TLS handshake of conn. It waits for a slot first if
+// concurrent handshakes are limited by Config.MaxConcurrentTLSHandshakes.
+func (g *Gateway) handshakeTLS(conn *tls.Conn) error {
+	timeout := g.conf.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if g.tlsSem != nil {
+		select {
+		case g.tlsSem <- struct{}{}:
+			defer func() { <-g.tlsSem }()
+		case <-ctx.Done():
+			return errors.Errorf("tls handshake is not started in %s", timeout)
+		case <-g.quit:
+			return errors.New("gateway is stopped")
+		}
+	}
+	return errors.WithStack(conn.HandshakeContext(ctx))
+}
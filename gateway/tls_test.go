@@ -0,0 +1,308 @@
+package gateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	caFile string
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{dir: t.TempDir(), serial: 1}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(ca.serial),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca.cert, err = x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca.key = key
+	ca.caFile = filepath.Join(ca.dir, "ca.pem")
+	writeTestPEM(t, ca.caFile, "CERTIFICATE", der)
+	return ca
+}
+
+// issue creates a certificate valid for localhost signed by the CA.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name) (certFile, keyFile string) {
+	ca.serial++
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	name := subject.CommonName + "-" + big.NewInt(ca.serial).String()
+	certFile = filepath.Join(ca.dir, name+".pem")
+	keyFile = filepath.Join(ca.dir, name+"-key.pem")
+	writeTestPEM(t, certFile, "CERTIFICATE", der)
+	writeTestPEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func (ca *testCA) serverConfig(t *testing.T) *tls.Config {
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "localhost"})
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+func writeTestPEM(t *testing.T, path, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+func TestMaxConcurrentTLSHandshakes(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "gateway"})
+	backend := startMockBackend(t, nil)
+	gw, _ := startTestGateway(t, &Config{
+		TLS:                        TLSConfig{Cert: certFile, Key: keyFile},
+		BackendConfigs:             BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxConcurrentTLSHandshakes: 1,
+	})
+
+	// A client requesting TLS but never completing the handshake holds the
+	// only slot.
+	rawConn, err := net.Dial("tcp", gw.l.Addr().String())
+	require.NoError(t, err)
+	stalled := mysql.NewConn(rawConn)
+	var hs mysql.Handshake
+	require.NoError(t, stalled.RecvPacket(&hs))
+	res := newTestHandshakeResponse("c1.root")
+	res.Capability |= mysql.ClientSSL
+	require.NoError(t, stalled.SendPacket((*mysql.SSLRequest)(res)))
+
+	connected := make(chan error, 1)
+	go func() {
+		conn, err := connectTestGatewayWith(gw, res)
+		if err == nil {
+			conn.Close()
+		}
+		connected <- err
+	}()
+	select {
+	case err := <-connected:
+		t.Fatalf("tls handshake is not queued, err: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	stalled.Close()
+	select {
+	case err := <-connected:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued tls handshake is not resumed")
+	}
+
+	// Stalled handshakes time out and release the slot.
+	gw, logs := startTestGateway(t, &Config{
+		TLS:                        TLSConfig{Cert: certFile, Key: keyFile},
+		BackendConfigs:             BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		MaxConcurrentTLSHandshakes: 1,
+		TLSHandshakeTimeout:        200 * time.Millisecond,
+	})
+	rawConn, err = net.Dial("tcp", gw.l.Addr().String())
+	require.NoError(t, err)
+	defer rawConn.Close()
+	stalled = mysql.NewConn(rawConn)
+	require.NoError(t, stalled.RecvPacket(&hs))
+	require.NoError(t, stalled.SendPacket((*mysql.SSLRequest)(res)))
+	waitTestLog(t, logs, "failed to upgrade to tls connection")
+	conn, err := connectTestGatewayWith(gw, res)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestBackendTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "gateway"})
+	// The backend requires client certificates signed by the CA as well.
+	backendConf := ca.serverConfig(t)
+	backendConf.ClientCAs = x509.NewCertPool()
+	backendConf.ClientCAs.AddCert(ca.cert)
+	backendConf.ClientAuth = tls.RequireAndVerifyClientCert
+	backend := startMockTLSBackend(t, backendConf, nil)
+
+	cases := []struct {
+		conf BackendTLSConfig
+		ok   bool
+	}{
+		{BackendTLSConfig{CA: ca.caFile, Cert: certFile, Key: keyFile}, true},
+		// The backend certificate is not signed by the system roots.
+		{BackendTLSConfig{Cert: certFile, Key: keyFile}, false},
+		{BackendTLSConfig{CA: ca.caFile, Cert: certFile, Key: keyFile, ServerName: "tidb.example.com"}, false},
+		// The backend requires a client certificate.
+		{BackendTLSConfig{CA: ca.caFile}, false},
+		{BackendTLSConfig{Cert: certFile, Key: keyFile, InsecureSkipVerify: true}, true},
+	}
+	for i, c := range cases {
+		gw, _ := startTestGateway(t, &Config{
+			TLS:            TLSConfig{Cert: certFile, Key: keyFile},
+			BackendTLS:     c.conf,
+			BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		})
+		res := newTestHandshakeResponse("c1.root")
+		res.Capability |= mysql.ClientSSL
+		conn, err := connectTestGatewayWith(gw, res)
+		if c.ok {
+			require.NoError(t, err, "case %d", i)
+			require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+			conn.Close()
+			continue
+		}
+		require.Error(t, err, "case %d", i)
+	}
+
+	_, err := New(nil, &Config{BackendTLS: BackendTLSConfig{CA: filepath.Join(ca.dir, "missing.pem")}})
+	require.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, pkix.Name{CommonName: "old"})
+	r, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "old", leaf.Subject.CommonName)
+
+	// Renew the certificate in place.
+	newCert, newKey := ca.issue(t, pkix.Name{CommonName: "new"})
+	require.NoError(t, os.Rename(newCert, certFile))
+	require.NoError(t, os.Rename(newKey, keyFile))
+	require.NoError(t, r.Reload())
+	cert, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	require.Equal(t, "new", leaf.Subject.CommonName)
+
+	// A failed reload keeps the current certificate.
+	require.NoError(t, os.WriteFile(certFile, []byte("invalid"), 0o600))
+	require.Error(t, r.Reload())
+	reloaded, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, cert, reloaded)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	serverCA, clientCA, otherCA := newTestCA(t), newTestCA(t), newTestCA(t)
+	certFile, keyFile := serverCA.issue(t, pkix.Name{CommonName: "gateway"})
+	backend := startMockBackend(t, nil)
+	_, err := New(nil, &Config{TLS: TLSConfig{Cert: certFile, Key: keyFile, MatchUserCN: true}})
+	require.Error(t, err)
+	var sink recordingSink
+	gw, logs := startTestGateway(t, &Config{
+		TLS: TLSConfig{
+			CA:           serverCA.caFile,
+			ClientCA:     clientCA.caFile,
+			Cert:         certFile,
+			Key:          keyFile,
+			VerifyClient: true,
+			MatchUserCN:  true,
+		},
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+		EventSink:      &sink,
+	})
+	clientConfig := func(ca *testCA, cn string) *tls.Config {
+		certFile, keyFile := ca.issue(t, pkix.Name{CommonName: cn})
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		require.NoError(t, err)
+		return &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true} // nolint: gosec // nolint
+	}
+	res := func(user string) *mysql.HandshakeResponse {
+		res := newTestHandshakeResponse(user)
+		res.Capability |= mysql.ClientSSL
+		return res
+	}
+
+	// Certificates signed by the client CA whose CN is the user are accepted.
+	conn, err := connectTestGatewayTLS(gw, res("c1.root"), clientConfig(clientCA, "root"))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, okPacket, execTestCommand(t, conn, []byte{mysql.ComPing}))
+	sink.Lock()
+	require.Equal(t, EventAuthOK, sink.events[1].Type)
+	require.Equal(t, "root", sink.events[1].CertCN)
+	sink.Unlock()
+
+	// Certificates of other users are denied.
+	_, err = connectTestGatewayTLS(gw, res("c1.admin"), clientConfig(clientCA, "root"))
+	require.Equal(t, uint16(mysql.ErrCodeAccessDenied), err.(*testErr).code)
+	require.ErrorContains(t, err, "user admin does not match client certificate CN root")
+
+	// Missing certificates and ones of untrusted CAs fail the TLS handshake,
+	// including the CA of the gateway certificate.
+	_, err = connectTestGatewayTLS(gw, res("c1.root"), &tls.Config{InsecureSkipVerify: true}) // nolint: gosec // nolint
+	require.Error(t, err)
+	_, err = connectTestGatewayTLS(gw, res("c1.root"), clientConfig(otherCA, "root"))
+	require.Error(t, err)
+	_, err = connectTestGatewayTLS(gw, res("c1.root"), clientConfig(serverCA, "root"))
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("failed to upgrade to tls connection").Len() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, logs.FilterMessage("failed to recv handshake response").Len())
+
+	// Clients without TLS are rejected before user names are matched.
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeSecureTransportRequired), err.(*testErr).code)
+
+	// Clients without TLS are rejected even if user names are not matched.
+	gw, _ = startTestGateway(t, &Config{
+		TLS: TLSConfig{
+			CA:           serverCA.caFile,
+			ClientCA:     clientCA.caFile,
+			Cert:         certFile,
+			Key:          keyFile,
+			VerifyClient: true,
+		},
+		BackendConfigs: BackendConfigs{{ClusterID: "c1", Address: backend.addr()}},
+	})
+	_, err = connectTestGateway(gw, "c1.root")
+	require.Equal(t, uint16(mysql.ErrCodeSecureTransportRequired), err.(*testErr).code)
+	conn, err = connectTestGatewayTLS(gw, res("c1.admin"), clientConfig(clientCA, "root"))
+	require.NoError(t, err)
+	conn.Close()
+}
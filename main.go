@@ -1,69 +1,550 @@
 package main
 
 import (
+	"crypto/rsa"
 	"flag"
-	"net"
+	"math"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/oh-my-tidb/tidb-gateway/gateway"
+	"github.com/oh-my-tidb/tidb-gateway/mysql"
 	"github.com/oh-my-tidb/tidb-gateway/utility"
+	"github.com/oh-my-tidb/tidb-gateway/version"
+	"github.com/pkg/errors"
 )
 
 var (
 	addr                     string
+	configFile               string
 	tlsCA                    string
 	tlsCert                  string
 	tlsKey                   string
 	tlsVersion               string
+	tlsVerifyClient          bool
+	tlsClientCA              string
+	tlsMatchUserCN           bool
+	backendTLSCA             string
+	backendTLSCert           string
+	backendTLSKey            string
+	backendTLSServerName     string
+	backendTLSSkipVerify     bool
+	routeByCert              string
+	routeByAttr              string
+	routeBySNI               bool
+	defaultBackend           string
 	backendConfigs           gateway.BackendConfigs
+	backendsFile             string
+	failClosedOnReload       bool
 	enableCompression        bool
 	backendInsecureTransport bool
+	backendHandshakeTimeout  time.Duration
+	sendProxyProtocol        bool
+	backendConnectRetries    int
+	backendUser              string
+	backendPasswordFile      string
+	backendPublicKeyFile     string
+	clientPasswordsFile      string
+	enableRWSplit            bool
+	compressDirection        string
+	compressLevel            int
+	compressThreshold        int
+	listenBacklog            int
+	maxConnections           int
+	maxTLSHandshakes         int
+	tlsHandshakeTimeout      time.Duration
+	acceptRate               float64
+	acceptBurst              int
+	acceptRatePolicy         string
+	shedMaxGoroutines        int
+	shedMaxFDRatio           float64
+	shedInterval             time.Duration
+	tarpitFailures           int
+	tarpitDelay              time.Duration
+	tarpitMaxDelay           time.Duration
+	tarpitDecay              time.Duration
+	idleTimeout              time.Duration
+	halfClose                bool
+	maxConnDuration          time.Duration
+	maxConnDurationErrCode   uint
+	maxConnDurationErrMsg    string
+	writeStallWarn           time.Duration
+	writeStallTimeout        time.Duration
+	bufferPoolSize           int
+	reuseAddr                bool
+	tcpKeepAlive             time.Duration
+	tcpRecvBuffer            int
+	tcpSendBuffer            int
+	countCommands            bool
+	logBackendVersion        bool
+	maxBackendAttrsLen       int
+	backendMaxPacketSize     uint
+	maxUserNameLen           int
+	maxDBNameLen             int
+	strictHandshake          bool
+	preserveReservedBytes    bool
+	spliceHandshakeResponse  bool
+	handshakeStatusFlags     uint
+	unknownCommandPolicy     string
+	queryCommentTemplate     string
+	logTxnStatus             bool
+	interceptPing            bool
+	maxPreparedStmts         int
+	maxAllowedPacket         uint64
+	maskDeprecateEOF         bool
+	countRows                bool
+	commandLatency           bool
+	logQueries               bool
+	queryLogSampleRate       float64
+	healthCheckInterval      time.Duration
+	healthCheckTimeout       time.Duration
+	healthCheckMode          string
+	healthCheckUser          string
+	healthCheckPasswordFile  string
+	breakerFailures          int
+	breakerCooldown          time.Duration
+	breakerErrCode           uint
+	breakerErrMessage        string
+	maxDials                 int
+	dialQueueLength          int
+	dialQueueTimeout         time.Duration
+	waitForBackends          string
+	waitForBackendsTimeout   time.Duration
+	eventFile                string
+	metricsAddr              string
+	pprofAddr                string
+	drainTimeout             time.Duration
+	forceTimeout             time.Duration
+	printVersion             bool
 )
 
 func main() {
 	flag.StringVar(&addr, "addr", ":3306", "listening address")
+	flag.StringVar(&configFile, "config", "", "YAML or JSON config file, overridden by flags given on the command line")
 	flag.StringVar(&tlsCA, "tls-ca", "", "TLS CA file")
-	flag.StringVar(&tlsCert, "tls-cert", "", "TLS cert file")
-	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS cert file, reloaded on SIGHUP")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file, reloaded on SIGHUP")
 	flag.StringVar(&tlsVersion, "tls-version", "", "Minimal TLS version (TLSv1.0/TLSv1.1/TLSv1.2/TLSv1.3)")
+	flag.BoolVar(&tlsVerifyClient, "tls-verify-client", false, "Require clients connecting with TLS to present certificates signed by -tls-client-ca, or -tls-ca if it is empty")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file verifying client certificates with -tls-verify-client, empty means -tls-ca")
+	flag.BoolVar(&tlsMatchUserCN, "tls-match-user-cn", false, "Require user names to equal the CN of verified client certificates")
+	flag.StringVar(&defaultBackend, "default-backend", "", "Address of the backend for unknown clusters, which receives the whole user name, empty means rejecting them. Not used with -route-by-cert")
+	flag.BoolVar(&routeBySNI, "route-by-sni", false, "Route TLS connections by the server name if it is a cluster ID or starts with one, e.g. c1.tidb.example.com")
+	flag.StringVar(&routeByAttr, "route-by-attr", "", "Route by the connection attribute with the key instead of the user name if clients send it, e.g. tidb_cluster")
+	flag.StringVar(&routeByCert, "route-by-cert", "", "Route by a field of verified client certificates instead of the user name (CN/OU/OU:<prefix>/OID:<oid>)")
 	flag.BoolVar(&enableCompression, "compress", false, "Enable compression")
-	flag.Var(&backendConfigs, "backend", "backend cluster configs")
+	flag.StringVar(&compressDirection, "compress-direction", string(gateway.CompressBoth), "Direction of traffic to compress (both/backend-to-client/client-to-backend)")
+	flag.IntVar(&compressLevel, "compress-level", -1, "Zlib level of data compressed for clients, from 0 (none) to 9 (best), -1 means the default level")
+	flag.IntVar(&compressThreshold, "compress-threshold", 128, "Length in bytes below which data sent to clients is not compressed, 0 means the default of 128")
+	flag.Var(&backendConfigs, "backend", "backend cluster configs, clusterID=address[,address...][?min-conns=N&idle-timeout=D&compress=B]")
+	flag.StringVar(&backendsFile, "backends-file", "", "File of backend cluster configs, one per line, reloaded on SIGHUP")
+	flag.BoolVar(&failClosedOnReload, "fail-closed-on-reload", false, "Reject new connections and report not ready at /ready after a failed reload, until a successful one")
 	flag.BoolVar(&backendInsecureTransport, "backend-insecure-transport", false, "Using insecure connection to backend")
+	flag.StringVar(&backendTLSCA, "backend-tls-ca", "", "CA file verifying backend certificates, empty means the system roots")
+	flag.StringVar(&backendTLSCert, "backend-tls-cert", "", "Cert file presented to backends requiring client certificates")
+	flag.StringVar(&backendTLSKey, "backend-tls-key", "", "Key file of -backend-tls-cert")
+	flag.StringVar(&backendTLSServerName, "backend-tls-server-name", "", "Server name verified in backend certificates, empty means the host of backend addresses")
+	flag.BoolVar(&backendTLSSkipVerify, "backend-tls-skip-verify", false, "Accept any backend certificate")
+	flag.IntVar(&backendConnectRetries, "backend-connect-retries", 0, "Number of times to retry connecting to the next address of a cluster")
+	flag.DurationVar(&backendHandshakeTimeout, "backend-handshake-timeout", 0, "Max time of the handshake and auth with backends, 0 means no limit")
+	flag.BoolVar(&sendProxyProtocol, "send-proxy-protocol", false, "Send a PROXY protocol v2 header with the client address to backends")
+	flag.DurationVar(&tcpKeepAlive, "tcp-keepalive", 0, "Keepalive period of client and backend connections, 0 means system default and negative disables keepalive")
+	flag.IntVar(&tcpRecvBuffer, "tcp-recv-buffer", 0, "SO_RCVBUF of client and backend connections, 0 means system default")
+	flag.IntVar(&tcpSendBuffer, "tcp-send-buffer", 0, "SO_SNDBUF of client and backend connections, 0 means system default")
+	flag.IntVar(&bufferPoolSize, "buffer-pool-size", 64<<20, "Max total bytes of relay buffers retained for reuse, 0 disables pooling")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 0, "Close connections idle in both directions for the duration, 0 means no timeout")
+	flag.BoolVar(&halfClose, "half-close", false, "Keep relaying results after clients shut down their write side")
+	flag.DurationVar(&maxConnDuration, "max-conn-duration", 0, "Close connections at the first command after they last for the duration, 0 means no limit")
+	flag.UintVar(&maxConnDurationErrCode, "max-conn-duration-error-code", 0, "Error code sent when closing connections for max-conn-duration, e.g. 1053, 0 means 1105")
+	flag.StringVar(&maxConnDurationErrMsg, "max-conn-duration-error-message", "", "Error message sent when closing connections for max-conn-duration")
+	flag.DurationVar(&writeStallWarn, "write-stall-warn", 0, "Warn about writes to clients blocking for the duration, 0 means no warning")
+	flag.DurationVar(&writeStallTimeout, "write-stall-timeout", 0, "Close connections whose writes to clients block for the duration, 0 means no timeout")
+	flag.StringVar(&backendUser, "backend-user", "", "Authenticate to backends as the user instead of passing client auth through")
+	flag.StringVar(&backendPasswordFile, "backend-password-file", "", "File containing the password of -backend-user")
+	flag.StringVar(&backendPublicKeyFile, "backend-public-key-file", "", "RSA public key of backends in PEM, for caching_sha2_password full auth of -backend-user without backend TLS")
+	flag.StringVar(&clientPasswordsFile, "client-passwords-file", "", "File of user:password lines that clients are authenticated against with -backend-user")
+	flag.BoolVar(&enableRWSplit, "enable-rw-split", false, "Route read-only statements outside transactions to the replica of clusters, matched by prefix on a best-effort basis, requires -backend-user")
+	flag.IntVar(&maxConnections, "max-connections", 0, "Max number of connections, 0 means no limit. Connections in the handshake count before their cluster is known, so min-conns reservations are best-effort")
+	flag.Float64Var(&acceptRate, "accept-rate", 0, "Max number of new connections accepted per second, 0 means no limit")
+	flag.IntVar(&acceptBurst, "accept-burst", 1, "Number of new connections accepted in a burst exceeding -accept-rate")
+	flag.StringVar(&acceptRatePolicy, "accept-rate-policy", string(gateway.AcceptRateQueue), "What to do with connections exceeding -accept-rate (queue/reject)")
+	flag.IntVar(&shedMaxGoroutines, "shed-max-goroutines", 0, "Reject new connections while the number of goroutines exceeds it, 0 means no limit")
+	flag.Float64Var(&shedMaxFDRatio, "shed-max-fd-ratio", 0, "Reject new connections while open file descriptors exceed the ratio of the limit, e.g. 0.9, 0 means no limit")
+	flag.IntVar(&tarpitFailures, "tarpit-failures", 0, "Recent auth failures of an IP from which handshakes to it are delayed, 0 disables the tarpit")
+	flag.DurationVar(&tarpitDelay, "tarpit-delay", time.Second, "Delay of handshakes at -tarpit-failures, doubled by each further failure")
+	flag.DurationVar(&tarpitMaxDelay, "tarpit-max-delay", 30*time.Second, "Max delay of handshakes to IPs failing auth")
+	flag.DurationVar(&tarpitDecay, "tarpit-decay", time.Minute, "Time for one auth failure of an IP to be forgotten")
+	flag.DurationVar(&shedInterval, "shed-interval", time.Second, "Interval of sampling resource usage for -shed-max-goroutines and -shed-max-fd-ratio")
+	flag.IntVar(&maxTLSHandshakes, "max-concurrent-tls-handshakes", 0, "Max number of concurrent TLS handshakes with clients and backends, 0 means no limit")
+	flag.DurationVar(&tlsHandshakeTimeout, "tls-handshake-timeout", 0, "Max time of a TLS handshake including waiting for a slot, 0 means 10s")
+	flag.IntVar(&listenBacklog, "listen-backlog", 0, "Listen backlog, 0 means system default")
+	flag.BoolVar(&reuseAddr, "reuse-addr", true, "Set SO_REUSEADDR on the listening socket")
+	flag.BoolVar(&countCommands, "count-commands", false, "Count commands of each connection in the access log")
+	flag.BoolVar(&countRows, "count-rows", false, "Count result set rows of each connection in the access log")
+	flag.BoolVar(&logBackendVersion, "log-backend-version", false, "Add the backend server version to the access log and count connections by it")
+	flag.UintVar(&backendMaxPacketSize, "backend-max-packet-size", 0, "Clamp the max packet size advertised by clients to backends, 0 means no clamping")
+	flag.IntVar(&maxUserNameLen, "max-username-len", 0, "Max length of user names in handshake responses, 0 means no limit")
+	flag.IntVar(&maxDBNameLen, "max-dbname-len", 0, "Max length of database names in handshake responses, 0 means no limit")
+	flag.IntVar(&maxBackendAttrsLen, "max-backend-attrs-len", 0, "Max length of connection attributes sent to backend, 0 means no limit")
+	flag.UintVar(&handshakeStatusFlags, "handshake-status-flags", uint(mysql.ServerStatusAutocommit), "Status flags advertised in the initial handshake")
+	flag.BoolVar(&maskDeprecateEOF, "mask-deprecate-eof", false, "Keep clients from negotiating CLIENT_DEPRECATE_EOF with backends")
+	flag.BoolVar(&preserveReservedBytes, "preserve-reserved-bytes", false, "Forward the reserved bytes of client handshake responses to backends instead of zeros")
+	flag.BoolVar(&spliceHandshakeResponse, "splice-handshake-response", false, "Forward client handshake responses as is except the fields changed by the gateway, instead of encoding them again")
+	flag.BoolVar(&strictHandshake, "strict-handshake", false, "Reject backend handshakes deviating from the protocol")
+	flag.StringVar(&unknownCommandPolicy, "unknown-command-policy", string(gateway.UnknownCommandForward), "How to treat unknown commands (forward/log/reject)")
+	flag.StringVar(&queryCommentTemplate, "inject-query-comment", "", "Comment template prepended to queries, e.g. 'gateway: connID={connID} cluster={cluster}'")
+	flag.BoolVar(&logTxnStatus, "log-txn-status", false, "Log transaction starts and ends seen in backend status flags, for debugging")
+	flag.BoolVar(&interceptPing, "intercept-ping", false, "Answer COM_PING in the gateway without forwarding it to backend")
+	flag.IntVar(&maxPreparedStmts, "max-prepared-stmts", 0, "Max prepared statements open on each connection, 0 means no limit")
+	flag.Uint64Var(&maxAllowedPacket, "max-allowed-packet", 0, "Max size of packets from clients, 0 means no limit")
+	flag.BoolVar(&commandLatency, "command-latency", false, "Record the latency histogram of commands per cluster")
+	flag.BoolVar(&logQueries, "log-queries", false, "Log commands of clients")
+	flag.Float64Var(&queryLogSampleRate, "query-log-sample-rate", 1, "Fraction of commands logged by -log-queries in (0, 1], e.g. 0.001 logs 1 in 1000, 0 means 1")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", 0, "Interval of checking backend addresses so that unhealthy ones are skipped, 0 disables health checking")
+	flag.DurationVar(&healthCheckTimeout, "health-check-timeout", 0, "Timeout of each health check, 0 means the interval")
+	flag.StringVar(&healthCheckMode, "health-check-mode", string(gateway.HealthCheckTCP), "How to check backend addresses (tcp/mysql), mysql logs in and pings")
+	flag.StringVar(&healthCheckUser, "health-check-user", "", "User logging in to backends in the mysql health check mode")
+	flag.StringVar(&healthCheckPasswordFile, "health-check-password-file", "", "File containing the password of -health-check-user")
+	flag.IntVar(&breakerFailures, "breaker-failures", 0, "Consecutive failures connecting to a cluster that fast-fail its new connections for -breaker-cooldown, 0 disables the circuit breaker")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 10*time.Second, "Time new connections to a cluster fast-fail after the circuit breaker opens")
+	flag.UintVar(&breakerErrCode, "breaker-error-code", 0, "Error code sent to clients rejected by an open circuit breaker, 0 means 9003")
+	flag.StringVar(&breakerErrMessage, "breaker-error-message", "", "Error message sent to clients rejected by an open circuit breaker")
+	flag.IntVar(&maxDials, "max-dials", 0, "Max concurrent backend dials of each cluster, 0 means no limit")
+	flag.IntVar(&dialQueueLength, "dial-queue-length", 0, "Max connections waiting for a backend dial slot of each cluster, connections beyond it are rejected")
+	flag.DurationVar(&dialQueueTimeout, "dial-queue-timeout", 0, "Max time connections wait for a backend dial slot, 0 means no timeout")
+	flag.StringVar(&waitForBackends, "wait-for-backends", "", "Wait for any/all backends to be reachable before accepting connections")
+	flag.DurationVar(&waitForBackendsTimeout, "wait-for-backends-timeout", 30*time.Second, "Max time to wait for backends")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address serving Prometheus metrics at /metrics, empty disables the metrics server")
+	flag.StringVar(&pprofAddr, "pprof-addr", "", "Address serving runtime profiles at /debug/pprof/, empty disables the pprof server")
+	flag.StringVar(&eventFile, "event-file", "", "File to append connection lifecycle events to as JSON lines")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 0, "Time for connections to finish after receiving SIGINT/SIGTERM before force closing them, 0 means closing immediately")
+	flag.DurationVar(&forceTimeout, "force-timeout", 10*time.Second, "Time to wait for force closed connections to terminate")
+	flag.BoolVar(&printVersion, "version", false, "Print version information and exit")
 	flag.Parse()
 
+	if printVersion {
+		version.Print(os.Stdout)
+		os.Exit(0)
+	}
+
 	log := utility.GetLogger()
-	log.Infow("initializing gateway", "addr", addr, "backend", backendConfigs)
+	// exitCode is set by failures after serving starts. It is deferred first,
+	// so that it exits after the other deferred calls.
+	var exitCode int
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+	log.Infow("starting tidb-gateway", version.Get().Fields()...)
+	if configFile != "" {
+		setFlags := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+		if err := applyConfigFile(configFile, setFlags); err != nil {
+			log.Errorw("failed to load config file", "err", err)
+			return
+		}
+	}
+	backends, err := loadBackends()
+	if err != nil {
+		log.Errorw("failed to load backends", "err", err)
+		return
+	}
+	log.Infow("initializing gateway", "addr", addr, "backend", backends)
 
-	lis, err := net.Listen("tcp", addr)
+	lis, err := gateway.Listen(addr, gateway.ListenConfig{
+		Backlog:   listenBacklog,
+		ReuseAddr: reuseAddr,
+	})
 	if err != nil {
 		log.Errorw("failed to listen", "err", err)
 		return
 	}
 
 	tlsConfig := gateway.TLSConfig{
-		CA:         tlsCA,
-		Cert:       tlsCert,
-		Key:        tlsKey,
-		MinVersion: tlsVersion,
+		CA:           tlsCA,
+		Cert:         tlsCert,
+		Key:          tlsKey,
+		MinVersion:   tlsVersion,
+		VerifyClient: tlsVerifyClient,
+		ClientCA:     tlsClientCA,
+		MatchUserCN:  tlsMatchUserCN,
+	}
+	backendTLSConfig := gateway.BackendTLSConfig{
+		CA:                 backendTLSCA,
+		Cert:               backendTLSCert,
+		Key:                backendTLSKey,
+		ServerName:         backendTLSServerName,
+		InsecureSkipVerify: backendTLSSkipVerify,
+	}
+
+	var eventSink gateway.EventSink
+	if eventFile != "" {
+		sink, err := gateway.NewFileEventSink(eventFile)
+		if err != nil {
+			log.Errorw("failed to open event file", "err", err)
+			return
+		}
+		defer sink.Close()
+		eventSink = sink
+	}
+
+	if handshakeStatusFlags > math.MaxUint16 {
+		log.Errorw("invalid handshake status flags", "flags", handshakeStatusFlags)
+		return
+	}
+	statusFlags := uint16(handshakeStatusFlags)
+	if maxConnDurationErrCode > math.MaxUint16 {
+		log.Errorw("invalid max conn duration error code", "code", maxConnDurationErrCode)
+		return
+	}
+	if breakerErrCode > math.MaxUint16 {
+		log.Errorw("invalid breaker error code", "code", breakerErrCode)
+		return
+	}
+	if backendMaxPacketSize > math.MaxUint32 {
+		log.Errorw("invalid backend max packet size", "size", backendMaxPacketSize)
+		return
+	}
+
+	var backendPassword string
+	if backendPasswordFile != "" {
+		backendPassword, err = gateway.LoadPasswordFile(backendPasswordFile)
+		if err != nil {
+			log.Errorw("failed to load backend password", "err", err)
+			return
+		}
+	}
+	var backendPublicKey *rsa.PublicKey
+	if backendPublicKeyFile != "" {
+		backendPublicKey, err = gateway.LoadPublicKeyFile(backendPublicKeyFile)
+		if err != nil {
+			log.Errorw("failed to load backend public key", "err", err)
+			return
+		}
+	}
+	var clientPasswords map[string]string
+	if clientPasswordsFile != "" {
+		clientPasswords, err = gateway.LoadClientPasswords(clientPasswordsFile)
+		if err != nil {
+			log.Errorw("failed to load client passwords", "err", err)
+			return
+		}
+	}
+
+	var healthCheckPassword string
+	if healthCheckPasswordFile != "" {
+		healthCheckPassword, err = gateway.LoadPasswordFile(healthCheckPasswordFile)
+		if err != nil {
+			log.Errorw("failed to load health check password", "err", err)
+			return
+		}
+	}
+	healthCheck := gateway.HealthCheck{
+		Interval: healthCheckInterval,
+		Timeout:  healthCheckTimeout,
+		Mode:     gateway.HealthCheckMode(healthCheckMode),
+		User:     healthCheckUser,
+		Password: healthCheckPassword,
 	}
 
 	gw, err := gateway.New(lis, &gateway.Config{
-		TLS:                      tlsConfig,
-		BackendConfigs:           backendConfigs,
-		EnableCompression:        enableCompression,
-		BackendInsecureTransport: backendInsecureTransport,
+		TLS:                        tlsConfig,
+		BackendTLS:                 backendTLSConfig,
+		BackendConfigs:             backends,
+		EnableCompression:          enableCompression,
+		BackendInsecureTransport:   backendInsecureTransport,
+		BackendConnectRetries:      backendConnectRetries,
+		BackendHandshakeTimeout:    backendHandshakeTimeout,
+		SendProxyProtocol:          sendProxyProtocol,
+		BackendUser:                backendUser,
+		BackendPassword:            backendPassword,
+		BackendPublicKey:           backendPublicKey,
+		ClientPasswords:            clientPasswords,
+		EnableRWSplit:              enableRWSplit,
+		TCPKeepAlive:               tcpKeepAlive,
+		TCPRecvBuffer:              tcpRecvBuffer,
+		TCPSendBuffer:              tcpSendBuffer,
+		MaxConnections:             maxConnections,
+		MaxConcurrentTLSHandshakes: maxTLSHandshakes,
+		TLSHandshakeTimeout:        tlsHandshakeTimeout,
+		AcceptRate:                 acceptRate,
+		AcceptBurst:                acceptBurst,
+		AcceptRatePolicy:           gateway.AcceptRatePolicy(acceptRatePolicy),
+		Tarpit: gateway.Tarpit{
+			Failures: tarpitFailures,
+			Delay:    tarpitDelay,
+			MaxDelay: tarpitMaxDelay,
+			Decay:    tarpitDecay,
+		},
+		ShedLoad: gateway.ShedLoad{
+			MaxGoroutines: shedMaxGoroutines,
+			MaxFDRatio:    shedMaxFDRatio,
+			Interval:      shedInterval,
+		},
+		IdleTimeout:             idleTimeout,
+		HalfClose:               halfClose,
+		MaxConnDuration:         maxConnDuration,
+		MaxConnDurationErrCode:  uint16(maxConnDurationErrCode),
+		MaxConnDurationErrMsg:   maxConnDurationErrMsg,
+		WriteStallWarn:          writeStallWarn,
+		WriteStallTimeout:       writeStallTimeout,
+		BufferPoolSize:          bufferPoolSize,
+		CompressDirection:       gateway.CompressDirection(compressDirection),
+		CompressLevel:           &compressLevel,
+		CompressThreshold:       compressThreshold,
+		CountCommands:           countCommands,
+		LogBackendVersion:       logBackendVersion,
+		MaxBackendAttrsLen:      maxBackendAttrsLen,
+		BackendMaxPacketSize:    uint32(backendMaxPacketSize),
+		MaxUserNameLen:          maxUserNameLen,
+		MaxDBNameLen:            maxDBNameLen,
+		HandshakeStatusFlags:    &statusFlags,
+		MaskDeprecateEOF:        maskDeprecateEOF,
+		CountRows:               countRows,
+		StrictHandshake:         strictHandshake,
+		PreserveReservedBytes:   preserveReservedBytes,
+		SpliceHandshakeResponse: spliceHandshakeResponse,
+		UnknownCommandPolicy:    gateway.UnknownCommandPolicy(unknownCommandPolicy),
+		QueryCommentTemplate:    queryCommentTemplate,
+		LogTxnStatus:            logTxnStatus,
+		InterceptPing:           interceptPing,
+		MaxPreparedStmts:        maxPreparedStmts,
+		MaxAllowedPacket:        maxAllowedPacket,
+		CommandLatency:          commandLatency,
+		LogQueries:              logQueries,
+		QueryLogSampleRate:      queryLogSampleRate,
+		HealthCheck:             healthCheck,
+		CircuitBreaker: gateway.CircuitBreaker{
+			Failures:   breakerFailures,
+			Cooldown:   breakerCooldown,
+			ErrCode:    uint16(breakerErrCode),
+			ErrMessage: breakerErrMessage,
+		},
+		DialQueue: gateway.DialQueue{
+			MaxDials:  maxDials,
+			MaxQueued: dialQueueLength,
+			Timeout:   dialQueueTimeout,
+		},
+		WaitForBackends:        waitForBackends,
+		WaitForBackendsTimeout: waitForBackendsTimeout,
+		EventSink:              eventSink,
+		RouteByAttr:            routeByAttr,
+		RouteBySNI:             routeBySNI,
+		DefaultBackend:         defaultBackend,
+		RouteByCert:            routeByCert,
+		MetricsAddr:            metricsAddr,
+		PprofAddr:              pprofAddr,
+		FailClosedOnReload:     failClosedOnReload,
 	})
 	if err != nil {
 		log.Errorw("failed to create gateway", "err", err)
 		return
 	}
+	if err := gw.WaitForBackends(); err != nil {
+		log.Warnw("start serving with unreachable backends", "err", err)
+	}
 	gw.StartServe()
 
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigs
-	log.Warnw("received signal", "signal", sig)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-sigs:
+		case <-gw.Done():
+			log.Errorw("gateway stops unexpectedly", "err", gw.Err())
+			exitCode = 1
+			gw.Stop()
+			return
+		}
+		if sig == syscall.SIGHUP {
+			backends, reloadErr := loadBackends()
+			if reloadErr == nil {
+				reloadErr = backends.ValidateMinConnections(maxConnections)
+			}
+			if reloadErr != nil {
+				log.Errorw("failed to reload backends", "err", reloadErr)
+			} else {
+				gw.ReloadBackends(backends)
+			}
+			if err := gw.ReloadCerts(); err != nil {
+				log.Errorw("failed to reload tls certificates", "err", err)
+				reloadErr = joinErrors(reloadErr, err)
+			}
+			gw.ReportReload(reloadErr)
+			continue
+		}
+		log.Warnw("received signal", "signal", sig)
+		break
+	}
+	if drainTimeout > 0 {
+		if err := gw.GracefulStop(drainTimeout, forceTimeout); err != nil {
+			log.Errorw("failed to stop gracefully", "err", err)
+		}
+		return
+	}
 	gw.Stop()
 }
+
+// applyConfigFile sets the settings loaded from the config file, except those
+// given by flags in setFlags.
+func applyConfigFile(path string, setFlags map[string]bool) error {
+	conf, err := gateway.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	for name, apply := range map[string]func(){
+		"tls-ca":                     func() { tlsCA = conf.TLS.CA },
+		"tls-cert":                   func() { tlsCert = conf.TLS.Cert },
+		"tls-key":                    func() { tlsKey = conf.TLS.Key },
+		"tls-version":                func() { tlsVersion = conf.TLS.MinVersion },
+		"tls-verify-client":          func() { tlsVerifyClient = conf.TLS.VerifyClient },
+		"tls-client-ca":              func() { tlsClientCA = conf.TLS.ClientCA },
+		"tls-match-user-cn":          func() { tlsMatchUserCN = conf.TLS.MatchUserCN },
+		"backend-tls-ca":             func() { backendTLSCA = conf.BackendTLS.CA },
+		"backend-tls-cert":           func() { backendTLSCert = conf.BackendTLS.Cert },
+		"backend-tls-key":            func() { backendTLSKey = conf.BackendTLS.Key },
+		"backend-tls-server-name":    func() { backendTLSServerName = conf.BackendTLS.ServerName },
+		"backend-tls-skip-verify":    func() { backendTLSSkipVerify = conf.BackendTLS.InsecureSkipVerify },
+		"compress":                   func() { enableCompression = conf.EnableCompression },
+		"backend-insecure-transport": func() { backendInsecureTransport = conf.BackendInsecureTransport },
+		"backend":                    func() { backendConfigs = conf.BackendConfigs },
+	} {
+		if !setFlags[name] {
+			apply()
+		}
+	}
+	return nil
+}
+
+// joinErrors returns an error with the messages of the non-nil errors, or nil
+// if all of them are nil.
+func joinErrors(errs ...error) error {
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// loadBackends returns the backends from flags and the backends file.
+func loadBackends() (gateway.BackendConfigs, error) {
+	backends := append(gateway.BackendConfigs(nil), backendConfigs...)
+	if backendsFile == "" {
+		return backends, nil
+	}
+	fileBackends, err := gateway.LoadBackendConfigs(backendsFile)
+	if err != nil {
+		return nil, err
+	}
+	return append(backends, fileBackends...), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/oh-my-tidb/tidb-gateway/gateway"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionFlag(t *testing.T) {
+	if os.Getenv("GATEWAY_TEST_MAIN") == "1" {
+		os.Args = []string{"tidb-gateway", "-version"}
+		main()
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionFlag$")
+	cmd.Env = append(os.Environ(), "GATEWAY_TEST_MAIN=1")
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	require.Equal(t, "Version: unknown\nGit Commit: unknown\nBuild Date: unknown\n", string(out))
+}
+
+func TestJoinErrors(t *testing.T) {
+	require.NoError(t, joinErrors(nil, nil))
+	require.EqualError(t, joinErrors(nil, errors.New("bad cert")), "bad cert")
+	require.EqualError(t, joinErrors(errors.New("bad backend"), errors.New("bad cert")), "bad backend; bad cert")
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	defer func() {
+		tlsCA, tlsCert, tlsKey, tlsVersion = "", "", "", ""
+		enableCompression, backendInsecureTransport = false, false
+		backendConfigs = nil
+	}()
+	tlsCA = "/flag/ca.pem"
+	backendConfigs = gateway.BackendConfigs{{ClusterID: "c3", Address: "10.0.0.3:4000"}}
+	require.NoError(t, applyConfigFile("gateway/testdata/config.yaml", map[string]bool{"tls-ca": true, "backend": true}))
+	require.Equal(t, "/flag/ca.pem", tlsCA)
+	require.Equal(t, "/etc/gateway/cert.pem", tlsCert)
+	require.Equal(t, "/etc/gateway/key.pem", tlsKey)
+	require.Equal(t, "TLSv1.2", tlsVersion)
+	require.True(t, enableCompression)
+	require.True(t, backendInsecureTransport)
+	require.Equal(t, gateway.BackendConfigs{{ClusterID: "c3", Address: "10.0.0.3:4000"}}, backendConfigs)
+
+	require.NoError(t, applyConfigFile("gateway/testdata/config.yaml", nil))
+	require.Equal(t, "/etc/gateway/ca.pem", tlsCA)
+	require.Len(t, backendConfigs, 2)
+
+	require.Error(t, applyConfigFile("gateway/testdata/missing.yaml", nil))
+}
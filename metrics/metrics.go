@@ -0,0 +1,410 @@
+// Package metrics is a minimal metrics library exposing values in the
+// Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector is a set of metrics which can be registered to a Registry.
+type Collector interface {
+	// WriteText writes the metrics in the Prometheus text format.
+	WriteText(w io.Writer) error
+}
+
+// Registry is a list of collectors.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// DefaultRegistry is the registry used by Register.
+var DefaultRegistry = NewRegistry()
+
+// Register adds collectors to the default registry.
+func Register(cs ...Collector) {
+	DefaultRegistry.Register(cs...)
+}
+
+// Register adds collectors to the registry.
+func (r *Registry) Register(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, cs...)
+}
+
+// WriteText writes all registered metrics in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	cs := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+	for _, c := range cs {
+		if err := c.WriteText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentType is the content type of the Prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// ServeHTTP serves the registered metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var b bytes.Buffer
+	if err := r.WriteText(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(b.Bytes())
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value
+	family *CounterVec
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc() {
+	c.add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter.
+func (c *Counter) Add(delta float64) {
+	c.add(delta)
+}
+
+// Value returns the current value.
+func (c *Counter) Value() float64 {
+	return c.get()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	value
+	family *GaugeVec
+}
+
+// Set sets the gauge.
+func (g *Gauge) Set(f float64) {
+	g.set(f)
+}
+
+// Inc adds 1 to the gauge.
+func (g *Gauge) Inc() {
+	g.add(1)
+}
+
+// Dec subtracts 1 from the gauge.
+func (g *Gauge) Dec() {
+	g.add(-1)
+}
+
+// Add adds delta to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.add(delta)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() float64 {
+	return g.get()
+}
+
+// desc describes a metric family.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+	return err
+}
+
+// labelPairs renders label values as {k="v",...}, with extra pairs appended.
+func (d *desc) labelPairs(values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", d.labels[i], v))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// vec holds the children of a metric family by label values.
+type vec struct {
+	desc
+	mu       sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+	newChild func() interface{}
+}
+
+func newVec(d desc) *vec {
+	return &vec{
+		desc:     d,
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+	}
+}
+
+func (v *vec) with(values []string) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.children[key]
+	if !ok {
+		c = v.newChild()
+		v.children[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// each calls f with children sorted by label values.
+func (v *vec) each(f func(values []string, child interface{}) error) error {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	children, values := make(map[string]interface{}, len(keys)), make(map[string][]string, len(keys))
+	for _, k := range keys {
+		children[k], values[k] = v.children[k], v.values[k]
+	}
+	v.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := f(values[k], children[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *vec) writeValues(w io.Writer, get func(child interface{}) float64) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	return v.each(func(values []string, child interface{}) error {
+		_, err := fmt.Fprintf(w, "%s%s %v\n", v.name, v.labelPairs(values), get(child))
+		return err
+	})
+}
+
+// CounterVec is a counter family partitioned by labels.
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec creates a counter family.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(desc{name: name, help: help, typ: "counter", labels: labels})}
+	v.newChild = func() interface{} {
+		return &Counter{family: v}
+	}
+	return v
+}
+
+// WithLabelValues returns the counter of the label values, creating it if
+// needed.
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.with(values).(*Counter)
+}
+
+// WriteText implements Collector.
+func (v *CounterVec) WriteText(w io.Writer) error {
+	return v.writeValues(w, func(child interface{}) float64 {
+		return child.(*Counter).Value()
+	})
+}
+
+// NewCounter creates a counter without labels.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).WithLabelValues()
+}
+
+// WriteText implements Collector.
+func (c *Counter) WriteText(w io.Writer) error {
+	return c.family.WriteText(w)
+}
+
+// GaugeVec is a gauge family partitioned by labels.
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec creates a gauge family.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec(desc{name: name, help: help, typ: "gauge", labels: labels})}
+	v.newChild = func() interface{} {
+		return &Gauge{family: v}
+	}
+	return v
+}
+
+// WithLabelValues returns the gauge of the label values, creating it if
+// needed.
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return v.with(values).(*Gauge)
+}
+
+// WriteText implements Collector.
+func (v *GaugeVec) WriteText(w io.Writer) error {
+	return v.writeValues(w, func(child interface{}) float64 {
+		return child.(*Gauge).Value()
+	})
+}
+
+// NewGauge creates a gauge without labels.
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).WithLabelValues()
+}
+
+// WriteText implements Collector.
+func (g *Gauge) WriteText(w io.Writer) error {
+	return g.family.WriteText(w)
+}
+
+// DefBuckets are the default histogram buckets in seconds, from 1ms to 10s.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	// counts holds the non-cumulative count of each bucket, with the last
+	// one for +Inf.
+	counts []uint64
+	sum    value
+	family *HistogramVec
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.family.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	h.sum.add(v)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	var n uint64
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+	}
+	return n
+}
+
+// Sum returns the sum of observations.
+func (h *Histogram) Sum() float64 {
+	return h.sum.get()
+}
+
+// WriteText implements Collector.
+func (h *Histogram) WriteText(w io.Writer) error {
+	return h.family.WriteText(w)
+}
+
+// HistogramVec is a histogram family partitioned by labels.
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogramVec creates a histogram family. buckets are the upper bounds
+// in increasing order, DefBuckets if nil.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	v := &HistogramVec{
+		vec:     newVec(desc{name: name, help: help, typ: "histogram", labels: labels}),
+		buckets: buckets,
+	}
+	v.newChild = func() interface{} {
+		return &Histogram{counts: make([]uint64, len(buckets)+1), family: v}
+	}
+	return v
+}
+
+// WithLabelValues returns the histogram of the label values, creating it if
+// needed.
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.with(values).(*Histogram)
+}
+
+// WriteText implements Collector.
+func (v *HistogramVec) WriteText(w io.Writer) error {
+	if err := v.writeHeader(w); err != nil {
+		return err
+	}
+	return v.each(func(values []string, child interface{}) error {
+		h := child.(*Histogram)
+		var cumulative uint64
+		for i := range h.counts {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			le := "+Inf"
+			if i < len(v.buckets) {
+				le = fmt.Sprint(v.buckets[i])
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelPairs(values, "le", le), cumulative); err != nil {
+				return err
+			}
+		}
+		labels := v.labelPairs(values)
+		_, err := fmt.Fprintf(w, "%s_sum%s %v\n%s_count%s %d\n", v.name, labels, h.Sum(), v.name, labels, cumulative)
+		return err
+	})
+}
+
+// NewHistogram creates a histogram without labels.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).WithLabelValues()
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := NewCounterVec("requests_total", "Total requests.", "cluster", "result")
+	active := NewGauge("active_connections", "Active connections.")
+	r.Register(requests, active)
+
+	requests.WithLabelValues("c2", "ok").Inc()
+	requests.WithLabelValues("c1", "ok").Add(2)
+	requests.WithLabelValues("c1", "ok").Inc()
+	active.Inc()
+	active.Inc()
+	active.Dec()
+	require.Equal(t, float64(3), requests.WithLabelValues("c1", "ok").Value())
+	require.Equal(t, float64(1), active.Value())
+
+	var b bytes.Buffer
+	require.NoError(t, r.WriteText(&b))
+	require.Equal(t, `# HELP requests_total Total requests.
+# TYPE requests_total counter
+requests_total{cluster="c1",result="ok"} 3
+requests_total{cluster="c2",result="ok"} 1
+# HELP active_connections Active connections.
+# TYPE active_connections gauge
+active_connections 1
+`, b.String())
+
+	require.Panics(t, func() { requests.WithLabelValues("c1") })
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	latency := NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "cmd")
+	r.Register(latency)
+
+	h := latency.WithLabelValues("query")
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+	require.Equal(t, uint64(4), h.Count())
+	require.Equal(t, 2.65, h.Sum())
+
+	var b bytes.Buffer
+	require.NoError(t, r.WriteText(&b))
+	require.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{cmd="query",le="0.1"} 2
+latency_seconds_bucket{cmd="query",le="1"} 3
+latency_seconds_bucket{cmd="query",le="+Inf"} 4
+latency_seconds_sum{cmd="query"} 2.65
+latency_seconds_count{cmd="query"} 4
+`, b.String())
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	active := NewGauge("active_connections", "Active connections.")
+	r.Register(active)
+	active.Set(2)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, `# HELP active_connections Active connections.
+# TYPE active_connections gauge
+active_connections 2
+`, w.Body.String())
+}
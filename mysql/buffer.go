@@ -17,6 +17,11 @@ func newBuffer(data []byte) *Buffer {
 	return &Buffer{bytes.NewBuffer(data)}
 }
 
+// NewBuffer returns a buffer reading data, for parsing packets already read.
+func NewBuffer(data []byte) *Buffer {
+	return newBuffer(data)
+}
+
 // WriteByte writes a single byte.
 func (b *Buffer) WriteByte(by byte) {
 	b.b.WriteByte(by)
@@ -57,6 +62,26 @@ func (b *Buffer) ReadStringNull() (string, error) {
 	return s[:len(s)-1], nil
 }
 
+// ReadStringNullMax reads a string followed by a null byte. It fails with
+// ErrMalformPacket if the string is longer than max, without looking for the
+// null byte any further. max <= 0 means no limit.
+func (b *Buffer) ReadStringNullMax(max int) (string, error) {
+	if max <= 0 {
+		return b.ReadStringNull()
+	}
+	data := b.b.Bytes()
+	if len(data) > max+1 {
+		data = data[:max+1]
+	}
+	if bytes.IndexByte(data, 0x00) < 0 {
+		if len(data) > max {
+			return "", errors.WithStack(ErrMalformPacket)
+		}
+		return "", errors.WithStack(io.EOF)
+	}
+	return b.ReadStringNull()
+}
+
 // WriteUint32 writes a uint32.
 func (b *Buffer) WriteUint32(n uint32) {
 	var b4 [4]byte
@@ -9,16 +9,25 @@ import (
 )
 
 const (
+	// minCompressLen is the default compression threshold.
 	minCompressLen = 128
 	maxBufferLen   = (1 << 23) - 1
 )
 
+// ErrTruncatedTrunk is returned when the stream ends in the middle of a
+// compressed packet. A stream ending at a packet boundary returns io.EOF
+// instead, which is a normal close.
+var ErrTruncatedTrunk = errors.New("compressed packet is truncated")
+
 // Compressor wraps a Reader and a WriteFlusher for compression.
 type Compressor struct {
 	r           io.Reader
 	w           WriteFlusher
 	sequence    uint8
 	seqreset    uint8
+	noCompress  bool         // write without compression.
+	level       int          // zlib compression level.
+	threshold   int          // data shorter than it is written without compression.
 	readBuffer  bytes.Buffer // decompressed data to be read.
 	writeBuffer bytes.Buffer // bytes to be compressed.
 	flushBuffer bytes.Buffer // compressed data to be sent.
@@ -27,21 +36,26 @@ type Compressor struct {
 // NewCompressor creates a new Compressor.
 func NewCompressor(r io.Reader, w WriteFlusher) *Compressor {
 	return &Compressor{
-		r: r,
-		w: w,
+		r:         r,
+		w:         w,
+		level:     zlib.DefaultCompression,
+		threshold: minCompressLen,
 	}
 }
 
 // Read reads data from the underlying reader.
 func (c *Compressor) Read(p []byte) (int, error) {
-	// drain buffer before reading next trunk.
-	if n := c.readBuffer.Len(); n > 0 {
-		if n > len(p) {
-			n = len(p)
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// drain buffer before reading next trunk. A trunk may be empty, so load
+	// until there is data to avoid returning 0, nil.
+	for c.readBuffer.Len() == 0 {
+		if err := c.loadNextTrunk(); err != nil {
+			return 0, err
 		}
-		return c.readBuffer.Read(p[:n])
 	}
-	return 0, c.loadNextTrunk()
+	return c.readBuffer.Read(p)
 }
 
 func (c *Compressor) loadNextTrunk() error {
@@ -50,7 +64,10 @@ func (c *Compressor) loadNextTrunk() error {
 	var head [7]byte
 	n, err := io.ReadFull(c.r, head[:])
 	if n != 7 {
-		return err // err is guranateed not nil.
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return truncated(err)
 	}
 	if c.seqreset&SeqResetOnRead != 0 {
 		c.seqreset &= ^SeqResetOnRead
@@ -62,21 +79,24 @@ func (c *Compressor) loadNextTrunk() error {
 	uncompressedLen := readLen3(head[4:7])
 
 	if sequence != c.sequence {
-		return errors.Errorf("invalid sequence %d != %d", sequence, c.sequence)
+		return errors.WithStack(&sequenceError{got: sequence, want: c.sequence})
 	}
 
 	if uncompressedLen == 0 {
 		// uncompressed payload.
 		n, err := io.CopyN(&c.readBuffer, c.r, int64(payloadLen))
 		if n != int64(payloadLen) {
-			return err // err is guranateed not nil.
+			return truncated(err)
 		}
 	} else {
 		zr, err := zlib.NewReader(io.LimitReader(c.r, int64(payloadLen)))
 		if err != nil {
-			return err
+			return truncated(err)
 		}
 		n, err := io.Copy(&c.readBuffer, zr)
+		if errors.Cause(err) == io.ErrUnexpectedEOF {
+			return truncated(err)
+		}
 		if n != int64(uncompressedLen) {
 			return errors.Errorf("uncompessed length mismatch %d != %d", n, uncompressedLen)
 		}
@@ -85,6 +105,15 @@ func (c *Compressor) loadNextTrunk() error {
 	return nil
 }
 
+// truncated converts err of reading a partial trunk to ErrTruncatedTrunk,
+// keeping errors other than EOF.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncatedTrunk
+	}
+	return err
+}
+
 // Write writes data to the underlying writer. It works like bufio.Writer with compression.
 func (c *Compressor) Write(p []byte) (int, error) {
 	for len(p) > 0 {
@@ -115,7 +144,7 @@ func (c *Compressor) Flush() error {
 	var head [7]byte
 	var payload []byte
 
-	if c.writeBuffer.Len() < minCompressLen {
+	if c.noCompress || c.writeBuffer.Len() < c.threshold {
 		// write without compression.
 		writeLen3(head[0:3], c.writeBuffer.Len())
 		head[3] = c.sequence
@@ -123,7 +152,10 @@ func (c *Compressor) Flush() error {
 		payload = c.writeBuffer.Bytes()
 	} else {
 		// with compression.
-		zw := zlib.NewWriter(&c.flushBuffer)
+		zw, err := zlib.NewWriterLevel(&c.flushBuffer, c.level)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 		n, err := zw.Write(c.writeBuffer.Bytes())
 		if n != c.writeBuffer.Len() {
 			return err // err is guranateed not nil.
@@ -152,6 +184,31 @@ func (c *Compressor) Flush() error {
 	return c.w.Flush()
 }
 
+// SetCompressWrite sets whether written data is compressed. Data is framed as
+// compressed packets either way, and the read side is not affected.
+func (c *Compressor) SetCompressWrite(enabled bool) {
+	c.noCompress = !enabled
+}
+
+// SetCompressLevel sets the zlib level of written data. An invalid level
+// makes Flush fail.
+func (c *Compressor) SetCompressLevel(level int) {
+	c.level = level
+}
+
+// SetCompressThreshold sets the length below which written data is sent
+// without compression, since compressing small packets costs CPU for little
+// gain.
+func (c *Compressor) SetCompressThreshold(threshold int) {
+	c.threshold = threshold
+}
+
+// ValidCompressLevel returns whether level is a zlib level from
+// zlib.DefaultCompression to zlib.BestCompression.
+func ValidCompressLevel(level int) bool {
+	return level >= zlib.DefaultCompression && level <= zlib.BestCompression
+}
+
 // SetResetOption marks the sequence to be reset on next read or write.
 func (c *Compressor) SetResetOption(opt uint8) {
 	c.seqreset = opt
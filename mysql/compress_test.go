@@ -0,0 +1,150 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressWrite(t *testing.T) {
+	payload := bytes.Repeat([]byte("select 1;"), 100)
+	for _, enabled := range []bool{true, false} {
+		var wire bytes.Buffer
+		w := NewCompressor(nil, bufio.NewWriter(&wire))
+		w.SetCompressWrite(enabled)
+		_, err := w.Write(payload)
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+
+		data := wire.Bytes()
+		payloadLen, uncompressedLen := readLen3(data[0:3]), readLen3(data[4:7])
+		if enabled {
+			require.Equal(t, len(payload), uncompressedLen)
+			require.Less(t, payloadLen, len(payload))
+		} else {
+			require.Equal(t, 0, uncompressedLen)
+			require.Equal(t, len(payload), payloadLen)
+		}
+
+		r := NewCompressor(&wire, nil)
+		result := make([]byte, len(payload))
+		_, err = io.ReadFull(r, result)
+		require.NoError(t, err)
+		require.Equal(t, payload, result)
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	payload := bytes.Repeat([]byte("select * from t where id = 1;"), 1000)
+	sizes := make(map[int]int)
+	for _, level := range []int{1, 9} {
+		var wire bytes.Buffer
+		w := NewCompressor(nil, bufio.NewWriter(&wire))
+		w.SetCompressLevel(level)
+		_, err := w.Write(payload)
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+		sizes[level] = wire.Len()
+
+		r := NewCompressor(&wire, nil)
+		result := make([]byte, len(payload))
+		_, err = io.ReadFull(r, result)
+		require.NoError(t, err)
+		require.Equal(t, payload, result)
+	}
+	require.LessOrEqual(t, sizes[9], sizes[1])
+
+	w := NewCompressor(nil, bufio.NewWriter(io.Discard))
+	w.SetCompressLevel(10)
+	_, err := w.Write(payload)
+	require.NoError(t, err)
+	require.Error(t, w.Flush())
+	require.False(t, ValidCompressLevel(10))
+	require.True(t, ValidCompressLevel(-1))
+}
+
+func TestCompressReadEOF(t *testing.T) {
+	payload := bytes.Repeat([]byte("select 1;"), 100)
+	for _, enabled := range []bool{true, false} {
+		var wire bytes.Buffer
+		w := NewCompressor(nil, bufio.NewWriter(&wire))
+		w.SetCompressWrite(enabled)
+		_, err := w.Write(payload)
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+		data := wire.Bytes()
+
+		// The stream ends cleanly at a trunk boundary.
+		r := NewCompressor(bytes.NewReader(data), nil)
+		result := make([]byte, len(payload))
+		_, err = io.ReadFull(r, result)
+		require.NoError(t, err)
+		_, err = r.Read(result)
+		require.Equal(t, io.EOF, err)
+
+		// The stream ends in the middle of a header or a payload.
+		for _, n := range []int{3, 7, len(data) - 1} {
+			r = NewCompressor(bytes.NewReader(data[:n]), nil)
+			_, err = io.ReadFull(r, result)
+			require.Equal(t, ErrTruncatedTrunk, err, "enabled %v, length %d", enabled, n)
+		}
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	const threshold = 200
+	for _, n := range []int{threshold - 1, threshold} {
+		payload := bytes.Repeat([]byte("a"), n)
+		var wire bytes.Buffer
+		w := NewCompressor(nil, bufio.NewWriter(&wire))
+		w.SetCompressThreshold(threshold)
+		_, err := w.Write(payload)
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+
+		data := wire.Bytes()
+		payloadLen, uncompressedLen := readLen3(data[0:3]), readLen3(data[4:7])
+		if n < threshold {
+			require.Equal(t, 0, uncompressedLen)
+			require.Equal(t, n, payloadLen)
+		} else {
+			require.Equal(t, n, uncompressedLen)
+			require.Less(t, payloadLen, n)
+		}
+
+		r := NewCompressor(&wire, nil)
+		result := make([]byte, n)
+		_, err = io.ReadFull(r, result)
+		require.NoError(t, err)
+		require.Equal(t, payload, result)
+	}
+}
+
+func TestCompressReadSmallBuffer(t *testing.T) {
+	var wire, payload bytes.Buffer
+	w := NewCompressor(nil, bufio.NewWriter(&wire))
+	for i, n := range []int{10, 0, 500, 7} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, n)
+		payload.Write(data)
+		_, err := w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+	}
+
+	r := NewCompressor(&wire, nil)
+	var result bytes.Buffer
+	p := make([]byte, 3)
+	for {
+		n, err := r.Read(p)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Greater(t, n, 0)
+		result.Write(p[:n])
+	}
+	require.Equal(t, payload.Bytes(), result.Bytes())
+}
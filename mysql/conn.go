@@ -38,6 +38,7 @@ package mysql
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"math"
 	"net"
@@ -53,6 +54,29 @@ var (
 	ErrMalformPacket     = errors.New("malform packet")
 )
 
+// IsNetPacketTooLarge returns whether err is caused by reading a packet
+// larger than max allowed packet.
+func IsNetPacketTooLarge(err error) bool {
+	return errors.Cause(err) == errNetPacketTooLarge
+}
+
+// sequenceError is returned when a packet has an unexpected sequence, i.e.
+// the peers are out of sync.
+type sequenceError struct {
+	got, want uint8
+}
+
+func (e *sequenceError) Error() string {
+	return fmt.Sprintf("invalid sequence %d != %d", e.got, e.want)
+}
+
+// IsInvalidSequence returns whether err is caused by reading a packet with an
+// unexpected sequence.
+func IsInvalidSequence(err error) bool {
+	var seqErr *sequenceError
+	return errors.As(err, &seqErr)
+}
+
 const (
 	defaultWriterSize = 16 * 1024
 	defaultReaderSize = 16 * 1024
@@ -86,18 +110,23 @@ type Conn struct {
 	sequence    uint8
 	seqreset    uint8
 	readTimeout time.Duration
-	// maxAllowedPacket is the maximum size of one packet in readPacket.
+	// maxAllowedPacket is the maximum payload size of one packet read.
 	maxAllowedPacket uint64
-	compressor       *Compressor
+	// remain is the payload size left for the rest of the packet being read
+	// if inPacket is set, i.e. the last chunk read is followed by more.
+	remain     uint64
+	inPacket   bool
+	compressor *Compressor
+	// capability is the negotiated capability flags, set after auth.
+	capability uint32
 }
 
 // NewConn wraps a raw net.Conn into a Conn.
 func NewConn(conn net.Conn) *Conn {
 	return &Conn{
-		conn: conn,
-		r:    bufio.NewReaderSize(conn, defaultReaderSize),
-		w:    bufio.NewWriterSize(conn, defaultWriterSize),
-		// TODO: config max allowed packet
+		conn:             conn,
+		r:                bufio.NewReaderSize(conn, defaultReaderSize),
+		w:                bufio.NewWriterSize(conn, defaultWriterSize),
 		maxAllowedPacket: math.MaxUint64,
 	}
 }
@@ -115,11 +144,63 @@ func (c *Conn) SetReadTimeout(timeout time.Duration) {
 	c.readTimeout = timeout
 }
 
-// SetMaxAllowedPacket sets the maximum packet size.
+// SetMaxAllowedPacket sets the maximum payload size of packets read, beyond
+// which reads fail with errNetPacketTooLarge.
 func (c *Conn) SetMaxAllowedPacket(maxAllowedPacket uint64) {
 	c.maxAllowedPacket = maxAllowedPacket
 }
 
+// SetCapability sets the capability flags negotiated with the peer.
+func (c *Conn) SetCapability(capability uint32) {
+	c.capability = capability
+}
+
+// Capability returns the capability flags negotiated with the peer.
+func (c *Conn) Capability() uint32 {
+	return c.capability
+}
+
+// IsEOFPacket reports whether the payload read from the connection is an EOF
+// packet. If ClientDeprecateEOF is negotiated, it is an OK packet with the EOF
+// header, which may be longer than an EOF packet.
+func (c *Conn) IsEOFPacket(data []byte) bool {
+	if len(data) == 0 || data[0] != HeaderEOF {
+		return false
+	}
+	if c.capability&ClientDeprecateEOF != 0 {
+		return len(data) < MaxPayloadLen
+	}
+	// A longer packet is a row starting with an 8-byte length encoded int.
+	return len(data) < 9 // nolint:gomnd // nolint
+}
+
+// StatusFlags returns the server status flags carried by an OK or EOF packet
+// read from the connection. It returns false if data is neither of them or
+// the flags are absent.
+func (c *Conn) StatusFlags(data []byte) (uint16, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	switch {
+	case data[0] == HeaderEOF && c.capability&ClientDeprecateEOF == 0:
+		// EOF packets have 2 bytes of warnings before status flags.
+		if !c.IsEOFPacket(data) || len(data) < 5 || c.capability&ClientProtocol41 == 0 {
+			return 0, false
+		}
+		return uint16(data[3]) | uint16(data[4])<<8, true
+	case data[0] == HeaderOK || c.IsEOFPacket(data):
+		if c.capability&(ClientProtocol41|ClientTransactions) == 0 {
+			return 0, false
+		}
+		ok := OK{Capability: c.capability}
+		if err := ok.Read(newBuffer(data)); err != nil {
+			return 0, false
+		}
+		return ok.StatusFlags, true
+	}
+	return 0, false
+}
+
 // Packet is the interface for a MySQL packet.
 type Packet interface {
 	Write(b *Buffer)
@@ -159,7 +240,26 @@ func (c *Conn) readFull(data []byte) error {
 	return nil
 }
 
-// ReadPacket reads a complete MySQL packet.
+// Peek returns the next n bytes without consuming them, for inspecting what
+// the peer sends before parsing it. It is not supported after compression is
+// enabled.
+func (c *Conn) Peek(n int) ([]byte, error) {
+	br, ok := c.r.(*bufio.Reader)
+	if !ok {
+		return nil, errors.New("peek is not supported on compressed connections")
+	}
+	if c.readTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	data, err := br.Peek(n)
+	return data, errors.WithStack(err)
+}
+
+// ReadPacket reads a complete MySQL packet, or the rest of it if some chunks
+// are read by ReadPartialPacket. It fails with errNetPacketTooLarge if the
+// accumulated payload exceeds maxAllowedPacket.
 func (c *Conn) ReadPacket(b *bytes.Buffer) error {
 	for {
 		n, err := c.ReadPartialPacket(b)
@@ -173,8 +273,25 @@ func (c *Conn) ReadPacket(b *bytes.Buffer) error {
 }
 
 // ReadpartialPacket reads a MySQL wire packet. It may be
-// part of a larger packet.
+// part of a larger packet. It fails with errNetPacketTooLarge if the payload
+// accumulated with the previous chunks exceeds maxAllowedPacket, which is
+// checked before the buffer grows.
 func (c *Conn) ReadPartialPacket(b *bytes.Buffer) (n int, err error) {
+	if !c.inPacket {
+		c.remain = c.maxAllowedPacket
+	}
+	n, err = c.readPartialPacket(b, c.remain)
+	if err != nil {
+		return n, err
+	}
+	c.inPacket = n == MaxPayloadLen
+	c.remain -= uint64(n)
+	return n, nil
+}
+
+// readPartialPacket reads a MySQL wire packet whose payload must not exceed
+// limit. The limit is checked before growing the buffer.
+func (c *Conn) readPartialPacket(b *bytes.Buffer, limit uint64) (n int, err error) {
 	var head [4]byte
 	if err = c.readFull(head[:]); err != nil {
 		return
@@ -185,11 +302,14 @@ func (c *Conn) ReadPartialPacket(b *bytes.Buffer) (n int, err error) {
 	}
 	sequence := head[3]
 	if sequence != c.sequence {
-		return 0, errors.Errorf("invalid sequence %d != %d", sequence, c.sequence)
+		return 0, errors.WithStack(&sequenceError{got: sequence, want: c.sequence})
 	}
 	c.sequence++
 
 	n = readLen3(head[:3])
+	if uint64(n) > limit {
+		return 0, errors.WithStack(errNetPacketTooLarge)
+	}
 	b.Grow(n)
 	readLen, err := b.ReadFrom(&io.LimitedReader{R: c.r, N: int64(n)})
 	if int(readLen) != n {
@@ -198,6 +318,11 @@ func (c *Conn) ReadPartialPacket(b *bytes.Buffer) (n int, err error) {
 	return n, nil
 }
 
+// Sequence returns the sequence number expected for the next packet.
+func (c *Conn) Sequence() uint8 {
+	return c.sequence
+}
+
 // WritePacket writes data.
 func (c *Conn) WritePacket(data []byte) error {
 	if c.seqreset&SeqResetOnWrite != 0 {
@@ -248,11 +373,42 @@ func (p *Conn) RawConn() net.Conn {
 	return p.conn
 }
 
+// BufferedConn returns the underlying net.Conn. Different from RawConn, data
+// already buffered by Conn are read first, e.g. a TLS ClientHello sent right
+// after the SSL request. Used for upgrading to TLS or relaying raw bytes.
+func (p *Conn) BufferedConn() net.Conn {
+	if br, ok := p.r.(*bufio.Reader); ok && br.Buffered() > 0 {
+		return &bufferedConn{Conn: p.conn, r: br}
+	}
+	return p.conn
+}
+
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 // Close closes the connection.
 func (p *Conn) Close() {
 	p.conn.Close()
 }
 
+// CloseWrite shuts down the write side of the connection while reads keep
+// working, so the peer reads EOF. Data buffered by Conn must be flushed
+// first. It fails if the underlying net.Conn cannot shut down its write
+// side, which *net.TCPConn and *tls.Conn can.
+func (p *Conn) CloseWrite() error {
+	cw, ok := p.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return errors.Errorf("%T does not support closing write", p.conn)
+	}
+	return errors.WithStack(cw.CloseWrite())
+}
+
 // SetResetOption marks the connection to reset sequence on next read/write.
 func (c *Conn) SetResetOption(opt uint8) {
 	c.seqreset = opt
@@ -261,9 +417,24 @@ func (c *Conn) SetResetOption(opt uint8) {
 	}
 }
 
-// EnableCompression wraps the underlying reader and writer to support compression.
-func (c *Conn) EnableCompression() {
+// EnableCompression wraps the underlying reader and writer to support
+// compression, compressing written data with the zlib level.
+func (c *Conn) EnableCompression(level int) {
 	c.compressor = NewCompressor(c.r, c.w)
+	c.compressor.SetCompressLevel(level)
 	c.r = c.compressor
 	c.w = c.compressor
 }
+
+// SetCompressWrite sets whether data written to the compressed connection is
+// compressed. It must be called after EnableCompression.
+func (c *Conn) SetCompressWrite(enabled bool) {
+	c.compressor.SetCompressWrite(enabled)
+}
+
+// SetCompressThreshold sets the length below which data written to the
+// compressed connection is not compressed. It must be called after
+// EnableCompression.
+func (c *Conn) SetCompressThreshold(threshold int) {
+	c.compressor.SetCompressThreshold(threshold)
+}
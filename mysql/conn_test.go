@@ -2,6 +2,7 @@ package mysql
 
 import (
 	"bytes"
+	"compress/zlib"
 	"io"
 	"math/rand"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -64,6 +66,59 @@ func testConnRequestResponse(t *testing.T, client, server *Conn) {
 	}
 }
 
+func TestConnOversizedPacket(t *testing.T) {
+	client, server := makeConnPair()
+	defer client.Close()
+	defer server.Close()
+
+	// The first chunk fits, the accumulated size of the second one does not.
+	server.SetMaxAllowedPacket(MaxPayloadLen + 10)
+	go func() {
+		client.WritePacket(make([]byte, MaxPayloadLen+100))
+		client.Flush()
+	}()
+
+	var b bytes.Buffer
+	err := server.ReadPacket(&b)
+	require.ErrorIs(t, err, errNetPacketTooLarge)
+	require.Equal(t, MaxPayloadLen, b.Len())
+}
+
+func TestConnOversizedPartialPacket(t *testing.T) {
+	client, server := makeConnPair()
+	defer client.Close()
+	defer server.Close()
+	server.SetMaxAllowedPacket(1024)
+
+	// A declared length beyond the limit is rejected before the buffer grows.
+	go func() {
+		client.RawConn().Write([]byte{0xff, 0xff, 0xff, 0})
+	}()
+	var b bytes.Buffer
+	_, err := server.ReadPartialPacket(&b)
+	require.ErrorIs(t, err, errNetPacketTooLarge)
+	require.Less(t, b.Cap(), 1024)
+
+	// The limit applies to the payload accumulated over chunks.
+	client, server = makeConnPair()
+	defer client.Close()
+	defer server.Close()
+	server.SetMaxAllowedPacket(MaxPayloadLen + 10)
+	go func() {
+		client.WritePacket(make([]byte, 10))
+		client.WritePacket(make([]byte, MaxPayloadLen+100))
+		client.Flush()
+	}()
+	n, err := server.ReadPartialPacket(&b)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	n, err = server.ReadPartialPacket(&b)
+	require.NoError(t, err)
+	require.Equal(t, MaxPayloadLen, n)
+	_, err = server.ReadPartialPacket(&b)
+	require.ErrorIs(t, err, errNetPacketTooLarge)
+}
+
 func randomPayloads() [][]byte {
 	p := make([][]byte, rand.Intn(10)+1)
 	for i := range p {
@@ -136,7 +191,81 @@ func makeConnPair() (*Conn, *Conn) {
 
 func makeConnPairWithCompression() (*Conn, *Conn) {
 	conn1, conn2 := makeConnPair()
-	conn1.EnableCompression()
-	conn2.EnableCompression()
+	conn1.EnableCompression(zlib.DefaultCompression)
+	conn2.EnableCompression(zlib.DefaultCompression)
 	return conn1, conn2
 }
+
+func TestConnIsEOFPacket(t *testing.T) {
+	eof := []byte{HeaderEOF, 0, 0, 2, 0}
+	// An OK packet with the EOF header and session state info.
+	ok := append([]byte{HeaderEOF, 0, 0, 2, 0x40, 0, 0}, bytes.Repeat([]byte{1}, 10)...)
+	row := append([]byte{HeaderEOF}, bytes.Repeat([]byte{1}, 8)...)
+
+	var c Conn
+	require.Equal(t, uint32(0), c.Capability())
+	require.True(t, c.IsEOFPacket(eof))
+	require.False(t, c.IsEOFPacket(ok))
+	require.False(t, c.IsEOFPacket(row))
+	require.False(t, c.IsEOFPacket([]byte{HeaderOK, 0, 0, 2, 0, 0, 0}))
+
+	c.SetCapability(DefaultCapability | ClientDeprecateEOF)
+	require.Equal(t, uint32(DefaultCapability|ClientDeprecateEOF), c.Capability())
+	require.True(t, c.IsEOFPacket(eof))
+	require.True(t, c.IsEOFPacket(ok))
+}
+
+func TestConnStatusFlags(t *testing.T) {
+	c := Conn{capability: DefaultCapability}
+	status, ok := c.StatusFlags([]byte{HeaderOK, 0xFC, 0x00, 0x01, 0x05, 0x03, 0x00, 0x00, 0x00})
+	require.True(t, ok)
+	require.Equal(t, ServerStatusInTrans|ServerStatusAutocommit, status)
+	status, ok = c.StatusFlags([]byte{HeaderEOF, 0x00, 0x00, 0x02, 0x00})
+	require.True(t, ok)
+	require.Equal(t, ServerStatusAutocommit, status)
+	_, ok = c.StatusFlags([]byte{HeaderErr, 0x13, 0x04})
+	require.False(t, ok)
+
+	c.SetCapability(DefaultCapability | ClientDeprecateEOF)
+	status, ok = c.StatusFlags([]byte{HeaderEOF, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00})
+	require.True(t, ok)
+	require.Equal(t, ServerStatusInTrans, status)
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	rawClient, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	client := NewConn(rawClient)
+	defer client.Close()
+	server := NewConn(<-accepted)
+	defer server.Close()
+
+	require.NoError(t, client.WritePacket([]byte{1}))
+	require.NoError(t, client.Flush())
+	require.NoError(t, client.CloseWrite())
+	// The peer reads the packet written before, then EOF.
+	var b bytes.Buffer
+	require.NoError(t, server.ReadPacket(&b))
+	require.Equal(t, []byte{1}, b.Bytes())
+	b.Reset()
+	require.Equal(t, io.EOF, errors.Cause(server.ReadPacket(&b)))
+	// Writes of the peer are still read.
+	require.NoError(t, server.WritePacket([]byte{2}))
+	require.NoError(t, server.Flush())
+	b.Reset()
+	require.NoError(t, client.ReadPacket(&b))
+	require.Equal(t, []byte{2}, b.Bytes())
+
+	conn, _ := makeConnPair()
+	require.Error(t, conn.CloseWrite())
+}
@@ -16,6 +16,17 @@ const (
 	HeaderOK  = 0x00
 	HeaderEOF = 0xFE
 	HeaderErr = 0xFF
+	// HeaderLocalInFile starts a LOCAL INFILE request in a query response.
+	HeaderLocalInFile = 0xFB
+	// HeaderAuthMoreData starts an AuthMoreData packet during auth.
+	HeaderAuthMoreData = 0x01
+)
+
+// Statuses of caching_sha2_password sent in AuthMoreData.
+const (
+	CachingSha2RequestPublicKey = 0x02
+	CachingSha2FastAuthSuccess  = 0x03
+	CachingSha2PerformFullAuth  = 0x04
 )
 
 // Server information.
@@ -63,6 +74,60 @@ const (
 	ClientCanHandleExpiredPasswords
 	ClientSessionTrack
 	ClientDeprecateEOF
+	ClientOptionalResultsetMetadata
+	// ClientZstdCompressionAlgorithm is never advertised, as the gateway only
+	// implements zlib compression.
+	ClientZstdCompressionAlgorithm
+)
+
+// ClientMySQL shares the bit with ClientLongPassword. MariaDB peers clear it to
+// announce extended capabilities stored in the reserved bytes.
+const ClientMySQL = ClientLongPassword
+
+// MariaDB extended capabilities, i.e. the upper 32 bits of its capabilities.
+const (
+	MariaDBClientProgress uint32 = 1 << iota
+	MariaDBClientComMulti
+	MariaDBClientStmtBulkOperations
+	MariaDBClientExtendedTypeInfo
+	MariaDBClientCacheMetadata
+)
+
+// Command information.
+const (
+	ComSleep byte = iota
+	ComQuit
+	ComInitDB
+	ComQuery
+	ComFieldList
+	ComCreateDB
+	ComDropDB
+	ComRefresh
+	ComShutdown
+	ComStatistics
+	ComProcessInfo
+	ComConnect
+	ComProcessKill
+	ComDebug
+	ComPing
+	ComTime
+	ComDelayedInsert
+	ComChangeUser
+	ComBinlogDump
+	ComTableDump
+	ComConnectOut
+	ComRegisterSlave
+	ComStmtPrepare
+	ComStmtExecute
+	ComStmtSendLongData
+	ComStmtClose
+	ComStmtReset
+	ComSetOption
+	ComStmtFetch
+	ComDaemon
+	ComBinlogDumpGtid
+	ComResetConnection
+	ComEnd
 )
 
 // Auth name information.
@@ -522,6 +587,20 @@ var CollationNames = map[string]uint8{
 }
 
 const (
-	ErrCodeUnknown = 1105
-	UnknownState   = "08S01"
+	ErrCodeConCount       = 1040
+	ErrCodeAccessDenied   = 1045
+	ErrCodeUnknownCom     = 1047
+	ErrCodeServerShutdown = 1053
+	ErrCodeUnknown        = 1105
+	// ErrCodeNetPacketTooLarge is ER_NET_PACKET_TOO_LARGE.
+	ErrCodeNetPacketTooLarge = 1153
+	// ErrCodeMaxPreparedStmtCountReached is
+	// ER_MAX_PREPARED_STMT_COUNT_REACHED.
+	ErrCodeMaxPreparedStmtCountReached = 1461
+	// ErrCodeSecureTransportRequired is ER_SECURE_TRANSPORT_REQUIRED.
+	ErrCodeSecureTransportRequired = 3159
+	// ErrCodeTiKVServerBusy is TiDB's ErrTiKVServerBusy, which TiDB clients
+	// treat as retryable.
+	ErrCodeTiKVServerBusy = 9003
+	UnknownState          = "08S01"
 )
@@ -0,0 +1,36 @@
+package mysql
+
+import "github.com/pkg/errors"
+
+// AuthMoreData is sent by the server during auth with data specific to the
+// auth plugin, e.g. the result of caching_sha2_password fast auth or a
+// public key.
+type AuthMoreData struct {
+	Data []byte
+}
+
+// Write writes the packet to a buffer.
+func (p *AuthMoreData) Write(b *Buffer) {
+	b.WriteByte(HeaderAuthMoreData)
+	b.WriteBytes(p.Data)
+}
+
+// Read reads the packet from a buffer.
+func (p *AuthMoreData) Read(b *Buffer) error {
+	header, err := b.ReadByte()
+	if err != nil {
+		return err
+	}
+	if header != HeaderAuthMoreData {
+		return errors.WithStack(ErrMalformPacket)
+	}
+	p.Data = append([]byte(nil), b.Bytes()...)
+	return nil
+}
+
+// FastAuthSuccess returns whether the packet tells that caching_sha2_password
+// fast auth succeeds, in which case the OK packet follows without a reply
+// from the client.
+func (p *AuthMoreData) FastAuthSuccess() bool {
+	return len(p.Data) == 1 && p.Data[0] == CachingSha2FastAuthSuccess
+}
@@ -0,0 +1,46 @@
+package mysql
+
+import "github.com/pkg/errors"
+
+// eofPacketMaxLen is the max length of EOF packets during auth: the header,
+// warnings and status flags. A longer packet with the EOF header is an auth
+// switch request.
+const eofPacketMaxLen = 5
+
+// AuthSwitchRequest is sent by the server during auth to make the client
+// switch to another auth plugin.
+type AuthSwitchRequest struct {
+	PluginName string
+	// PluginData is the data for the plugin as sent, e.g. the scramble
+	// followed by a NUL for mysql_native_password.
+	PluginData []byte
+}
+
+// IsAuthSwitchRequest returns whether a packet read during auth is an auth
+// switch request rather than an EOF packet.
+func IsAuthSwitchRequest(data []byte) bool {
+	return len(data) > eofPacketMaxLen && data[0] == HeaderEOF
+}
+
+// Write writes the packet to a buffer.
+func (p *AuthSwitchRequest) Write(b *Buffer) {
+	b.WriteByte(HeaderEOF)
+	b.WriteStringNull(p.PluginName)
+	b.WriteBytes(p.PluginData)
+}
+
+// Read reads the packet from a buffer.
+func (p *AuthSwitchRequest) Read(b *Buffer) error {
+	if !IsAuthSwitchRequest(b.Bytes()) {
+		return errors.WithStack(ErrMalformPacket)
+	}
+	if err := b.Skip(1); err != nil {
+		return err
+	}
+	var err error
+	if p.PluginName, err = b.ReadStringNull(); err != nil {
+		return err
+	}
+	p.PluginData = append([]byte(nil), b.Bytes()...)
+	return nil
+}
@@ -20,7 +20,27 @@ func (e *Err) Write(b *Buffer) {
 	b.WriteBytes([]byte(e.Message))
 }
 
-// Read reads packet from a buffer.
+// Read reads packet from a buffer. The SQL state is optional even with
+// ClientProtocol41, e.g. errors sent before the handshake do not have it.
 func (e *Err) Read(b *Buffer) error {
-	panic("implemented")
+	var err error
+	if e.Header, err = b.ReadByte(); err != nil {
+		return err
+	}
+	if e.Code, err = b.ReadUint16(); err != nil {
+		return err
+	}
+	e.State = ""
+	if data := b.Bytes(); e.Capability&ClientProtocol41 != 0 && len(data) > 0 && data[0] == '#' {
+		if err = b.Skip(1); err != nil {
+			return err
+		}
+		state, err := b.ReadBytes(5)
+		if err != nil {
+			return err
+		}
+		e.State = string(state)
+	}
+	e.Message = string(b.Bytes())
+	return nil
 }
@@ -12,6 +12,12 @@ type Handshake struct {
 	CharacterSet    uint8
 	StatusFlags     uint16
 	AuthPluginName  string
+	// ExtCapability is the MariaDB extended capabilities. It is only
+	// meaningful if ClientMySQL is not set.
+	ExtCapability uint32
+	// Strict makes Read reject packets deviating from the protocol, such as
+	// a non-zero filler. Otherwise minor deviations are tolerated.
+	Strict bool
 }
 
 // Write writes the packet to a buffer.
@@ -44,16 +50,21 @@ func (s *Handshake) Write(b *Buffer) {
 	} else {
 		b.WriteByte(0x00)
 	}
-	// string[10]     reserved (all [00])
-	b.WriteBytes(make([]byte, 10))
+	// string[6]      reserved (all [00])
+	b.WriteBytes(make([]byte, 6))
+	// 4              reserved (all [00]) or MariaDB extended capabilities
+	b.WriteUint32(s.ExtCapability)
 	//   if capabilities & CLIENT_SECURE_CONNECTION {
 	//     string[$len]   auth-plugin-data-part-2 ($len=MAX(13, length of auth-plugin-data - 8))
 	if s.Capability&ClientSecureConnection != 0 {
-		l := len(s.AuthPluginData) - 8
-		b.WriteBytes(s.AuthPluginData[8 : 8+l])
+		// The length of auth-plugin-data includes the NUL terminator.
+		l := len(s.AuthPluginData) + 1 - 8
 		if l < 13 {
-			b.WriteBytes(make([]byte, 13-l))
+			l = 13
 		}
+		b.WriteBytes(s.AuthPluginData[8:])
+		// The NUL terminator and the padding.
+		b.WriteBytes(make([]byte, l-(len(s.AuthPluginData)-8)))
 	}
 	//   if capabilities & CLIENT_PLUGIN_AUTH {
 	//    string[NUL]    auth-plugin name
@@ -105,9 +116,13 @@ func (s *Handshake) Read(b *Buffer) error {
 	s.AuthPluginData = append(s.AuthPluginData, data...)
 
 	// 1              [00] filler
-	if _, err := b.ReadByte(); err != nil {
+	filler, err := b.ReadByte()
+	if err != nil {
 		return err
 	}
+	if s.Strict && filler != 0x00 {
+		return errors.Errorf("invalid handshake filler 0x%02x", filler)
+	}
 
 	// 2              capability flags (lower 2 bytes)
 	capLow, err := b.ReadUint16()
@@ -150,25 +165,39 @@ func (s *Handshake) Read(b *Buffer) error {
 	if err != nil {
 		return err
 	}
+	if s.Strict && s.Capability&ClientPluginAuth == 0 && authDataLen != 0 {
+		return errors.Errorf("invalid auth-plugin-data length %d without CLIENT_PLUGIN_AUTH", authDataLen)
+	}
 
-	// string[10]     reserved (all [00])
-	if err = b.Skip(10); err != nil {
+	// string[6]      reserved (all [00])
+	if err = b.Skip(6); err != nil {
+		return err
+	}
+	// 4              reserved (all [00]) or MariaDB extended capabilities
+	extCapability, err := b.ReadUint32()
+	if err != nil {
 		return err
 	}
+	if s.Capability&ClientMySQL == 0 {
+		s.ExtCapability = extCapability
+	}
 
 	//   if capabilities & CLIENT_SECURE_CONNECTION {
 	//     string[$len]   auth-plugin-data-part-2 ($len=MAX(13, length of auth-plugin-data - 8))
 	if s.Capability&ClientSecureConnection != 0 {
-		l := int(authDataLen) - 8 - 1
+		l := int(authDataLen) - 8
+		if l < 13 {
+			l = 13
+		}
 		data, err = b.ReadBytes(l)
 		if err != nil {
 			return err
 		}
-		if l < 13 {
-			err = b.Skip(13 - l)
-			if err != nil {
-				return err
-			}
+		// The scramble is terminated by a NUL byte which is not part of it.
+		if data[l-1] == 0x00 {
+			data = data[:l-1]
+		} else if s.Strict {
+			return errors.New("auth-plugin-data is not NUL terminated")
 		}
 		s.AuthPluginData = append(s.AuthPluginData, data...)
 	}
@@ -1,5 +1,10 @@
 package mysql
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
 // HandshakerResponse is the initial handshake response from the client.
 type HandshakeResponse struct {
 	Capability    uint32
@@ -10,6 +15,57 @@ type HandshakeResponse struct {
 	Auth          []byte
 	AuthPlugin    string
 	Attrs         map[string]string
+	// ExtCapability is the MariaDB extended capabilities. It is only
+	// meaningful if ClientMySQL is not set.
+	ExtCapability uint32
+	// Reserved is the 23-byte reserved block sent by the client, nil if it
+	// is all zero besides ExtCapability. It is only written if
+	// PreserveReserved is set, with the last 4 bytes replaced by
+	// ExtCapability if ClientMySQL is not set.
+	Reserved         []byte
+	PreserveReserved bool
+	// MaxUserNameLen and MaxDBNameLen make Read fail with ErrMalformPacket
+	// if the user name or database is longer. 0 means no limit.
+	MaxUserNameLen int
+	MaxDBNameLen   int
+	// KeepRaw makes Read keep the packet, so that Splice can forward it
+	// with minimal changes.
+	KeepRaw bool
+	raw     *rawHandshakeResponse
+}
+
+// rawHandshakeResponse is a handshake response as read, with the offsets of
+// the fields Splice replaces.
+type rawHandshakeResponse struct {
+	data                   []byte
+	userStart, userEnd     int
+	pluginStart, pluginEnd int
+}
+
+// spliceLayoutCapability are the capabilities deciding the layout of the
+// fields kept by Splice.
+const spliceLayoutCapability = ClientProtocol41 | ClientPluginAuthLenencClientData |
+	ClientSecureConnection | ClientConnectWithDB | ClientConnectAttrs
+
+// reservedLen is the length of the reserved block, including the 4 bytes of
+// MariaDB extended capabilities.
+const reservedLen = 23
+
+// writeReserved writes the reserved block.
+func (s *HandshakeResponse) writeReserved(b *Buffer) {
+	if !s.PreserveReserved || len(s.Reserved) != reservedLen {
+		// string[19]     reserved (all [0])
+		b.WriteBytes(make([]byte, 19))
+		// 4              reserved (all [0]) or MariaDB extended capabilities
+		b.WriteUint32(s.ExtCapability)
+		return
+	}
+	b.WriteBytes(s.Reserved[:19])
+	if s.Capability&ClientMySQL == 0 {
+		b.WriteUint32(s.ExtCapability)
+	} else {
+		b.WriteBytes(s.Reserved[19:])
+	}
 }
 
 // Write writes the handshake response to the buffer.
@@ -45,8 +101,7 @@ func (s *HandshakeResponse) Write(b *Buffer) {
 	b.WriteUint32(s.MaxPacketSize)
 	// 1              character set
 	b.WriteByte(s.CharacterSet)
-	// string[23]     reserved (all [0])
-	b.WriteBytes(make([]byte, 23))
+	s.writeReserved(b)
 	// string[NUL]    username
 	b.WriteStringNull(s.UserName)
 	//    if capabilities & CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA {
@@ -86,19 +141,82 @@ func (s *HandshakeResponse) Write(b *Buffer) {
 	//     lenenc-str     key
 	//     lenenc-str     value
 	if s.Capability&ClientConnectAttrs != 0 {
-		ab := newBuffer(nil)
-		for k, v := range s.Attrs {
-			ab.WriteLenencString(k)
-			ab.WriteLenencString(v)
-		}
+		ab := s.attrsBuffer()
 		b.WriteLenencInt(uint64(ab.Len()))
 		b.WriteBytes(ab.Bytes())
 	}
 }
 
+func (s *HandshakeResponse) attrsBuffer() *Buffer {
+	ab := newBuffer(nil)
+	for k, v := range s.Attrs {
+		ab.WriteLenencString(k)
+		ab.WriteLenencString(v)
+	}
+	return ab
+}
+
+// AttrsLen returns the length of the serialized connection attributes.
+func (s *HandshakeResponse) AttrsLen() int {
+	return s.attrsBuffer().Len()
+}
+
+// Splice returns the packet read with only the capability flags, user name
+// and auth plugin name replaced, instead of encoding it again by Write. It
+// returns false if the packet is not kept or other fields have changed, in
+// which case Write should be used.
+func (s *HandshakeResponse) Splice() ([]byte, bool) {
+	if s.raw == nil {
+		return nil, false
+	}
+	orig := HandshakeResponse{KeepRaw: true}
+	if err := orig.Read(newBuffer(s.raw.data)); err != nil {
+		return nil, false
+	}
+	raw := orig.raw
+	if orig.Capability&ClientProtocol41 == 0 ||
+		(orig.Capability^s.Capability)&spliceLayoutCapability != 0 ||
+		orig.MaxPacketSize != s.MaxPacketSize ||
+		orig.CharacterSet != s.CharacterSet ||
+		orig.DBName != s.DBName ||
+		!bytes.Equal(orig.Auth, s.Auth) ||
+		!attrsEqual(orig.Attrs, s.Attrs) ||
+		(orig.Capability&ClientMySQL == 0 && orig.ExtCapability != s.ExtCapability) ||
+		(orig.Reserved != nil && !s.PreserveReserved) {
+		return nil, false
+	}
+
+	b := newBuffer(nil)
+	b.WriteUint32(s.Capability)
+	b.WriteBytes(raw.data[4:raw.userStart])
+	b.WriteStringNull(s.UserName)
+	b.WriteBytes(raw.data[raw.userEnd:raw.pluginStart])
+	if s.Capability&ClientPluginAuth != 0 {
+		b.WriteStringNull(s.AuthPlugin)
+	}
+	b.WriteBytes(raw.data[raw.pluginEnd:])
+	return b.Bytes(), true
+}
+
+func attrsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
 // Read reads the handshake response from the buffer.
 func (s *HandshakeResponse) Read(b *Buffer) error {
 	var err error
+	s.raw = nil
+	data := b.Bytes()
+	// pos is the offset of the next field in data.
+	pos := func() int { return len(data) - b.Len() }
 	// 4              capability flags
 	s.Capability, err = b.ReadUint32()
 	if s.Capability&ClientProtocol41 == 0 {
@@ -110,7 +228,7 @@ func (s *HandshakeResponse) Read(b *Buffer) error {
 			return err
 		}
 		// string[NUL]    username
-		s.UserName, err = b.ReadStringNull()
+		s.UserName, err = b.ReadStringNullMax(s.MaxUserNameLen)
 		if err != nil {
 			return err
 		}
@@ -126,7 +244,7 @@ func (s *HandshakeResponse) Read(b *Buffer) error {
 				return err
 			}
 			s.Auth = []byte(auth)
-			s.DBName, err = b.ReadStringNull()
+			s.DBName, err = b.ReadStringNullMax(s.MaxDBNameLen)
 			if err != nil {
 				return err
 			}
@@ -148,11 +266,21 @@ func (s *HandshakeResponse) Read(b *Buffer) error {
 	if err != nil {
 		return err
 	}
-	// string[23]     reserved (all [0])
-	err = b.Skip(23)
+	// string[19]     reserved (all [0])
+	// 4              reserved (all [0]) or MariaDB extended capabilities
+	reserved, err := b.ReadBytes(reservedLen)
 	if err != nil {
 		return err
 	}
+	s.Reserved = nil
+	if s.Capability&ClientMySQL == 0 {
+		s.ExtCapability = binary.LittleEndian.Uint32(reserved[19:])
+		if !bytes.Equal(reserved[:19], make([]byte, 19)) {
+			s.Reserved = append([]byte(nil), reserved...)
+		}
+	} else if !bytes.Equal(reserved, make([]byte, reservedLen)) {
+		s.Reserved = append([]byte(nil), reserved...)
+	}
 
 	// Handle SSL Connection Request.
 	if s.Capability&ClientSSL != 0 && b.Len() == 0 {
@@ -160,10 +288,12 @@ func (s *HandshakeResponse) Read(b *Buffer) error {
 	}
 
 	// string[NUL]    username
-	s.UserName, err = b.ReadStringNull()
+	userStart := pos()
+	s.UserName, err = b.ReadStringNullMax(s.MaxUserNameLen)
 	if err != nil {
 		return err
 	}
+	userEnd := pos()
 	//    if capabilities & CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA {
 	// 	    lenenc-int     length of auth-response
 	// 	    string[n]      auth-response
@@ -202,7 +332,7 @@ func (s *HandshakeResponse) Read(b *Buffer) error {
 	//   string[NUL]    database
 	// }
 	if s.Capability&ClientConnectWithDB != 0 {
-		s.DBName, err = b.ReadStringNull()
+		s.DBName, err = b.ReadStringNullMax(s.MaxDBNameLen)
 		if err != nil {
 			return err
 		}
@@ -210,12 +340,22 @@ func (s *HandshakeResponse) Read(b *Buffer) error {
 	// if capabilities & CLIENT_PLUGIN_AUTH {
 	//   string[NUL]    auth plugin name
 	// }
+	pluginStart := pos()
 	if s.Capability&ClientPluginAuth != 0 {
 		s.AuthPlugin, err = b.ReadStringNull()
 		if err != nil {
 			return err
 		}
 	}
+	if s.KeepRaw {
+		s.raw = &rawHandshakeResponse{
+			data:        append([]byte(nil), data...),
+			userStart:   userStart,
+			userEnd:     userEnd,
+			pluginStart: pluginStart,
+			pluginEnd:   pos(),
+		}
+	}
 	//   if capabilities & CLIENT_CONNECT_ATTRS {
 	//     lenenc-int     length of all key-values
 	//     lenenc-str     key
@@ -248,3 +388,23 @@ func (s *HandshakeResponse) Read(b *Buffer) error {
 
 	return nil
 }
+
+// SSLRequest is the truncated HandshakeResponse sent by the client to
+// request upgrading to TLS. It must not contain any credentials.
+type SSLRequest HandshakeResponse
+
+// Write writes the ssl request to the buffer.
+func (s *SSLRequest) Write(b *Buffer) {
+	// 4              capability flags
+	b.WriteUint32(s.Capability)
+	// 4              max-packet size
+	b.WriteUint32(s.MaxPacketSize)
+	// 1              character set
+	b.WriteByte(s.CharacterSet)
+	(*HandshakeResponse)(s).writeReserved(b)
+}
+
+// Read reads the ssl request from the buffer.
+func (s *SSLRequest) Read(b *Buffer) error {
+	return (*HandshakeResponse)(s).Read(b)
+}
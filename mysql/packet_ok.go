@@ -0,0 +1,82 @@
+package mysql
+
+// OK represents a MySQL packet that indicates a successful command.
+type OK struct {
+	Header       byte
+	AffectedRows uint64
+	LastInsertID uint64
+	StatusFlags  uint16
+	Warnings     uint16
+	Info         string
+	// SessionState is the raw session state changes, only present with
+	// ClientSessionTrack and ServerSessionStateChanged.
+	SessionState []byte
+	Capability   uint32
+}
+
+// Write writes the packet to a buffer.
+func (p *OK) Write(b *Buffer) {
+	b.WriteByte(p.Header)
+	b.WriteLenencInt(p.AffectedRows)
+	b.WriteLenencInt(p.LastInsertID)
+	if p.Capability&ClientProtocol41 != 0 {
+		b.WriteUint16(p.StatusFlags)
+		b.WriteUint16(p.Warnings)
+	} else if p.Capability&ClientTransactions != 0 {
+		b.WriteUint16(p.StatusFlags)
+	}
+	if p.Capability&ClientSessionTrack != 0 {
+		b.WriteLenencString(p.Info)
+		if p.StatusFlags&ServerSessionStateChanged != 0 {
+			b.WriteLenencString(string(p.SessionState))
+		}
+		return
+	}
+	b.WriteBytes([]byte(p.Info))
+}
+
+// Read reads the packet from a buffer.
+func (p *OK) Read(b *Buffer) error {
+	var err error
+	if p.Header, err = b.ReadByte(); err != nil {
+		return err
+	}
+	if p.AffectedRows, err = b.ReadLenencInt(); err != nil {
+		return err
+	}
+	if p.LastInsertID, err = b.ReadLenencInt(); err != nil {
+		return err
+	}
+	if p.Capability&ClientProtocol41 != 0 {
+		if p.StatusFlags, err = b.ReadUint16(); err != nil {
+			return err
+		}
+		if p.Warnings, err = b.ReadUint16(); err != nil {
+			return err
+		}
+	} else if p.Capability&ClientTransactions != 0 {
+		if p.StatusFlags, err = b.ReadUint16(); err != nil {
+			return err
+		}
+	}
+	p.Info, p.SessionState = "", nil
+	if p.Capability&ClientSessionTrack == 0 {
+		p.Info = string(b.Bytes())
+		return nil
+	}
+	// The info may be omitted if it is empty and there is no session state.
+	if b.Len() == 0 {
+		return nil
+	}
+	if p.Info, err = b.ReadLenencString(); err != nil {
+		return err
+	}
+	if p.StatusFlags&ServerSessionStateChanged != 0 {
+		state, err := b.ReadLenencString()
+		if err != nil {
+			return err
+		}
+		p.SessionState = []byte(state)
+	}
+	return nil
+}
@@ -1,10 +1,15 @@
 package mysql
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1" // nolint:gosec // nolint
+	"encoding/hex"
 	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestProtocol(t *testing.T) {
@@ -27,7 +32,403 @@ func TestProtocol(t *testing.T) {
 	assert.Equal(t, toJson(hs2), toJson(hs1))
 }
 
+func TestErrRoundTrip(t *testing.T) {
+	for _, capability := range []uint32{DefaultCapability, DefaultCapability &^ ClientProtocol41} {
+		e1 := Err{
+			Header:     HeaderErr,
+			Code:       1045,
+			State:      "28000",
+			Message:    "Access denied for user 'root'",
+			Capability: capability,
+		}
+		b := newBuffer(nil)
+		e1.Write(b)
+		e2 := Err{Capability: capability}
+		require.NoError(t, e2.Read(newBuffer(b.Bytes())))
+		if capability&ClientProtocol41 == 0 {
+			e1.State = ""
+		}
+		require.Equal(t, e1, e2)
+	}
+
+	// The state may be missing with ClientProtocol41.
+	e := Err{Capability: DefaultCapability}
+	require.NoError(t, e.Read(newBuffer([]byte("\xff\x10\x04Too many connections"))))
+	require.Equal(t, uint16(ErrCodeConCount), e.Code)
+	require.Empty(t, e.State)
+	require.Equal(t, "Too many connections", e.Message)
+
+	require.Error(t, e.Read(newBuffer([]byte{HeaderErr, 0x10})))
+}
+
+func TestOKRoundTrip(t *testing.T) {
+	for _, ok1 := range []OK{
+		{
+			AffectedRows: 300,
+			LastInsertID: 1 << 20,
+			StatusFlags:  ServerStatusAutocommit | ServerMoreResultsExists,
+			Warnings:     2,
+			Info:         "Rows matched: 300  Changed: 300  Warnings: 2",
+			Capability:   DefaultCapability,
+		},
+		{
+			AffectedRows: 1,
+			StatusFlags:  ServerStatusInTrans,
+			Info:         "info",
+			Capability:   DefaultCapability | ClientSessionTrack,
+		},
+		{
+			StatusFlags:  ServerStatusAutocommit | ServerSessionStateChanged,
+			SessionState: []byte{0x00, 0x0a, 0x0a, 'a', 'u', 't', 'o', 'c', 'o', 'm', 'm', 'i', 't'},
+			Capability:   DefaultCapability | ClientSessionTrack,
+		},
+		{
+			StatusFlags: ServerStatusAutocommit,
+			Info:        "info",
+			Capability:  DefaultCapability &^ ClientProtocol41,
+		},
+	} {
+		b := newBuffer(nil)
+		ok1.Write(b)
+		ok2 := OK{Capability: ok1.Capability}
+		require.NoError(t, ok2.Read(newBuffer(b.Bytes())))
+		require.Equal(t, ok1, ok2)
+	}
+
+	// The info is omitted by servers if it is empty.
+	ok := OK{Capability: DefaultCapability | ClientSessionTrack}
+	require.NoError(t, ok.Read(newBuffer([]byte{HeaderOK, 0, 0, 0x02, 0, 0, 0})))
+	require.Equal(t, ServerStatusAutocommit, ok.StatusFlags)
+	require.Empty(t, ok.Info)
+}
+
 func toJson(x interface{}) string {
 	jb, _ := json.Marshal(x)
 	return string(jb)
 }
+
+// Synthetic initial handshakes, not captures. Each has the version string,
+// capabilities and auth plugin of the server, with made-up connection IDs and
+// scrambles.
+var (
+	mysqlHandshake   = "0a382e302e323800080000001a4e2b3c5d6f112200ffffff0200ffdf15000000000000000000003344556677112233445566770063616368696e675f736861325f70617373776f726400"
+	tidbHandshake    = "0a352e372e32352d546944422d76362e312e3000a50100002f1b6e0c3a7d5412008fa22e0200190015000000000000000000006b2c4f1d0e7a3b5c69285d1f006d7973716c5f6e61746976655f70617373776f726400"
+	mariadbHandshake = "0a352e352e352d31302e362e372d4d61726961444200030000002b5d2f7c3e4a616000fef72d0200ff81150000000000001d0000004d2e5b723c29574e266a3f22006d7973716c5f6e61746976655f70617373776f726400"
+)
+
+func TestReadHandshake(t *testing.T) {
+	cases := []struct {
+		data          string
+		serverVersion string
+		authPlugin    string
+	}{
+		{mysqlHandshake, "8.0.28", AuthCachingSha2Password},
+		{tidbHandshake, "5.7.25-TiDB-v6.1.0", AuthNativePassword},
+		{mariadbHandshake, "5.5.5-10.6.7-MariaDB", AuthNativePassword},
+	}
+	for _, c := range cases {
+		data, err := hex.DecodeString(c.data)
+		require.NoError(t, err)
+		for _, strict := range []bool{false, true} {
+			hs := Handshake{Strict: strict}
+			require.NoError(t, hs.Read(newBuffer(data)))
+			require.Equal(t, c.serverVersion, hs.ServerVersion)
+			require.Equal(t, c.authPlugin, hs.AuthPluginName)
+			require.Len(t, hs.AuthPluginData, 20)
+		}
+	}
+}
+
+func TestReadHandshakeFiller(t *testing.T) {
+	data, err := hex.DecodeString(tidbHandshake)
+	require.NoError(t, err)
+	// filler follows protocol version, server version, connection id and
+	// auth-plugin-data-part-1.
+	data[1+len("5.7.25-TiDB-v6.1.0")+1+4+8] = 0x01
+
+	var hs Handshake
+	require.NoError(t, hs.Read(newBuffer(data)))
+	require.Equal(t, AuthNativePassword, hs.AuthPluginName)
+
+	hs = Handshake{Strict: true}
+	require.Error(t, hs.Read(newBuffer(data)))
+}
+
+func TestMariaDBExtCapability(t *testing.T) {
+	data, err := hex.DecodeString(mariadbHandshake)
+	require.NoError(t, err)
+	var hs Handshake
+	require.NoError(t, hs.Read(newBuffer(data)))
+	require.Zero(t, hs.Capability&ClientMySQL)
+	ext := MariaDBClientProgress | MariaDBClientStmtBulkOperations | MariaDBClientExtendedTypeInfo | MariaDBClientCacheMetadata
+	require.Equal(t, ext, hs.ExtCapability)
+
+	b := newBuffer(nil)
+	hs.Write(b)
+	require.Equal(t, data, b.Bytes())
+
+	res1 := HandshakeResponse{
+		Capability:    DefaultCapability &^ ClientMySQL,
+		MaxPacketSize: MaxPayloadLen,
+		CharacterSet:  DefaultCollationID,
+		UserName:      "root",
+		Auth:          make([]byte, 20),
+		AuthPlugin:    AuthNativePassword,
+		ExtCapability: MariaDBClientProgress | MariaDBClientStmtBulkOperations,
+	}
+	b = newBuffer(nil)
+	res1.Write(b)
+	var res2 HandshakeResponse
+	require.NoError(t, res2.Read(newBuffer(b.Bytes())))
+	require.Equal(t, res1, res2)
+}
+
+func TestHandshakeResponseReserved(t *testing.T) {
+	reserved := make([]byte, reservedLen)
+	copy(reserved, "reserved")
+	copy(reserved[19:], []byte{1, 2, 3, 4})
+	res1 := HandshakeResponse{
+		Capability:    DefaultCapability,
+		MaxPacketSize: MaxPayloadLen,
+		CharacterSet:  DefaultCollationID,
+		UserName:      "root",
+		Auth:          make([]byte, 20),
+		AuthPlugin:    AuthNativePassword,
+		Reserved:      reserved,
+	}
+	// Zeros are written by default.
+	b := newBuffer(nil)
+	res1.Write(b)
+	require.Equal(t, make([]byte, reservedLen), b.Bytes()[9:9+reservedLen])
+	var res2 HandshakeResponse
+	require.NoError(t, res2.Read(newBuffer(b.Bytes())))
+	require.Nil(t, res2.Reserved)
+
+	res1.PreserveReserved = true
+	b = newBuffer(nil)
+	res1.Write(b)
+	require.Equal(t, reserved, b.Bytes()[9:9+reservedLen])
+	res2 = HandshakeResponse{}
+	require.NoError(t, res2.Read(newBuffer(b.Bytes())))
+	require.Equal(t, reserved, res2.Reserved)
+	require.Zero(t, res2.ExtCapability)
+
+	// SSLRequest preserves them as well.
+	b = newBuffer(nil)
+	(*SSLRequest)(&res1).Write(b)
+	require.Equal(t, reserved, b.Bytes()[9:])
+}
+
+// testMySQLClientResponse is a synthetic handshake response, not a capture.
+// It follows the layout of the mysql 8.0 command-line client, i.e. its
+// capabilities and the order of its attributes, with made-up auth data, user
+// tidb1.root and database test.
+var testMySQLClientResponse = "8da6ff0100000001ff0000000000000000000000000000000000000000000000" +
+	"74696462312e726f6f7400205a3c0e9f1b7d22a4c6e8013f5d79b2e4f60a8c1e" +
+	"3b5d7f9102a4c6e8f01b3d5e746573740063616368696e675f736861325f7061" +
+	"7373776f72640072045f706964053238353139095f706c6174666f726d067838" +
+	"365f3634035f6f73054c696e75780c5f636c69656e745f6e616d65086c69626d" +
+	"7973716c076f735f75736572036465760f5f636c69656e745f76657273696f6e" +
+	"06382e302e33360c70726f6772616d5f6e616d65056d7973716c"
+
+func TestHandshakeResponseSplice(t *testing.T) {
+	raw, err := hex.DecodeString(testMySQLClientResponse)
+	require.NoError(t, err)
+	read := func(keep bool) *HandshakeResponse {
+		res := &HandshakeResponse{KeepRaw: keep}
+		require.NoError(t, res.Read(newBuffer(raw)))
+		return res
+	}
+
+	// The changes made by the gateway are spliced in, and the rest, like the
+	// order of attributes, is kept.
+	res := read(true)
+	res.UserName = "root"
+	res.AuthPlugin = AuthInvalidMethod
+	res.Capability &^= ClientCanHandleExpiredPasswords
+	data, ok := res.Splice()
+	require.True(t, ok)
+	expected := append([]byte(nil), raw...)
+	expected[2] &^= byte(ClientCanHandleExpiredPasswords >> 16)
+	expected = bytes.Replace(expected, []byte("tidb1.root\x00"), []byte("root\x00"), 1)
+	expected = bytes.Replace(expected, []byte(AuthCachingSha2Password+"\x00"), []byte(AuthInvalidMethod+"\x00"), 1)
+	require.Equal(t, expected, data)
+	spliced := &HandshakeResponse{}
+	require.NoError(t, spliced.Read(newBuffer(data)))
+	require.Equal(t, res.Capability, spliced.Capability)
+	require.Equal(t, "root", spliced.UserName)
+	require.Equal(t, "test", spliced.DBName)
+	require.Equal(t, res.Auth, spliced.Auth)
+	require.Equal(t, AuthInvalidMethod, spliced.AuthPlugin)
+	require.Equal(t, res.Attrs, spliced.Attrs)
+
+	// The plugin name is inserted if the client does not send one.
+	res = read(true)
+	res.Capability &^= ClientPluginAuth
+	b := newBuffer(nil)
+	res.Write(b)
+	res = &HandshakeResponse{KeepRaw: true}
+	require.NoError(t, res.Read(newBuffer(b.Bytes())))
+	res.Capability |= ClientPluginAuth
+	res.AuthPlugin = AuthInvalidMethod
+	data, ok = res.Splice()
+	require.True(t, ok)
+	spliced = &HandshakeResponse{}
+	require.NoError(t, spliced.Read(newBuffer(data)))
+	require.Equal(t, AuthInvalidMethod, spliced.AuthPlugin)
+	require.Equal(t, res.Attrs, spliced.Attrs)
+
+	// Other changes need encoding again.
+	for _, change := range []func(res *HandshakeResponse){
+		func(res *HandshakeResponse) { res.DBName = "mysql" },
+		func(res *HandshakeResponse) { res.Auth = make([]byte, 20) },
+		func(res *HandshakeResponse) { res.MaxPacketSize = 1 << 20 },
+		func(res *HandshakeResponse) { res.Attrs["_pid"] = "1" },
+		func(res *HandshakeResponse) { res.Capability &^= ClientConnectAttrs },
+	} {
+		res := read(true)
+		change(res)
+		_, ok := res.Splice()
+		require.False(t, ok)
+	}
+	_, ok = read(false).Splice()
+	require.False(t, ok)
+}
+
+func TestHandshakeResponseMaxLen(t *testing.T) {
+	res1 := HandshakeResponse{
+		Capability:    DefaultCapability,
+		MaxPacketSize: MaxPayloadLen,
+		CharacterSet:  DefaultCollationID,
+		UserName:      "c1.root",
+		DBName:        "test",
+		Auth:          []byte("01234567890123456789"),
+		AuthPlugin:    AuthNativePassword,
+	}
+	for _, capability := range []uint32{DefaultCapability, DefaultCapability &^ ClientProtocol41} {
+		res1.Capability = capability
+		b := newBuffer(nil)
+		res1.Write(b)
+		data := b.Bytes()
+
+		res2 := HandshakeResponse{MaxUserNameLen: len(res1.UserName), MaxDBNameLen: len(res1.DBName)}
+		require.NoError(t, res2.Read(newBuffer(data)))
+		require.Equal(t, res1.UserName, res2.UserName)
+		require.Equal(t, res1.DBName, res2.DBName)
+
+		res2 = HandshakeResponse{MaxUserNameLen: len(res1.UserName) - 1}
+		require.ErrorIs(t, res2.Read(newBuffer(data)), ErrMalformPacket)
+		if capability&ClientProtocol41 != 0 {
+			res2 = HandshakeResponse{MaxDBNameLen: len(res1.DBName) - 1}
+			require.ErrorIs(t, res2.Read(newBuffer(data)), ErrMalformPacket)
+		}
+	}
+
+	// The NUL is not looked for beyond the limit.
+	b := newBuffer(append(bytes.Repeat([]byte{'x'}, 100), 0))
+	_, err := b.ReadStringNullMax(10)
+	require.ErrorIs(t, err, ErrMalformPacket)
+	s, err := b.ReadStringNullMax(100)
+	require.NoError(t, err)
+	require.Len(t, s, 100)
+}
+
+func TestNativePasswordAuth(t *testing.T) {
+	scramble := []byte("0123456789abcdefghij")
+	auth := NativePasswordAuth("password", scramble)
+	require.Equal(t, "a41b086992be108194f80bdc922a1af85d38a142", hex.EncodeToString(auth))
+
+	// Verify it the way the server does with the stored SHA1(SHA1(password)),
+	// which is "*2470C0C06DEE42FD1618BB99005ADCA2EC9D1E19" in mysql.user.
+	stored, err := hex.DecodeString("2470c0c06dee42fd1618bb99005adca2ec9d1e19")
+	require.NoError(t, err)
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stored)
+	stage1 := h.Sum(nil)
+	for i := range stage1 {
+		stage1[i] ^= auth[i]
+	}
+	stage2 := sha1.Sum(stage1)
+	require.Equal(t, stored, stage2[:])
+
+	require.NotEqual(t, auth, NativePasswordAuth("password", []byte("jihgfedcba9876543210")))
+	require.Empty(t, NativePasswordAuth("", scramble))
+}
+
+func TestHandshakeScramble(t *testing.T) {
+	scramble, err := NewScramble(rand.Reader)
+	require.NoError(t, err)
+	require.Len(t, scramble, ScrambleLen)
+	require.NotEqual(t, make([]byte, ScrambleLen), scramble)
+	for _, c := range scramble {
+		require.NotZero(t, c)
+		require.Less(t, c, byte(0x80))
+	}
+
+	// A deterministic source gives reproducible scrambles.
+	src := append([]byte{0x00, '$', 0x80, 0x80 | '$', 0xC1}, bytes.Repeat([]byte{'a'}, ScrambleLen-5)...)
+	scramble, err = NewScramble(bytes.NewReader(src))
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{0x01, '%', 0x01, '%', 'A'}, bytes.Repeat([]byte{'a'}, ScrambleLen-5)...), scramble)
+	_, err = NewScramble(bytes.NewReader(src[:5]))
+	require.Error(t, err)
+
+	for _, n := range []int{ScrambleLen, 32} {
+		hs := Handshake{
+			ProtocolVersion: DefaultHandshakeVersion,
+			ServerVersion:   "5.7.25-TiDB",
+			AuthPluginData:  bytes.Repeat([]byte{'x'}, n),
+			Capability:      DefaultCapability,
+			AuthPluginName:  AuthNativePassword,
+		}
+		b := newBuffer(nil)
+		hs.Write(b)
+		data := b.Bytes()
+		// The length byte follows the version, connection id, part 1 and the
+		// capability, character set and status flags.
+		lenPos := 1 + len(hs.ServerVersion) + 1 + 4 + 8 + 1 + 2 + 1 + 2 + 2
+		require.Equal(t, byte(n+1), data[lenPos])
+
+		hs2 := Handshake{Strict: true}
+		require.NoError(t, hs2.Read(newBuffer(data)))
+		require.Equal(t, hs.AuthPluginData, hs2.AuthPluginData)
+		require.Equal(t, AuthNativePassword, hs2.AuthPluginName)
+	}
+}
+
+func TestAuthMoreData(t *testing.T) {
+	b := newBuffer(nil)
+	(&AuthMoreData{Data: []byte{CachingSha2FastAuthSuccess}}).Write(b)
+	require.Equal(t, []byte{HeaderAuthMoreData, CachingSha2FastAuthSuccess}, b.Bytes())
+	var p AuthMoreData
+	require.NoError(t, p.Read(newBuffer(b.Bytes())))
+	require.True(t, p.FastAuthSuccess())
+
+	require.NoError(t, p.Read(newBuffer([]byte{HeaderAuthMoreData, CachingSha2PerformFullAuth})))
+	require.False(t, p.FastAuthSuccess())
+	require.ErrorIs(t, p.Read(newBuffer([]byte{HeaderOK})), ErrMalformPacket)
+}
+
+func TestAuthSwitchRequest(t *testing.T) {
+	// A synthetic switch request in the layout TiDB sends, not a capture:
+	// plugin name and a made-up 20-byte salt, both NUL terminated.
+	data, err := hex.DecodeString("fe6d7973716c5f6e61746976655f70617373776f7264001d2f3a0c5b6e17487a0b2c3d4e5f60717f0e1a2b00")
+	require.NoError(t, err)
+	require.True(t, IsAuthSwitchRequest(data))
+	var p AuthSwitchRequest
+	require.NoError(t, p.Read(newBuffer(data)))
+	require.Equal(t, AuthNativePassword, p.PluginName)
+	require.Len(t, p.PluginData, 21)
+	require.Equal(t, byte(0), p.PluginData[20])
+
+	b := newBuffer(nil)
+	p.Write(b)
+	require.Equal(t, data, b.Bytes())
+
+	// EOF packets are not switch requests.
+	for _, eof := range [][]byte{{HeaderEOF}, {HeaderEOF, 0, 0, 2, 0}} {
+		require.False(t, IsAuthSwitchRequest(eof))
+		require.ErrorIs(t, p.Read(newBuffer(eof)), ErrMalformPacket)
+	}
+}
@@ -1,5 +1,72 @@
 package mysql
 
+import (
+	"crypto/sha1" // nolint:gosec // nolint
+	"crypto/sha256"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ScrambleLen is the length of the scramble sent in the initial handshake.
+const ScrambleLen = 20
+
+// NewScramble generates a scramble for the initial handshake from the random
+// source r, usually crypto/rand.Reader. The bytes are 7-bit and never NUL, as
+// clients expect it to be NUL terminated.
+func NewScramble(r io.Reader) ([]byte, error) {
+	scramble := make([]byte, ScrambleLen)
+	if _, err := io.ReadFull(r, scramble); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for i, c := range scramble {
+		c &= 0x7F
+		if c == 0 || c == '$' {
+			c++
+		}
+		scramble[i] = c
+	}
+	return scramble, nil
+}
+
+// NativePasswordAuth computes the mysql_native_password auth response to
+// scramble: SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password))). An empty
+// password gets an empty response.
+func NativePasswordAuth(password string, scramble []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	auth := h.Sum(nil)
+	for i := range auth {
+		auth[i] ^= stage1[i]
+	}
+	return auth
+}
+
+// CachingSha2PasswordAuth computes the caching_sha2_password scramble
+// response: SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble).
+// An empty password gets an empty response.
+func CachingSha2PasswordAuth(password string, scramble []byte) []byte {
+	if password == "" {
+		return nil
+	}
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(scramble)
+	auth := h.Sum(nil)
+	for i := range auth {
+		auth[i] ^= stage1[i]
+	}
+	return auth
+}
+
 func readLen3(b []byte) int {
 	return int(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16)
 }
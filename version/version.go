@@ -0,0 +1,40 @@
+// Package version holds the build information of the gateway, injected at
+// build time with -ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/oh-my-tidb/tidb-gateway/version.Version=v0.1.0"
+package version
+
+import (
+	"fmt"
+	"io"
+)
+
+// Build information. They are "unknown" unless injected at build time.
+var (
+	Version   = "unknown"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// Info is the build information, served at the /status of the gateway.
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// Get returns the build information.
+func Get() Info {
+	return Info{Version: Version, GitCommit: GitCommit, BuildDate: BuildDate}
+}
+
+// Fields returns the build information as key-value pairs for logging.
+func (i Info) Fields() []interface{} {
+	return []interface{}{"version", i.Version, "gitCommit", i.GitCommit, "buildDate", i.BuildDate}
+}
+
+// Print writes the build information in a human readable form.
+func Print(w io.Writer) {
+	i := Get()
+	fmt.Fprintf(w, "Version: %s\nGit Commit: %s\nBuild Date: %s\n", i.Version, i.GitCommit, i.BuildDate)
+}